@@ -15,18 +15,26 @@ const (
 	dirRetryCount        = "retry_count"
 	dirMode              = "mode"
 	dirReconnectInterval = "reconnect_interval"
+	dirPolicy            = "policy"
+	dirResolver          = "resolver"
 	dirHTTP              = "http"
 	dirGRPC              = "GRPC"
 	dirCertificate       = "certificate"
 
 	dirMainServer    = "main_server"
 	dirStandbyServer = "standby_server"
+	dirPoolServer    = "server"
+	dirSRV           = "srv"
 
 	dirURL        = "url"
 	dirAuthMethod = "authMethod"
 	dirToken      = "token"
+	dirTokenFile  = "tokenFile"
 	dirPEM        = "pem"
 	dirServerAddr = "server"
+	dirPriority   = "priority"
+	dirWeight     = "weight"
+	dirName       = "name"
 )
 
 func init() {
@@ -74,6 +82,18 @@ func parseCertDXGlobalOptions(d *caddyfile.Dispenser, _ any) (any, error) {
 					return nil, err
 				}
 				module.ReconnectInterval = v
+			case dirPolicy:
+				v, err := expectArg1(d)
+				if err != nil {
+					return nil, err
+				}
+				module.Policy = v
+			case dirResolver:
+				v, err := expectArg1(d)
+				if err != nil {
+					return nil, err
+				}
+				module.Resolver = v
 			case dirHTTP:
 				if d.NextArg() {
 					return nil, d.Errf("no argument expected for %s", dirHTTP)
@@ -121,6 +141,16 @@ func (c *CertDXCaddyDaemon) UnmarshalHttpBlock(d *caddyfile.Dispenser) error {
 				if err := c.unmarshalHttpServerBlock(&c.Http.StandbyServer, d.NewFromNextSegment()); err != nil {
 					return err
 				}
+			case dirPoolServer:
+				s := config.ClientHttpServer{AuthMethod: config.HTTP_AUTH_TOKEN}
+				if err := c.unmarshalHttpServerBlock(&s, d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				c.Http.Servers = append(c.Http.Servers, s)
+			case dirSRV:
+				if err := c.unmarshalHttpSRVBlock(d.NewFromNextSegment()); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective for %s: %s", dirHTTP, d.Val())
 			}
@@ -144,8 +174,14 @@ func (c *CertDXCaddyDaemon) unmarshalHttpServerBlock(s *config.ClientHttpServer,
 				s.AuthMethod = v
 			case dirToken:
 				s.Token = v
+			case dirTokenFile:
+				s.TokenFile = v
 			case dirPEM:
 				s.PEM = v
+			case dirPriority, dirWeight:
+				if err := unmarshalPoolMember(&s.ClientPoolMember, directive, v, d); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective for http server: %s", directive)
 			}
@@ -154,6 +190,75 @@ func (c *CertDXCaddyDaemon) unmarshalHttpServerBlock(s *config.ClientHttpServer,
 	return nil
 }
 
+// unmarshalHttpSRVBlock parses the http srv { ... } block: the SRV name
+// plus the url template and auth of the discovered servers.
+func (c *CertDXCaddyDaemon) unmarshalHttpSRVBlock(d *caddyfile.Dispenser) error {
+	s := &c.Http.SRV
+	for d.Next() {
+		for d.NextBlock(0) {
+			directive := d.Val()
+			v, err := expectArg1(d)
+			if err != nil {
+				return err
+			}
+			switch directive {
+			case dirName:
+				s.Name = v
+			case dirURL:
+				s.Url = v
+			case dirAuthMethod:
+				s.AuthMethod = v
+			case dirToken:
+				s.Token = v
+			case dirTokenFile:
+				s.TokenFile = v
+			case dirPEM:
+				s.PEM = v
+			default:
+				return d.Errf("unrecognized subdirective for http srv: %s", directive)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalGRPCSRVBlock parses the GRPC srv { ... } block.
+func (c *CertDXCaddyDaemon) unmarshalGRPCSRVBlock(d *caddyfile.Dispenser) error {
+	s := &c.GRPC.SRV
+	for d.Next() {
+		for d.NextBlock(0) {
+			directive := d.Val()
+			v, err := expectArg1(d)
+			if err != nil {
+				return err
+			}
+			switch directive {
+			case dirName:
+				s.Name = v
+			case dirPEM:
+				s.PEM = v
+			default:
+				return d.Errf("unrecognized subdirective for grpc srv: %s", directive)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalPoolMember sets the priority or weight of a server.
+func unmarshalPoolMember(m *config.ClientPoolMember, directive, v string, d *caddyfile.Dispenser) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return d.Errf("invalid value for %s: %v", directive, v)
+	}
+	if directive == dirPriority {
+		m.Priority = n
+	} else {
+		m.Weight = n
+	}
+	return nil
+}
+
 // UnmarshalGRPCBlock parses the GRPC { ... } sub-block.
 func (c *CertDXCaddyDaemon) UnmarshalGRPCBlock(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -167,6 +272,16 @@ func (c *CertDXCaddyDaemon) UnmarshalGRPCBlock(d *caddyfile.Dispenser) error {
 				if err := c.unmarshalGRPCServerBlock(&c.GRPC.StandbyServer, d.NewFromNextSegment()); err != nil {
 					return err
 				}
+			case dirPoolServer:
+				var s config.ClientGRPCServer
+				if err := c.unmarshalGRPCServerBlock(&s, d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				c.GRPC.Servers = append(c.GRPC.Servers, s)
+			case dirSRV:
+				if err := c.unmarshalGRPCSRVBlock(d.NewFromNextSegment()); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective for grpc: %s", d.Val())
 			}
@@ -188,6 +303,10 @@ func (c *CertDXCaddyDaemon) unmarshalGRPCServerBlock(s *config.ClientGRPCServer,
 				s.Server = v
 			case dirPEM:
 				s.PEM = v
+			case dirPriority, dirWeight:
+				if err := unmarshalPoolMember(&s.ClientPoolMember, directive, v, d); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective for grpc server: %s", directive)
 			}
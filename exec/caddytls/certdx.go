@@ -46,13 +46,17 @@ type CertDXCaddyConfig struct {
 	config.ClientCommonConfig
 
 	Http struct {
-		MainServer    config.ClientHttpServer `json:"main_server,omitempty"`
-		StandbyServer config.ClientHttpServer `json:"standby_server,omitempty"`
+		MainServer    config.ClientHttpServer   `json:"main_server,omitempty"`
+		StandbyServer config.ClientHttpServer   `json:"standby_server,omitempty"`
+		Servers       []config.ClientHttpServer `json:"servers,omitempty"`
+		SRV           config.ClientHttpSRV      `json:"srv,omitempty"`
 	} `json:"http,omitempty"`
 
 	GRPC struct {
-		MainServer    config.ClientGRPCServer `json:"main_server,omitempty"`
-		StandbyServer config.ClientGRPCServer `json:"standby_server,omitempty"`
+		MainServer    config.ClientGRPCServer   `json:"main_server,omitempty"`
+		StandbyServer config.ClientGRPCServer   `json:"standby_server,omitempty"`
+		Servers       []config.ClientGRPCServer `json:"servers,omitempty"`
+		SRV           config.ClientGRPCSRV      `json:"srv,omitempty"`
 	} `json:"GRPC,omitempty"`
 
 	CertificateDefs CertificateDef `json:"certificates"`
@@ -62,9 +66,11 @@ func (c *CertDXCaddyConfig) SetDefaultConfig() {
 	c.RetryCount = 5
 	c.Mode = config.CLIENT_MODE_HTTP
 	c.ReconnectInterval = "10m"
+	c.Policy = config.CLIENT_POLICY_PRIORITY
 
 	c.Http.MainServer.AuthMethod = config.HTTP_AUTH_TOKEN
 	c.Http.StandbyServer.AuthMethod = config.HTTP_AUTH_TOKEN
+	c.Http.SRV.AuthMethod = config.HTTP_AUTH_TOKEN
 }
 
 type CertDXCaddyDaemon struct {
@@ -97,8 +103,12 @@ func (m *CertDXCaddyDaemon) Provision(ctx caddy.Context) error {
 	m.certDXDaemon.Config.Common = m.ClientCommonConfig
 	m.certDXDaemon.Config.Http.MainServer = m.Http.MainServer
 	m.certDXDaemon.Config.Http.StandbyServer = m.Http.StandbyServer
+	m.certDXDaemon.Config.Http.Servers = m.Http.Servers
+	m.certDXDaemon.Config.Http.SRV = m.Http.SRV
 	m.certDXDaemon.Config.GRPC.MainServer = m.GRPC.MainServer
 	m.certDXDaemon.Config.GRPC.StandbyServer = m.GRPC.StandbyServer
+	m.certDXDaemon.Config.GRPC.Servers = m.GRPC.Servers
+	m.certDXDaemon.Config.GRPC.SRV = m.GRPC.SRV
 
 	d, err := time.ParseDuration(m.ReconnectInterval)
 	if err != nil {
@@ -118,15 +128,15 @@ func (m *CertDXCaddyDaemon) Start() error {
 	mode := m.certDXDaemon.Config.Common.Mode
 	switch mode {
 	case config.CLIENT_MODE_HTTP:
-		if m.certDXDaemon.Config.Http.MainServer.Url == "" {
-			return fmt.Errorf("http main_server url is required")
+		if !m.certDXDaemon.Config.HasHttpServers() {
+			return fmt.Errorf("http main_server, server or srv is required")
 		}
 		m.wg.Go(func() {
 			m.certDXDaemon.HttpMain()
 		})
 	case config.CLIENT_MODE_GRPC:
-		if m.certDXDaemon.Config.GRPC.MainServer.Server == "" {
-			return fmt.Errorf("grpc main_server is required")
+		if !m.certDXDaemon.Config.HasGRPCServers() {
+			return fmt.Errorf("grpc main_server, server or srv is required")
 		}
 		m.wg.Go(func() {
 			m.certDXDaemon.GRPCMain()
@@ -101,6 +101,15 @@ func main() {
 		}()
 	}
 
+	if cdxsrv.Config.AdminServer.Enabled {
+		go func() {
+			if err := cdxsrv.AdminSrv(); err != nil {
+				logging.Error("Admin server failed: %s", err)
+				cdxsrv.Stop()
+			}
+		}()
+	}
+
 	// WaitForShutdown handles signal-driven Stop in a goroutine; main
 	// blocks on Wait() so subserver-driven Stop also unblocks it.
 	go cli.WaitForShutdown(cdxsrv.Stop, shutdownTimeout)
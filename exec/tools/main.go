@@ -37,10 +37,23 @@ type commandGroup struct {
 // commands is the registry of canonical sub-commands.
 var commands = map[string]command{
 	"show-certs":     {tasks.ShowCerts, "Show cached certificates on the server", nil},
+	"cert-history":   {tasks.ShowCertHistory, "List retained versions of a cert pack through the admin API", nil},
+	"rollback-cert":  {tasks.RollbackCert, "Roll a cert pack back to a previous version through the admin API", nil},
+	"import-cert":    {tasks.ImportCert, "Import an externally obtained certificate and key", nil},
 	"google-account": {tasks.RegisterGoogleAccount, "Register a Google ACME EAB account", nil},
 	"make-ca":        {tasks.MakeCA, "Generate mTLS CA certificate and key", nil},
 	"make-server":    {tasks.MakeServer, "Generate mTLS server certificate and key", nil},
 	"make-client":    {tasks.MakeClient, "Generate mTLS client certificate and key", nil},
+	"make-token":     {tasks.MakeToken, "Generate a scoped HTTP API token", nil},
+	"approvals":      {tasks.ListApprovals, "List cert packs awaiting approval on a running server", nil},
+	"approve":        {tasks.ApprovePack, "Approve a cert pack on a running server", nil},
+	"deny":           {tasks.DenyPack, "Deny a cert pack on a running server", nil},
+	"make-encryption-key": {tasks.MakeEncryptionKey,
+		"Generate a key for encrypting server state at rest", nil},
+	"rotate-encryption-key": {tasks.RotateEncryptionKey,
+		"Re-encrypt server state at rest under a new key", nil},
+	"backup":  {tasks.Backup, "Archive ACME accounts, the cert cache and mTLS material", nil},
+	"restore": {tasks.Restore, "Restore server state from a backup archive", nil},
 	"tencent-cloud-certificate-updater": {txcCertificateUpdater.TencentCloudReplaceCertificate,
 		"Update expiring Tencent Cloud certificates",
 		[]string{"tx-update", "tencent-cloud-certificates-updater"}},
@@ -65,14 +78,19 @@ func init() {
 
 // groups controls the order and grouping of commands in the help output.
 var groups = []commandGroup{
-	{"Certificate Inspection", []string{"show-certs"}},
+	{"Certificate Inspection", []string{"show-certs", "cert-history", "rollback-cert", "import-cert"}},
 	{"ACME", []string{"google-account"}},
+	{"Access", []string{"make-token"}},
+	{"Approvals", []string{"approvals", "approve", "deny"}},
 	{"mTLS Setup", []string{"make-ca", "make-server", "make-client"}},
+	{"Encryption at Rest", []string{"make-encryption-key", "rotate-encryption-key"}},
+	{"Backup", []string{"backup", "restore"}},
 	{"Certificate Updaters", []string{"tencent-cloud-certificate-updater", "kubernetes-certificate-updater"}},
 }
 
 func main() {
 	ver := cli.Version{Name: "tools", Tag: buildTag, Date: buildDate}
+	tasks.Version = buildTag
 
 	args := os.Args[1:]
 	if len(args) == 0 {
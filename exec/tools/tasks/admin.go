@@ -0,0 +1,69 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"pkg.para.party/certdx/pkg/api"
+)
+
+// adminFlags are the flags locating a running certdx server's admin API.
+type adminFlags struct {
+	url   *string
+	token *string
+}
+
+func registerAdminFlags(fs *flag.FlagSet) adminFlags {
+	return adminFlags{
+		url:   fs.StringP("admin", "a", "http://127.0.0.1:10003", "Server admin API URL, at [AdminServer] listen"),
+		token: fs.StringP("token", "t", "", "Admin API token, as in [AdminServer] token"),
+	}
+}
+
+// do sends an admin API request with body, if not nil, and decodes the
+// response into resp.
+func (f adminFlags) do(method, path string, body, resp any) error {
+	if *f.token == "" {
+		return fmt.Errorf("--token is required")
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(*f.url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+*f.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var e api.AdminErrorResp
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || e.Error == nil {
+			return fmt.Errorf("%s %s: %s", method, path, r.Status)
+		}
+		return fmt.Errorf("%s: %s", e.Error.Code, e.Error.Message)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
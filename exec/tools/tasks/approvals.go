@@ -0,0 +1,100 @@
+package tasks
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+)
+
+func printApproval(a api.ApprovalRequest) {
+	fmt.Printf("\nDomains:     %s\nStatus:      %s\n", strings.Join(a.Domains, ", "), a.Status)
+	if a.Requester != "" {
+		fmt.Printf("Requester:   %s\n", a.Requester)
+	}
+	fmt.Printf("RequestedAt: %s\n", a.RequestedAt.Format(time.RFC3339))
+	if !a.DecidedAt.IsZero() {
+		fmt.Printf("DecidedAt:   %s\n", a.DecidedAt.Format(time.RFC3339))
+	}
+	if a.Reason != "" {
+		fmt.Printf("Reason:      %s\n", a.Reason)
+	}
+}
+
+// ListApprovals lists the approval requests of cert packs on a running
+// server.
+func ListApprovals(name string, args []string) error {
+	fs := newFlagSet(name)
+	admin := registerAdminFlags(fs)
+	status := fs.String("status", api.ApprovalPending, "List requests with this status: pending, approved, denied, or all")
+	help := fs.BoolP("help", "h", false, "Print help")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+
+	path := api.AdminApprovalsPath
+	if *status != "all" {
+		path += "?status=" + url.QueryEscape(*status)
+	}
+	var resp api.AdminApprovalsResp
+	if err := admin.do("GET", path, nil, &resp); err != nil {
+		return fmt.Errorf("list approvals: %w", err)
+	}
+	if len(resp.Approvals) == 0 {
+		fmt.Println("No approval requests")
+	}
+	for _, a := range resp.Approvals {
+		printApproval(a)
+	}
+	return nil
+}
+
+// decideApproval approves or denies a cert pack on a running server.
+func decideApproval(name string, args []string, path string, withReason bool) error {
+	fs := newFlagSet(name)
+	admin := registerAdminFlags(fs)
+	domains := registerDomainsFlag(fs)
+	var reason *string
+	if withReason {
+		reason = fs.StringP("reason", "r", "", "Why the pack is denied, kept with the decision")
+	}
+	help := fs.BoolP("help", "h", false, "Print help")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if len(*domains) == 0 {
+		return fmt.Errorf("--domains is required")
+	}
+
+	req := api.AdminApprovalReq{Domains: *domains}
+	if reason != nil {
+		req.Reason = *reason
+	}
+	var resp api.AdminApprovalResp
+	if err := admin.do("POST", path, &req, &resp); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	printApproval(resp.Approval)
+	return nil
+}
+
+// ApprovePack approves a cert pack awaiting approval, or ahead of any
+// request for it; the server then issues it.
+func ApprovePack(name string, args []string) error {
+	return decideApproval(name, args, api.AdminApprovePath, false)
+}
+
+// DenyPack denies a cert pack, so clients asking for it are refused.
+func DenyPack(name string, args []string) error {
+	return decideApproval(name, args, api.AdminDenyPath, true)
+}
@@ -0,0 +1,175 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/tools"
+)
+
+// Version is the build tag of the tools binary, recorded in backups. Set
+// by main.
+var Version string
+
+// readKeyFile loads a key written by make-encryption-key, or returns nil
+// when path is empty.
+func readKeyFile(path string) (encryption.KeyProvider, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	kp, err := encryption.NewLocalKeyProvider(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("key file: %w", err)
+	}
+	return kp, nil
+}
+
+// backupPathsFor returns where the server config at confPath keeps the
+// cert store and approvals. Call after applyDataDir.
+func backupPathsFor(confPath string) (tools.BackupPaths, error) {
+	cfg, err := loadServerConfig(confPath)
+	if err != nil {
+		return tools.BackupPaths{}, fmt.Errorf("load server config: %w", err)
+	}
+	p := tools.BackupPaths{Approvals: cfg.ACME.ApprovalsFile}
+	switch cfg.CertStore.Type {
+	case config.CertStoreTypeJSON, "":
+		p.CertStore = cfg.CertStore.Path
+	case config.CertStoreTypeSQLite:
+		p.CertStoreDB = cfg.CertStore.Path
+	}
+	return p, nil
+}
+
+func printBackupManifest(m *tools.BackupManifest) {
+	version := m.Version
+	if version == "" {
+		version = "unknown"
+	}
+	fmt.Printf("Backup format %d, certdx %s, created %s\n", m.Format, version, m.CreatedAt.Format(time.RFC3339))
+	for _, f := range m.Files {
+		fmt.Printf("  %s (%d bytes)\n", f.Path, f.Size)
+	}
+}
+
+// Backup writes the server's ACME account keys, cert cache and mTLS
+// material into a single archive.
+func Backup(name string, args []string) error {
+	fs := newFlagSet(name)
+	var (
+		dataDir  = registerDataDirFlag(fs)
+		confPath = registerServerConfFlag(fs)
+		out      = fs.StringP("out", "o", "", "Archive to write (mode 0600)")
+		keyFile  = fs.String("key-file", "", "Encrypt the archive with the key in this file (see make-encryption-key)")
+		help     = fs.BoolP("help", "h", false, "Print help")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if *out == "" {
+		return fmt.Errorf("--out is required")
+	}
+
+	applyDataDir(*dataDir)
+
+	p, err := backupPathsFor(*confPath)
+	if err != nil {
+		return err
+	}
+	kp, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	manifest, err := tools.WriteBackup(context.Background(), f, Version, kp, p)
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+
+	printBackupManifest(manifest)
+	fmt.Printf("Backup written to %s\n", *out)
+	return nil
+}
+
+// Restore verifies a backup archive and writes its files back into the
+// data directory. Stop the server first.
+func Restore(name string, args []string) error {
+	fs := newFlagSet(name)
+	var (
+		dataDir  = registerDataDirFlag(fs)
+		confPath = registerServerConfFlag(fs)
+		in       = fs.StringP("in", "i", "", "Archive to restore")
+		keyFile  = fs.String("key-file", "", "Key the archive was encrypted with")
+		force    = fs.Bool("force", false, "Overwrite existing files")
+		dryRun   = fs.Bool("dry-run", false, "Only verify the archive and list its contents")
+		help     = fs.BoolP("help", "h", false, "Print help")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if *in == "" {
+		return fmt.Errorf("--in is required")
+	}
+
+	applyDataDir(*dataDir)
+
+	p, err := backupPathsFor(*confPath)
+	if err != nil {
+		return err
+	}
+	kp, err := readKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	archive, err := os.ReadFile(*in)
+	if err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+
+	ctx := context.Background()
+	if *dryRun {
+		manifest, _, err := tools.ReadBackup(ctx, archive, kp)
+		if err != nil {
+			return err
+		}
+		printBackupManifest(manifest)
+		fmt.Println("Archive verified")
+		return nil
+	}
+
+	manifest, err := tools.RestoreBackup(ctx, archive, kp, *force, p)
+	if errors.Is(err, tools.ErrBackupExists) {
+		return fmt.Errorf("%w; pass --force to overwrite", err)
+	}
+	if err != nil {
+		return err
+	}
+	printBackupManifest(manifest)
+	fmt.Println("Restored")
+	return nil
+}
@@ -0,0 +1,88 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"pkg.para.party/certdx/pkg/api"
+)
+
+func registerDomainsFlag(fs *flag.FlagSet) *[]string {
+	return fs.StringSliceP("domains", "d", []string{}, "Domains of the cert pack (comma-separated)")
+}
+
+func printCertVersion(v api.HttpCertVersion) {
+	current := ""
+	if v.Current {
+		current = " (current)"
+	}
+	if v.External {
+		current += " (external)"
+	}
+	fmt.Printf("\nSerial:      %s%s\nIssuer:      %s\nNotAfter:    %s\nValidBefore: %s\nRenewAt:     %s\n",
+		v.Serial, current, v.Issuer, v.NotAfter.Format(time.RFC3339), v.ValidBefore.Format(time.RFC3339), v.RenewAt.Format(time.RFC3339))
+}
+
+// ShowCertHistory lists the current cert and the retained previous
+// versions of a cert pack on a running server.
+func ShowCertHistory(name string, args []string) error {
+	fs := newFlagSet(name)
+	admin := registerAdminFlags(fs)
+	domains := registerDomainsFlag(fs)
+	help := fs.BoolP("help", "h", false, "Print help")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if len(*domains) == 0 {
+		return fmt.Errorf("--domains is required")
+	}
+
+	var resp api.AdminHistoryResp
+	if err := admin.do("POST", api.AdminHistoryPath, &api.AdminPackReq{Domains: *domains}, &resp); err != nil {
+		return fmt.Errorf("get history: %w", err)
+	}
+
+	fmt.Printf("Domains: %s\n", strings.Join(*domains, ", "))
+	for _, v := range resp.Versions {
+		printCertVersion(v)
+	}
+	return nil
+}
+
+// RollbackCert switches a cert pack on a running server back to a
+// retained previous version.
+func RollbackCert(name string, args []string) error {
+	fs := newFlagSet(name)
+	admin := registerAdminFlags(fs)
+	domains := registerDomainsFlag(fs)
+	serial := fs.String("serial", "", "Serial of the version to roll back to, as listed by cert-history")
+	help := fs.BoolP("help", "h", false, "Print help")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if *serial == "" {
+		return fmt.Errorf("--serial is required")
+	}
+	if len(*domains) == 0 {
+		return fmt.Errorf("--domains is required")
+	}
+
+	var resp api.AdminRollbackResp
+	if err := admin.do("POST", api.AdminRollbackPath, &api.AdminRollbackReq{Domains: *domains, Serial: *serial}, &resp); err != nil {
+		return fmt.Errorf("rollback: %w", err)
+	}
+
+	fmt.Printf("Rolled back %s, now serving:\n", strings.Join(*domains, ", "))
+	printCertVersion(resp.Current)
+	return nil
+}
@@ -0,0 +1,51 @@
+package tasks
+
+import (
+	flag "github.com/spf13/pflag"
+	"pkg.para.party/certdx/pkg/cli"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/server"
+)
+
+// registerServerConfFlag adds --conf to fs for tasks that operate on the
+// server's state. The flag is optional: without it the task falls back
+// to the server defaults (JSON cert store under the data root).
+func registerServerConfFlag(fs *flag.FlagSet) *string {
+	return fs.StringP("conf", "c", "", "Server config file path, used to locate the cert store")
+}
+
+// loadServerConfig returns the server config at confPath, or the server
+// defaults when confPath is empty.
+func loadServerConfig(confPath string) (*config.ServerConfig, error) {
+	cfg := &config.ServerConfig{}
+	cfg.SetDefault()
+	if confPath == "" {
+		return cfg, nil
+	}
+	if err := cli.LoadTOML(confPath, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// openCertStore opens the cert store configured in the server config at
+// confPath, decrypting private keys with the configured [Encryption] key.
+// Call after applyDataDir so default paths resolve against the right
+// root.
+func openCertStore(confPath string) (server.CertStore, error) {
+	cfg, err := loadServerConfig(confPath)
+	if err != nil {
+		return nil, err
+	}
+	return openCertStoreFor(cfg)
+}
+
+// openCertStoreFor opens the cert store configured in cfg.
+func openCertStoreFor(cfg *config.ServerConfig) (server.CertStore, error) {
+	keys, err := encryption.NewKeyProvider(&cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return server.OpenCertStore(cfg, keys)
+}
@@ -0,0 +1,149 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"pkg.para.party/certdx/pkg/acme/acmeproviders"
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/paths"
+	"pkg.para.party/certdx/pkg/server"
+)
+
+// writeNewKeyFile generates a key and writes it to path, refusing to
+// overwrite an existing file.
+func writeNewKeyFile(path string) error {
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("create key file: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		f.Close()
+		return fmt.Errorf("write key file: %w", err)
+	}
+	return f.Close()
+}
+
+// MakeEncryptionKey generates a key for the file or env encryption
+// providers.
+func MakeEncryptionKey(name string, args []string) error {
+	fs := newFlagSet(name)
+	var (
+		out  = fs.StringP("out", "o", "", "Write the key to this file (mode 0600) instead of stdout")
+		help = fs.BoolP("help", "h", false, "Print help")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+
+	if *out != "" {
+		if err := writeNewKeyFile(*out); err != nil {
+			return err
+		}
+		fmt.Printf("Encryption key written to %s\n", *out)
+		return nil
+	}
+
+	key, err := encryption.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// RotateEncryptionKey re-wraps every private key the server keeps at
+// rest (cert store entries and the ACME account key) from the key
+// configured in [Encryption] to a new one. Stop the server first.
+func RotateEncryptionKey(name string, args []string) error {
+	fs := newFlagSet(name)
+	var (
+		dataDir    = registerDataDirFlag(fs)
+		confPath   = registerServerConfFlag(fs)
+		newKeyFile = fs.String("new-key-file", "", "Rotate to the key in this file, generating it if missing. "+
+			"Without it, keys are rewrapped under the configured provider's current key")
+		help = fs.BoolP("help", "h", false, "Print help")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if *confPath == "" {
+		return fmt.Errorf("--conf is required")
+	}
+
+	applyDataDir(*dataDir)
+
+	cfg, err := loadServerConfig(*confPath)
+	if err != nil {
+		return err
+	}
+	from, err := encryption.NewKeyProvider(&cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
+	to := from
+	if *newKeyFile != "" {
+		if !paths.FileExists(*newKeyFile) {
+			if err := writeNewKeyFile(*newKeyFile); err != nil {
+				return err
+			}
+			fmt.Printf("Generated new encryption key at %s\n", *newKeyFile)
+		}
+		data, err := os.ReadFile(*newKeyFile)
+		if err != nil {
+			return fmt.Errorf("read new key file: %w", err)
+		}
+		if to, err = encryption.NewLocalKeyProvider(string(data)); err != nil {
+			return fmt.Errorf("new key file: %w", err)
+		}
+	}
+	if to == nil {
+		return fmt.Errorf("no [Encryption] provider configured; pass --new-key-file")
+	}
+
+	ctx := context.Background()
+
+	store, err := server.NewCertStore(&cfg.CertStore)
+	if err != nil {
+		return fmt.Errorf("init cert store: %w", err)
+	}
+	defer store.Close()
+
+	n, err := server.RewrapCertStore(ctx, store, from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rewrapped %d cert store entries under key %s\n", n, to.KeyID())
+
+	if cfg.ACME.Email != "" && !acmeproviders.IsMock(cfg.ACME.Provider) {
+		keyPath, err := paths.ACMEPrivateKey(cfg.ACME.Email, cfg.ACME.Provider)
+		if err != nil {
+			return err
+		}
+		if paths.FileExists(keyPath) {
+			if err := encryption.RewrapFile(ctx, from, to, keyPath); err != nil {
+				return fmt.Errorf("rewrap ACME account key: %w", err)
+			}
+			fmt.Printf("Rewrapped ACME account key %s\n", keyPath)
+		}
+	}
+
+	if *newKeyFile != "" {
+		fmt.Printf("Point [Encryption] at %s (provider = \"file\") before restarting the server\n", *newKeyFile)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/encryption"
 )
 
 // RegisterGoogleAccount registers (or registers a test) Google ACME
@@ -15,6 +16,7 @@ func RegisterGoogleAccount(name string, args []string) error {
 		email       = fs.StringP("email", "e", "", "Email of registration")
 		keyID       = fs.StringP("kid", "k", "", "Key id of EAB")
 		hmac        = fs.StringP("hmac", "m", "", "B64HMAC of EAB")
+		confPath    = fs.StringP("conf", "c", "", "Server config file path, used to encrypt the account key with its [Encryption] key")
 		help        = fs.BoolP("help", "h", false, "Print help")
 	)
 	if err := fs.Parse(args); err != nil {
@@ -28,11 +30,20 @@ func RegisterGoogleAccount(name string, args []string) error {
 	if *email == "" || *keyID == "" || *hmac == "" {
 		return fmt.Errorf("--email, --kid and --hmac are required")
 	}
+	cfg, err := loadServerConfig(*confPath)
+	if err != nil {
+		return err
+	}
+	keys, err := encryption.NewKeyProvider(&cfg.Encryption)
+	if err != nil {
+		return err
+	}
+
 	provider := "google"
 	if *testAccount {
 		provider = "googletest"
 	}
-	if err := acme.RegisterAccount(provider, *email, *keyID, *hmac); err != nil {
+	if err := acme.RegisterAccount(provider, *email, *keyID, *hmac, keys); err != nil {
 		return fmt.Errorf("register account: %w", err)
 	}
 	return nil
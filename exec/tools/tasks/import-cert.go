@@ -0,0 +1,73 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/server"
+)
+
+// ImportCert imports an externally obtained certificate and key. With
+// --token it goes through a running server's admin API, which starts
+// serving it right away; otherwise it is written straight into the cert
+// store of a stopped server.
+func ImportCert(name string, args []string) error {
+	fs := newFlagSet(name)
+	certPath := fs.String("cert", "", "PEM full chain, leaf first")
+	keyPath := fs.String("key", "", "PEM private key of the leaf")
+	admin := registerAdminFlags(fs)
+	dataDir := registerDataDirFlag(fs)
+	confPath := registerServerConfFlag(fs)
+	help := fs.BoolP("help", "h", false, "Print help")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+	if *certPath == "" || *keyPath == "" {
+		return fmt.Errorf("--cert and --key are required")
+	}
+
+	fullchain, err := os.ReadFile(*certPath)
+	if err != nil {
+		return fmt.Errorf("read cert: %w", err)
+	}
+	key, err := os.ReadFile(*keyPath)
+	if err != nil {
+		return fmt.Errorf("read key: %w", err)
+	}
+
+	if *admin.token != "" {
+		var resp api.AdminImportResp
+		if err := admin.do("POST", api.AdminImportPath, &api.AdminImportReq{FullChain: fullchain, Key: key}, &resp); err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		fmt.Printf("Imported %s, now serving:\n", strings.Join(resp.Domains, ", "))
+		printCertVersion(resp.Current)
+		return nil
+	}
+
+	applyDataDir(*dataDir)
+	cfg, err := loadServerConfig(*confPath)
+	if err != nil {
+		return fmt.Errorf("load server config: %w", err)
+	}
+	certStore, err := openCertStoreFor(cfg)
+	if err != nil {
+		return fmt.Errorf("init cert store: %w", err)
+	}
+	defer certStore.Close()
+
+	entry, err := server.ImportToStore(context.Background(), certStore, cfg, fullchain, key)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	fmt.Println("Imported into the cert store, served once the server starts:")
+	server.PrintCertInfo([]*server.CertStoreEntry{entry})
+	return nil
+}
@@ -190,12 +190,12 @@ func (r *KubernetesCertificateUpdater) registerWatchAndHandlers(ctx context.Cont
 func (r *KubernetesCertificateUpdater) startCertDXDaemon() error {
 	switch r.certDXDaemon.Config.Common.Mode {
 	case config.CLIENT_MODE_HTTP:
-		if r.certDXDaemon.Config.Http.MainServer.Url == "" {
+		if !r.certDXDaemon.Config.HasHttpServers() {
 			return fmt.Errorf("http main server url should not be empty")
 		}
 		go r.certDXDaemon.HttpMain()
 	case config.CLIENT_MODE_GRPC:
-		if r.certDXDaemon.Config.GRPC.MainServer.Server == "" {
+		if !r.certDXDaemon.Config.HasGRPCServers() {
 			return fmt.Errorf("GRPC main server url should not be empty")
 		}
 		go r.certDXDaemon.GRPCMain()
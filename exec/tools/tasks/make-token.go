@@ -0,0 +1,79 @@
+package tasks
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// MakeToken generates an HTTP API token and prints it along with the
+// [[HttpServer.Tokens]] entry that stores its hash in the server config,
+// or with --peer the [[PeerSync.Peers]] entry of a standby's peer token.
+func MakeToken(name string, args []string) error {
+	fs := newFlagSet(name)
+	var (
+		tokenName = fs.StringP("name", "n", "", "Token name, shown in the server's logs")
+		domains   = fs.StringSliceP("domains", "d", nil, "Restrict the token to these domains and their subdomains")
+		expires   = fs.StringP("expires", "e", "", "Expiry time, RFC 3339 (e.g. 2027-01-01T00:00:00Z)")
+		token     = fs.StringP("token", "t", "", "Hash this existing token instead of generating one")
+		peer      = fs.Bool("peer", false, "Make a peer sync token for a standby server")
+		help      = fs.BoolP("help", "h", false, "Print help")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *help {
+		fs.PrintDefaults()
+		return nil
+	}
+
+	if *tokenName == "" {
+		return fmt.Errorf("--name is required")
+	}
+	if *expires != "" {
+		if _, err := time.Parse(time.RFC3339, *expires); err != nil {
+			return fmt.Errorf("parse --expires: %w", err)
+		}
+	}
+
+	generated := *token == ""
+	if generated {
+		b := make([]byte, 32)
+		rand.Read(b)
+		*token = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	section := "HttpServer.Tokens"
+	if *peer {
+		section = "PeerSync.Peers"
+	}
+	var entry strings.Builder
+	fmt.Fprintf(&entry, "[[%s]]\nname = %q\nhash = %q\n", section, *tokenName, config.HashToken(*token))
+	if len(*domains) > 0 {
+		quoted := make([]string, len(*domains))
+		for i, d := range *domains {
+			quoted[i] = fmt.Sprintf("%q", d)
+		}
+		fmt.Fprintf(&entry, "domains = [%s]\n", strings.Join(quoted, ", "))
+	}
+	if *expires != "" {
+		fmt.Fprintf(&entry, "expires = %q\n", *expires)
+	}
+
+	if *peer {
+		if generated {
+			fmt.Printf("Token (set it as [PeerSync.Main] token on the standby; the main only keeps its hash):\n\n%s\n\n", *token)
+		}
+		fmt.Printf("Main server config entry:\n\n%s", entry.String())
+		return nil
+	}
+	if generated {
+		fmt.Printf("Token (hand it to the client; the server only keeps its hash):\n\n%s\n\n", *token)
+	}
+	fmt.Printf("Server config entry (in a tokensFile, use [[Tokens]]):\n\n%s", entry.String())
+	return nil
+}
@@ -1,16 +1,18 @@
 package tasks
 
 import (
+	"context"
 	"fmt"
 
 	"pkg.para.party/certdx/pkg/server"
 )
 
-// ShowCerts loads the persisted server cache file and prints its
+// ShowCerts loads the persisted server cert store and prints its
 // contents.
 func ShowCerts(name string, args []string) error {
 	fs := newFlagSet(name)
 	dataDir := registerDataDirFlag(fs)
+	confPath := registerServerConfFlag(fs)
 	help := fs.BoolP("help", "h", false, "Print help")
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -22,13 +24,24 @@ func ShowCerts(name string, args []string) error {
 
 	applyDataDir(*dataDir)
 
-	certStore, err := server.NewCertStore()
+	certStore, err := openCertStore(*confPath)
 	if err != nil {
 		return fmt.Errorf("init cert store: %w", err)
 	}
-	if err := certStore.Load(); err != nil {
+	defer certStore.Close()
+
+	// List rather than Load: Load may migrate the store in place, and
+	// inspecting it must not write.
+	entries, err := certStore.List(context.Background())
+	if err != nil {
 		return fmt.Errorf("load cert store: %w", err)
 	}
-	certStore.PrintCertInfo()
+	valid := entries[:0]
+	for _, e := range entries {
+		if !e.Cert.Expired() {
+			valid = append(valid, e)
+		}
+	}
+	server.PrintCertInfo(valid)
 	return nil
 }
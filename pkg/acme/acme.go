@@ -12,6 +12,7 @@ import (
 
 	"pkg.para.party/certdx/pkg/acme/acmeproviders"
 	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/encryption"
 	"pkg.para.party/certdx/pkg/logging"
 	"pkg.para.party/certdx/pkg/retry"
 )
@@ -32,6 +33,8 @@ type ACME struct {
 	Client       *lego.Client
 	retry        int
 	needNotAfter bool
+
+	user *ACMEUser
 }
 
 func (a *ACME) Obtain(ctx context.Context, domains []string, deadline time.Time) (fullchain, key []byte, err error) {
@@ -63,26 +66,49 @@ func (a *ACME) RetryObtain(ctx context.Context, domains []string, deadline time.
 	return
 }
 
-func MakeACME(c *config.ServerConfig) (Obtainer, error) {
+// MakeACME constructs the Obtainer selected by c. keys, when non-nil,
+// encrypts the ACME account key at rest.
+func MakeACME(c *config.ServerConfig, keys encryption.KeyProvider) (Obtainer, error) {
 	legolog.Logger = &logging.LegoLogger{}
 
 	if acmeproviders.IsMock(c.ACME.Provider) {
 		return NewMockACME(c.ACME.CertLifeTimeDuration), nil
 	}
 
-	user, err := makeACMEUser(c)
+	user, err := makeACMEUser(c, keys)
 	if err != nil {
 		return nil, err
 	}
 
+	return newACME(c, user)
+}
+
+// Derive constructs an Obtainer for c, typically a managed cert pack's
+// effective config, that shares base's ACME account. Only the key type,
+// challenge provider and requested lifetime may differ from the config
+// base was made from.
+func Derive(base Obtainer, c *config.ServerConfig) (Obtainer, error) {
+	switch b := base.(type) {
+	case *MockACME:
+		return NewMockACME(c.ACME.CertLifeTimeDuration), nil
+	case *ACME:
+		return newACME(c, b.user)
+	default:
+		return nil, fmt.Errorf("can not derive from obtainer %T", base)
+	}
+}
+
+func newACME(c *config.ServerConfig, user *ACMEUser) (*ACME, error) {
 	instance := &ACME{
 		retry:        c.ACME.RetryCount,
 		needNotAfter: acmeproviders.IsGoogle(c.ACME.Provider),
+		user:         user,
 	}
 	config := lego.NewConfig(user)
 	config.CADirURL = acmeproviders.URL(c.ACME.Provider)
-	config.Certificate.KeyType = certcrypto.EC256
+	config.Certificate.KeyType = keyType(c.ACME.KeyType)
 
+	var err error
 	instance.Client, err = lego.NewClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error constructing acme client: %w", err)
@@ -95,3 +121,22 @@ func MakeACME(c *config.ServerConfig) (Obtainer, error) {
 
 	return instance, nil
 }
+
+// keyType maps an ACME.keyType value to lego's. Unknown or empty values
+// use EC256.
+func keyType(t string) certcrypto.KeyType {
+	switch t {
+	case config.KeyTypeEC384:
+		return certcrypto.EC384
+	case config.KeyTypeRSA2048:
+		return certcrypto.RSA2048
+	case config.KeyTypeRSA3072:
+		return certcrypto.RSA3072
+	case config.KeyTypeRSA4096:
+		return certcrypto.RSA4096
+	case config.KeyTypeRSA8192:
+		return certcrypto.RSA8192
+	default:
+		return certcrypto.EC256
+	}
+}
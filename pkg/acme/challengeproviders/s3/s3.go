@@ -34,6 +34,21 @@ func NewHTTPProvider(cfg config.S3Client) (*HTTPProvider, error) {
 		return nil, fmt.Errorf("s3 challenge provider: bucket is required")
 	}
 
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPProvider{
+		bucket: cfg.Bucket,
+		client: client,
+	}, nil
+}
+
+// NewClient builds an S3 client for the endpoint and static credentials
+// in cfg, shared by the HTTP-01 provider and the server's S3 cert store.
+// optFns adjust the client on top of cfg, as in s3.NewFromConfig.
+func NewClient(cfg config.S3Client, optFns ...func(*s3.Options)) (*s3.Client, error) {
 	credential := credentials.NewStaticCredentialsProvider(cfg.AccessKeyId, cfg.AccessKeySecret, cfg.SessionToken)
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
@@ -53,12 +68,18 @@ func NewHTTPProvider(cfg config.S3Client) (*HTTPProvider, error) {
 		return nil, fmt.Errorf("load AWS config: %w", err)
 	}
 
-	return &HTTPProvider{
-		bucket: cfg.Bucket,
-		client: s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-			o.UsePathStyle = false
-		}),
-	}, nil
+	optFns = append([]func(*s3.Options){func(o *s3.Options) {
+		o.UsePathStyle = cfg.PathStyle
+	}}, optFns...)
+	return s3.NewFromConfig(awsCfg, optFns...), nil
+}
+
+// ChecksumsWhenRequired has the client compute and validate checksums
+// only when an operation requires them: several S3-compatible stores
+// reject the SDK's default trailing checksums.
+func ChecksumsWhenRequired(o *s3.Options) {
+	o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+	o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
 }
 
 // Present makes the token available at `HTTP01ChallengePath(token)` by creating a file in the given s3 bucket.
@@ -0,0 +1,27 @@
+package acme
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+)
+
+// RateLimited reports whether err is the CA refusing an order because an
+// ACME rate limit was hit, and how long the CA asked to wait before
+// retrying, or zero when it didn't say.
+func RateLimited(err error) (time.Duration, bool) {
+	var rl *legoacme.RateLimitedError
+	if !errors.As(err, &rl) {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(rl.RetryAfter); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(rl.RetryAfter); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, true
+}
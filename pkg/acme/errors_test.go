@@ -0,0 +1,35 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+)
+
+func TestRateLimited(t *testing.T) {
+	wrap := func(retryAfter string) error {
+		rl := &legoacme.RateLimitedError{
+			ProblemDetails: &legoacme.ProblemDetails{Type: "urn:ietf:params:acme:error:rateLimited"},
+			RetryAfter:     retryAfter,
+		}
+		return fmt.Errorf("failed obtaining cert: %w", errors.Join(fmt.Errorf("example.com: %w", rl)))
+	}
+
+	if d, ok := RateLimited(wrap("120")); !ok || d != 2*time.Minute {
+		t.Errorf("seconds: got %s, %v want 2m, true", d, ok)
+	}
+	at := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d, ok := RateLimited(wrap(at)); !ok || d < 59*time.Minute || d > time.Hour {
+		t.Errorf("http date: got %s, %v want about 1h, true", d, ok)
+	}
+	if d, ok := RateLimited(wrap("")); !ok || d != 0 {
+		t.Errorf("no retry-after: got %s, %v want 0, true", d, ok)
+	}
+	if _, ok := RateLimited(errors.New("connection refused")); ok {
+		t.Error("plain error reported as rate limited")
+	}
+}
@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -17,6 +18,8 @@ import (
 	"pkg.para.party/certdx/pkg/acme/acmeproviders"
 	"pkg.para.party/certdx/pkg/acme/acmeproviders/google"
 	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/logging"
 	"pkg.para.party/certdx/pkg/paths"
 )
 
@@ -46,7 +49,31 @@ func parsePEM(pem []byte) (crypto.PrivateKey, error) {
 	return key, nil
 }
 
-func makeACMEUser(c *config.ServerConfig) (*ACMEUser, error) {
+// readAccountKey reads the ACME account key at keyPath. A plaintext key
+// found while encryption is enabled is sealed in place, migrating keys
+// written before encryption was turned on.
+func readAccountKey(keyPath string, keys encryption.KeyProvider) ([]byte, error) {
+	ctx := context.Background()
+	raw, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile, err := encryption.Open(ctx, keys, raw)
+	if err != nil {
+		return nil, fmt.Errorf("open ACME account key %s: %w", keyPath, err)
+	}
+
+	if keys != nil && !encryption.IsSealed(raw) {
+		logging.Info("Encrypting ACME account key %s", keyPath)
+		if err := encryption.WriteFile(ctx, keys, keyPath, keyFile, 0o600); err != nil {
+			return nil, fmt.Errorf("encrypt ACME account key: %w", err)
+		}
+	}
+	return keyFile, nil
+}
+
+func makeACMEUser(c *config.ServerConfig, keys encryption.KeyProvider) (*ACMEUser, error) {
 	keyPath, err := paths.ACMEPrivateKey(c.ACME.Email, c.ACME.Provider)
 	if err != nil {
 		return nil, err
@@ -65,14 +92,14 @@ func makeACMEUser(c *config.ServerConfig) (*ACMEUser, error) {
 			hmac = account.HmacEncoded
 		}
 
-		if err := RegisterAccount(c.ACME.Provider, c.ACME.Email, kid, hmac); err != nil {
+		if err := RegisterAccount(c.ACME.Provider, c.ACME.Email, kid, hmac, keys); err != nil {
 			return nil, err
 		}
 	} else if err != nil {
 		return nil, err
 	}
 
-	keyFile, err := os.ReadFile(keyPath)
+	keyFile, err := readAccountKey(keyPath, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +128,10 @@ func makeACMEUser(c *config.ServerConfig) (*ACMEUser, error) {
 	return user, nil
 }
 
-func RegisterAccount(ACMEProvider, Email, Kid, Hmac string) error {
+// RegisterAccount generates an ACME account key, registers it with
+// ACMEProvider and saves it under the state root. The key is sealed under
+// keys when keys is non-nil.
+func RegisterAccount(ACMEProvider, Email, Kid, Hmac string, keys encryption.KeyProvider) error {
 	keyPath, err := paths.ACMEPrivateKey(Email, ACMEProvider)
 	if err != nil {
 		return err
@@ -118,7 +148,7 @@ func RegisterAccount(ACMEProvider, Email, Kid, Hmac string) error {
 	}
 	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
 
-	if err := os.WriteFile(keyPath, pemEncoded, 0o600); err != nil {
+	if err := encryption.WriteFile(context.Background(), keys, keyPath, pemEncoded, 0o600); err != nil {
 		return fmt.Errorf("save ACME account key: %w", err)
 	}
 
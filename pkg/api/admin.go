@@ -0,0 +1,157 @@
+package api
+
+import "time"
+
+// Paths of the admin API, served by the server's [AdminServer] listener.
+// Errors are reported as an AdminErrorResp with the status of their
+// code, as in the v2 cert API.
+const (
+	AdminPacksPath  = "/packs"
+	AdminRenewPath  = "/packs/renew"
+	AdminEvictPath  = "/packs/evict"
+	AdminOrdersPath = "/orders"
+
+	AdminHistoryPath  = "/packs/history"
+	AdminRollbackPath = "/packs/rollback"
+	AdminImportPath   = "/packs/import"
+
+	AdminApprovalsPath = "/approvals"
+	AdminApprovePath   = "/approvals/approve"
+	AdminDenyPath      = "/approvals/deny"
+)
+
+// Admin API error codes besides the v2 ones, reported with status 404
+// and 409.
+const (
+	ErrCodeNotFound = "not_found"
+	ErrCodeConflict = "conflict"
+)
+
+// AdminErrorResp is the body of a failed admin API request.
+type AdminErrorResp struct {
+	Error *HttpErrorV2 `json:"error"`
+}
+
+// AdminPack describes one pack in the server's cache. Subscribers
+// counts the SDS streams, watches and HTTP lease keeping it renewed.
+// Cert is unset until a cert was obtained. Renewing is set while an ACME
+// order for the pack is in flight. LastError is the error of the last
+// failed order, cleared once an order succeeds.
+type AdminPack struct {
+	Domains     []string         `json:"domains"`
+	Managed     bool             `json:"managed,omitempty"`
+	Subscribers int64            `json:"subscribers"`
+	HttpLease   bool             `json:"httpLease,omitempty"`
+	LastUsed    time.Time        `json:"lastUsed"`
+	Version     uint64           `json:"version"`
+	Cert        *HttpCertVersion `json:"cert,omitempty"`
+	Renewing    bool             `json:"renewing,omitempty"`
+	LastError   string           `json:"lastError,omitempty"`
+	LastErrorAt time.Time        `json:"lastErrorAt,omitzero"`
+}
+
+// AdminPacksResp is the response body for GET /packs, sorted by the
+// packs' first domain.
+type AdminPacksResp struct {
+	Packs []AdminPack `json:"packs"`
+}
+
+// AdminPackReq is the request body for POST /packs/renew and POST
+// /packs/evict, naming the pack to act on.
+type AdminPackReq struct {
+	Domains []string `json:"domains"`
+}
+
+// AdminPackResp is the response body for POST /packs/renew and POST
+// /packs/evict: the pack after renewal, or as it was when evicted.
+type AdminPackResp struct {
+	Pack AdminPack `json:"pack"`
+}
+
+// AdminHistoryResp is the response body for POST /packs/history, whose
+// request body is an AdminPackReq: the pack's current cert followed by
+// the retained previous versions, newest first.
+type AdminHistoryResp struct {
+	Versions []HttpCertVersion `json:"versions"`
+}
+
+// AdminRollbackReq is the request body for POST /packs/rollback. The
+// pack for Domains is switched to the retained version with Serial.
+type AdminRollbackReq struct {
+	Domains []string `json:"domains"`
+	Serial  string   `json:"serial"`
+}
+
+// AdminRollbackResp is the response body for POST /packs/rollback.
+// Current describes the cert the pack now serves.
+type AdminRollbackResp struct {
+	Current HttpCertVersion `json:"current"`
+}
+
+// AdminImportReq is the request body for POST /packs/import: an
+// externally obtained PEM chain and its private key. The pack's domains
+// are taken from the leaf's SANs.
+type AdminImportReq struct {
+	FullChain []byte `json:"fullchain"`
+	Key       []byte `json:"key"`
+}
+
+// AdminImportResp is the response body for POST /packs/import. Domains
+// is the pack the cert was imported into and Current describes the
+// imported cert.
+type AdminImportResp struct {
+	Domains []string        `json:"domains"`
+	Current HttpCertVersion `json:"current"`
+}
+
+// AdminOrder is an ACME order in flight.
+type AdminOrder struct {
+	Domains []string  `json:"domains"`
+	Started time.Time `json:"started"`
+}
+
+// AdminOrdersResp is the response body for GET /orders, oldest order
+// first.
+type AdminOrdersResp struct {
+	Orders []AdminOrder `json:"orders"`
+}
+
+// Statuses of an ApprovalRequest.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+)
+
+// ApprovalRequest is a pack under the server's ACME.requireApproval
+// domains and its operator's decision. Requester is the credential name
+// of the client that first asked for it, empty when approved ahead of
+// any request. Reason is the operator's, given when denying.
+type ApprovalRequest struct {
+	Domains     []string  `json:"domains"`
+	Status      string    `json:"status"`
+	Requester   string    `json:"requester,omitempty"`
+	RequestedAt time.Time `json:"requestedAt,omitzero"`
+	DecidedAt   time.Time `json:"decidedAt,omitzero"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// AdminApprovalsResp is the response body for GET /approvals, oldest
+// request first. A status query parameter lists only the requests with
+// that status.
+type AdminApprovalsResp struct {
+	Approvals []ApprovalRequest `json:"approvals"`
+}
+
+// AdminApprovalReq is the request body for POST /approvals/approve and
+// POST /approvals/deny.
+type AdminApprovalReq struct {
+	Domains []string `json:"domains"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// AdminApprovalResp is the response body for POST /approvals/approve
+// and POST /approvals/deny: the request as decided.
+type AdminApprovalResp struct {
+	Approval ApprovalRequest `json:"approval"`
+}
@@ -23,9 +23,26 @@ type HttpCertReq struct {
 //
 // Err carries a human-readable error string when the server cannot satisfy
 // the request — e.g. the requested Domains are outside the allow-list.
+// Warning is set when the cert is served but needs operator attention,
+// e.g. an imported cert that expires soon.
 type HttpCertResp struct {
 	RenewTimeLeft time.Duration `json:"renewTimeLeft"`
 	FullChain     []byte        `json:"fullchain"`
 	Key           []byte        `json:"key"`
 	Err           string        `json:"err"`
+	Warning       string        `json:"warning,omitempty"`
+}
+
+// HttpCertVersion describes one issued cert of a pack. Serial is the
+// leaf's serial number in hex and identifies the version for rollback.
+// ValidBefore is when the server considers the cert due for renewal.
+// External is set for imported certs, which are never renewed.
+type HttpCertVersion struct {
+	Serial      string    `json:"serial"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"notAfter"`
+	ValidBefore time.Time `json:"validBefore"`
+	RenewAt     time.Time `json:"renewAt"`
+	External    bool      `json:"external,omitempty"`
+	Current     bool      `json:"current"`
 }
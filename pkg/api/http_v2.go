@@ -0,0 +1,107 @@
+package api
+
+import "time"
+
+// V2Path is the path of the v2 cert endpoint under the server's apiPath.
+// The v1 endpoint at apiPath itself keeps its contract unchanged.
+const V2Path = "v2/certs"
+
+// WatchPathV2 is the path of the v2 watch endpoint under the server's
+// apiPath.
+const WatchPathV2 = "v2/watch"
+
+// HttpCertsMaxPacksV2 caps how many packs one v2 request may ask for.
+const HttpCertsMaxPacksV2 = 100
+
+// HttpWatchMaxWaitV2 caps how long the server holds a watch request.
+const HttpWatchMaxWaitV2 = 5 * time.Minute
+
+// Error codes of the v2 API, reported in HttpErrorV2.Code. Each maps to
+// one HTTP status.
+const (
+	ErrCodeApprovalPending  = "approval_pending"    // 202
+	ErrCodeBadRequest       = "bad_request"         // 400
+	ErrCodeUnauthorized     = "unauthorized"        // 401
+	ErrCodeNotAllowed       = "domains_not_allowed" // 403
+	ErrCodeApprovalDenied   = "approval_denied"     // 403
+	ErrCodeMethodNotAllowed = "method_not_allowed"  // 405
+	ErrCodePackRejected     = "pack_rejected"       // 422
+	ErrCodeQuotaExceeded    = "quota_exceeded"      // 429
+	ErrCodeRateLimited      = "rate_limited"        // 429
+	ErrCodeTooManyRequests  = "too_many_requests"   // 429
+	ErrCodeInternal         = "internal"            // 500
+	ErrCodeUnavailable      = "unavailable"         // 503
+	ErrCodeExternalExpired  = "external_expired"    // 503
+)
+
+// HttpErrorV2 is a v2 API error. Message is meant for humans; clients
+// branch on Code. RetryAfter, in seconds, is set when the server knows
+// when retrying may succeed and is also sent as the Retry-After header.
+type HttpErrorV2 struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// HttpPackReqV2 names one cert pack in an HttpCertsReqV2.
+type HttpPackReqV2 struct {
+	Domains []string `json:"domains"`
+}
+
+// HttpCertsReqV2 is the request body for POST <apiPath>/v2/certs: the
+// packs to fetch, between 1 and HttpCertsMaxPacksV2 of them.
+type HttpCertsReqV2 struct {
+	Packs []HttpPackReqV2 `json:"packs"`
+}
+
+// HttpPackV2 is one pack of an HttpCertsRespV2, in the order requested.
+// Either Error is set, or the cert fields are.
+//
+// Leaf is the PEM leaf certificate and Chain the PEM intermediates that
+// follow it; together they are v1's fullchain. Version increases each
+// time the server's cert for the pack changes and is only comparable
+// between responses of the same server process. RenewTimeLeft plays the
+// same role as in v1: clients poll every RenewTimeLeft/4.
+type HttpPackV2 struct {
+	Domains []string `json:"domains"`
+
+	Version       uint64        `json:"version,omitempty"`
+	Serial        string        `json:"serial,omitempty"`
+	Issuer        string        `json:"issuer,omitempty"`
+	NotBefore     time.Time     `json:"notBefore,omitzero"`
+	NotAfter      time.Time     `json:"notAfter,omitzero"`
+	RenewTimeLeft time.Duration `json:"renewTimeLeft,omitempty"`
+	External      bool          `json:"external,omitempty"`
+
+	Leaf  []byte `json:"leaf,omitempty"`
+	Chain []byte `json:"chain,omitempty"`
+	Key   []byte `json:"key,omitempty"`
+
+	Warning string       `json:"warning,omitempty"`
+	Error   *HttpErrorV2 `json:"error,omitempty"`
+}
+
+// HttpCertsRespV2 is the response body for POST <apiPath>/v2/certs.
+//
+// The status is 200 when at least one pack was served, with the packs
+// that failed carrying their own Error. When the request itself is
+// rejected, or every pack failed, Error is set and the status is the one
+// of its code; Packs then still reports each pack's error, if the
+// request got that far.
+type HttpCertsRespV2 struct {
+	Packs []HttpPackV2 `json:"packs,omitempty"`
+	Error *HttpErrorV2 `json:"error,omitempty"`
+}
+
+// HttpWatchReqV2 is the request body for POST <apiPath>/v2/watch.
+//
+// The server answers as soon as its version of the pack differs from
+// Version, with an HttpCertsRespV2 holding that one pack, so a Version of
+// 0 returns the current pack at once. Otherwise it holds the request for
+// Wait, at most HttpWatchMaxWaitV2 (also the default), and answers 204 No
+// Content if the pack didn't change meanwhile.
+type HttpWatchReqV2 struct {
+	Domains []string      `json:"domains"`
+	Version uint64        `json:"version,omitempty"`
+	Wait    time.Duration `json:"wait,omitempty"`
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpCertsReqV2JSON(t *testing.T) {
+	in := HttpCertsReqV2{Packs: []HttpPackReqV2{
+		{Domains: []string{"example.com"}},
+		{Domains: []string{"a.example.com", "b.example.com"}},
+	}}
+
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want := `{"packs":[{"domains":["example.com"]},{"domains":["a.example.com","b.example.com"]}]}`
+	if string(b) != want {
+		t.Fatalf("wire format drift:\n got:  %s\n want: %s", b, want)
+	}
+}
+
+func TestHttpCertsRespV2JSONRoundTrip(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := HttpCertsRespV2{Packs: []HttpPackV2{
+		{
+			Domains:       []string{"example.com"},
+			Version:       3,
+			Serial:        "0a1b",
+			Issuer:        "CN=Test CA",
+			NotBefore:     now,
+			NotAfter:      now.Add(90 * 24 * time.Hour),
+			RenewTimeLeft: 24 * time.Hour,
+			Leaf:          []byte("PEM-leaf"),
+			Chain:         []byte("PEM-chain"),
+			Key:           []byte("PEM-key"),
+		},
+		{
+			Domains: []string{"evil.com"},
+			Error:   &HttpErrorV2{Code: ErrCodeNotAllowed, Message: "Domains not allowed"},
+		},
+	}}
+
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, want := range []string{
+		`"version":`, `"serial":`, `"issuer":`, `"notBefore":`, `"notAfter":`,
+		`"renewTimeLeft":`, `"leaf":`, `"chain":`, `"key":`, `"code":"domains_not_allowed"`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("missing wire tag %s in %s", want, b)
+		}
+	}
+	// The failed pack carries no empty cert fields.
+	if strings.Contains(string(b), `"notBefore":"0001`) {
+		t.Errorf("zero time marshalled in %s", b)
+	}
+
+	var out HttpCertsRespV2
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round-trip lost data: in=%+v out=%+v", in, out)
+	}
+}
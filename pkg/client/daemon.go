@@ -6,8 +6,9 @@
 //
 //   - daemon.go        — daemon lifecycle, config loading, watcher
 //     registration, and the cert-change fan-out.
+//   - pool.go          — server pool health tracking and selection.
 //   - http_poller.go   — HTTP-mode polling loop.
-//   - grpc_streamer.go — gRPC SDS failover state machine.
+//   - grpc_streamer.go — gRPC SDS stream with failover and fallback.
 //   - http.go / sds.go / mtls.go / handler.go — protocol clients and
 //     the on-disk write/reload handler.
 package client
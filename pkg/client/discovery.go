@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// discovery returns the servers a client fetches from: the listed ones,
+// or those behind the [Http.SRV] / [GRPC.SRV] name, looked up again on
+// every call. When a lookup fails the last answer is kept.
+type discovery struct {
+	config   *config.ClientConfig
+	resolver *net.Resolver
+
+	mu   sync.Mutex
+	http []config.ClientHttpServer
+	grpc []config.ClientGRPCServer
+}
+
+func newDiscovery(c *config.ClientConfig) *discovery {
+	d := &discovery{config: c, resolver: net.DefaultResolver}
+	if addr := c.Common.Resolver; addr != "" {
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return d
+}
+
+// lookup resolves the SRV records of name, most preferred first.
+// Targets of "." announce that the service is not available and are
+// dropped.
+func (d *discovery) lookup(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup SRV %s: %w", name, err)
+	}
+	ret := records[:0]
+	for _, r := range records {
+		if r.Target != "." {
+			ret = append(ret, r)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("lookup SRV %s: no servers", name)
+	}
+	return ret, nil
+}
+
+// srvAddr returns the host:port record r points at.
+func srvAddr(r *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+}
+
+// srvMember returns the pool placement record r asks for.
+func srvMember(r *net.SRV) config.ClientPoolMember {
+	return config.ClientPoolMember{Priority: int(r.Priority), Weight: int(r.Weight)}
+}
+
+// httpServers returns the servers of an HTTP mode client.
+func (d *discovery) httpServers(ctx context.Context) []config.ClientHttpServer {
+	srv := &d.config.Http.SRV
+	if srv.Name == "" {
+		return d.config.HttpServers()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records, err := d.lookup(ctx, srv.Name)
+	if err != nil {
+		logging.Warn("Discover http servers failed, using the last %d found: %s", len(d.http), err)
+		return d.http
+	}
+
+	base, err := url.Parse(srv.Url)
+	if err != nil {
+		logging.Error("Parse http SRV url %q: %s", srv.Url, err)
+		return d.http
+	}
+	d.http = d.http[:0:0]
+	for _, r := range records {
+		u := *base
+		u.Host = srvAddr(r)
+		s := srv.ClientHttpServer
+		s.Url = u.String()
+		s.ClientPoolMember = srvMember(r)
+		d.http = append(d.http, s)
+	}
+	return d.http
+}
+
+// grpcServers returns the servers of a gRPC mode client.
+func (d *discovery) grpcServers(ctx context.Context) []config.ClientGRPCServer {
+	srv := &d.config.GRPC.SRV
+	if srv.Name == "" {
+		return d.config.GRPCServers()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	records, err := d.lookup(ctx, srv.Name)
+	if err != nil {
+		logging.Warn("Discover grpc servers failed, using the last %d found: %s", len(d.grpc), err)
+		return d.grpc
+	}
+
+	d.grpc = d.grpc[:0:0]
+	for _, r := range records {
+		d.grpc = append(d.grpc, config.ClientGRPCServer{
+			Server:           srvAddr(r),
+			ClientMtlsConfig: srv.ClientMtlsConfig,
+			ClientPoolMember: srvMember(r),
+		})
+	}
+	return d.grpc
+}
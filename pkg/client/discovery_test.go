@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// serveSRV answers SRV queries on a local UDP port from records, keyed by
+// fully qualified name, until the test ends. It returns the address.
+func serveSRV(t *testing.T, records map[string][]dnsmessage.SRVResource) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+				Questions: req.Questions,
+			}
+			srvs, ok := records[q.Name.String()]
+			if !ok || q.Type != dnsmessage.TypeSRV {
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+			for _, srv := range srvs {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &srv,
+				})
+			}
+			out, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func srvRecord(target string, port, priority, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{
+		Target:   dnsmessage.MustNewName(target),
+		Port:     port,
+		Priority: priority,
+		Weight:   weight,
+	}
+}
+
+func TestDiscoveryGRPCServers(t *testing.T) {
+	records := map[string][]dnsmessage.SRVResource{
+		"_certdx-grpc._tcp.example.com.": {
+			srvRecord("b.example.com.", 10002, 1, 1),
+			srvRecord("a.example.com.", 10001, 0, 5),
+		},
+		"_moved._tcp.example.com.": {
+			srvRecord("c.example.com.", 10003, 0, 0),
+		},
+	}
+	c := &config.ClientConfig{}
+	c.SetDefault()
+	c.Common.Resolver = serveSRV(t, records)
+	c.GRPC.SRV.Name = "_certdx-grpc._tcp.example.com"
+	c.GRPC.SRV.PEM = "/etc/certdx/client.pem"
+
+	d := newDiscovery(c)
+	servers := d.grpcServers(context.Background())
+	if len(servers) != 2 {
+		t.Fatalf("servers: got %+v want 2", servers)
+	}
+	a := servers[0]
+	if a.Server != "a.example.com:10001" || a.Priority != 0 || a.Weight != 5 || a.PEM != "/etc/certdx/client.pem" {
+		t.Errorf("first server: got %+v", a)
+	}
+	if b := servers[1]; b.Server != "b.example.com:10002" || b.Priority != 1 {
+		t.Errorf("second server: got %+v", b)
+	}
+
+	// Lookups are repeated on every call, and a failed one keeps the
+	// last answer.
+	c.GRPC.SRV.Name = "_moved._tcp.example.com"
+	if got := d.grpcServers(context.Background()); len(got) != 1 || got[0].Server != "c.example.com:10003" {
+		t.Errorf("after the records changed: got %+v", got)
+	}
+	c.GRPC.SRV.Name = "_missing._tcp.example.com"
+	if got := d.grpcServers(context.Background()); len(got) != 1 || got[0].Server != "c.example.com:10003" {
+		t.Errorf("after a failed lookup: got %+v want the last answer", got)
+	}
+}
+
+func TestDiscoveryHttpServers(t *testing.T) {
+	c := &config.ClientConfig{}
+	c.SetDefault()
+	c.Common.Resolver = serveSRV(t, map[string][]dnsmessage.SRVResource{
+		"_certdx._tcp.example.com.": {
+			srvRecord("a.example.com.", 19198, 0, 1),
+			srvRecord(".", 0, 0, 0),
+		},
+	})
+	c.Http.SRV.Name = "_certdx._tcp.example.com"
+	c.Http.SRV.Url = "https://certdx/1145141919810"
+	c.Http.SRV.Token = "secret"
+
+	servers := newDiscovery(c).httpServers(context.Background())
+	if len(servers) != 1 {
+		t.Fatalf("servers: got %+v want 1", servers)
+	}
+	s := servers[0]
+	if s.Url != "https://a.example.com:19198/1145141919810" {
+		t.Errorf("url: got %s", s.Url)
+	}
+	if s.Token != "secret" || s.AuthMethod != config.HTTP_AUTH_TOKEN {
+		t.Errorf("auth: got %s %s", s.AuthMethod, s.Token)
+	}
+}
+
+func TestDiscoveryStaticServers(t *testing.T) {
+	c := &config.ClientConfig{}
+	c.SetDefault()
+	c.Http.MainServer.Url = "https://main.example.com"
+	servers := newDiscovery(c).httpServers(context.Background())
+	if len(servers) != 1 || servers[0].Url != "https://main.example.com" {
+		t.Fatalf("servers: got %+v", servers)
+	}
+}
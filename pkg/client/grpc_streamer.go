@@ -2,9 +2,10 @@ package client
 
 import (
 	"context"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"pkg.para.party/certdx/pkg/config"
 	"pkg.para.party/certdx/pkg/logging"
 )
 
@@ -18,256 +19,277 @@ const grpcRetryWindow = 5 * time.Minute
 // the per-server retry budget has not yet been exhausted.
 const grpcRetryBackoff = 15 * time.Second
 
-// GRPC_CLIENT_STATE enumerates the discrete phases of the failover
-// state machine that drives GRPCMain.
-type GRPC_CLIENT_STATE int
-
-const (
-	GRPC_STATE_STOP GRPC_CLIENT_STATE = iota
-	GRPC_STATE_MAIN
-	GRPC_STATE_FAILOVER
-	GRPC_STATE_TRY_FALLBACK
-	GRPC_STATE_RESTART_MAIN
-)
+// grpcSwitch asks the dispatch loop to stream from another server, or,
+// with an empty server, from the one the pool prefers. When a probe
+// already has a stream running on it, ctx, cancel, started and done hand
+// that stream over instead of a new one being dialed.
+type grpcSwitch struct {
+	server  string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started time.Time
+	done    <-chan error
+}
 
-// grpcStreamer owns one run of the gRPC failover state machine. Its
-// fields collect the parameters and per-cycle state that the dispatch
-// loop needs; methods named handle* implement each state. The struct
-// is re-created per GRPCMain call, so its state is not shared across
-// daemon restarts.
+// grpcStreamer keeps one SDS stream open to a server of the pool. The
+// dispatch loop in run owns a session per server in use: the session
+// retries its server within the retry budget and then asks to fail over,
+// while, under the priority policy, a prober retries the preferred
+// servers every ReconnectInterval and asks to move back as soon as one
+// delivers. The servers are discovered again on every reconnect. The
+// struct is re-created per GRPCMain call, so its state is not shared
+// across daemon restarts.
 type grpcStreamer struct {
 	daemon *CertDXClientDaemon
+	disc   *discovery
+	pool   *serverPool
 
-	mainClient    *CertDXgRPCClient
-	standbyClient *CertDXgRPCClient
-	standbyExists bool
-
-	stateChan chan GRPC_CLIENT_STATE
-
-	mainRetryCount int
-	standbyActive  atomic.Bool
+	mu      sync.Mutex
+	servers map[string]config.ClientGRPCServer
+	clients map[string]*CertDXgRPCClient
 
-	// sessionCtx / sessionCancel are mutated only by the dispatch
-	// goroutine in run. They scope every goroutine spawned for a
-	// single FAILOVER → TRY_FALLBACK → RESTART_MAIN cycle, derived
-	// from the daemon's rootCtx so daemon Stop drains them too.
-	sessionCtx    context.Context
-	sessionCancel context.CancelFunc
+	// switches carries session and prober requests to the dispatch
+	// loop. Senders give up when their session ends.
+	switches chan grpcSwitch
 }
 
 func newGRPCStreamer(d *CertDXClientDaemon) *grpcStreamer {
-	s := &grpcStreamer{
-		daemon:        d,
-		mainClient:    MakeCertDXgRPCClient(&d.Config.GRPC.MainServer, d.certs),
-		standbyExists: d.Config.GRPC.StandbyServer.Server != "",
-		stateChan:     make(chan GRPC_CLIENT_STATE, 1),
+	return &grpcStreamer{
+		daemon:   d,
+		disc:     newDiscovery(d.Config),
+		pool:     newGRPCServerPool(d.Config),
+		servers:  map[string]config.ClientGRPCServer{},
+		clients:  map[string]*CertDXgRPCClient{},
+		switches: make(chan grpcSwitch),
 	}
-	if s.standbyExists {
-		s.standbyClient = MakeCertDXgRPCClient(&d.Config.GRPC.StandbyServer, d.certs)
-	}
-	s.sessionCtx, s.sessionCancel = context.WithCancel(d.rootCtx)
-	return s
 }
 
-// run is the dispatch loop. It reads state transitions off stateChan
-// and invokes the matching handler. Exits when GRPC_STATE_STOP arrives.
-func (s *grpcStreamer) run() {
-	defer s.daemon.wg.Done()
-	defer s.sessionCancel()
+// refresh discovers the servers again and updates the pool with them.
+func (s *grpcStreamer) refresh(ctx context.Context) {
+	servers := s.disc.grpcServers(ctx)
+	s.pool.setGRPC(servers)
 
-	for {
-		var state GRPC_CLIENT_STATE
-		select {
-		case state = <-s.stateChan:
-		case <-s.daemon.rootCtx.Done():
-			s.sessionCancel()
-			return
-		}
-		logging.Debug("Process grpc client state: %d", state)
-		switch state {
-		case GRPC_STATE_STOP:
-			s.sessionCancel()
-			return
-		case GRPC_STATE_MAIN:
-			s.daemon.wg.Add(1)
-			go s.handleMain()
-		case GRPC_STATE_FAILOVER:
-			// Cancel any leftover cycle and start a fresh one.
-			s.sessionCancel()
-			s.sessionCtx, s.sessionCancel = context.WithCancel(s.daemon.rootCtx)
-
-			s.standbyActive.Store(true)
-			s.daemon.wg.Add(1)
-			go s.handleFailover()
-			s.sendState(GRPC_STATE_TRY_FALLBACK)
-		case GRPC_STATE_TRY_FALLBACK:
-			s.daemon.wg.Add(1)
-			go s.handleFallback(s.sessionCtx, s.sessionCancel)
-			s.sendState(GRPC_STATE_RESTART_MAIN)
-		case GRPC_STATE_RESTART_MAIN:
-			s.daemon.wg.Add(1)
-			go s.handleRestart(s.sessionCtx)
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range servers {
+		s.servers[server.Server] = server
 	}
 }
 
-func (s *grpcStreamer) sendState(state GRPC_CLIENT_STATE) bool {
-	select {
-	case s.stateChan <- state:
-		return true
-	case <-s.daemon.rootCtx.Done():
-		return false
+// client returns the client of server name, creating it on first use.
+func (s *grpcStreamer) client(name string) *CertDXgRPCClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[name]
+	if !ok {
+		server := s.servers[name]
+		c = MakeCertDXgRPCClient(&server, s.daemon.certs)
+		s.clients[name] = c
 	}
+	return c
 }
 
-// handleMain runs one attempt at the main stream. On success the
-// retry counter resets; on failure it increments and schedules either
-// a retry, a failover to standby, or a sleep-then-retry depending on
-// the budget.
-func (s *grpcStreamer) handleMain() {
-	defer func() {
-		s.daemon.wg.Done()
-		logging.Debug("Main stream goroutine exit")
-	}()
-
-	logging.Info("Starting gRPC main stream")
-	startTime := time.Now()
-	err := s.mainClient.Stream(s.daemon.rootCtx)
-	logging.Info("gRPC main stream stopped: %s", err)
-	if s.daemon.rootCtx.Err() != nil {
-		// Daemon shutdown was requested while we were on the wire — stop
-		// the dispatcher rather than re-entering the retry loop.
-		s.sendState(GRPC_STATE_STOP)
-		return
-	}
+// run is the dispatch loop. It runs one session at a time, on the
+// server the pool prefers first, and replaces it on every switch
+// request until rootCtx is done.
+func (s *grpcStreamer) run() {
+	defer s.daemon.wg.Done()
+	rootCtx := s.daemon.rootCtx
+
+	var next grpcSwitch
+	for rootCtx.Err() == nil {
+		cur := next
+		next = grpcSwitch{}
+		if cur.server == "" {
+			s.refresh(rootCtx)
+			order := s.pool.order()
+			if len(order) == 0 {
+				logging.Error("No gRPC server found, retry in %s", s.daemon.Config.Common.ReconnectInterval)
+				if !sleepCtx(rootCtx, s.daemon.Config.Common.ReconnectDuration) {
+					return
+				}
+				continue
+			}
+			cur.server = order[0]
+		}
+		if cur.ctx == nil {
+			cur.ctx, cur.cancel = context.WithCancel(rootCtx)
+		}
 
-	if time.Now().Before(startTime.Add(grpcRetryWindow)) {
-		s.mainRetryCount++
-	} else {
-		s.mainRetryCount = 0
-		s.sendState(GRPC_STATE_MAIN)
-		return
-	}
+		var session sync.WaitGroup
+		session.Go(func() { s.stream(cur) })
+		if len(s.pool.better(cur.server)) != 0 {
+			session.Go(func() { s.probe(cur.ctx, cur.server) })
+		}
 
-	logging.Info("Current main server retry count: %d", s.mainRetryCount)
-	if s.mainRetryCount < s.daemon.Config.Common.RetryCount {
 		select {
-		case <-time.After(grpcRetryBackoff):
-			s.sendState(GRPC_STATE_MAIN)
-			return
-		case <-s.daemon.rootCtx.Done():
-			return
+		case next = <-s.switches:
+		case <-rootCtx.Done():
 		}
-	}
-
-	logging.Info("Retry limit for main stream reached")
-	s.mainRetryCount = 0
-	if s.standbyExists && !s.standbyActive.Load() {
-		logging.Info("Start trying standby stream")
-		s.sendState(GRPC_STATE_FAILOVER)
-	} else {
-		logging.Info("Sleep %s", s.daemon.Config.Common.ReconnectInterval)
-		s.sendState(GRPC_STATE_RESTART_MAIN)
+		cur.cancel()
+		session.Wait()
 	}
 }
 
-// handleFailover drives the standby gRPC stream while the main is
-// dead, retrying with the same backoff as handleMain. It exits when
-// sessionCtx is cancelled (main recovered or daemon stopped).
-func (s *grpcStreamer) handleFailover() {
-	defer func() {
-		s.daemon.wg.Done()
-		s.standbyActive.Store(false)
-		logging.Debug("Standby goroutine exit")
+// startStream runs a stream to server name until ctx is done or the
+// stream fails, recording a success in the pool once a message arrives.
+// The returned channel yields the stream's error.
+func (s *grpcStreamer) startStream(ctx context.Context, name string) <-chan error {
+	client := s.client(name)
+	done := make(chan error, 1)
+	received := client.Received.Load()
+	go func() {
+		ended := make(chan struct{})
+		go func() {
+			select {
+			case <-*received:
+				s.pool.success(name)
+			case <-ended:
+			}
+		}()
+		done <- client.Stream(ctx)
+		close(ended)
 	}()
+	return done
+}
 
-	standbyRetryCount := 0
+// sleepCtx sleeps for d and reports whether ctx is still alive.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// stream is the session on cur's server. A stream that lived past
+// grpcRetryWindow is simply reopened; one that failed sooner counts
+// against the retry budget, with grpcRetryBackoff between attempts.
+// Once the budget is spent the session fails over to the next server
+// that is up, or, if there is none, sleeps ReconnectInterval and starts
+// over on its own server. A server that discovery no longer returns is
+// left at once. It returns when cur.ctx is done.
+func (s *grpcStreamer) stream(cur grpcSwitch) {
+	name := cur.server
+	retryCount := s.daemon.Config.Common.RetryCount
+
+	retries := 0
 	for {
-		if s.sessionCtx.Err() != nil {
+		started, done := cur.started, cur.done
+		if done == nil {
+			logging.Info("Starting gRPC stream to %s", name)
+			started, done = time.Now(), s.startStream(cur.ctx, name)
+		}
+		cur.done = nil
+
+		err := <-done
+		logging.Info("gRPC stream to %s stopped: %s", name, err)
+		if cur.ctx.Err() != nil {
 			return
 		}
-		logging.Info("Starting gRPC standby stream")
-		startTime := time.Now()
-		err := s.standbyClient.Stream(s.sessionCtx)
-		logging.Info("gRPC standby stream stopped: %s", err)
-		if s.sessionCtx.Err() != nil {
-			// Session ended (failover resolved or daemon stopped); the
-			// loop-top check will exit on the next iteration anyway, but
-			// returning here skips the retry-window bookkeeping.
+
+		s.refresh(cur.ctx)
+		if !s.pool.has(name) {
+			logging.Info("Server %s is no longer discovered, switching", name)
+			s.requestSwitch(cur.ctx, grpcSwitch{})
 			return
 		}
 
-		if time.Now().Before(startTime.Add(grpcRetryWindow)) {
-			standbyRetryCount++
-		} else {
-			standbyRetryCount = 0
+		if time.Since(started) >= grpcRetryWindow {
+			retries = 0
 			continue
 		}
+		retries++
+		s.pool.failure(name)
 
-		logging.Info("Current standby server retry count: %d", standbyRetryCount)
-		if standbyRetryCount < s.daemon.Config.Common.RetryCount {
-			select {
-			case <-time.After(grpcRetryBackoff):
-				continue
-			case <-s.sessionCtx.Done():
-				logging.Debug("Standby goroutine reset")
+		logging.Info("Server %s retry count: %d", name, retries)
+		if retries < retryCount {
+			if !sleepCtx(cur.ctx, grpcRetryBackoff) {
 				return
 			}
+			continue
 		}
 
-		logging.Info("Retry limit for standby stream reached, sleep %s", s.daemon.Config.Common.ReconnectInterval)
-		standbyRetryCount = 0
-		select {
-		case <-time.After(s.daemon.Config.Common.ReconnectDuration):
-			continue
-		case <-s.sessionCtx.Done():
-			logging.Debug("Standby goroutine reset")
+		retries = 0
+		if next, ok := s.pool.failover(name); ok {
+			logging.Info("Retry limit for %s reached, switching to %s", name, next)
+			s.requestSwitch(cur.ctx, grpcSwitch{server: next})
+			return
+		}
+		logging.Info("Retry limit for %s reached and no other server is up, sleep %s", name, s.daemon.Config.Common.ReconnectInterval)
+		if !sleepCtx(cur.ctx, s.daemon.Config.Common.ReconnectDuration) {
 			return
 		}
 	}
 }
 
-// handleFallback waits for the main client to receive a message (i.e.
-// main is alive again). On recovery it kills the standby and cancels
-// the session, which signals every other session-bound goroutine
-// (handleFailover, handleRestart) to wind down. If sessionCtx fires
-// first, fallback exits without action.
-func (s *grpcStreamer) handleFallback(sessionCtx context.Context, sessionCancel context.CancelFunc) {
-	defer func() {
-		s.daemon.wg.Done()
-		logging.Debug("Fallback goroutine exit")
-	}()
+// requestSwitch sends sw to the dispatch loop, giving up when ctx, the
+// sender's session, is done. It reports whether sw was sent.
+func (s *grpcStreamer) requestSwitch(ctx context.Context, sw grpcSwitch) bool {
 	select {
-	case <-*s.mainClient.Received.Load():
-		s.standbyClient.Kill()
-		sessionCancel()
-	case <-sessionCtx.Done():
-		logging.Debug("Fallback goroutine reset")
+	case s.switches <- sw:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
-// handleRestart sleeps for ReconnectDuration before signalling MAIN
-// again. Cancelled by sessionCtx; in that case it exits without
-// re-entering MAIN.
-func (s *grpcStreamer) handleRestart(sessionCtx context.Context) {
-	defer func() {
-		s.daemon.wg.Done()
-		logging.Debug("Restart goroutine exit")
-	}()
-	logging.Debug("Reconnect duration is: %s", s.daemon.Config.Common.ReconnectDuration)
+// probe retries the servers preferred over name, most preferred first,
+// every ReconnectInterval while the session on name runs. It returns
+// once one of them delivers, handing its stream to the dispatch loop, or
+// when ctx is done.
+func (s *grpcStreamer) probe(ctx context.Context, name string) {
+	t := time.NewTicker(s.daemon.Config.Common.ReconnectDuration)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		s.refresh(ctx)
+		for _, better := range s.pool.better(name) {
+			if s.tryProbe(ctx, better) {
+				return
+			}
+		}
+	}
+}
+
+// tryProbe opens a stream to server name and waits for its first
+// message. It reports whether probing is over, either because the stream
+// was handed to the dispatch loop or because ctx is done.
+func (s *grpcStreamer) tryProbe(ctx context.Context, name string) bool {
+	logging.Debug("Probing gRPC server %s", name)
+
+	probeCtx, cancel := context.WithCancel(s.daemon.rootCtx)
+	received := s.client(name).Received.Load()
+	started := time.Now()
+	done := s.startStream(probeCtx, name)
+
 	select {
-	case <-time.After(s.daemon.Config.Common.ReconnectDuration):
-		s.sendState(GRPC_STATE_MAIN)
-	case <-sessionCtx.Done():
-		logging.Debug("Restart goroutine reset")
-		return
+	case <-*received:
+		logging.Info("Server %s is reachable again, switching to it", name)
+		if s.requestSwitch(ctx, grpcSwitch{server: name, ctx: probeCtx, cancel: cancel, started: started, done: done}) {
+			return true
+		}
+	case err := <-done:
+		cancel()
+		s.pool.failure(name)
+		logging.Debug("Probe of %s failed: %s", name, err)
+		return ctx.Err() != nil
+	case <-ctx.Done():
 	}
+	cancel()
+	<-done
+	return true
 }
 
 // GRPCMain runs the gRPC SDS client (with failover) until Stop is
-// called. The five-state machine and its state transitions are
-// preserved; encapsulating it in grpcStreamer just makes the
-// dispatch loop and per-state logic easier to read.
+// called.
 func (r *CertDXClientDaemon) GRPCMain() {
 	r.startWatchers()
 
@@ -276,16 +298,8 @@ func (r *CertDXClientDaemon) GRPCMain() {
 	r.wg.Add(1)
 	go s.run()
 
-	s.sendState(GRPC_STATE_MAIN)
-
 	<-r.rootCtx.Done()
 
-	s.sendState(GRPC_STATE_STOP)
-
 	logging.Info("Stopping gRPC client")
-	s.mainClient.Kill()
-	if s.standbyClient != nil {
-		s.standbyClient.Kill()
-	}
 	r.wg.Wait()
 }
@@ -5,20 +5,40 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"pkg.para.party/certdx/pkg/api"
 	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
 	"pkg.para.party/certdx/pkg/logging"
 	"pkg.para.party/certdx/pkg/mtls"
 )
 
+// ErrWatchUnsupported is returned by WatchCertV2Ctx when the server has
+// no watch endpoint, as servers predating it don't.
+var ErrWatchUnsupported = errors.New("server does not support watching certs")
+
 type CertDXHttpClient struct {
 	HttpClient *http.Client
 	Server     *config.ClientHttpServer
+
+	// cached holds the last cert fetched per pack with its ETag. It is
+	// sent as If-None-Match and answered again on 304 Not Modified, so
+	// an unchanged cert and its key don't cross the network again.
+	mu     sync.Mutex
+	cached map[domain.Key]cachedCertResp
+}
+
+type cachedCertResp struct {
+	etag string
+	resp api.HttpCertResp
 }
 
 type CertDXHttpClientOption func(client *CertDXHttpClient)
@@ -76,26 +96,62 @@ func (c *CertDXHttpClient) makeGetCertRequest(ctx context.Context, domains []str
 
 	req = req.WithContext(ctx)
 
-	if c.Server.AuthMethod == config.HTTP_AUTH_TOKEN && c.Server.Token != "" {
-		req.Header = http.Header{
-			"Authorization": {fmt.Sprintf("Token %s", c.Server.Token)},
-		}
+	if err := c.setAuthorization(req); err != nil {
+		return nil, err
 	}
 	return req, nil
 }
 
+// setAuthorization sets the Authorization header of req per the auth
+// method: the token, or a bearer JWT. A JWT in TokenFile is read for
+// every request, as whatever provides it rotates it in place.
+func (c *CertDXHttpClient) setAuthorization(req *http.Request) error {
+	switch c.Server.AuthMethod {
+	case config.HTTP_AUTH_TOKEN:
+		if c.Server.Token != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.Server.Token))
+		}
+	case config.HTTP_AUTH_JWT:
+		token := c.Server.Token
+		if c.Server.TokenFile != "" {
+			b, err := os.ReadFile(c.Server.TokenFile)
+			if err != nil {
+				return fmt.Errorf("read token file: %w", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	return nil
+}
+
+// GetCertCtx fetches the cert for domains. Once the client has fetched
+// it, the request is conditional, and an unchanged cert is returned from
+// the client's cache.
 func (c *CertDXHttpClient) GetCertCtx(ctx context.Context, domains []string) (*api.HttpCertResp, error) {
 	req, err := c.makeGetCertRequest(ctx, domains)
 	if err != nil {
 		return nil, err
 	}
 
+	key := domain.AsKey(domains)
+	c.mu.Lock()
+	cached, isCached := c.cached[key]
+	c.mu.Unlock()
+	if isCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		certResp := cached.resp
+		return &certResp, nil
+	}
 	if resp.StatusCode != http.StatusOK {
 		_, _ = io.Copy(io.Discard, resp.Body)
 		return nil, fmt.Errorf("POST '%s' status: %s", c.Server.Url, resp.Status)
@@ -107,9 +163,122 @@ func (c *CertDXHttpClient) GetCertCtx(ctx context.Context, domains []string) (*a
 		return nil, err
 	}
 
+	if etag := resp.Header.Get("ETag"); etag != "" && certResp.Err == "" {
+		c.mu.Lock()
+		if c.cached == nil {
+			c.cached = map[domain.Key]cachedCertResp{}
+		}
+		c.cached[key] = cachedCertResp{etag: etag, resp: *certResp}
+		c.mu.Unlock()
+	}
 	return certResp, nil
 }
 
 func (c *CertDXHttpClient) GetCert(domains []string) (*api.HttpCertResp, error) {
 	return c.GetCertCtx(context.Background(), domains)
 }
+
+// endpointURL returns the URL of the named endpoint under the server's
+// API URL.
+func (c *CertDXHttpClient) endpointURL(name string) string {
+	return strings.TrimSuffix(c.Server.Url, "/") + "/" + name
+}
+
+// jsonRequest returns a request POSTing reqBody as JSON to url.
+func (c *CertDXHttpClient) jsonRequest(ctx context.Context, url string, reqBody any) (*http.Request, error) {
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := c.setAuthorization(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// doJSON POSTs reqBody as JSON to url.
+func (c *CertDXHttpClient) doJSON(ctx context.Context, url string, reqBody any) (*http.Response, error) {
+	req, err := c.jsonRequest(ctx, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	return c.HttpClient.Do(req)
+}
+
+// GetCertsV2Ctx fetches the packs for each set of domains in packs from
+// the v2 endpoint. When the server rejects the request, or fails every
+// pack, the decoded response is returned along with an error carrying
+// its error code.
+func (c *CertDXHttpClient) GetCertsV2Ctx(ctx context.Context, packs [][]string) (*api.HttpCertsRespV2, error) {
+	req := &api.HttpCertsReqV2{Packs: make([]api.HttpPackReqV2, len(packs))}
+	for i, domains := range packs {
+		req.Packs[i].Domains = domains
+	}
+
+	url := c.endpointURL(api.V2Path)
+	resp, err := c.doJSON(ctx, url, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	certsResp := new(api.HttpCertsRespV2)
+	if err := json.NewDecoder(resp.Body).Decode(certsResp); err != nil {
+		return nil, fmt.Errorf("POST '%s' status: %s: %w", url, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if certsResp.Error == nil {
+			return nil, fmt.Errorf("POST '%s' status: %s", url, resp.Status)
+		}
+		return certsResp, fmt.Errorf("POST '%s' status: %s: %s: %s", url, resp.Status, certsResp.Error.Code, certsResp.Error.Message)
+	}
+	return certsResp, nil
+}
+
+// WatchCertV2Ctx waits up to wait for the server's version of the pack
+// for domains to move past version, and returns the pack then. It returns
+// a nil pack if it didn't change in time. A version of 0 returns the
+// current pack at once.
+func (c *CertDXHttpClient) WatchCertV2Ctx(ctx context.Context, domains []string, version uint64, wait time.Duration) (*api.HttpPackV2, error) {
+	// The request is held by the server for up to wait, on top of the
+	// usual time to answer.
+	httpClient := *c.HttpClient
+	httpClient.Timeout += wait
+
+	url := c.endpointURL(api.WatchPathV2)
+	req, err := c.jsonRequest(ctx, url, &api.HttpWatchReqV2{Domains: domains, Version: version, Wait: wait})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, ErrWatchUnsupported
+	}
+
+	watchResp := new(api.HttpCertsRespV2)
+	if err := json.NewDecoder(resp.Body).Decode(watchResp); err != nil {
+		return nil, fmt.Errorf("POST '%s' status: %s: %w", url, resp.Status, err)
+	}
+	if watchResp.Error != nil {
+		return nil, fmt.Errorf("POST '%s' status: %s: %s: %s", url, resp.Status, watchResp.Error.Code, watchResp.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK || len(watchResp.Packs) != 1 {
+		return nil, fmt.Errorf("POST '%s' status: %s: unexpected response", url, resp.Status)
+	}
+	return &watchResp.Packs[0], nil
+}
@@ -1,58 +1,113 @@
 package client
 
 import (
+	"sync"
 	"time"
 
 	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
 	"pkg.para.party/certdx/pkg/logging"
 	"pkg.para.party/certdx/pkg/retry"
 )
 
-// httpRequestCert fetches the cert for domains from the configured main
-// HTTP server, falling back to the standby server if the main fails the
-// retry budget. Returns nil only when both are unreachable.
-func (r *CertDXClientDaemon) httpRequestCert(domains []string) *api.HttpCertResp {
-	var resp *api.HttpCertResp
-	err := retry.Do(r.rootCtx, r.Config.Common.RetryCount, func() error {
-		certdxClient := MakeCertDXHttpClient(append(r.ClientOpt, WithCertDXServerInfo(&r.Config.Http.MainServer))...)
-		var err error
-		resp, err = certdxClient.GetCertCtx(r.rootCtx, domains)
-		return err
-	})
-	if err == nil {
-		return resp
+// httpPoller fetches the certs of an HTTP mode daemon, one poll loop per
+// cert. The loops share one server pool, so a server found down by one
+// is tried last by the others, one client per server, which remembers
+// the certs it fetched so unchanged ones aren't sent again, and what they
+// learn about which servers can push updates.
+type httpPoller struct {
+	daemon *CertDXClientDaemon
+	disc   *discovery
+	pool   *serverPool
+
+	mu      sync.Mutex
+	clients map[string]*CertDXHttpClient
+	noWatch map[string]bool
+}
+
+func newHttpPoller(d *CertDXClientDaemon) *httpPoller {
+	return &httpPoller{
+		daemon:  d,
+		disc:    newDiscovery(d.Config),
+		pool:    newHttpServerPool(d.Config),
+		clients: map[string]*CertDXHttpClient{},
+		noWatch: map[string]bool{},
+	}
+}
+
+// client returns the client of server, creating it on first use or when
+// discovery changed the server's settings.
+func (p *httpPoller) client(server *config.ClientHttpServer) *CertDXHttpClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[server.Url]
+	if !ok || *c.Server != *server {
+		s := *server
+		c = MakeCertDXHttpClient(append(p.daemon.ClientOpt, WithCertDXServerInfo(&s))...)
+		p.clients[server.Url] = c
+	}
+	return c
+}
+
+// requestCert fetches the cert for domains from the servers of the pool,
+// in the order it picks, spending the retry budget on each before moving
+// to the next. The servers are discovered again first. It also returns
+// the server that answered. Returns nil only when all are unreachable.
+func (p *httpPoller) requestCert(domains []string) (*api.HttpCertResp, *config.ClientHttpServer) {
+	r := p.daemon
+	servers := p.disc.httpServers(r.rootCtx)
+	p.pool.setHttp(servers)
+	byUrl := make(map[string]*config.ClientHttpServer, len(servers))
+	for i := range servers {
+		byUrl[servers[i].Url] = &servers[i]
 	}
-	logging.Warn("Failed to get cert %v from MainServer, err: %s", domains, err)
 
-	if r.Config.Http.StandbyServer.Url != "" {
-		certdxClient := MakeCertDXHttpClient(append(r.ClientOpt, WithCertDXServerInfo(&r.Config.Http.StandbyServer))...)
-		err = retry.Do(r.rootCtx, r.Config.Common.RetryCount, func() error {
+	for _, name := range p.pool.order() {
+		server, ok := byUrl[name]
+		if !ok {
+			// Another poller's discovery changed the pool since.
+			continue
+		}
+		certdxClient := p.client(server)
+		var resp *api.HttpCertResp
+		err := retry.Do(r.rootCtx, r.Config.Common.RetryCount, func() error {
 			var err error
 			resp, err = certdxClient.GetCertCtx(r.rootCtx, domains)
 			return err
 		})
 		if err == nil {
-			return resp
+			p.pool.success(name)
+			return resp, server
+		}
+		if r.rootCtx.Err() != nil {
+			return nil, nil
 		}
-		logging.Warn("Failed to get cert %v from StandbyServer, err: %s", domains, err)
+		p.pool.failure(name)
+		logging.Warn("Failed to get cert %v from %s, err: %s", domains, name, err)
 	}
-	return nil
+	return nil, nil
 }
 
-// httpPollingCert is the per-cert HTTP-mode poll loop. It requests the
-// cert, hands the result to the watcher via cert.UpdateChan, and sleeps
-// for RenewTimeLeft/4 (or one hour by default) before the next round.
-// Exits when rootCtx fires.
-func (r *CertDXClientDaemon) httpPollingCert(cert *watchingCert) {
+// pollCert is the per-cert HTTP-mode poll loop. It requests the cert,
+// hands the result to the watcher via cert.UpdateChan, and waits for
+// RenewTimeLeft/4 (or one hour by default) before the next round, or
+// until the server pushes a new cert. Exits when rootCtx fires.
+func (p *httpPoller) pollCert(cert *watchingCert) {
+	r := p.daemon
 	sleepTime := 1 * time.Hour // default sleep time
 	for {
 		logging.Info("Requesting cert %v", cert.Config.Domains)
-		resp := r.httpRequestCert(cert.Config.Domains)
+		resp, server := p.requestCert(cert.Config.Domains)
+		var fullchain []byte
 		if resp != nil {
 			if resp.Err != "" {
 				logging.Error("Failed to request cert, err: %s", resp.Err)
 			} else {
+				if resp.Warning != "" {
+					logging.Warn("Server warning for cert %v: %s", cert.Config.Domains, resp.Warning)
+				}
 				sleepTime = resp.RenewTimeLeft / 4
+				fullchain = resp.FullChain
 				select {
 				case cert.UpdateChan <- certData{
 					Domains:   cert.Config.Domains,
@@ -66,28 +121,24 @@ func (r *CertDXClientDaemon) httpPollingCert(cert *watchingCert) {
 		} else {
 			logging.Error("Failed to request cert, retry next round.")
 		}
-		t := time.NewTimer(sleepTime)
-		select {
-		case <-t.C:
-			// continue
-		case <-r.rootCtx.Done():
-			t.Stop()
+		if !p.waitCert(server, cert.Config.Domains, fullchain, sleepTime) {
 			return
 		}
 	}
 }
 
 // HttpMain runs the HTTP polling client until Stop is called. It
-// launches one watchUpdate + one httpPollingCert per registered cert
-// and blocks until rootCtx is done.
+// launches one watchUpdate + one poll loop per registered cert and
+// blocks until rootCtx is done.
 func (r *CertDXClientDaemon) HttpMain() {
 	r.startWatchers()
 
+	p := newHttpPoller(r)
 	for _, c := range r.certs {
 		r.wg.Add(1)
 		go func(_c *watchingCert) {
 			defer r.wg.Done()
-			r.httpPollingCert(_c)
+			p.pollCert(_c)
 		}(c)
 	}
 
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"testing"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func TestHttpPollerClient(t *testing.T) {
+	p := newHttpPoller(MakeCertDXClientDaemon())
+	server := config.ClientHttpServer{Url: "https://a.example.com", Token: "t1"}
+
+	c := p.client(&server)
+	if p.client(&server) != c {
+		t.Error("client not reused for the same server")
+	}
+	server.Token = "t2"
+	if c2 := p.client(&server); c2 == c || c2.Server.Token != "t2" {
+		t.Error("client not replaced after the server's settings changed")
+	}
+}
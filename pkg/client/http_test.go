@@ -6,6 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -99,6 +102,36 @@ func TestMakeGetCertRequestNoTokenHeader(t *testing.T) {
 	}
 }
 
+func TestMakeGetCertRequestBearerHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("jwt-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{
+		Url:        "https://example.com",
+		AuthMethod: config.HTTP_AUTH_JWT,
+		TokenFile:  path,
+	}))
+
+	for _, want := range []string{"jwt-1", "jwt-2"} {
+		if err := os.WriteFile(path, []byte(want+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		req, err := c.makeGetCertRequest(context.Background(), []string{"a.com"})
+		if err != nil {
+			t.Fatalf("makeGetCertRequest: %v", err)
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer "+want {
+			t.Fatalf("Authorization header: got %q want %q", auth, "Bearer "+want)
+		}
+	}
+
+	os.Remove(path)
+	if _, err := c.makeGetCertRequest(context.Background(), []string{"a.com"}); err == nil {
+		t.Fatal("missing token file should fail the request")
+	}
+}
+
 func TestMakeGetCertRequestBody(t *testing.T) {
 	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{
 		Url: "https://example.com",
@@ -212,3 +245,84 @@ func TestGetCertDelegatesToGetCertCtx(t *testing.T) {
 		t.Errorf("fullchain: got %q", got.FullChain)
 	}
 }
+
+func TestGetCertsV2Ctx(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/certdx/"+api.V2Path {
+			t.Errorf("path: got %q", r.URL.Path)
+		}
+		var req api.HttpCertsReqV2
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		resp := api.HttpCertsRespV2{}
+		for _, p := range req.Packs {
+			resp.Packs = append(resp.Packs, api.HttpPackV2{Domains: p.Domains, Leaf: []byte("leaf")})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{Url: ts.URL + "/certdx/"}))
+	got, err := c.GetCertsV2Ctx(context.Background(), [][]string{{"a.com"}, {"b.com"}})
+	if err != nil {
+		t.Fatalf("GetCertsV2Ctx: %v", err)
+	}
+	if len(got.Packs) != 2 || got.Packs[1].Domains[0] != "b.com" || string(got.Packs[0].Leaf) != "leaf" {
+		t.Errorf("packs: got %+v", got.Packs)
+	}
+}
+
+func TestGetCertsV2CtxError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(api.HttpCertsRespV2{
+			Error: &api.HttpErrorV2{Code: api.ErrCodeNotAllowed, Message: "Domains not allowed"},
+		})
+	}))
+	defer ts.Close()
+
+	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{Url: ts.URL}))
+	got, err := c.GetCertsV2Ctx(context.Background(), [][]string{{"evil.com"}})
+	if err == nil || !strings.Contains(err.Error(), api.ErrCodeNotAllowed) {
+		t.Fatalf("error: got %v", err)
+	}
+	if got == nil || got.Error.Code != api.ErrCodeNotAllowed {
+		t.Errorf("response: got %+v", got)
+	}
+}
+
+func TestGetCertCtxConditional(t *testing.T) {
+	var lastINM string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastINM = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"v1"`)
+		if lastINM == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(api.HttpCertResp{FullChain: []byte("fc"), Key: []byte("k")})
+	}))
+	defer ts.Close()
+
+	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{Url: ts.URL}))
+	for i := range 2 {
+		got, err := c.GetCertCtx(context.Background(), []string{"example.com"})
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if string(got.FullChain) != "fc" || string(got.Key) != "k" {
+			t.Errorf("request %d: got %+v", i, got)
+		}
+	}
+	if lastINM != `"v1"` {
+		t.Errorf("If-None-Match: got %q", lastINM)
+	}
+
+	// Other packs are fetched unconditionally.
+	if _, err := c.GetCertCtx(context.Background(), []string{"other.com"}); err != nil || lastINM != "" {
+		t.Errorf("other pack: If-None-Match %q, err %v", lastINM, err)
+	}
+}
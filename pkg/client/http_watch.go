@@ -0,0 +1,99 @@
+package client
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// httpWatchWait is how long one watch request asks the server to wait.
+// It stays under the 60 second idle timeout common to reverse proxies.
+const httpWatchWait = 55 * time.Second
+
+// httpWatchBackoff is the delay before watching again after a watch
+// request failed.
+const httpWatchBackoff = 15 * time.Second
+
+// watchable reports whether server wasn't found to lack the watch
+// endpoint.
+func (p *httpPoller) watchable(server *config.ClientHttpServer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.noWatch[server.Url]
+}
+
+func (p *httpPoller) setUnwatchable(server *config.ClientHttpServer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.noWatch[server.Url] = true
+}
+
+// leafSerial returns the serial of the first certificate in fullchain,
+// in the server's notation, or "" if there is none.
+func leafSerial(fullchain []byte) string {
+	block, _ := pem.Decode(fullchain)
+	if block == nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return leaf.SerialNumber.Text(16)
+}
+
+// waitCert waits up to d for the cert of domains, whose current
+// fullchain came from server, to change there. It watches the server
+// when it can, and otherwise just sleeps d. It returns early when the
+// cert changed, and reports whether rootCtx is still alive. Without a
+// cert to compare against, there is nothing to watch for.
+//
+// Versions are only comparable within one server process, so the first
+// watch request learns the current version and checks, by serial, that
+// it is the cert already held. After a failed request it starts over
+// that way, as the server may have restarted.
+func (p *httpPoller) waitCert(server *config.ClientHttpServer, domains []string, fullchain []byte, d time.Duration) bool {
+	r := p.daemon
+	serial := leafSerial(fullchain)
+	if server == nil || serial == "" || !p.watchable(server) {
+		return sleepCtx(r.rootCtx, d)
+	}
+
+	deadline := time.Now().Add(d)
+	client := p.client(server)
+	var version uint64
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return r.rootCtx.Err() == nil
+		}
+
+		pack, err := client.WatchCertV2Ctx(r.rootCtx, domains, version, min(remaining, httpWatchWait))
+		if r.rootCtx.Err() != nil {
+			return false
+		}
+		switch {
+		case errors.Is(err, ErrWatchUnsupported):
+			logging.Info("Server %s can't push cert updates, polling it", server.Url)
+			p.setUnwatchable(server)
+			return sleepCtx(r.rootCtx, remaining)
+		case err != nil:
+			logging.Warn("Watch cert %v on %s failed: %s", domains, server.Url, err)
+			version = 0
+			if !sleepCtx(r.rootCtx, min(remaining, httpWatchBackoff)) {
+				return false
+			}
+		case pack == nil:
+			// Unchanged, watch again.
+		case version == 0 && pack.Serial == serial:
+			version = pack.Version
+		default:
+			logging.Info("Server %s pushed cert %v version %d", server.Url, domains, pack.Version)
+			return true
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func TestWatchCertV2Ctx(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+api.WatchPathV2 {
+			http.NotFound(w, r)
+			return
+		}
+		var req api.HttpWatchReqV2
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		if req.Version == 3 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(api.HttpCertsRespV2{Packs: []api.HttpPackV2{{Domains: req.Domains, Version: 3}}})
+	}))
+	defer ts.Close()
+
+	c := MakeCertDXHttpClient(WithCertDXServerInfo(&config.ClientHttpServer{Url: ts.URL}))
+	pack, err := c.WatchCertV2Ctx(context.Background(), []string{"example.com"}, 0, time.Second)
+	if err != nil || pack == nil || pack.Version != 3 {
+		t.Fatalf("watch from 0: got %+v, %v", pack, err)
+	}
+	pack, err = c.WatchCertV2Ctx(context.Background(), []string{"example.com"}, 3, time.Second)
+	if err != nil || pack != nil {
+		t.Fatalf("unchanged watch: got %+v, %v", pack, err)
+	}
+
+	c.Server.Url = ts.URL + "/old"
+	if _, err := c.WatchCertV2Ctx(context.Background(), []string{"example.com"}, 0, time.Second); !errors.Is(err, ErrWatchUnsupported) {
+		t.Fatalf("old server: got %v want ErrWatchUnsupported", err)
+	}
+}
+
+func TestHttpPollerWaitCertPushed(t *testing.T) {
+	fullchain, _, err := acme.NewMockACME(time.Hour).Obtain(context.Background(), []string{"example.com"}, time.Time{})
+	if err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	serial := leafSerial(fullchain)
+	if serial == "" {
+		t.Fatal("no serial parsed")
+	}
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var req api.HttpWatchReqV2
+		json.NewDecoder(r.Body).Decode(&req)
+		pack := api.HttpPackV2{Domains: req.Domains, Version: 7, Serial: serial}
+		switch req.Version {
+		case 0:
+		case 7:
+			pack.Version, pack.Serial = 8, "ffff"
+		default:
+			t.Errorf("watched version %d", req.Version)
+		}
+		json.NewEncoder(w).Encode(api.HttpCertsRespV2{Packs: []api.HttpPackV2{pack}})
+	}))
+	defer ts.Close()
+
+	d := MakeCertDXClientDaemon()
+	defer d.Stop()
+	start := time.Now()
+	if !newHttpPoller(d).waitCert(&config.ClientHttpServer{Url: ts.URL}, []string{"example.com"}, fullchain, time.Hour) {
+		t.Fatal("waitCert reported the daemon stopped")
+	}
+	if time.Since(start) > 10*time.Second || requests.Load() != 2 {
+		t.Errorf("push took %s and %d requests", time.Since(start), requests.Load())
+	}
+}
+
+func TestHttpPollerWaitCertUnsupported(t *testing.T) {
+	fullchain, _, err := acme.NewMockACME(time.Hour).Obtain(context.Background(), []string{"example.com"}, time.Time{})
+	if err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	d := MakeCertDXClientDaemon()
+	defer d.Stop()
+	p := newHttpPoller(d)
+	server := &config.ClientHttpServer{Url: ts.URL}
+	start := time.Now()
+	if !p.waitCert(server, []string{"example.com"}, fullchain, 100*time.Millisecond) {
+		t.Fatal("waitCert reported the daemon stopped")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("returned after %s, before the poll interval", time.Since(start))
+	}
+	if p.watchable(server) {
+		t.Error("server not remembered as unsupported")
+	}
+}
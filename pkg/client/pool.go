@@ -0,0 +1,286 @@
+package client
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// poolServer is one server of a serverPool with its health.
+type poolServer struct {
+	name     string
+	priority int
+	weight   int
+
+	// failures counts failed attempts since the last success.
+	failures    int
+	lastFailure time.Time
+	lastSuccess time.Time
+
+	// current is the server's smooth weighted round-robin counter.
+	current int
+}
+
+// serverPool tracks the health of the servers a client fetches certs from
+// and decides which one to use. A server is down once it has failed
+// threshold attempts in a row, until cooldown has passed since its last
+// failure; down servers are only tried when nothing else works. Servers
+// are referred to by their address, so the list can be replaced by set
+// as discovery re-resolves it without losing their health.
+//
+// serverPool is safe for concurrent use.
+type serverPool struct {
+	policy    string
+	threshold int
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	servers []*poolServer
+}
+
+func newServerPool(policy string, threshold int, cooldown time.Duration) *serverPool {
+	return &serverPool{
+		policy:    policy,
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+}
+
+func newHttpServerPool(c *config.ClientConfig) *serverPool {
+	// Each HTTP attempt already spends the retry budget, so one failed
+	// attempt marks the server down.
+	p := newServerPool(c.Common.Policy, 1, c.Common.ReconnectDuration)
+	p.setHttp(c.HttpServers())
+	return p
+}
+
+func newGRPCServerPool(c *config.ClientConfig) *serverPool {
+	p := newServerPool(c.Common.Policy, c.Common.RetryCount, c.Common.ReconnectDuration)
+	p.setGRPC(c.GRPCServers())
+	return p
+}
+
+// set replaces the servers of the pool. Servers already in it keep their
+// health.
+func (p *serverPool) set(names []string, members []config.ClientPoolMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := make([]*poolServer, 0, len(names))
+	for i, name := range names {
+		s := p.findLocked(name)
+		if s == nil {
+			s = &poolServer{name: name}
+		}
+		s.priority, s.weight = members[i].Priority, members[i].Weight
+		if s.weight == 0 {
+			s.weight = 1
+		}
+		servers = append(servers, s)
+	}
+	p.servers = servers
+}
+
+func (p *serverPool) setHttp(servers []config.ClientHttpServer) {
+	names := make([]string, len(servers))
+	members := make([]config.ClientPoolMember, len(servers))
+	for i, s := range servers {
+		names[i], members[i] = s.Url, s.ClientPoolMember
+	}
+	p.set(names, members)
+}
+
+func (p *serverPool) setGRPC(servers []config.ClientGRPCServer) {
+	names := make([]string, len(servers))
+	members := make([]config.ClientPoolMember, len(servers))
+	for i, s := range servers {
+		names[i], members[i] = s.Server, s.ClientPoolMember
+	}
+	p.set(names, members)
+}
+
+// findLocked returns the server named name, or nil when it is not in the
+// pool. Callers hold mu.
+func (p *serverPool) findLocked(name string) *poolServer {
+	for _, s := range p.servers {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// has reports whether server name is in the pool.
+func (p *serverPool) has(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.findLocked(name) != nil
+}
+
+// downLocked reports whether s is down. Callers hold mu.
+func (p *serverPool) downLocked(s *poolServer, now time.Time) bool {
+	return s.failures >= p.threshold && now.Before(s.lastFailure.Add(p.cooldown))
+}
+
+// weightedShuffle orders servers by repeated weighted random draws, so a
+// server of twice the weight is twice as likely to come first.
+func weightedShuffle(servers []*poolServer) {
+	for n := 0; n < len(servers)-1; n++ {
+		total := 0
+		for _, s := range servers[n:] {
+			total += s.weight
+		}
+		r := rand.IntN(total)
+		for k, s := range servers[n:] {
+			if r < s.weight {
+				servers[n], servers[n+k] = servers[n+k], servers[n]
+				break
+			}
+			r -= s.weight
+		}
+	}
+}
+
+// rotateLocked advances the smooth weighted round-robin over the servers
+// that are up and returns the one picked, or nil when all are down.
+// Callers hold mu.
+func (p *serverPool) rotateLocked(now time.Time) *poolServer {
+	var best *poolServer
+	total := 0
+	for _, s := range p.servers {
+		if p.downLocked(s, now) {
+			continue
+		}
+		s.current += s.weight
+		total += s.weight
+		if best == nil || s.current > best.current {
+			best = s
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// orderLocked returns every server in the order to try them for one
+// request. Servers that are up come first: by priority then a weighted
+// draw under the priority policy, or starting with the next in the
+// weighted rotation under round-robin. Down servers follow, by priority.
+// Callers hold mu.
+func (p *serverPool) orderLocked(now time.Time) []*poolServer {
+	var up, down []*poolServer
+	for _, s := range p.servers {
+		if p.downLocked(s, now) {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+
+	byPriority := func(servers []*poolServer) {
+		weightedShuffle(servers)
+		slices.SortStableFunc(servers, func(a, b *poolServer) int {
+			return a.priority - b.priority
+		})
+	}
+	if p.policy == config.CLIENT_POLICY_ROUND_ROBIN {
+		if first := p.rotateLocked(now); first != nil {
+			k := slices.Index(up, first)
+			up = slices.Concat(up[k:], up[:k])
+		}
+	} else {
+		byPriority(up)
+	}
+	byPriority(down)
+	return append(up, down...)
+}
+
+// order returns the addresses of every server in the order to try them
+// for one request.
+func (p *serverPool) order() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ret []string
+	for _, s := range p.orderLocked(time.Now()) {
+		ret = append(ret, s.name)
+	}
+	return ret
+}
+
+// failover returns the server to switch to after name failed its retry
+// budget, or false when every other server is down.
+func (p *serverPool) failover(name string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, s := range p.orderLocked(now) {
+		if s.name != name && !p.downLocked(s, now) {
+			return s.name, true
+		}
+	}
+	return "", false
+}
+
+// better returns the servers preferred over name under the priority
+// policy, most preferred first. A client using name keeps probing them so
+// it can move back once one recovers. When name has left the pool every
+// server is preferred over it.
+func (p *serverPool) better(name string) []string {
+	if p.policy == config.CLIENT_POLICY_ROUND_ROBIN {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	priority := math.MaxInt
+	if cur := p.findLocked(name); cur != nil {
+		priority = cur.priority
+	}
+	var ret []string
+	for _, s := range p.orderLocked(time.Now()) {
+		if s.priority < priority {
+			ret = append(ret, s.name)
+		}
+	}
+	return ret
+}
+
+// success records that server name answered.
+func (p *serverPool) success(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.findLocked(name)
+	if s == nil {
+		return
+	}
+	if s.failures >= p.threshold {
+		logging.Info("Server %s is back up", s.name)
+	}
+	s.failures = 0
+	s.lastSuccess = time.Now()
+}
+
+// failure records a failed attempt on server name.
+func (p *serverPool) failure(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.findLocked(name)
+	if s == nil {
+		return
+	}
+	s.failures++
+	s.lastFailure = time.Now()
+	if s.failures == p.threshold {
+		if s.lastSuccess.IsZero() {
+			logging.Warn("Server %s is down after %d failed attempts", s.name, s.failures)
+		} else {
+			logging.Warn("Server %s is down after %d failed attempts, last success at %s",
+				s.name, s.failures, s.lastSuccess.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func makeTestPool(policy string, threshold int, cooldown time.Duration, members ...config.ClientPoolMember) *serverPool {
+	names := make([]string, len(members))
+	for i := range names {
+		names[i] = string(rune('a' + i))
+	}
+	p := newServerPool(policy, threshold, cooldown)
+	p.set(names, members)
+	return p
+}
+
+func TestServerPoolPriorityOrder(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_PRIORITY, 1, time.Hour,
+		config.ClientPoolMember{Priority: 2},
+		config.ClientPoolMember{Priority: 0},
+		config.ClientPoolMember{Priority: 1},
+	)
+	if got := p.order(); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Fatalf("order: got %v want [b c a]", got)
+	}
+	if got := p.better("a"); !slices.Equal(got, []string{"b", "c"}) {
+		t.Fatalf("better(a): got %v want [b c]", got)
+	}
+	if got := p.better("b"); len(got) != 0 {
+		t.Fatalf("better(b): got %v want none", got)
+	}
+}
+
+func TestServerPoolDownServersLast(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_PRIORITY, 2, time.Hour,
+		config.ClientPoolMember{Priority: 0},
+		config.ClientPoolMember{Priority: 1},
+		config.ClientPoolMember{Priority: 2},
+	)
+
+	p.failure("a")
+	if got := p.order(); got[0] != "a" {
+		t.Fatalf("one failure below threshold should keep server a first, got %v", got)
+	}
+	p.failure("a")
+	if got := p.order(); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Fatalf("order with a down: got %v want [b c a]", got)
+	}
+	if j, ok := p.failover("b"); !ok || j != "c" {
+		t.Fatalf("failover(b): got %s, %v want c, true", j, ok)
+	}
+
+	p.failure("c")
+	p.failure("c")
+	if _, ok := p.failover("b"); ok {
+		t.Fatal("failover(b) should find nothing with a and c down")
+	}
+
+	p.success("a")
+	if got := p.order(); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("order after a recovered: got %v want [a b c]", got)
+	}
+}
+
+func TestServerPoolCooldown(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_PRIORITY, 1, 50*time.Millisecond,
+		config.ClientPoolMember{Priority: 0},
+		config.ClientPoolMember{Priority: 1},
+	)
+	p.failure("a")
+	if got := p.order(); got[0] != "b" {
+		t.Fatalf("server a should be down, got %v", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := p.order(); got[0] != "a" {
+		t.Fatalf("server a should be retried after the cooldown, got %v", got)
+	}
+}
+
+func TestServerPoolRoundRobinWeights(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_ROUND_ROBIN, 1, time.Hour,
+		config.ClientPoolMember{Weight: 1},
+		config.ClientPoolMember{Weight: 3},
+	)
+	counts := map[string]int{}
+	for range 8 {
+		counts[p.order()[0]]++
+	}
+	if counts["a"] != 2 || counts["b"] != 6 {
+		t.Fatalf("round-robin picks: got %v want a:2 b:6", counts)
+	}
+	if got := p.better("a"); got != nil {
+		t.Fatalf("better under round-robin: got %v want nil", got)
+	}
+
+	p.failure("b")
+	for range 4 {
+		if got := p.order(); !slices.Equal(got, []string{"a", "b"}) {
+			t.Fatalf("order with b down: got %v want [a b]", got)
+		}
+	}
+}
+
+func TestServerPoolWeightedDraw(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_PRIORITY, 1, time.Hour,
+		config.ClientPoolMember{Weight: 1},
+		config.ClientPoolMember{Weight: 9},
+		config.ClientPoolMember{Priority: 1, Weight: 100},
+	)
+	first := 0
+	for range 1000 {
+		order := p.order()
+		if order[2] != "c" {
+			t.Fatalf("lower priority server should come last, got %v", order)
+		}
+		if order[0] == "b" {
+			first++
+		}
+	}
+	if first < 800 {
+		t.Fatalf("weight 9 server picked first %d/1000 times, want about 900", first)
+	}
+}
+
+func TestServerPoolSetKeepsHealth(t *testing.T) {
+	p := makeTestPool(config.CLIENT_POLICY_PRIORITY, 1, time.Hour,
+		config.ClientPoolMember{Priority: 0},
+		config.ClientPoolMember{Priority: 1},
+	)
+	p.failure("a")
+
+	p.set([]string{"a", "c"}, []config.ClientPoolMember{{Priority: 0}, {Priority: 2}})
+	if got := p.order(); !slices.Equal(got, []string{"c", "a"}) {
+		t.Fatalf("order after set: got %v want [c a]", got)
+	}
+	if p.has("b") {
+		t.Fatal("b should have left the pool")
+	}
+	if got := p.better("b"); !slices.Equal(got, []string{"c", "a"}) {
+		t.Fatalf("better(b) for a server that left: got %v want [c a]", got)
+	}
+	p.failure("b") // no longer in the pool, ignored
+}
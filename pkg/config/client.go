@@ -3,6 +3,8 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"path"
 	"time"
 
@@ -12,14 +14,22 @@ import (
 type ClientConfig struct {
 	Common ClientCommonConfig `toml:"Common" json:"common,omitempty"`
 
+	// Servers lists the servers to fetch from. MainServer and
+	// StandbyServer are the older two-server shorthand for it; see
+	// HttpServers and GRPCServers. SRV discovers the servers from DNS
+	// instead.
 	Http struct {
-		MainServer    ClientHttpServer `toml:"MainServer" json:"main_server,omitempty"`
-		StandbyServer ClientHttpServer `toml:"StandbyServer" json:"standby_server,omitempty"`
+		MainServer    ClientHttpServer   `toml:"MainServer" json:"main_server,omitempty"`
+		StandbyServer ClientHttpServer   `toml:"StandbyServer" json:"standby_server,omitempty"`
+		Servers       []ClientHttpServer `toml:"Servers" json:"servers,omitempty"`
+		SRV           ClientHttpSRV      `toml:"SRV" json:"srv,omitempty"`
 	} `toml:"Http" json:"http,omitempty"`
 
 	GRPC struct {
-		MainServer    ClientGRPCServer `toml:"MainServer" json:"main_server,omitempty"`
-		StandbyServer ClientGRPCServer `toml:"StandbyServer" json:"standby_server,omitempty"`
+		MainServer    ClientGRPCServer   `toml:"MainServer" json:"main_server,omitempty"`
+		StandbyServer ClientGRPCServer   `toml:"StandbyServer" json:"standby_server,omitempty"`
+		Servers       []ClientGRPCServer `toml:"Servers" json:"servers,omitempty"`
+		SRV           ClientGRPCSRV      `toml:"SRV" json:"srv,omitempty"`
 	} `toml:"GRPC" json:"GRPC,omitempty"`
 
 	Certifications []ClientCertification `toml:"Certifications" json:"certifications,omitempty"`
@@ -47,6 +57,18 @@ func (c *ClientConfig) Validate(optionList []ValidatingOption) error {
 		}
 	}
 
+	switch c.Common.Policy {
+	case "", CLIENT_POLICY_PRIORITY, CLIENT_POLICY_ROUND_ROBIN:
+	default:
+		ret = append(ret, fmt.Errorf("unsupported policy: %s", c.Common.Policy))
+	}
+
+	if c.Common.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Common.Resolver); err != nil {
+			ret = append(ret, fmt.Errorf("resolver %q must be host:port: %w", c.Common.Resolver, err))
+		}
+	}
+
 	switch c.Common.Mode {
 	case CLIENT_MODE_HTTP:
 		err := c.validateHttpMode()
@@ -74,7 +96,80 @@ func (c *ClientConfig) parseDuration() error {
 	return nil
 }
 
+// HttpServers returns the servers an HTTP mode client fetches from:
+// [[Http.Servers]], or else MainServer and StandbyServer at priorities 0
+// and 1.
+func (c *ClientConfig) HttpServers() []ClientHttpServer {
+	if len(c.Http.Servers) != 0 {
+		return c.Http.Servers
+	}
+	var ret []ClientHttpServer
+	if c.Http.MainServer.Url != "" {
+		ret = append(ret, c.Http.MainServer)
+		ret[0].Priority = 0
+	}
+	if c.Http.StandbyServer.Url != "" {
+		ret = append(ret, c.Http.StandbyServer)
+		ret[len(ret)-1].Priority = 1
+	}
+	return ret
+}
+
+// GRPCServers is HttpServers for gRPC mode.
+func (c *ClientConfig) GRPCServers() []ClientGRPCServer {
+	if len(c.GRPC.Servers) != 0 {
+		return c.GRPC.Servers
+	}
+	var ret []ClientGRPCServer
+	if c.GRPC.MainServer.Server != "" {
+		ret = append(ret, c.GRPC.MainServer)
+		ret[0].Priority = 0
+	}
+	if c.GRPC.StandbyServer.Server != "" {
+		ret = append(ret, c.GRPC.StandbyServer)
+		ret[len(ret)-1].Priority = 1
+	}
+	return ret
+}
+
+// HasHttpServers reports whether an HTTP mode client has servers to fetch
+// from, listed or discovered.
+func (c *ClientConfig) HasHttpServers() bool {
+	return c.Http.SRV.Name != "" || len(c.HttpServers()) != 0
+}
+
+// HasGRPCServers is HasHttpServers for gRPC mode.
+func (c *ClientConfig) HasGRPCServers() bool {
+	return c.GRPC.SRV.Name != "" || len(c.GRPCServers()) != 0
+}
+
 func (c *ClientConfig) validateHttpMode() error {
+	if c.Http.SRV.Name != "" {
+		if len(c.Http.Servers) != 0 || c.Http.MainServer.Url != "" || c.Http.StandbyServer.Url != "" {
+			return fmt.Errorf("use either [Http.SRV] or listed http servers")
+		}
+		return c.Http.SRV.Validate()
+	}
+
+	if len(c.Http.Servers) != 0 {
+		if c.Http.MainServer.Url != "" || c.Http.StandbyServer.Url != "" {
+			return fmt.Errorf("use either [[Http.Servers]] or [Http.MainServer] / [Http.StandbyServer]")
+		}
+		for i := range c.Http.Servers {
+			s := &c.Http.Servers[i]
+			if s.Url == "" {
+				return fmt.Errorf("http server %d url is empty", i)
+			}
+			if s.AuthMethod == "" {
+				s.AuthMethod = HTTP_AUTH_TOKEN
+			}
+			if err := s.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	if c.Http.MainServer.Url == "" {
 		return fmt.Errorf("http main server url is empty")
 	}
@@ -93,6 +188,29 @@ func (c *ClientConfig) validateHttpMode() error {
 }
 
 func (c *ClientConfig) validateGrpcMode() error {
+	if c.GRPC.SRV.Name != "" {
+		if len(c.GRPC.Servers) != 0 || c.GRPC.MainServer.Server != "" || c.GRPC.StandbyServer.Server != "" {
+			return fmt.Errorf("use either [GRPC.SRV] or listed grpc servers")
+		}
+		return c.GRPC.SRV.Validate()
+	}
+
+	if len(c.GRPC.Servers) != 0 {
+		if c.GRPC.MainServer.Server != "" || c.GRPC.StandbyServer.Server != "" {
+			return fmt.Errorf("use either [[GRPC.Servers]] or [GRPC.MainServer] / [GRPC.StandbyServer]")
+		}
+		for i := range c.GRPC.Servers {
+			s := &c.GRPC.Servers[i]
+			if s.Server == "" {
+				return fmt.Errorf("grpc server %d url is empty", i)
+			}
+			if err := s.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	if c.GRPC.MainServer.Server == "" {
 		return fmt.Errorf("grpc main server url is empty")
 	}
@@ -115,9 +233,32 @@ type ClientCommonConfig struct {
 	Mode              string `toml:"mode" json:"mode,omitempty"`
 	ReconnectInterval string `toml:"reconnectInterval" json:"reconnect_interval,omitempty"`
 
+	// Policy picks the server to use among the healthy ones: the
+	// preferred priority (the default), or a weighted rotation.
+	Policy string `toml:"policy" json:"policy,omitempty"`
+
+	// Resolver is the host:port of the DNS server SRV names are looked up
+	// on. The system resolver is used when empty.
+	Resolver string `toml:"resolver" json:"resolver,omitempty"`
+
 	ReconnectDuration time.Duration `toml:"-" json:"-"`
 }
 
+// ClientPoolMember places a server in the client's pool. Lower Priority
+// is preferred; Weight, 1 when unset, shares traffic between servers
+// picked alike.
+type ClientPoolMember struct {
+	Priority int `toml:"priority" json:"priority,omitempty"`
+	Weight   int `toml:"weight" json:"weight,omitempty"`
+}
+
+func (c *ClientPoolMember) Validate() error {
+	if c.Priority < 0 || c.Weight < 0 {
+		return fmt.Errorf("priority and weight must not be negative")
+	}
+	return nil
+}
+
 type ClientMtlsConfig struct {
 	PEM string `toml:"pem" json:"pem,omitempty"`
 }
@@ -134,23 +275,76 @@ type ClientHttpServer struct {
 	Url        string `toml:"url" json:"url,omitempty"`
 	AuthMethod string `toml:"authMethod" json:"authMethod,omitempty"`
 	Token      string `toml:"token" json:"token,omitempty"`
+	// TokenFile holds the bearer JWT for the jwt auth method, read for
+	// every request.
+	TokenFile string `toml:"tokenFile" json:"token_file,omitempty"`
 	ClientMtlsConfig
+	ClientPoolMember
 }
 
 func (c *ClientHttpServer) Validate() error {
-	if c.AuthMethod == HTTP_AUTH_MTLS {
-		return c.ClientMtlsConfig.Validate()
+	if err := c.ClientPoolMember.Validate(); err != nil {
+		return fmt.Errorf("http server %s: %w", c.Url, err)
 	}
+	return c.validateAuth()
+}
 
+func (c *ClientHttpServer) validateAuth() error {
+	switch c.AuthMethod {
+	case HTTP_AUTH_MTLS:
+		return c.ClientMtlsConfig.Validate()
+	case HTTP_AUTH_JWT:
+		if (c.Token == "") == (c.TokenFile == "") {
+			return fmt.Errorf("http server %s: jwt auth needs one of token and tokenFile", c.Url)
+		}
+	}
 	return nil
 }
 
 type ClientGRPCServer struct {
 	Server string `toml:"server" json:"server,omitempty"`
 	ClientMtlsConfig
+	ClientPoolMember
 }
 
 func (c *ClientGRPCServer) Validate() error {
+	if err := c.ClientPoolMember.Validate(); err != nil {
+		return fmt.Errorf("grpc server %s: %w", c.Server, err)
+	}
+	return c.ClientMtlsConfig.Validate()
+}
+
+// ClientHttpSRV discovers HTTP servers from the SRV records of Name. Each
+// record is reached at Url with the host replaced by the record's target
+// and port, using the auth settings given here; priority and weight come
+// from the record.
+type ClientHttpSRV struct {
+	Name string `toml:"name" json:"name,omitempty"`
+	ClientHttpServer
+}
+
+func (c *ClientHttpSRV) Validate() error {
+	u, err := url.Parse(c.Url)
+	if err != nil {
+		return fmt.Errorf("http SRV url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("http SRV url %q must be http or https", c.Url)
+	}
+	if c.AuthMethod == "" {
+		c.AuthMethod = HTTP_AUTH_TOKEN
+	}
+	return c.validateAuth()
+}
+
+// ClientGRPCSRV discovers gRPC servers from the SRV records of Name, all
+// reached with the same mTLS bundle.
+type ClientGRPCSRV struct {
+	Name string `toml:"name" json:"name,omitempty"`
+	ClientMtlsConfig
+}
+
+func (c *ClientGRPCSRV) Validate() error {
 	return c.ClientMtlsConfig.Validate()
 }
 
@@ -186,10 +380,12 @@ func (c *ClientConfig) SetDefault() {
 		RetryCount:        5,
 		Mode:              CLIENT_MODE_HTTP,
 		ReconnectInterval: "10m",
+		Policy:            CLIENT_POLICY_PRIORITY,
 	}
 
 	c.Http.MainServer.AuthMethod = HTTP_AUTH_TOKEN
 	c.Http.StandbyServer.AuthMethod = HTTP_AUTH_TOKEN
+	c.Http.SRV.AuthMethod = HTTP_AUTH_TOKEN
 }
 
 type validatingConfiguration struct {
@@ -228,3 +228,155 @@ func TestClientConfigValidateMultipleErrors(t *testing.T) {
 		t.Errorf("missing no certification configured error in: %s", msg)
 	}
 }
+
+func TestClientConfigHttpServersShorthand(t *testing.T) {
+	c := &ClientConfig{}
+	c.SetDefault()
+	c.Http.MainServer.Url = "https://main.example.com"
+	c.Http.StandbyServer.Url = "https://standby.example.com"
+	c.Http.StandbyServer.Priority = 7
+
+	servers := c.HttpServers()
+	if len(servers) != 2 {
+		t.Fatalf("servers: got %d want 2", len(servers))
+	}
+	if servers[0].Url != "https://main.example.com" || servers[0].Priority != 0 {
+		t.Errorf("main: got %s priority %d", servers[0].Url, servers[0].Priority)
+	}
+	if servers[1].Url != "https://standby.example.com" || servers[1].Priority != 1 {
+		t.Errorf("standby: got %s priority %d", servers[1].Url, servers[1].Priority)
+	}
+
+	c.Http.StandbyServer.Url = ""
+	if n := len(c.HttpServers()); n != 1 {
+		t.Errorf("without standby: got %d servers want 1", n)
+	}
+}
+
+func TestClientConfigValidateServerList(t *testing.T) {
+	c := &ClientConfig{}
+	c.SetDefault()
+	c.Common.Policy = CLIENT_POLICY_ROUND_ROBIN
+	c.Http.Servers = []ClientHttpServer{
+		{Url: "https://a.example.com", Token: "t"},
+		{Url: "https://b.example.com", Token: "t", ClientPoolMember: ClientPoolMember{Weight: 2}},
+	}
+	c.Certifications = []ClientCertification{
+		{Name: "x", SavePath: "/tmp", Domains: []string{"example.com"}},
+	}
+	if err := c.Validate(nil); err != nil {
+		t.Fatalf("expected valid server list: %v", err)
+	}
+	if c.Http.Servers[0].AuthMethod != HTTP_AUTH_TOKEN {
+		t.Errorf("default authMethod: got %q want %q", c.Http.Servers[0].AuthMethod, HTTP_AUTH_TOKEN)
+	}
+	if got := c.HttpServers(); len(got) != 2 || got[1].Url != "https://b.example.com" {
+		t.Errorf("HttpServers: got %+v", got)
+	}
+}
+
+func TestClientConfigValidateServerListErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(c *ClientConfig)
+		want  string
+	}{
+		{"mixed with main", func(c *ClientConfig) {
+			c.Http.MainServer.Url = "https://main.example.com"
+		}, "use either [[Http.Servers]]"},
+		{"missing url", func(c *ClientConfig) {
+			c.Http.Servers = append(c.Http.Servers, ClientHttpServer{})
+		}, "http server 1 url is empty"},
+		{"negative weight", func(c *ClientConfig) {
+			c.Http.Servers[0].Weight = -1
+		}, "must not be negative"},
+		{"bad policy", func(c *ClientConfig) {
+			c.Common.Policy = "random"
+		}, "unsupported policy"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &ClientConfig{}
+			c.SetDefault()
+			c.Http.MainServer.Url = ""
+			c.Http.Servers = []ClientHttpServer{{Url: "https://a.example.com"}}
+			c.Certifications = []ClientCertification{
+				{Name: "x", SavePath: "/tmp", Domains: []string{"example.com"}},
+			}
+			tc.setup(c)
+			err := c.Validate(nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error wording drifted: %v", err)
+			}
+		})
+	}
+}
+
+func TestClientConfigValidateGrpcServerListMixed(t *testing.T) {
+	c := &ClientConfig{}
+	c.SetDefault()
+	c.Common.Mode = CLIENT_MODE_GRPC
+	c.GRPC.MainServer.Server = "main.example.com:10002"
+	c.GRPC.Servers = []ClientGRPCServer{{Server: "a.example.com:10002"}}
+	c.Certifications = []ClientCertification{
+		{Name: "x", SavePath: "/tmp", Domains: []string{"example.com"}},
+	}
+	err := c.Validate(nil)
+	if err == nil || !strings.Contains(err.Error(), "use either [[GRPC.Servers]]") {
+		t.Fatalf("expected mixing error, got %v", err)
+	}
+}
+
+func TestClientConfigValidateSRV(t *testing.T) {
+	newConfig := func() *ClientConfig {
+		c := &ClientConfig{}
+		c.SetDefault()
+		c.Common.Resolver = "127.0.0.1:53"
+		c.Http.SRV.Name = "_certdx._tcp.example.com"
+		c.Http.SRV.Url = "https://certdx/1145141919810"
+		c.Certifications = []ClientCertification{
+			{Name: "x", SavePath: "/tmp", Domains: []string{"example.com"}},
+		}
+		return c
+	}
+
+	c := newConfig()
+	if err := c.Validate(nil); err != nil {
+		t.Fatalf("expected valid SRV config: %v", err)
+	}
+	if !c.HasHttpServers() {
+		t.Error("HasHttpServers should count the SRV name")
+	}
+
+	cases := []struct {
+		name  string
+		setup func(c *ClientConfig)
+		want  string
+	}{
+		{"mixed with main", func(c *ClientConfig) {
+			c.Http.MainServer.Url = "https://main.example.com"
+		}, "use either [Http.SRV]"},
+		{"bad scheme", func(c *ClientConfig) {
+			c.Http.SRV.Url = "ftp://certdx/"
+		}, "must be http or https"},
+		{"bad resolver", func(c *ClientConfig) {
+			c.Common.Resolver = "127.0.0.1"
+		}, "must be host:port"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConfig()
+			tc.setup(c)
+			err := c.Validate(nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error wording drifted: %v", err)
+			}
+		})
+	}
+}
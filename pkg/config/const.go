@@ -3,6 +3,10 @@ package config
 const (
 	HTTP_AUTH_TOKEN string = "token"
 	HTTP_AUTH_MTLS  string = "mtls"
+	// HTTP_AUTH_JWT and HTTP_AUTH_OIDC authenticate bearer JWTs; OIDC can
+	// discover the JWKS from the issuer.
+	HTTP_AUTH_JWT  string = "jwt"
+	HTTP_AUTH_OIDC string = "oidc"
 )
 
 const (
@@ -18,7 +22,39 @@ const (
 	ChallengeTypeHttp01 string = "http"
 )
 
+const (
+	KeyTypeEC256   string = "ec256"
+	KeyTypeEC384   string = "ec384"
+	KeyTypeRSA2048 string = "rsa2048"
+	KeyTypeRSA3072 string = "rsa3072"
+	KeyTypeRSA4096 string = "rsa4096"
+	KeyTypeRSA8192 string = "rsa8192"
+)
+
+const (
+	CertStoreTypeJSON   string = "json"
+	CertStoreTypeSQLite string = "sqlite"
+	CertStoreTypeS3     string = "s3"
+)
+
+const (
+	EncryptionProviderFile string = "file"
+	EncryptionProviderEnv  string = "env"
+	EncryptionProviderExec string = "exec"
+)
+
+const (
+	LeaderLockFile string = "file"
+	LeaderLockS3   string = "s3"
+	LeaderLockSQL  string = "sql"
+)
+
 const (
 	CLIENT_MODE_HTTP string = "http"
 	CLIENT_MODE_GRPC string = "grpc"
 )
+
+const (
+	CLIENT_POLICY_PRIORITY    string = "priority"
+	CLIENT_POLICY_ROUND_ROBIN string = "round-robin"
+)
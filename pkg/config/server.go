@@ -1,12 +1,24 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"pkg.para.party/certdx/pkg/acme/acmeproviders"
+	"pkg.para.party/certdx/pkg/domain"
 	"pkg.para.party/certdx/pkg/paths"
 )
 
@@ -18,9 +30,21 @@ type ServerConfig struct {
 	DnsProvider  *DnsProvider  `toml:"DnsProvider" json:"dns_provider,omitempty"`
 	HttpProvider *HttpProvider `toml:"HttpProvider" json:"http_provider,omitempty"`
 
-	MTLS          MTLSConfig       `toml:"MTLS" json:"mtls,omitempty"`
-	HttpServer    HttpServerConfig `toml:"HttpServer" json:"http_server,omitempty"`
-	GRPCSDSServer GRPCServerConfig `toml:"gRPCSDSServer" json:"grpc_sds_server,omitempty"`
+	MTLS          MTLSConfig        `toml:"MTLS" json:"mtls,omitempty"`
+	HttpServer    HttpServerConfig  `toml:"HttpServer" json:"http_server,omitempty"`
+	GRPCSDSServer GRPCServerConfig  `toml:"gRPCSDSServer" json:"grpc_sds_server,omitempty"`
+	AdminServer   AdminServerConfig `toml:"AdminServer" json:"admin_server,omitempty"`
+
+	CertStore  CertStoreConfig  `toml:"CertStore" json:"cert_store,omitempty"`
+	Encryption EncryptionConfig `toml:"Encryption" json:"encryption,omitempty"`
+	FileSource FileSourceConfig `toml:"FileSource" json:"file_source,omitempty"`
+
+	Quota QuotaConfig `toml:"Quota" json:"quota,omitempty"`
+
+	LeaderElection LeaderElectionConfig `toml:"LeaderElection" json:"leader_election,omitempty"`
+	PeerSync       PeerSyncConfig       `toml:"PeerSync" json:"peer_sync,omitempty"`
+
+	ManagedCertificates []ManagedCertificate `toml:"ManagedCertificates" json:"managed_certificates,omitempty"`
 }
 
 func (c *ServerConfig) Validate() error {
@@ -30,42 +54,56 @@ func (c *ServerConfig) Validate() error {
 		ret = append(ret, err)
 	}
 
-	// The mock provider is hermetic and does not require any DNS/HTTP
-	// challenge provider configuration.
-	if !acmeproviders.IsMock(c.ACME.Provider) {
-		switch c.ACME.ChallengeType {
-		case ChallengeTypeDns01:
-			if c.DnsProvider != nil {
-				if err := c.DnsProvider.Validate(); err != nil {
-					ret = append(ret, err)
-				}
-			} else {
-				ret = append(ret, fmt.Errorf("no dns provider"))
-			}
-		case ChallengeTypeHttp01:
-			if c.HttpProvider != nil {
-				if err := c.HttpProvider.Validate(); err != nil {
-					ret = append(ret, err)
-				}
-			} else {
-				ret = append(ret, fmt.Errorf("no http provider"))
-			}
-		default:
-		}
+	if err := c.validateChallenger(); err != nil {
+		ret = append(ret, err)
 	}
 
 	if err := c.parseDuration(); err != nil {
 		ret = append(ret, err)
 	}
 
+	if err := c.validateManaged(); err != nil {
+		ret = append(ret, err)
+	}
+
 	if err := c.HttpServer.Validate(); err != nil {
 		ret = append(ret, err)
+	} else if err := c.validateTokenScopes(); err != nil {
+		ret = append(ret, err)
 	}
 
 	if err := c.GRPCSDSServer.Validate(); err != nil {
 		ret = append(ret, err)
 	}
 
+	if err := c.AdminServer.Validate(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.CertStore.Validate(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.Encryption.Validate(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.FileSource.Validate(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.Quota.Validate(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.validateLeaderElection(); err != nil {
+		ret = append(ret, err)
+	}
+
+	if err := c.validatePeerSync(); err != nil {
+		ret = append(ret, err)
+	}
+
 	if c.needsMTLS() {
 		if err := c.MTLS.Validate(); err != nil {
 			ret = append(ret, err)
@@ -75,6 +113,29 @@ func (c *ServerConfig) Validate() error {
 	return errors.Join(ret...)
 }
 
+// validateChallenger checks the challenge provider selected by
+// ACME.challengeType. The mock provider is hermetic and does not require
+// any DNS/HTTP challenge provider configuration.
+func (c *ServerConfig) validateChallenger() error {
+	if acmeproviders.IsMock(c.ACME.Provider) {
+		return nil
+	}
+
+	switch c.ACME.ChallengeType {
+	case ChallengeTypeDns01:
+		if c.DnsProvider == nil {
+			return fmt.Errorf("no dns provider")
+		}
+		return c.DnsProvider.Validate()
+	case ChallengeTypeHttp01:
+		if c.HttpProvider == nil {
+			return fmt.Errorf("no http provider")
+		}
+		return c.HttpProvider.Validate()
+	}
+	return nil
+}
+
 func (c *ServerConfig) parseDuration() error {
 	var err error
 	c.ACME.CertLifeTimeDuration, err = time.ParseDuration(c.ACME.CertLifeTime)
@@ -90,6 +151,10 @@ func (c *ServerConfig) parseDuration() error {
 	return nil
 }
 
+// ACMEConfig is the ACME account and what it issues. RequireApproval
+// lists allowed domains under which a new pack waits for an operator to
+// approve it before it is ordered; ApprovalsFile is where the requests
+// are kept, by default approvals.json under the state root.
 type ACMEConfig struct {
 	ChallengeType  string   `toml:"challengeType" json:"challenge_type,omitempty"`
 	Email          string   `toml:"email" json:"email,omitempty"`
@@ -97,8 +162,12 @@ type ACMEConfig struct {
 	RetryCount     int      `toml:"retryCount" json:"retry_count,omitempty"`
 	CertLifeTime   string   `toml:"certLifeTime" json:"cert_life_time,omitempty"`
 	RenewTimeLeft  string   `toml:"renewTimeLeft" json:"renew_time_left,omitempty"`
+	KeyType        string   `toml:"keyType" json:"key_type,omitempty"`
 	AllowedDomains []string `toml:"allowedDomains" json:"allowed_domains,omitempty"`
 
+	RequireApproval []string `toml:"requireApproval" json:"require_approval,omitempty"`
+	ApprovalsFile   string   `toml:"approvalsFile" json:"approvals_file,omitempty"`
+
 	CertLifeTimeDuration  time.Duration `toml:"-" json:"-"`
 	RenewTimeLeftDuration time.Duration `toml:"-" json:"-"`
 }
@@ -108,6 +177,15 @@ func (c *ACMEConfig) Validate() error {
 		return fmt.Errorf("AllowedDomains is empty")
 	}
 
+	if !domain.AllAllowed(c.AllowedDomains, c.RequireApproval) {
+		return fmt.Errorf("requireApproval %v not within allowedDomains", c.RequireApproval)
+	}
+
+	// An empty key type means ec256.
+	if c.KeyType != "" && !validKeyType(c.KeyType) {
+		return fmt.Errorf("key type: %s not supported", c.KeyType)
+	}
+
 	if acmeproviders.IsMock(c.Provider) {
 		// Mock provider skips ACME-specific validation entirely.
 		return nil
@@ -171,6 +249,7 @@ type S3Client struct {
 	AccessKeyId     string `toml:"accessKeyId" json:"access_key_id,omitempty"`
 	AccessKeySecret string `toml:"accessKeySecret" json:"access_key_secret,omitempty"`
 	SessionToken    string `toml:"sessionToken" json:"session_token,omitempty"`
+	PathStyle       bool   `toml:"pathStyle" json:"path_style,omitempty"`
 }
 
 type HttpProvider struct {
@@ -196,14 +275,322 @@ func (p *HttpProvider) Validate() error {
 	return nil
 }
 
+// ListenOptions are how a server binds its listen address: a TCP
+// host:port, or unix:/path for a unix socket created with SocketMode,
+// an octal string, and owned by SocketGroup, a group name or id.
+// ProxyProtocol requires a PROXY protocol v1 or v2 header on every TCP
+// connection, as load balancers such as HAProxy send, and serves the
+// client address it carries. Only the proxies at the addresses or CIDR
+// ranges of ProxyProtocolFrom may connect.
+type ListenOptions struct {
+	SocketMode        string   `toml:"socketMode" json:"socket_mode,omitempty"`
+	SocketGroup       string   `toml:"socketGroup" json:"socket_group,omitempty"`
+	ProxyProtocol     bool     `toml:"proxyProtocol" json:"proxy_protocol,omitempty"`
+	ProxyProtocolFrom []string `toml:"proxyProtocolFrom" json:"proxy_protocol_from,omitempty"`
+
+	SocketFileMode        os.FileMode    `toml:"-" json:"-"`
+	ProxyProtocolPrefixes []netip.Prefix `toml:"-" json:"-"`
+}
+
+// UnixSocketPath returns the socket path of a unix:/path listen address.
+func UnixSocketPath(listen string) (string, bool) {
+	return strings.CutPrefix(listen, "unix:")
+}
+
+// validate checks the options of the section listening at listen.
+func (o *ListenOptions) validate(section, listen string) error {
+	if o.SocketMode == "" {
+		o.SocketMode = "0660"
+	}
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("[%s] socketMode must be octal permissions such as \"0660\": %q", section, o.SocketMode)
+	}
+	o.SocketFileMode = os.FileMode(mode)
+
+	path, unix := UnixSocketPath(listen)
+	switch {
+	case unix && path == "":
+		return fmt.Errorf("[%s] listen: unix socket with no path", section)
+	case unix && o.ProxyProtocol:
+		return fmt.Errorf("[%s] proxyProtocol needs a TCP listen address", section)
+	case !unix && o.SocketGroup != "":
+		return fmt.Errorf("[%s] socketGroup needs a unix:/path listen address", section)
+	case o.ProxyProtocol && len(o.ProxyProtocolFrom) == 0:
+		return fmt.Errorf("[%s] proxyProtocol needs proxyProtocolFrom, the proxies' addresses", section)
+	case !o.ProxyProtocol && len(o.ProxyProtocolFrom) != 0:
+		return fmt.Errorf("[%s] proxyProtocolFrom needs proxyProtocol = true", section)
+	}
+	o.ProxyProtocolPrefixes, err = parsePrefixes(section, "proxyProtocolFrom", o.ProxyProtocolFrom)
+	return err
+}
+
+// parsePrefixes parses the addresses and CIDR ranges of the key of
+// section. A plain address stands for itself alone.
+func parsePrefixes(section, key string, list []string) ([]netip.Prefix, error) {
+	var ret []netip.Prefix
+	for _, p := range list {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(p)
+			if aerr != nil {
+				return nil, fmt.Errorf("[%s] %s: %q is no address or CIDR range", section, key, p)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		ret = append(ret, prefix.Masked())
+	}
+	return ret, nil
+}
+
 type HttpServerConfig struct {
-	Enabled    bool     `toml:"enabled" json:"enabled,omitempty"`
-	Listen     string   `toml:"listen" json:"listen,omitempty"`
+	Enabled bool   `toml:"enabled" json:"enabled,omitempty"`
+	Listen  string `toml:"listen" json:"listen,omitempty"`
+	ListenOptions
 	APIPath    string   `toml:"apiPath" json:"api_path,omitempty"`
 	AuthMethod string   `toml:"authMethod" json:"authMethod,omitempty"`
 	Secure     bool     `toml:"secure" json:"secure,omitempty"`
 	Names      []string `toml:"names" json:"names,omitempty"`
-	Token      string   `toml:"token" json:"token,omitempty"`
+	// Token is a single plaintext token with access to every allowed
+	// domain. Prefer Tokens, which are stored hashed and can be scoped.
+	Token      string      `toml:"token" json:"token,omitempty"`
+	Tokens     []HttpToken `toml:"Tokens" json:"tokens,omitempty"`
+	TokensFile string      `toml:"tokensFile" json:"tokens_file,omitempty"`
+
+	JWT HttpJWTConfig `toml:"JWT" json:"jwt,omitempty"`
+
+	RateLimit HttpRateLimitConfig `toml:"RateLimit" json:"rate_limit,omitempty"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For is believed for the client's address.
+	TrustedProxies []string `toml:"trustedProxies" json:"trusted_proxies,omitempty"`
+
+	TrustedProxyPrefixes []netip.Prefix `toml:"-" json:"-"`
+
+	fileTokens []HttpToken
+}
+
+// HttpRateLimitConfig throttles the HTTP API. PerIP and PerIdentity are
+// the sustained requests per second allowed to each client address and
+// each credential, in bursts of up to PerIPBurst and PerIdentityBurst;
+// 0 turns a limit off. An address failing to authenticate
+// MaxAuthFailures times within FailureWindow is locked out for Lockout.
+type HttpRateLimitConfig struct {
+	PerIP            float64 `toml:"perIP" json:"per_ip,omitempty"`
+	PerIPBurst       int     `toml:"perIPBurst" json:"per_ip_burst,omitempty"`
+	PerIdentity      float64 `toml:"perIdentity" json:"per_identity,omitempty"`
+	PerIdentityBurst int     `toml:"perIdentityBurst" json:"per_identity_burst,omitempty"`
+	MaxAuthFailures  int     `toml:"maxAuthFailures" json:"max_auth_failures,omitempty"`
+	FailureWindow    string  `toml:"failureWindow" json:"failure_window,omitempty"`
+	Lockout          string  `toml:"lockout" json:"lockout,omitempty"`
+
+	FailureWindowDuration time.Duration `toml:"-" json:"-"`
+	LockoutDuration       time.Duration `toml:"-" json:"-"`
+}
+
+// Enabled reports whether any limit is on.
+func (c *HttpRateLimitConfig) Enabled() bool {
+	return c.PerIP > 0 || c.PerIdentity > 0 || c.MaxAuthFailures > 0
+}
+
+// defaultBurst is the burst of a rate limit without one: a second's
+// worth of requests, at least one.
+func defaultBurst(perSecond float64) int {
+	return max(1, int(math.Ceil(perSecond)))
+}
+
+func (c *HttpRateLimitConfig) validate() error {
+	var ret []error
+	if c.PerIP < 0 || c.PerIdentity < 0 || c.PerIPBurst < 0 || c.PerIdentityBurst < 0 || c.MaxAuthFailures < 0 {
+		ret = append(ret, fmt.Errorf("[HttpServer.RateLimit] limits must not be negative"))
+	}
+	if c.PerIPBurst == 0 {
+		c.PerIPBurst = defaultBurst(c.PerIP)
+	}
+	if c.PerIdentityBurst == 0 {
+		c.PerIdentityBurst = defaultBurst(c.PerIdentity)
+	}
+
+	if c.FailureWindow == "" {
+		c.FailureWindow = "10m"
+	}
+	if c.Lockout == "" {
+		c.Lockout = "15m"
+	}
+	var err error
+	if c.FailureWindowDuration, err = time.ParseDuration(c.FailureWindow); err != nil || c.FailureWindowDuration <= 0 {
+		ret = append(ret, fmt.Errorf("[HttpServer.RateLimit] failureWindow must be a positive duration: %q", c.FailureWindow))
+	}
+	if c.LockoutDuration, err = time.ParseDuration(c.Lockout); err != nil || c.LockoutDuration <= 0 {
+		ret = append(ret, fmt.Errorf("[HttpServer.RateLimit] lockout must be a positive duration: %q", c.Lockout))
+	}
+	return errors.Join(ret...)
+}
+
+// parseTrustedProxies parses TrustedProxies into TrustedProxyPrefixes.
+func (c *HttpServerConfig) parseTrustedProxies() error {
+	var err error
+	c.TrustedProxyPrefixes, err = parsePrefixes("HttpServer", "trustedProxies", c.TrustedProxies)
+	return err
+}
+
+// UsesJWT reports whether the HTTP API authenticates bearer JWTs.
+func (c *HttpServerConfig) UsesJWT() bool {
+	return c.AuthMethod == HTTP_AUTH_JWT || c.AuthMethod == HTTP_AUTH_OIDC
+}
+
+// HttpJWTConfig configures the jwt and oidc auth methods: bearer JWTs
+// signed by a key of a JWKS, whose claims Rules map to domains.
+type HttpJWTConfig struct {
+	Issuer   string `toml:"issuer" json:"issuer,omitempty"`
+	Audience string `toml:"audience" json:"audience,omitempty"`
+	// JWKSFile or JWKSURL hold the signing keys. With oidc and neither
+	// set, the JWKS is discovered from Issuer.
+	JWKSFile  string `toml:"jwksFile" json:"jwks_file,omitempty"`
+	JWKSURL   string `toml:"jwksURL" json:"jwks_url,omitempty"`
+	Refresh   string `toml:"refresh" json:"refresh,omitempty"`
+	Leeway    string `toml:"leeway" json:"leeway,omitempty"`
+	NameClaim string `toml:"nameClaim" json:"name_claim,omitempty"`
+
+	Rules []HttpJWTRule `toml:"Rules" json:"rules,omitempty"`
+
+	RefreshDuration time.Duration `toml:"-" json:"-"`
+	LeewayDuration  time.Duration `toml:"-" json:"-"`
+}
+
+// HttpJWTRule grants Domains, and their subdomains, to tokens whose Claim
+// holds one of Values. A claim holding a list matches if any of its
+// items does; a dotted Claim reaches into nested objects. No Domains
+// grants every allowed domain.
+type HttpJWTRule struct {
+	Claim   string   `toml:"claim" json:"claim,omitempty"`
+	Values  []string `toml:"values" json:"values,omitempty"`
+	Domains []string `toml:"domains" json:"domains,omitempty"`
+}
+
+func (c *HttpJWTConfig) validate(method string) error {
+	var ret []error
+	if c.Issuer == "" {
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] issuer is required"))
+	}
+	if c.Audience == "" {
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] audience is required"))
+	}
+	switch {
+	case c.JWKSFile != "" && c.JWKSURL != "":
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] set only one of jwksFile and jwksURL"))
+	case c.JWKSFile == "" && c.JWKSURL == "" && method != HTTP_AUTH_OIDC:
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] jwksFile or jwksURL is required"))
+	}
+
+	var err error
+	if c.RefreshDuration, err = time.ParseDuration(c.Refresh); err != nil {
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] can not parse refresh: %w", err))
+	}
+	if c.LeewayDuration, err = time.ParseDuration(c.Leeway); err != nil {
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] can not parse leeway: %w", err))
+	}
+
+	if len(c.Rules) == 0 {
+		ret = append(ret, fmt.Errorf("[HttpServer.JWT] no rules, no token would be let in"))
+	}
+	for i, r := range c.Rules {
+		if r.Claim == "" || len(r.Values) == 0 {
+			ret = append(ret, fmt.Errorf("[HttpServer.JWT] rule %d needs a claim and values", i))
+		}
+	}
+	return errors.Join(ret...)
+}
+
+// HttpToken is a named API token. Only its hash is kept; Domains, when
+// set, restricts it to those domains and their subdomains, which must
+// lie within ACME.allowedDomains.
+type HttpToken struct {
+	Name    string   `toml:"name" json:"name,omitempty"`
+	Hash    string   `toml:"hash" json:"hash,omitempty"`
+	Domains []string `toml:"domains" json:"domains,omitempty"`
+	Expires string   `toml:"expires" json:"expires,omitempty"`
+
+	ExpiresAt time.Time `toml:"-" json:"-"`
+}
+
+// tokenHashPrefix tags the hash algorithm of HttpToken.Hash, leaving room
+// for others.
+const tokenHashPrefix = "sha256:"
+
+// LegacyTokenName is the name HttpServerConfig.Token goes by in logs.
+const LegacyTokenName = "default"
+
+// HashToken returns the HttpToken.Hash of token. Tokens are random, so a
+// plain digest is enough; no salt or stretching is needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Matches reports in constant time whether token hashes to t.Hash.
+func (t *HttpToken) Matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(strings.ToLower(t.Hash))) == 1
+}
+
+// Expired reports whether t has expired at now.
+func (t *HttpToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// Allows reports whether t may access every one of domains.
+func (t *HttpToken) Allows(domains []string) bool {
+	return len(t.Domains) == 0 || domain.AllAllowed(t.Domains, domains)
+}
+
+func (t *HttpToken) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("token with no name")
+	}
+	digest, ok := strings.CutPrefix(strings.ToLower(t.Hash), tokenHashPrefix)
+	if !ok {
+		return fmt.Errorf("token %q: hash must start with %q", t.Name, tokenHashPrefix)
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("token %q: malformed hash", t.Name)
+	}
+	if t.Expires != "" {
+		var err error
+		t.ExpiresAt, err = time.Parse(time.RFC3339, t.Expires)
+		if err != nil {
+			return fmt.Errorf("token %q: can not parse expires: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// tokensFile is the layout of HttpServerConfig.TokensFile.
+type tokensFile struct {
+	Tokens []HttpToken `toml:"Tokens"`
+}
+
+func (c *HttpServerConfig) loadTokensFile() error {
+	c.fileTokens = nil
+	if c.TokensFile == "" {
+		return nil
+	}
+	var f tokensFile
+	if _, err := toml.DecodeFile(c.TokensFile, &f); err != nil {
+		return fmt.Errorf("load tokens file: %w", err)
+	}
+	c.fileTokens = f.Tokens
+	return nil
+}
+
+// AuthTokens returns every token the HTTP server accepts: Token, under
+// LegacyTokenName, then Tokens and those loaded from TokensFile. None
+// means the API is open.
+func (c *HttpServerConfig) AuthTokens() []HttpToken {
+	ret := make([]HttpToken, 0, 1+len(c.Tokens)+len(c.fileTokens))
+	if c.Token != "" {
+		ret = append(ret, HttpToken{Name: LegacyTokenName, Hash: HashToken(c.Token)})
+	}
+	ret = append(ret, c.Tokens...)
+	return append(ret, c.fileTokens...)
 }
 
 func (c *HttpServerConfig) Validate() error {
@@ -219,12 +606,72 @@ func (c *HttpServerConfig) Validate() error {
 		return fmt.Errorf("secure http server with no name")
 	}
 
-	return nil
+	if err := errors.Join(c.ListenOptions.validate("HttpServer", c.Listen), c.RateLimit.validate(), c.parseTrustedProxies()); err != nil {
+		return err
+	}
+
+	if c.UsesJWT() {
+		return c.JWT.validate(c.AuthMethod)
+	}
+
+	if err := c.loadTokensFile(); err != nil {
+		return err
+	}
+	var ret []error
+	names := map[string]bool{}
+	if c.Token != "" {
+		names[LegacyTokenName] = true
+	}
+	for _, tokens := range [][]HttpToken{c.Tokens, c.fileTokens} {
+		for i := range tokens {
+			t := &tokens[i]
+			if err := t.Validate(); err != nil {
+				ret = append(ret, err)
+				continue
+			}
+			if names[t.Name] {
+				ret = append(ret, fmt.Errorf("duplicate token name %q", t.Name))
+			}
+			names[t.Name] = true
+		}
+	}
+	return errors.Join(ret...)
+}
+
+// validateTokenScopes checks that no token, JWT rule or mTLS client
+// rule reaches beyond ACME.allowedDomains.
+func (c *ServerConfig) validateTokenScopes() error {
+	var ret []error
+	if c.needsMTLS() {
+		for _, r := range c.MTLS.Clients {
+			if !domain.AllAllowed(c.ACME.AllowedDomains, r.Domains) {
+				ret = append(ret, fmt.Errorf("[MTLS] client rule %q: domains %v not within allowedDomains", r.Name, r.Domains))
+			}
+		}
+	}
+	if !c.HttpServer.Enabled {
+		return errors.Join(ret...)
+	}
+	if c.HttpServer.UsesJWT() {
+		for i, r := range c.HttpServer.JWT.Rules {
+			if !domain.AllAllowed(c.ACME.AllowedDomains, r.Domains) {
+				ret = append(ret, fmt.Errorf("[HttpServer.JWT] rule %d: domains %v not within allowedDomains", i, r.Domains))
+			}
+		}
+		return errors.Join(ret...)
+	}
+	for _, t := range c.HttpServer.AuthTokens() {
+		if !domain.AllAllowed(c.ACME.AllowedDomains, t.Domains) {
+			ret = append(ret, fmt.Errorf("token %q: domains %v not within allowedDomains", t.Name, t.Domains))
+		}
+	}
+	return errors.Join(ret...)
 }
 
 type GRPCServerConfig struct {
 	Enabled bool   `toml:"enabled" json:"enabled,omitempty"`
 	Listen  string `toml:"listen" json:"listen,omitempty"`
+	ListenOptions
 }
 
 func (c *GRPCServerConfig) Validate() error {
@@ -232,11 +679,492 @@ func (c *GRPCServerConfig) Validate() error {
 		return nil
 	}
 
+	return c.ListenOptions.validate("gRPCSDSServer", c.Listen)
+}
+
+// AdminServerConfig is the operator API: a plain HTTP listener of its
+// own, so it can be kept off the network clients reach, authenticated
+// with a token only operators hold.
+type AdminServerConfig struct {
+	Enabled bool   `toml:"enabled" json:"enabled,omitempty"`
+	Listen  string `toml:"listen" json:"listen,omitempty"`
+	Token   string `toml:"token" json:"token,omitempty"`
+}
+
+func (c *AdminServerConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Token == "" {
+		return fmt.Errorf("[AdminServer] token is required")
+	}
+	return nil
+}
+
+// CertStoreConfig selects the backend that persists obtained
+// certificates across restarts. Path is optional; when empty the
+// backend's default file under the state root is used. S3 and Prefix
+// are only used by the s3 backend. History is how many previous certs
+// are kept per pack for rollback. IdleTimeout is how long a pack nobody
+// uses is kept renewed before it is evicted; "0" disables eviction.
+// ImportRoots are PEM files of CA certs that imported and file source
+// certs may chain to besides the system roots.
+type CertStoreConfig struct {
+	Type        string   `toml:"type" json:"type,omitempty"`
+	Path        string   `toml:"path" json:"path,omitempty"`
+	History     int      `toml:"history" json:"history,omitempty"`
+	IdleTimeout string   `toml:"idleTimeout" json:"idle_timeout,omitempty"`
+	ImportRoots []string `toml:"importRoots" json:"import_roots,omitempty"`
+
+	S3     *S3Client `toml:"S3" json:"s3,omitempty"`
+	Prefix string    `toml:"prefix" json:"prefix,omitempty"`
+
+	IdleTimeoutDuration time.Duration `toml:"-" json:"-"`
+}
+
+func (c *CertStoreConfig) Validate() error {
+	if c.History < 0 {
+		return fmt.Errorf("[CertStore] history must not be negative")
+	}
+
+	if c.IdleTimeout != "" {
+		d, err := time.ParseDuration(c.IdleTimeout)
+		if err != nil {
+			return fmt.Errorf("[CertStore] can not parse idleTimeout: %w", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("[CertStore] idleTimeout must not be negative")
+		}
+		c.IdleTimeoutDuration = d
+	}
+
+	switch c.Type {
+	case CertStoreTypeJSON, CertStoreTypeSQLite:
+		return nil
+	case CertStoreTypeS3:
+		if c.S3 == nil || c.S3.Bucket == "" {
+			return fmt.Errorf("[CertStore] s3 store requires [CertStore.S3] with a bucket")
+		}
+		return nil
+	default:
+		return fmt.Errorf("[CertStore] unsupported type: %q", c.Type)
+	}
+}
+
+// EncryptionConfig selects the key provider used to encrypt private keys
+// at rest. An empty Provider disables encryption. KeyFile and KeyEnv are
+// used by the file and env providers, Command by the exec provider, and
+// Options is passed through to providers registered by plugins.
+type EncryptionConfig struct {
+	Provider string            `toml:"provider" json:"provider,omitempty"`
+	KeyFile  string            `toml:"keyFile" json:"key_file,omitempty"`
+	KeyEnv   string            `toml:"keyEnv" json:"key_env,omitempty"`
+	Command  []string          `toml:"command" json:"command,omitempty"`
+	Options  map[string]string `toml:"options" json:"options,omitempty"`
+}
+
+// Enabled reports whether a key provider is configured.
+func (c *EncryptionConfig) Enabled() bool {
+	return c.Provider != ""
+}
+
+func (c *EncryptionConfig) Validate() error {
+	switch c.Provider {
+	case "":
+		return nil
+	case EncryptionProviderFile:
+		if c.KeyFile == "" {
+			return fmt.Errorf("[Encryption] file provider requires keyFile")
+		}
+	case EncryptionProviderEnv:
+		if c.KeyEnv == "" {
+			return fmt.Errorf("[Encryption] env provider requires keyEnv")
+		}
+	case EncryptionProviderExec:
+		if len(c.Command) == 0 {
+			return fmt.Errorf("[Encryption] exec provider requires command")
+		}
+	}
+	// Other provider names may be registered by plugins; they are
+	// resolved when the provider is constructed.
 	return nil
 }
 
+// FileSourceConfig points the server at a directory of externally
+// managed <name>.pem/<name>.key pairs, which it serves without ACME. An
+// empty Dir disables the file source.
+type FileSourceConfig struct {
+	Dir          string `toml:"dir" json:"dir,omitempty"`
+	ScanInterval string `toml:"scanInterval" json:"scan_interval,omitempty"`
+
+	ScanIntervalDuration time.Duration `toml:"-" json:"-"`
+}
+
+// Enabled reports whether a directory is configured.
+func (c *FileSourceConfig) Enabled() bool {
+	return c.Dir != ""
+}
+
+func (c *FileSourceConfig) Validate() error {
+	if c.ScanInterval == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(c.ScanInterval)
+	if err != nil {
+		return fmt.Errorf("[FileSource] can not parse scanInterval: %w", err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("[FileSource] scanInterval must be positive")
+	}
+	c.ScanIntervalDuration = d
+	return nil
+}
+
+// LeaderElectionConfig lets several servers share one cert store with
+// only the elected leader ordering certs from ACME. Lock selects how the
+// leadership lease is held; empty disables election.
+// QuotaConfig limits the packs clients can have the server issue, so an
+// authenticated client can't run up ACME orders by requesting arbitrary
+// combinations of allowed domains. Each limit is off when zero.
+//
+// MaxDomainsPerPack and ForbidWildcardMix restrict what a pack may hold.
+// MaxPacks caps the packs in the cache, MaxPacksPerClient those each
+// client identity brought into it, and MaxNewOrdersPerHour how many new
+// packs are admitted in any hour. Managed packs and packs serving an
+// imported cert are exempt and not counted.
+type QuotaConfig struct {
+	MaxDomainsPerPack   int  `toml:"maxDomainsPerPack" json:"max_domains_per_pack,omitempty"`
+	MaxPacks            int  `toml:"maxPacks" json:"max_packs,omitempty"`
+	MaxPacksPerClient   int  `toml:"maxPacksPerClient" json:"max_packs_per_client,omitempty"`
+	MaxNewOrdersPerHour int  `toml:"maxNewOrdersPerHour" json:"max_new_orders_per_hour,omitempty"`
+	ForbidWildcardMix   bool `toml:"forbidWildcardMix" json:"forbid_wildcard_mix,omitempty"`
+}
+
+func (c *QuotaConfig) Validate() error {
+	limits := map[string]int{
+		"maxDomainsPerPack":   c.MaxDomainsPerPack,
+		"maxPacks":            c.MaxPacks,
+		"maxPacksPerClient":   c.MaxPacksPerClient,
+		"maxNewOrdersPerHour": c.MaxNewOrdersPerHour,
+	}
+	for _, name := range slices.Sorted(maps.Keys(limits)) {
+		if limits[name] < 0 {
+			return fmt.Errorf("[Quota] %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+type LeaderElectionConfig struct {
+	Lock  string `toml:"lock" json:"lock,omitempty"`
+	Name  string `toml:"name" json:"name,omitempty"`
+	Lease string `toml:"lease" json:"lease,omitempty"`
+
+	// Path is the lease file for the file lock and the SQLite database
+	// for the sql lock.
+	Path string `toml:"path" json:"path,omitempty"`
+
+	// S3 and Key locate the lease object of the s3 lock. They default to
+	// [CertStore.S3] and <CertStore.prefix>leader.lock.
+	S3  *S3Client `toml:"S3" json:"s3,omitempty"`
+	Key string    `toml:"key" json:"key,omitempty"`
+
+	LeaseDuration time.Duration `toml:"-" json:"-"`
+}
+
+// Enabled reports whether a lock is configured.
+func (c *LeaderElectionConfig) Enabled() bool {
+	return c.Lock != ""
+}
+
+// validateLeaderElection checks [LeaderElection] and fills the lock
+// defaults taken from [CertStore].
+func (c *ServerConfig) validateLeaderElection() error {
+	l := &c.LeaderElection
+	if !l.Enabled() {
+		return nil
+	}
+
+	// Followers learn about renewals through the shared store, which the
+	// single-file JSON store can't be.
+	if c.CertStore.Type != CertStoreTypeSQLite && c.CertStore.Type != CertStoreTypeS3 {
+		return fmt.Errorf("[LeaderElection] requires a sqlite or s3 cert store")
+	}
+
+	if l.Lease != "" {
+		d, err := time.ParseDuration(l.Lease)
+		if err != nil {
+			return fmt.Errorf("[LeaderElection] can not parse lease: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("[LeaderElection] lease must be positive")
+		}
+		l.LeaseDuration = d
+	}
+
+	switch l.Lock {
+	case LeaderLockFile:
+		if l.Path == "" {
+			return fmt.Errorf("[LeaderElection] file lock requires path")
+		}
+	case LeaderLockS3:
+		if l.S3 == nil {
+			l.S3 = c.CertStore.S3
+		}
+		if l.S3 == nil || l.S3.Bucket == "" {
+			return fmt.Errorf("[LeaderElection] s3 lock requires [LeaderElection.S3] or an s3 cert store")
+		}
+		if l.Key == "" {
+			l.Key = c.CertStore.Prefix + "leader.lock"
+		}
+	case LeaderLockSQL:
+		if l.Path == "" && c.CertStore.Type != CertStoreTypeSQLite {
+			return fmt.Errorf("[LeaderElection] sql lock requires path or a sqlite cert store")
+		}
+		if l.Path == "" {
+			l.Path = c.CertStore.Path
+		}
+	default:
+		return fmt.Errorf("[LeaderElection] unsupported lock: %q", l.Lock)
+	}
+	return nil
+}
+
+// PeerSyncConfig replicates certs from a main server to standby servers.
+// Serve exposes the main's certs to standbys over its HTTP API, to the
+// holders of Peers only. Main makes this server a standby of the server
+// it points to: it polls the main every Interval and only orders certs
+// from ACME itself once the main has been unreachable for TakeoverAfter.
+type PeerSyncConfig struct {
+	Serve bool        `toml:"serve" json:"serve,omitempty"`
+	Peers []HttpToken `toml:"Peers" json:"peers,omitempty"`
+
+	Main          *ClientHttpServer `toml:"Main" json:"main,omitempty"`
+	Interval      string            `toml:"interval" json:"interval,omitempty"`
+	TakeoverAfter string            `toml:"takeoverAfter" json:"takeover_after,omitempty"`
+
+	IntervalDuration      time.Duration `toml:"-" json:"-"`
+	TakeoverAfterDuration time.Duration `toml:"-" json:"-"`
+}
+
+// Standby reports whether a main server is configured.
+func (c *PeerSyncConfig) Standby() bool {
+	return c.Main != nil && c.Main.Url != ""
+}
+
+// validatePeerSync checks [PeerSync]. Synced entries carry every private
+// key, so they are served only to a peer token of their own, over TLS.
+// The standby always sends that token, whatever the main's auth method.
+func (c *ServerConfig) validatePeerSync() error {
+	p := &c.PeerSync
+	if p.Serve {
+		h := &c.HttpServer
+		switch {
+		case !h.Enabled:
+			return fmt.Errorf("[PeerSync] serve requires the http server")
+		case !h.Secure && h.AuthMethod != HTTP_AUTH_MTLS:
+			return fmt.Errorf("[PeerSync] serve requires secure = true or mtls auth")
+		case len(p.Peers) == 0:
+			return fmt.Errorf("[PeerSync] serve requires a [[PeerSync.Peers]] token")
+		}
+		for i := range p.Peers {
+			if err := p.Peers[i].Validate(); err != nil {
+				return fmt.Errorf("[PeerSync.Peers] %w", err)
+			}
+			if !domain.AllAllowed(c.ACME.AllowedDomains, p.Peers[i].Domains) {
+				return fmt.Errorf("[PeerSync.Peers] token %q: domains %v not within allowedDomains", p.Peers[i].Name, p.Peers[i].Domains)
+			}
+		}
+	}
+
+	if !p.Standby() {
+		return nil
+	}
+	if c.LeaderElection.Enabled() {
+		return fmt.Errorf("[PeerSync] main can not be combined with [LeaderElection]")
+	}
+	switch p.Main.AuthMethod {
+	case HTTP_AUTH_TOKEN:
+	case HTTP_AUTH_MTLS:
+		if err := p.Main.Validate(); err != nil {
+			return fmt.Errorf("[PeerSync.Main] %w", err)
+		}
+	default:
+		return fmt.Errorf("[PeerSync.Main] unsupported authMethod: %q", p.Main.AuthMethod)
+	}
+	if p.Main.Token == "" {
+		return fmt.Errorf("[PeerSync.Main] requires the main's peer token")
+	}
+
+	for _, d := range []struct {
+		name string
+		s    string
+		d    *time.Duration
+	}{
+		{"interval", p.Interval, &p.IntervalDuration},
+		{"takeoverAfter", p.TakeoverAfter, &p.TakeoverAfterDuration},
+	} {
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil {
+			return fmt.Errorf("[PeerSync] can not parse %s: %w", d.name, err)
+		}
+		if v <= 0 {
+			return fmt.Errorf("[PeerSync] %s must be positive", d.name)
+		}
+		*d.d = v
+	}
+	if p.TakeoverAfterDuration <= p.IntervalDuration {
+		return fmt.Errorf("[PeerSync] takeoverAfter must be longer than interval")
+	}
+	return nil
+}
+
+// ManagedCertificate declares a cert pack the server issues at startup
+// and keeps renewed in the background, whether or not anything is
+// subscribed to it. Empty fields fall back to [ACME] and the top-level
+// DnsProvider / HttpProvider.
+type ManagedCertificate struct {
+	Name          string   `toml:"name" json:"name,omitempty"`
+	Domains       []string `toml:"domains" json:"domains,omitempty"`
+	CertLifeTime  string   `toml:"certLifeTime" json:"cert_life_time,omitempty"`
+	RenewTimeLeft string   `toml:"renewTimeLeft" json:"renew_time_left,omitempty"`
+	KeyType       string   `toml:"keyType" json:"key_type,omitempty"`
+	ChallengeType string   `toml:"challengeType" json:"challenge_type,omitempty"`
+
+	DnsProvider  *DnsProvider  `toml:"DnsProvider" json:"dns_provider,omitempty"`
+	HttpProvider *HttpProvider `toml:"HttpProvider" json:"http_provider,omitempty"`
+}
+
+// Managed returns the effective server config for issuing m: c with m's
+// overrides applied.
+func (c *ServerConfig) Managed(m *ManagedCertificate) *ServerConfig {
+	ret := *c
+	ret.ACME.AllowedDomains = slices.Clone(c.ACME.AllowedDomains)
+	if m.CertLifeTime != "" {
+		ret.ACME.CertLifeTime = m.CertLifeTime
+	}
+	if m.RenewTimeLeft != "" {
+		ret.ACME.RenewTimeLeft = m.RenewTimeLeft
+	}
+	if m.KeyType != "" {
+		ret.ACME.KeyType = m.KeyType
+	}
+	if m.ChallengeType != "" {
+		ret.ACME.ChallengeType = m.ChallengeType
+	}
+	if m.DnsProvider != nil {
+		ret.DnsProvider = m.DnsProvider
+	}
+	if m.HttpProvider != nil {
+		ret.HttpProvider = m.HttpProvider
+	}
+	// Errors are reported by validateManaged.
+	ret.parseDuration()
+	return &ret
+}
+
+func (c *ServerConfig) validateManaged() error {
+	var ret []error
+	names := map[string]bool{}
+	packs := map[domain.Key]string{}
+
+	for i := range c.ManagedCertificates {
+		m := &c.ManagedCertificates[i]
+		if m.Name == "" {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] #%d: name is empty", i+1))
+			continue
+		}
+		if names[m.Name] {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: duplicate name", m.Name))
+		}
+		names[m.Name] = true
+
+		if len(m.Domains) == 0 {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: domains is empty", m.Name))
+		} else if !domain.AllAllowed(c.ACME.AllowedDomains, m.Domains) {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: domains %v: %w", m.Name, m.Domains, domain.ErrNotAllowed))
+		} else if other, ok := packs[domain.AsKey(m.Domains)]; ok {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: same domains as %s", m.Name, other))
+		} else {
+			packs[domain.AsKey(m.Domains)] = m.Name
+		}
+
+		if m.KeyType != "" && !validKeyType(m.KeyType) {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: key type: %s not supported", m.Name, m.KeyType))
+		}
+		if m.ChallengeType != "" && m.ChallengeType != ChallengeTypeDns01 && m.ChallengeType != ChallengeTypeHttp01 {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: challenge type: %s not supported", m.Name, m.ChallengeType))
+			continue
+		}
+
+		eff := c.Managed(m)
+		if err := eff.validateChallenger(); err != nil {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: %w", m.Name, err))
+		}
+		if err := eff.parseDuration(); err != nil {
+			ret = append(ret, fmt.Errorf("[[ManagedCertificates]] %s: %w", m.Name, err))
+		}
+	}
+
+	return errors.Join(ret...)
+}
+
+func validKeyType(t string) bool {
+	switch t {
+	case KeyTypeEC256, KeyTypeEC384, KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096, KeyTypeRSA8192:
+		return true
+	}
+	return false
+}
+
 type MTLSConfig struct {
 	PEM string `toml:"pem" json:"pem,omitempty"`
+	// Clients restricts what each client may receive. Without rules,
+	// every client cert signed by the CA gets every allowed domain.
+	Clients []MTLSClientRule `toml:"Clients" json:"clients,omitempty"`
+}
+
+// MTLSClientRule grants Domains, and their subdomains, to the clients
+// matching every selector set. Selectors are path.Match patterns, e.g.
+// "spiffe://example.org/ns/web/sa/*": CommonName matches the client
+// cert's subject CN, DNSName and URI any of its SANs, NodeID and Cluster
+// the Envoy node of an SDS stream, so rules using those never match an
+// HTTP client. No Domains grants every allowed domain.
+type MTLSClientRule struct {
+	Name       string   `toml:"name" json:"name,omitempty"`
+	CommonName string   `toml:"commonName" json:"common_name,omitempty"`
+	DNSName    string   `toml:"dnsName" json:"dns_name,omitempty"`
+	URI        string   `toml:"uri" json:"uri,omitempty"`
+	NodeID     string   `toml:"nodeId" json:"node_id,omitempty"`
+	Cluster    string   `toml:"cluster" json:"cluster,omitempty"`
+	Domains    []string `toml:"domains" json:"domains,omitempty"`
+}
+
+func (r *MTLSClientRule) selectors() []string {
+	return []string{r.CommonName, r.DNSName, r.URI, r.NodeID, r.Cluster}
+}
+
+func (r *MTLSClientRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("[MTLS] client rule with no name")
+	}
+	set := false
+	for _, sel := range r.selectors() {
+		if sel == "" {
+			continue
+		}
+		set = true
+		if _, err := path.Match(sel, ""); err != nil {
+			return fmt.Errorf("[MTLS] client rule %q: bad pattern %q: %w", r.Name, sel, err)
+		}
+	}
+	if !set {
+		return fmt.Errorf("[MTLS] client rule %q matches nothing: set commonName, dnsName, uri, nodeId or cluster", r.Name)
+	}
+	return nil
 }
 
 func (c *MTLSConfig) Validate() error {
@@ -246,7 +1174,20 @@ func (c *MTLSConfig) Validate() error {
 	if !paths.FileExists(c.PEM) {
 		return fmt.Errorf("[MTLS] file not found: %s", c.PEM)
 	}
-	return nil
+	var ret []error
+	names := map[string]bool{}
+	for i := range c.Clients {
+		r := &c.Clients[i]
+		if err := r.Validate(); err != nil {
+			ret = append(ret, err)
+			continue
+		}
+		if names[r.Name] {
+			ret = append(ret, fmt.Errorf("[MTLS] duplicate client rule name %q", r.Name))
+		}
+		names[r.Name] = true
+	}
+	return errors.Join(ret...)
 }
 
 func (c *ServerConfig) needsMTLS() bool {
@@ -265,6 +1206,7 @@ func (c *ServerConfig) SetDefault() {
 		RetryCount:            5,
 		RenewTimeLeft:         "24h",
 		CertLifeTime:          "168h",
+		KeyType:               KeyTypeEC256,
 		RenewTimeLeftDuration: 24 * time.Hour,
 		CertLifeTimeDuration:  168 * time.Hour,
 	}
@@ -274,10 +1216,50 @@ func (c *ServerConfig) SetDefault() {
 		Listen:  ":10001",
 		APIPath: "/",
 		Secure:  false,
+		JWT: HttpJWTConfig{
+			Refresh:   "1h",
+			Leeway:    "1m",
+			NameClaim: "sub",
+		},
+		RateLimit: HttpRateLimitConfig{
+			FailureWindow:         "10m",
+			Lockout:               "15m",
+			FailureWindowDuration: 10 * time.Minute,
+			LockoutDuration:       15 * time.Minute,
+		},
 	}
 
 	c.GRPCSDSServer = GRPCServerConfig{
 		Enabled: false,
 		Listen:  ":10002",
 	}
+
+	c.AdminServer = AdminServerConfig{
+		Enabled: false,
+		Listen:  "127.0.0.1:10003",
+	}
+
+	c.CertStore = CertStoreConfig{
+		Type:                CertStoreTypeJSON,
+		History:             3,
+		IdleTimeout:         "720h",
+		IdleTimeoutDuration: 720 * time.Hour,
+	}
+
+	c.FileSource = FileSourceConfig{
+		ScanInterval:         "30s",
+		ScanIntervalDuration: 30 * time.Second,
+	}
+
+	c.LeaderElection = LeaderElectionConfig{
+		Lease:         "30s",
+		LeaseDuration: 30 * time.Second,
+	}
+
+	c.PeerSync = PeerSyncConfig{
+		Interval:              "1m",
+		TakeoverAfter:         "10m",
+		IntervalDuration:      time.Minute,
+		TakeoverAfterDuration: 10 * time.Minute,
+	}
 }
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestACMEConfigValidateEmptyAllowedDomains(t *testing.T) {
@@ -28,6 +31,22 @@ func TestACMEConfigValidateMockSkipsChallenge(t *testing.T) {
 	}
 }
 
+func TestACMEConfigValidateRequireApproval(t *testing.T) {
+	c := &ACMEConfig{
+		Provider:        "mock",
+		AllowedDomains:  []string{"example.com", "example.org"},
+		RequireApproval: []string{"example.org", "secure.example.com"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("requireApproval within allowedDomains: %v", err)
+	}
+
+	c.RequireApproval = []string{"example.net"}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "requireApproval") {
+		t.Fatalf("requireApproval outside allowedDomains: got %v", err)
+	}
+}
+
 func TestACMEConfigValidateMissingChallengeType(t *testing.T) {
 	c := &ACMEConfig{
 		Provider:       "r3test",
@@ -205,6 +224,238 @@ func TestHttpServerConfigValidateSecureNoNames(t *testing.T) {
 	}
 }
 
+func TestHttpServerConfigValidateTokens(t *testing.T) {
+	hash := HashToken("secret")
+	cases := []struct {
+		name   string
+		tokens []HttpToken
+		err    string
+	}{
+		{"valid", []HttpToken{{Name: "a", Hash: hash, Expires: "2030-01-02T03:04:05Z"}}, ""},
+		{"no name", []HttpToken{{Hash: hash}}, "token with no name"},
+		{"plaintext", []HttpToken{{Name: "a", Hash: "secret"}}, "hash must start with"},
+		{"short hash", []HttpToken{{Name: "a", Hash: "sha256:abcd"}}, "malformed hash"},
+		{"bad expires", []HttpToken{{Name: "a", Hash: hash, Expires: "tomorrow"}}, "can not parse expires"},
+		{"duplicate", []HttpToken{{Name: "a", Hash: hash}, {Name: "a", Hash: hash}}, `duplicate token name "a"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &HttpServerConfig{Enabled: true, APIPath: "/", Tokens: tc.tokens}
+			err := c.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestHttpServerConfigValidateRateLimit(t *testing.T) {
+	c := &HttpServerConfig{
+		Enabled:        true,
+		APIPath:        "/",
+		RateLimit:      HttpRateLimitConfig{PerIP: 2.5, PerIdentity: 0.1, MaxAuthFailures: 5, Lockout: "1h"},
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "::ffff:192.0.2.2"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rl := c.RateLimit
+	if rl.PerIPBurst != 3 || rl.PerIdentityBurst != 1 {
+		t.Errorf("default bursts: got %d, %d want 3, 1", rl.PerIPBurst, rl.PerIdentityBurst)
+	}
+	if rl.FailureWindowDuration != 10*time.Minute || rl.LockoutDuration != time.Hour {
+		t.Errorf("durations: got %v, %v", rl.FailureWindowDuration, rl.LockoutDuration)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "192.0.2.2/32"}
+	if len(c.TrustedProxyPrefixes) != len(want) {
+		t.Fatalf("trusted proxies: got %v", c.TrustedProxyPrefixes)
+	}
+	for i, p := range c.TrustedProxyPrefixes {
+		if p.String() != want[i] {
+			t.Errorf("trusted proxy %d: got %s want %s", i, p, want[i])
+		}
+	}
+
+	cases := []struct {
+		name string
+		c    HttpServerConfig
+		err  string
+	}{
+		{"negative", HttpServerConfig{RateLimit: HttpRateLimitConfig{PerIP: -1}}, "must not be negative"},
+		{"bad lockout", HttpServerConfig{RateLimit: HttpRateLimitConfig{Lockout: "forever"}}, "lockout must be a positive duration"},
+		{"bad proxy", HttpServerConfig{TrustedProxies: []string{"proxy.example.com"}}, "no address or CIDR range"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.c.Enabled, tc.c.APIPath = true, "/"
+			if err := tc.c.Validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestListenOptionsValidate(t *testing.T) {
+	c := &GRPCServerConfig{Enabled: true, Listen: "unix:/run/certdx/sds.sock"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.SocketFileMode != 0o660 {
+		t.Errorf("default socket mode: got %v want 0660", c.SocketFileMode)
+	}
+
+	cases := []struct {
+		name   string
+		listen string
+		opts   ListenOptions
+		err    string
+	}{
+		{"mode", "unix:/run/certdx.sock", ListenOptions{SocketMode: "0600"}, ""},
+		{"proxy over tcp", ":10002", ListenOptions{ProxyProtocol: true, ProxyProtocolFrom: []string{"10.0.0.0/8", "192.0.2.1"}}, ""},
+		{"proxy from anyone", ":10002", ListenOptions{ProxyProtocol: true}, "proxyProtocol needs proxyProtocolFrom"},
+		{"proxy from without proxy", ":10002", ListenOptions{ProxyProtocolFrom: []string{"10.0.0.0/8"}}, "proxyProtocolFrom needs proxyProtocol"},
+		{"bad proxy from", ":10002", ListenOptions{ProxyProtocol: true, ProxyProtocolFrom: []string{"lb.example.com"}}, "no address or CIDR range"},
+		{"bad mode", "unix:/run/certdx.sock", ListenOptions{SocketMode: "rw-rw----"}, "socketMode must be octal"},
+		{"mode too wide", "unix:/run/certdx.sock", ListenOptions{SocketMode: "4755"}, "socketMode must be octal"},
+		{"no path", "unix:", ListenOptions{}, "unix socket with no path"},
+		{"proxy over unix", "unix:/run/certdx.sock", ListenOptions{ProxyProtocol: true}, "proxyProtocol needs a TCP listen address"},
+		{"group over tcp", ":10002", ListenOptions{SocketGroup: "certdx"}, "socketGroup needs a unix:/path"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &HttpServerConfig{Enabled: true, APIPath: "/", Listen: tc.listen, ListenOptions: tc.opts}
+			err := c.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestHttpServerConfigTokensFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.toml")
+	content := `[[Tokens]]
+name = "web"
+hash = "` + HashToken("web-secret") + `"
+domains = ["web.example.com"]
+expires = "2030-01-01T00:00:00Z"
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &HttpServerConfig{Enabled: true, APIPath: "/", Token: "legacy", TokensFile: path}
+	for range 2 { // validating again must not load the file twice
+		if err := c.Validate(); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+	}
+	tokens := c.AuthTokens()
+	if len(tokens) != 2 || tokens[0].Name != LegacyTokenName || tokens[1].Name != "web" {
+		t.Fatalf("tokens: %+v", tokens)
+	}
+	web := tokens[1]
+	if !web.Matches("web-secret") || web.Matches("legacy") || !tokens[0].Matches("legacy") {
+		t.Error("token hashes don't match their secrets")
+	}
+	if !web.Allows([]string{"web.example.com", "a.web.example.com"}) || web.Allows([]string{"example.com"}) {
+		t.Error("token scope")
+	}
+	if web.Expired(time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)) || !web.Expired(web.ExpiresAt) {
+		t.Error("token expiry")
+	}
+
+	c.TokensFile = filepath.Join(t.TempDir(), "missing.toml")
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "load tokens file") {
+		t.Fatalf("missing tokens file: got %v", err)
+	}
+}
+
+func TestHttpServerConfigValidateJWT(t *testing.T) {
+	valid := func() *HttpServerConfig {
+		c := &ServerConfig{}
+		c.SetDefault()
+		h := c.HttpServer
+		h.Enabled = true
+		h.AuthMethod = HTTP_AUTH_JWT
+		h.JWT.Issuer = "https://idp.example.com"
+		h.JWT.Audience = "certdx"
+		h.JWT.JWKSURL = "https://idp.example.com/jwks"
+		h.JWT.Rules = []HttpJWTRule{{Claim: "sub", Values: []string{"web"}}}
+		return &h
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("valid jwt config: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(h *HttpServerConfig)
+		err    string
+	}{
+		{"no issuer", func(h *HttpServerConfig) { h.JWT.Issuer = "" }, "issuer is required"},
+		{"no audience", func(h *HttpServerConfig) { h.JWT.Audience = "" }, "audience is required"},
+		{"no jwks", func(h *HttpServerConfig) { h.JWT.JWKSURL = "" }, "jwksFile or jwksURL is required"},
+		{"two jwks", func(h *HttpServerConfig) { h.JWT.JWKSFile = "/jwks.json" }, "only one of"},
+		{"bad leeway", func(h *HttpServerConfig) { h.JWT.Leeway = "soon" }, "can not parse leeway"},
+		{"no rules", func(h *HttpServerConfig) { h.JWT.Rules = nil }, "no rules"},
+		{"empty rule", func(h *HttpServerConfig) { h.JWT.Rules[0].Values = nil }, "rule 0 needs a claim and values"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := valid()
+			tc.modify(h)
+			if err := h.Validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+
+	// OIDC discovers the JWKS from the issuer.
+	h := valid()
+	h.AuthMethod = HTTP_AUTH_OIDC
+	h.JWT.JWKSURL = ""
+	if err := h.Validate(); err != nil {
+		t.Fatalf("oidc without jwks: %v", err)
+	}
+}
+
+func TestServerConfigValidateTokenScopes(t *testing.T) {
+	c := &ServerConfig{}
+	c.ACME.AllowedDomains = []string{"example.com"}
+	c.HttpServer.Enabled = true
+	c.HttpServer.Tokens = []HttpToken{
+		{Name: "in", Hash: HashToken("a"), Domains: []string{"web.example.com"}},
+		{Name: "out", Hash: HashToken("b"), Domains: []string{"example.org"}},
+	}
+	err := c.validateTokenScopes()
+	if err == nil || !strings.Contains(err.Error(), `token "out"`) || strings.Contains(err.Error(), `token "in"`) {
+		t.Fatalf("got %v", err)
+	}
+
+	c.HttpServer.AuthMethod = HTTP_AUTH_OIDC
+	c.HttpServer.JWT.Rules = []HttpJWTRule{
+		{Claim: "sub", Values: []string{"a"}, Domains: []string{"web.example.com"}},
+		{Claim: "sub", Values: []string{"b"}, Domains: []string{"example.org"}},
+	}
+	err = c.validateTokenScopes()
+	if err == nil || !strings.Contains(err.Error(), "rule 1") || strings.Contains(err.Error(), "rule 0") {
+		t.Fatalf("jwt rules: got %v", err)
+	}
+}
+
 func TestGRPCServerConfigValidateDisabled(t *testing.T) {
 	c := &GRPCServerConfig{Enabled: false}
 	if err := c.Validate(); err != nil {
@@ -254,6 +505,23 @@ func TestACMEConfigValidateUnsupportedChallengeType(t *testing.T) {
 	}
 }
 
+func TestAdminServerConfigValidate(t *testing.T) {
+	c := &AdminServerConfig{Enabled: false}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("disabled admin server should skip validation: %v", err)
+	}
+
+	c.Enabled = true
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "[AdminServer] token is required") {
+		t.Fatalf("admin server without token: got %v", err)
+	}
+
+	c.Token = "secret"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("admin server with token: %v", err)
+	}
+}
+
 func TestServerConfigSetDefault(t *testing.T) {
 	c := &ServerConfig{}
 	c.SetDefault()
@@ -273,4 +541,295 @@ func TestServerConfigSetDefault(t *testing.T) {
 	if c.GRPCSDSServer.Listen != ":10002" {
 		t.Errorf("default grpc listen: got %s want :10002", c.GRPCSDSServer.Listen)
 	}
+	if c.AdminServer.Enabled || c.AdminServer.Listen != "127.0.0.1:10003" {
+		t.Errorf("default admin server: got %+v", c.AdminServer)
+	}
+}
+
+func makeManagedTestConfig(managed ...ManagedCertificate) *ServerConfig {
+	c := &ServerConfig{}
+	c.SetDefault()
+	c.ACME.Provider = "mock"
+	c.ACME.AllowedDomains = []string{"example.com"}
+	c.ManagedCertificates = managed
+	return c
+}
+
+func TestServerConfigValidateManaged(t *testing.T) {
+	cases := []struct {
+		name    string
+		managed []ManagedCertificate
+		wantErr string
+	}{
+		{"valid", []ManagedCertificate{{Name: "www", Domains: []string{"www.example.com"}, KeyType: KeyTypeRSA2048}}, ""},
+		{"no name", []ManagedCertificate{{Domains: []string{"www.example.com"}}}, "name is empty"},
+		{"duplicate name", []ManagedCertificate{
+			{Name: "www", Domains: []string{"www.example.com"}},
+			{Name: "www", Domains: []string{"api.example.com"}},
+		}, "duplicate name"},
+		{"same domains", []ManagedCertificate{
+			{Name: "a", Domains: []string{"www.example.com", "example.com"}},
+			{Name: "b", Domains: []string{"example.com", "www.example.com"}},
+		}, "same domains as a"},
+		{"not allowed", []ManagedCertificate{{Name: "www", Domains: []string{"www.example.org"}}}, "not allowed"},
+		{"bad key type", []ManagedCertificate{{Name: "www", Domains: []string{"www.example.com"}, KeyType: "dsa"}}, "key type"},
+		{"bad lifetime", []ManagedCertificate{{Name: "www", Domains: []string{"www.example.com"}, CertLifeTime: "long"}}, "CertLifeTime"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := makeManagedTestConfig(tc.managed...).Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate: got %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerConfigManagedRequiresChallengeProvider(t *testing.T) {
+	c := makeManagedTestConfig(ManagedCertificate{Name: "www", Domains: []string{"www.example.com"}, ChallengeType: ChallengeTypeHttp01})
+	c.ACME.Provider = "r3"
+	c.DnsProvider = &DnsProvider{Type: DnsProviderTypeTencentCloud, SecretID: "id", SecretKey: "key"}
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "www: no http provider") {
+		t.Fatalf("Validate: got %v", err)
+	}
+
+	c.ManagedCertificates[0].HttpProvider = &HttpProvider{Type: HttpProviderTypeS3, S3: &S3Client{Bucket: "b"}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate with per-pack http provider: %v", err)
+	}
+}
+
+func TestServerConfigManagedOverrides(t *testing.T) {
+	c := makeManagedTestConfig(ManagedCertificate{
+		Name:          "www",
+		Domains:       []string{"www.example.com"},
+		CertLifeTime:  "48h",
+		KeyType:       KeyTypeEC384,
+		ChallengeType: ChallengeTypeHttp01,
+	})
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	eff := c.Managed(&c.ManagedCertificates[0])
+	if eff.ACME.CertLifeTimeDuration != 48*time.Hour || eff.ACME.RenewTimeLeftDuration != c.ACME.RenewTimeLeftDuration {
+		t.Fatalf("durations: got %s / %s", eff.ACME.CertLifeTimeDuration, eff.ACME.RenewTimeLeftDuration)
+	}
+	if eff.ACME.KeyType != KeyTypeEC384 || eff.ACME.ChallengeType != ChallengeTypeHttp01 {
+		t.Fatalf("overrides not applied: %+v", eff.ACME)
+	}
+	if c.ACME.KeyType != KeyTypeEC256 || c.ACME.CertLifeTimeDuration != 168*time.Hour {
+		t.Fatalf("base config modified: %+v", c.ACME)
+	}
+}
+
+func TestCertStoreConfigValidateIdleTimeout(t *testing.T) {
+	c := CertStoreConfig{Type: CertStoreTypeJSON, IdleTimeout: "0"}
+	if err := c.Validate(); err != nil || c.IdleTimeoutDuration != 0 {
+		t.Fatalf("idleTimeout 0: err %v, duration %s", err, c.IdleTimeoutDuration)
+	}
+
+	for _, bad := range []string{"soon", "-1h"} {
+		c := CertStoreConfig{Type: CertStoreTypeJSON, IdleTimeout: bad}
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "idleTimeout") {
+			t.Fatalf("idleTimeout %q: got %v", bad, err)
+		}
+	}
+}
+
+func TestFileSourceConfigValidateScanInterval(t *testing.T) {
+	c := FileSourceConfig{Dir: "/certs", ScanInterval: "5s"}
+	if err := c.Validate(); err != nil || c.ScanIntervalDuration != 5*time.Second {
+		t.Fatalf("scanInterval 5s: err %v, duration %s", err, c.ScanIntervalDuration)
+	}
+
+	for _, bad := range []string{"often", "0", "-1s"} {
+		c := FileSourceConfig{Dir: "/certs", ScanInterval: bad}
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "scanInterval") {
+			t.Fatalf("scanInterval %q: got %v", bad, err)
+		}
+	}
+}
+
+func TestQuotaConfigValidate(t *testing.T) {
+	c := QuotaConfig{MaxDomainsPerPack: 10, MaxPacks: 100, ForbidWildcardMix: true}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("valid quota: %v", err)
+	}
+
+	c = QuotaConfig{MaxPacks: 100, MaxNewOrdersPerHour: -1}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "maxNewOrdersPerHour") {
+		t.Fatalf("negative maxNewOrdersPerHour: got %v", err)
+	}
+}
+
+func TestServerConfigValidateLeaderElection(t *testing.T) {
+	base := func() *ServerConfig {
+		c := makeManagedTestConfig()
+		c.CertStore.Type = CertStoreTypeSQLite
+		c.CertStore.Path = "/var/lib/certdx/cache.db"
+		return c
+	}
+
+	c := base()
+	c.LeaderElection.Lock = LeaderLockSQL
+	if err := c.Validate(); err != nil {
+		t.Fatalf("sql lock: %v", err)
+	}
+	if c.LeaderElection.Path != c.CertStore.Path || c.LeaderElection.LeaseDuration != 30*time.Second {
+		t.Fatalf("sql lock defaults: path %q, lease %s", c.LeaderElection.Path, c.LeaderElection.LeaseDuration)
+	}
+
+	c = base()
+	c.CertStore = CertStoreConfig{Type: CertStoreTypeS3, Prefix: "certdx/", S3: &S3Client{Bucket: "bucket"}}
+	c.LeaderElection.Lock = LeaderLockS3
+	if err := c.Validate(); err != nil {
+		t.Fatalf("s3 lock: %v", err)
+	}
+	if c.LeaderElection.S3 != c.CertStore.S3 || c.LeaderElection.Key != "certdx/leader.lock" {
+		t.Fatalf("s3 lock defaults: s3 %+v, key %q", c.LeaderElection.S3, c.LeaderElection.Key)
+	}
+
+	cases := []struct {
+		name    string
+		modify  func(c *ServerConfig)
+		wantErr string
+	}{
+		{"json store", func(c *ServerConfig) {
+			c.CertStore.Type = CertStoreTypeJSON
+			c.LeaderElection.Lock = LeaderLockFile
+			c.LeaderElection.Path = "/shared/leader.lock"
+		}, "requires a sqlite or s3 cert store"},
+		{"file without path", func(c *ServerConfig) { c.LeaderElection.Lock = LeaderLockFile }, "requires path"},
+		{"s3 without bucket", func(c *ServerConfig) { c.LeaderElection.Lock = LeaderLockS3 }, "s3 lock requires"},
+		{"bad lease", func(c *ServerConfig) {
+			c.LeaderElection.Lock = LeaderLockSQL
+			c.LeaderElection.Lease = "0s"
+		}, "lease must be positive"},
+		{"bad lock", func(c *ServerConfig) { c.LeaderElection.Lock = "zookeeper" }, "unsupported lock"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := base()
+			tc.modify(c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate: got %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerConfigValidatePeerSync(t *testing.T) {
+	base := func() *ServerConfig {
+		c := makeManagedTestConfig()
+		c.PeerSync.Main = &ClientHttpServer{Url: "https://main.example.com/", AuthMethod: HTTP_AUTH_TOKEN, Token: "secret"}
+		return c
+	}
+	if err := base().Validate(); err != nil {
+		t.Fatalf("standby: %v", err)
+	}
+
+	c := makeManagedTestConfig()
+	c.HttpServer = HttpServerConfig{Enabled: true, APIPath: "/", AuthMethod: HTTP_AUTH_TOKEN, Token: "secret", Secure: true, Names: []string{"example.com"}}
+	c.PeerSync.Serve = true
+	c.PeerSync.Peers = []HttpToken{{Name: "standby", Hash: HashToken("peer-secret")}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("serve over https: %v", err)
+	}
+	c.HttpServer = HttpServerConfig{Enabled: true, APIPath: "/", AuthMethod: HTTP_AUTH_OIDC, Secure: true, Names: []string{"example.com"},
+		JWT: HttpJWTConfig{Issuer: "https://idp.example.com", Audience: "certdx", Refresh: "1h", Leeway: "1m", Rules: []HttpJWTRule{{Claim: "sub", Values: []string{"web"}}}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("serve with oidc clients: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		modify  func(c *ServerConfig)
+		wantErr string
+	}{
+		{"serve without http", func(c *ServerConfig) { c.PeerSync.Serve = true }, "requires the http server"},
+		{"serve over plain http", func(c *ServerConfig) {
+			c.HttpServer = HttpServerConfig{Enabled: true, APIPath: "/", AuthMethod: HTTP_AUTH_TOKEN, Token: "secret"}
+			c.PeerSync.Serve = true
+			c.PeerSync.Peers = []HttpToken{{Name: "standby", Hash: HashToken("peer-secret")}}
+		}, "secure = true"},
+		{"serve without peers", func(c *ServerConfig) {
+			c.HttpServer = HttpServerConfig{Enabled: true, APIPath: "/", AuthMethod: HTTP_AUTH_TOKEN, Token: "secret", Secure: true, Names: []string{"example.com"}}
+			c.PeerSync.Serve = true
+		}, "[[PeerSync.Peers]]"},
+		{"bad peer hash", func(c *ServerConfig) {
+			c.HttpServer = HttpServerConfig{Enabled: true, APIPath: "/", AuthMethod: HTTP_AUTH_TOKEN, Token: "secret", Secure: true, Names: []string{"example.com"}}
+			c.PeerSync.Serve = true
+			c.PeerSync.Peers = []HttpToken{{Name: "standby", Hash: "peer-secret"}}
+		}, "[PeerSync.Peers]"},
+		{"no token", func(c *ServerConfig) { c.PeerSync.Main.Token = "" }, "peer token"},
+		{"bad auth", func(c *ServerConfig) { c.PeerSync.Main.AuthMethod = "basic" }, "unsupported authMethod"},
+		{"with election", func(c *ServerConfig) {
+			c.CertStore.Type = CertStoreTypeSQLite
+			c.LeaderElection.Lock = LeaderLockSQL
+		}, "can not be combined"},
+		{"takeover too short", func(c *ServerConfig) { c.PeerSync.TakeoverAfter = "30s" }, "longer than interval"},
+		{"bad interval", func(c *ServerConfig) { c.PeerSync.Interval = "often" }, "interval"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := base()
+			tc.modify(c)
+			err := c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Validate: got %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMTLSConfigValidateClients(t *testing.T) {
+	pem := filepath.Join(t.TempDir(), "server.pem")
+	if err := os.WriteFile(pem, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		rules []MTLSClientRule
+		err   string
+	}{
+		{"valid", []MTLSClientRule{{Name: "web", URI: "spiffe://example.org/ns/web/*"}, {Name: "edge", NodeID: "edge-*"}}, ""},
+		{"no name", []MTLSClientRule{{CommonName: "web"}}, "client rule with no name"},
+		{"no selector", []MTLSClientRule{{Name: "web", Domains: []string{"example.com"}}}, "matches nothing"},
+		{"bad pattern", []MTLSClientRule{{Name: "web", CommonName: "[web"}}, "bad pattern"},
+		{"duplicate", []MTLSClientRule{{Name: "web", CommonName: "a"}, {Name: "web", CommonName: "b"}}, `duplicate client rule name "web"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &MTLSConfig{PEM: pem, Clients: tc.rules}
+			err := c.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+
+	s := &ServerConfig{}
+	s.ACME.AllowedDomains = []string{"example.com"}
+	s.GRPCSDSServer.Enabled = true
+	s.MTLS.Clients = []MTLSClientRule{{Name: "out", CommonName: "x", Domains: []string{"example.org"}}}
+	if err := s.validateTokenScopes(); err == nil || !strings.Contains(err.Error(), `client rule "out"`) {
+		t.Fatalf("rule scope: got %v", err)
+	}
 }
@@ -0,0 +1,254 @@
+// Package encryption implements envelope encryption for the secrets the
+// server keeps at rest: the private keys in the cert store and the ACME
+// account keys.
+//
+// Every sealed blob gets its own random 256-bit data key (DEK). The
+// payload is encrypted with the DEK using AES-256-GCM, and the DEK itself
+// is wrapped by a key-encryption key (KEK) held by a [KeyProvider]. The
+// wrapped DEK travels with the ciphertext, so rotating the KEK only
+// rewraps DEKs (see [Rewrap]); payloads are never re-encrypted.
+//
+// A sealed blob is a PEM block of type [PEMType]:
+//
+//	-----BEGIN CERTDX ENCRYPTED DATA-----
+//	Key-Id: 3f1c0a9d2b7e6f41
+//	Wrapped-Key: <base64 wrapped DEK>
+//
+//	<base64 nonce || ciphertext>
+//	-----END CERTDX ENCRYPTED DATA-----
+//
+// so sealed and plaintext PEM material can be told apart with
+// [IsSealed], which is what lets existing plaintext stores be migrated
+// transparently.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PEMType is the PEM block type of a sealed blob.
+const PEMType = "CERTDX ENCRYPTED DATA"
+
+const (
+	headerKeyID      = "Key-Id"
+	headerWrappedKey = "Wrapped-Key"
+
+	dekSize = 32
+)
+
+// ErrNoKey is returned when sealed data is found but no key provider is
+// configured to open it.
+var ErrNoKey = errors.New("data is encrypted but no encryption key is configured")
+
+// KeyProvider holds a key-encryption key and wraps data keys with it.
+// Built-in providers read a local key from a file or the environment;
+// anything else (a cloud KMS, an HSM, Vault transit) plugs in through
+// [RegisterProvider] or the exec provider.
+//
+// Implementations must be safe for concurrent use.
+type KeyProvider interface {
+	// KeyID identifies the KEK new data keys are wrapped with. It is
+	// stored next to every wrapped DEK.
+	KeyID() string
+
+	// WrapKey encrypts dek under the current KEK.
+	WrapKey(ctx context.Context, dek []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a DEK wrapped under the KEK named keyID. A
+	// provider that can't open keyID must return an error rather than
+	// garbage.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// IsSealed reports whether data is a sealed blob.
+func IsSealed(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == PEMType
+}
+
+// Seal encrypts plaintext under a fresh data key wrapped by kp.
+func Seal(ctx context.Context, kp KeyProvider, plaintext []byte) ([]byte, error) {
+	dek := make([]byte, dekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+
+	ciphertext, err := aeadSeal(dek, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := kp.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+
+	return encodeBlock(kp.KeyID(), wrapped, ciphertext), nil
+}
+
+// Open decrypts a blob produced by Seal. Data that isn't sealed is
+// returned unchanged, so callers can read plaintext written before
+// encryption was enabled. kp may be nil, in which case sealed data
+// fails with ErrNoKey.
+func Open(ctx context.Context, kp KeyProvider, data []byte) ([]byte, error) {
+	block, keyID, wrapped, err := decodeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return data, nil
+	}
+	if kp == nil {
+		return nil, ErrNoKey
+	}
+
+	dek, err := kp.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key (key id %s): %w", keyID, err)
+	}
+	return aeadOpen(dek, block.Bytes)
+}
+
+// Rewrap re-wraps the data key of a sealed blob from one KEK to another
+// without touching the payload. Plaintext data is sealed under to, so
+// rotation also finishes any pending migration.
+func Rewrap(ctx context.Context, from, to KeyProvider, data []byte) ([]byte, error) {
+	block, keyID, wrapped, err := decodeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return Seal(ctx, to, data)
+	}
+	if from == nil {
+		return nil, ErrNoKey
+	}
+
+	dek, err := from.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key (key id %s): %w", keyID, err)
+	}
+	rewrapped, err := to.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	return encodeBlock(to.KeyID(), rewrapped, block.Bytes), nil
+}
+
+// KeyIDOf returns the KEK id a sealed blob was wrapped with, or "" when
+// data isn't sealed.
+func KeyIDOf(data []byte) string {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PEMType {
+		return ""
+	}
+	return block.Headers[headerKeyID]
+}
+
+func encodeBlock(keyID string, wrapped, ciphertext []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: PEMType,
+		Headers: map[string]string{
+			headerKeyID:      keyID,
+			headerWrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		},
+		Bytes: ciphertext,
+	})
+}
+
+// decodeBlock returns a nil block when data isn't sealed.
+func decodeBlock(data []byte) (*pem.Block, string, []byte, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	if block == nil || block.Type != PEMType {
+		return nil, "", nil, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(block.Headers[headerWrappedKey])
+	if err != nil || len(wrapped) == 0 {
+		return nil, "", nil, fmt.Errorf("malformed encrypted block: bad %s header", headerWrappedKey)
+	}
+	return block, block.Headers[headerKeyID], wrapped, nil
+}
+
+// aeadSeal encrypts plaintext with AES-256-GCM, prefixing the nonce.
+func aeadSeal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aeadOpen(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("init cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadFile reads path and opens its contents if they are sealed.
+func ReadFile(ctx context.Context, kp KeyProvider, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Open(ctx, kp, data)
+}
+
+// WriteFile writes data to path, sealed under kp when kp is non-nil.
+func WriteFile(ctx context.Context, kp KeyProvider, path string, data []byte, perm os.FileMode) error {
+	if kp != nil {
+		var err error
+		if data, err = Seal(ctx, kp, data); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// RewrapFile re-wraps the sealed file at path from one KEK to another,
+// sealing it under to if it is still plaintext.
+func RewrapFile(ctx context.Context, from, to KeyProvider, path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rewrapped, err := Rewrap(ctx, from, to, data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, rewrapped, st.Mode().Perm())
+}
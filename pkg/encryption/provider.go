@@ -0,0 +1,174 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// ProviderFactory constructs a KeyProvider from the [Encryption] config.
+type ProviderFactory func(c *config.EncryptionConfig) (KeyProvider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ProviderFactory{
+		config.EncryptionProviderFile: newFileProvider,
+		config.EncryptionProviderEnv:  newEnvProvider,
+		config.EncryptionProviderExec: newExecProvider,
+	}
+)
+
+// RegisterProvider makes a KeyProvider available under name, so builds
+// that link in a KMS client can select it with [Encryption].provider.
+// Provider-specific settings are read from EncryptionConfig.Options.
+func RegisterProvider(name string, f ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = f
+}
+
+// NewKeyProvider constructs the provider selected by c. It returns nil
+// and no error when encryption is disabled.
+func NewKeyProvider(c *config.EncryptionConfig) (KeyProvider, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	providersMu.RLock()
+	f, ok := providers[c.Provider]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption provider: %q", c.Provider)
+	}
+
+	kp, err := f(c)
+	if err != nil {
+		return nil, fmt.Errorf("encryption provider %s: %w", c.Provider, err)
+	}
+	return kp, nil
+}
+
+// GenerateKey returns a fresh base64-encoded 256-bit key in the format
+// read by the file and env providers.
+func GenerateKey() (string, error) {
+	key := make([]byte, dekSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// LocalKeyProvider wraps data keys with a 256-bit AES key held in
+// process memory. It backs the file and env providers.
+type LocalKeyProvider struct {
+	id  string
+	key []byte
+}
+
+// NewLocalKeyProvider parses a base64-encoded 256-bit key. The key id is
+// derived from the key itself, so a wrong key is reported as such
+// instead of as a decryption failure.
+func NewLocalKeyProvider(encoded string) (*LocalKeyProvider, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decode key: %w", err)
+	}
+	if len(key) != dekSize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", dekSize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &LocalKeyProvider{id: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+func (p *LocalKeyProvider) KeyID() string {
+	return p.id
+}
+
+func (p *LocalKeyProvider) WrapKey(_ context.Context, dek []byte) ([]byte, error) {
+	return aeadSeal(p.key, dek)
+}
+
+func (p *LocalKeyProvider) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != p.id {
+		return nil, fmt.Errorf("wrapped with key %s, configured key is %s", keyID, p.id)
+	}
+	return aeadOpen(p.key, wrapped)
+}
+
+func newFileProvider(c *config.EncryptionConfig) (KeyProvider, error) {
+	data, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read key file: %w", err)
+	}
+	return NewLocalKeyProvider(string(data))
+}
+
+func newEnvProvider(c *config.EncryptionConfig) (KeyProvider, error) {
+	encoded, ok := os.LookupEnv(c.KeyEnv)
+	if !ok || encoded == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", c.KeyEnv)
+	}
+	return NewLocalKeyProvider(encoded)
+}
+
+// execProvider delegates wrapping to an external program, the plugin
+// hook for KMSes without a built-in client. The program is invoked as
+//
+//	<command...> key-id            -> prints the current key id
+//	<command...> wrap              -> stdin: raw DEK, stdout: wrapped DEK
+//	<command...> unwrap <key id>   -> stdin: wrapped DEK, stdout: raw DEK
+//
+// and must exit non-zero on failure.
+type execProvider struct {
+	command []string
+	id      string
+}
+
+func newExecProvider(c *config.EncryptionConfig) (KeyProvider, error) {
+	p := &execProvider{command: c.Command}
+	id, err := p.run(context.Background(), nil, "key-id")
+	if err != nil {
+		return nil, err
+	}
+	p.id = strings.TrimSpace(string(id))
+	if p.id == "" {
+		return nil, fmt.Errorf("%s key-id printed no key id", c.Command[0])
+	}
+	return p, nil
+}
+
+func (p *execProvider) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	argv := append(append([]string{}, p.command[1:]...), args...)
+	cmd := exec.CommandContext(ctx, p.command[0], argv...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", p.command[0], args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (p *execProvider) KeyID() string {
+	return p.id
+}
+
+func (p *execProvider) WrapKey(ctx context.Context, dek []byte) ([]byte, error) {
+	return p.run(ctx, dek, "wrap")
+}
+
+func (p *execProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	return p.run(ctx, wrapped, "unwrap", keyID)
+}
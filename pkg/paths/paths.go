@@ -27,9 +27,11 @@ import (
 )
 
 const (
-	MtlsCertificateDir = "mtls"
-	ACMEPrivateKeyDir  = "private"
-	ServerCacheFile    = "cache.json"
+	MtlsCertificateDir  = "mtls"
+	ACMEPrivateKeyDir   = "private"
+	ServerCacheFile     = "cache.json"
+	ServerCacheDBFile   = "cache.db"
+	ServerApprovalsFile = "approvals.json"
 
 	fhsConfigDir = "/etc/certdx"
 	fhsStateDir  = "/var/lib/certdx"
@@ -97,6 +99,17 @@ func stateRoot() (string, error) {
 	return localBaseDir()
 }
 
+// ConfigDir returns the config root, which holds the mtls/ directory.
+func ConfigDir() (string, error) {
+	return configRoot()
+}
+
+// StateDir returns the state root, which holds the server cert cache and
+// the private/ ACME account keys.
+func StateDir() (string, error) {
+	return stateRoot()
+}
+
 // MtlsDir returns the directory for mtls material, creating it with
 // mode 0o700 if necessary.
 func MtlsDir() (string, error) {
@@ -163,3 +176,30 @@ func ServerCachePath() (string, error) {
 	}
 	return filepath.Join(root, ServerCacheFile), nil
 }
+
+// ServerCacheDBPath returns the on-disk path to the SQLite cert store,
+// creating its parent directory if necessary.
+func ServerCacheDBPath() (string, error) {
+	root, err := stateRoot()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.Join(root, ServerCacheDBFile), nil
+}
+
+// ServerApprovalsPath returns the on-disk path to the server's pending
+// and decided pack approvals, creating its parent directory if
+// necessary.
+func ServerApprovalsPath() (string, error) {
+	root, err := stateRoot()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.Join(root, ServerApprovalsFile), nil
+}
@@ -68,6 +68,14 @@ func TestSetDataDirOverride(t *testing.T) {
 	if want := filepath.Join(override, "cache.json"); cache != want {
 		t.Errorf("ServerCachePath=%s want %s", cache, want)
 	}
+
+	db, err := ServerCacheDBPath()
+	if err != nil {
+		t.Fatalf("ServerCacheDBPath: %v", err)
+	}
+	if want := filepath.Join(override, "cache.db"); db != want {
+		t.Errorf("ServerCacheDBPath=%s want %s", db, want)
+	}
 }
 
 func TestMtlsBundlePathName(t *testing.T) {
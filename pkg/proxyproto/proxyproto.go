@@ -0,0 +1,316 @@
+// Package proxyproto reads the PROXY protocol header (v1 and v2) that
+// load balancers such as HAProxy send ahead of a proxied connection, so
+// servers see the original client address.
+//
+// The protocol is specified at
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+const (
+	// v1MaxLen is the longest v1 header, CRLF included.
+	v1MaxLen = 107
+
+	// v2HeaderLen is the fixed part of a v2 header.
+	v2HeaderLen = 16
+
+	// acceptMinDelay and acceptMaxDelay bound the backoff after a failed
+	// Accept of the inner listener.
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// v2Signature starts every v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	// ErrNoHeader is returned for a connection that doesn't start with a
+	// PROXY protocol header.
+	ErrNoHeader = errors.New("no PROXY protocol header")
+
+	// ErrUntrustedPeer is returned for a connection from a peer not
+	// allowed to send a header.
+	ErrUntrustedPeer = errors.New("peer not allowed to send PROXY protocol headers")
+)
+
+// Conn is a connection whose header has been read. RemoteAddr and
+// LocalAddr are the addresses the header carried, or those of the
+// underlying connection for LOCAL and UNKNOWN headers.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *Conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ReadHeader reads the header from conn, waiting at most timeout for
+// it.
+func ReadHeader(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn, r: bufio.NewReader(conn)}
+	var err error
+	if c.remote, c.local, err = readHeader(c.r); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func readHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	// Both versions' headers are longer than the v2 signature.
+	sig, err := r.Peek(len(v2Signature))
+	if errors.Is(err, io.EOF) {
+		return nil, nil, ErrNoHeader
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(sig, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readV1(r)
+	}
+	return nil, nil, ErrNoHeader
+}
+
+// readV1 reads a v1 header, such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", s)
+	}
+	src, err := v1Addr(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := v1Addr(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func v1Addr(host, port string, v6 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return nil, fmt.Errorf("malformed v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary v2 header.
+func readV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var hdr [v2HeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, fmt.Errorf("read v2 header: %w", err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("read v2 header: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0x0:
+		// LOCAL: the proxy's own connection, such as a health check.
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", verCmd&0xf)
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no address worth reporting.
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("v2 address block too short: %d bytes", len(body))
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(body[:ipLen])),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(body[ipLen : 2*ipLen])),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// accepted is a connection, or an error, for Accept to return.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// listener reads the header of each connection in a goroutine of its
+// own, so a client slow to send it doesn't hold up others.
+type listener struct {
+	net.Listener
+	timeout time.Duration
+	from    []netip.Prefix
+
+	conns     chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener returns a listener whose connections are *Conn, requiring
+// a header within timeout of connecting. Only peers within from may
+// connect, since a header lets its sender claim any address; connections
+// from other peers, or without a valid header, are closed.
+func NewListener(inner net.Listener, timeout time.Duration, from []netip.Prefix) net.Listener {
+	l := &listener{
+		Listener: inner,
+		timeout:  timeout,
+		from:     from,
+		conns:    make(chan accepted),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts until the inner listener is closed. Other errors,
+// such as running out of file descriptors, are passed to Accept and
+// retried with backoff, as the caller may well call Accept again.
+func (l *listener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.conns <- accepted{err: err}:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, acceptMinDelay), acceptMaxDelay)
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+				return
+			}
+			continue
+		}
+		delay = 0
+		go func() {
+			c, err := l.readHeader(conn)
+			if errors.Is(err, ErrUntrustedPeer) {
+				logging.Warn("Drop connection from %s: %s", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if err != nil {
+				logging.Debug("Drop connection from %s: %s", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- accepted{conn: c}:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// readHeader reads the header of conn if its peer lies within l.from.
+func (l *listener) readHeader(conn net.Conn) (*Conn, error) {
+	peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range l.from {
+		if p.Contains(peer.Addr().Unmap()) {
+			return ReadHeader(conn, l.timeout)
+		}
+	}
+	return nil, ErrUntrustedPeer
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.conns:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
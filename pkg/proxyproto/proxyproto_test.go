@@ -0,0 +1,225 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(cmd, fam byte, addrs []byte) string {
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, 0x20|cmd, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+// readFrom writes data to one end of a pipe and reads the header from
+// the other.
+func readFrom(t *testing.T, data string) (*Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+	return ReadHeader(server, time.Second)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	v6[15], v6[31], v6[33], v6[35] = 1, 2, 80, 187
+	cases := []struct {
+		name, header, remote string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", "192.0.2.1:56324"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "pipe"},
+		{"v2 tcp4", v2Header(1, 0x11, v4), "192.0.2.1:56324"},
+		{"v2 tcp6 with tlv", v2Header(1, 0x21, append(v6, 0x04, 0x00, 0x01, 0x00)), "[::1]:80"},
+		{"v2 local", v2Header(0, 0x00, nil), "pipe"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := readFrom(t, tc.header+"payload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.RemoteAddr().String(); got != tc.remote {
+				t.Errorf("remote: got %s want %s", got, tc.remote)
+			}
+			if b, err := io.ReadAll(c); err != nil || string(b) != "payload" {
+				t.Errorf("payload: got %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	cases := []struct {
+		name, header, err string
+	}{
+		{"none", "GET / HTTP/1.1\r\n\r\n", "no PROXY protocol header"},
+		{"short", "PROXY", "no PROXY protocol header"},
+		{"no crlf", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", "not terminated by CRLF"},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "not terminated by CRLF"},
+		{"bad address", "PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", "malformed v1 address"},
+		{"bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n", "malformed v1 port"},
+		{"v2 bad command", v2Header(2, 0x11, make([]byte, 12)), "unsupported v2 command"},
+		{"v2 short addresses", v2Header(1, 0x21, make([]byte, 12)), "too short"},
+		{"v2 truncated", v2Header(1, 0x11, make([]byte, 12))[:20], "read v2 header"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readFrom(t, tc.header)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got %v want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, 100*time.Millisecond, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	defer l.Close()
+
+	// A connection that never sends its header doesn't hold up others,
+	// and one sending garbage is dropped.
+	stalled, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	bad, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	good, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	good.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("remote: got %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("payload: got %q, %v", buf, err)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("accept after close succeeded")
+	}
+}
+
+func TestListenerUntrustedPeer(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, time.Second, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	defer l.Close()
+
+	// A peer outside the allow-list can't claim an address.
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	// Closed with unread data, the connection may be reset rather than
+	// see EOF.
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Fatalf("connection from untrusted peer not closed: %v", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("accepted a connection from an untrusted peer")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// flakyListener fails its first Accept with a temporary error, like a
+// listener out of file descriptors.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	if !f.failed {
+		f.failed = true
+		return nil, tempError{}
+	}
+	return f.Listener.Accept()
+}
+
+func TestListenerAcceptError(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(&flakyListener{Listener: inner}, time.Second, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	defer l.Close()
+
+	if _, err := l.Accept(); !errors.Is(err, tempError{}) {
+		t.Fatalf("first accept: got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener stopped accepting after a temporary error")
+	}
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+var (
+	// ErrNotIssuing is returned by ForceRenew on a server that leaves
+	// ordering certs to a leader or main server.
+	ErrNotIssuing = errors.New("this server doesn't order certs, its leader or main server does")
+
+	// ErrExternalPack is returned by ForceRenew for a pack serving an
+	// imported cert, which can't be ordered.
+	ErrExternalPack = errors.New("pack serves an imported cert")
+
+	// ErrManagedPack is returned by Evict for a pack declared in
+	// [[ManagedCertificates]].
+	ErrManagedPack = errors.New("pack is managed")
+
+	// ErrPackInUse is returned by Evict for a pack with subscribers
+	// besides the HTTP lease.
+	ErrPackInUse = errors.New("pack is in use")
+)
+
+// takeForced reports whether a renewal was forced, clearing the request.
+func (c *certEntry) takeForced() bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	forced := c.renewForced
+	c.renewForced = false
+	return forced
+}
+
+// startOrder records that an ACME order for c is in flight.
+func (c *certEntry) startOrder() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.orderStarted = time.Now()
+}
+
+// endOrder records the outcome of the order started by startOrder.
+func (c *certEntry) endOrder(err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.orderStarted = time.Time{}
+	if err != nil {
+		c.lastErr = err.Error()
+		c.lastErrAt = time.Now()
+	} else {
+		c.lastErr = ""
+		c.lastErrAt = time.Time{}
+	}
+}
+
+// adminPack describes c for the admin API.
+func (c *certEntry) adminPack() api.AdminPack {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	pack := api.AdminPack{
+		Domains:     c.domains,
+		Managed:     c.managed != nil,
+		Subscribers: c.subscribing,
+		HttpLease:   c.httpLease,
+		LastUsed:    c.lastUsed,
+		Version:     c.version,
+		Renewing:    !c.orderStarted.IsZero(),
+		LastError:   c.lastErr,
+		LastErrorAt: c.lastErrAt,
+	}
+	if len(c.cert.FullChain) != 0 {
+		v := toAPIVersion(c.cert.version(true))
+		pack.Cert = &v
+	}
+	return pack
+}
+
+// list returns the entries of the cache.
+func (c *certCache) list() []*certEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := make([]*certEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		ret = append(ret, entry)
+	}
+	return ret
+}
+
+// ForceRenew orders a new cert for the cached pack for domains, even if
+// its cert isn't due yet, e.g. after it was revoked.
+func (s *CertDXServer) ForceRenew(ctx context.Context, domains []string) error {
+	if s.deferToMain() || !s.isLeader() {
+		return ErrNotIssuing
+	}
+	entry, err := s.lookupPack(domains)
+	if err != nil {
+		return err
+	}
+
+	entry.stateMu.Lock()
+	external := entry.cert.External
+	entry.renewForced = !external
+	entry.stateMu.Unlock()
+	if external {
+		return fmt.Errorf("%v: %w", domains, ErrExternalPack)
+	}
+
+	logging.Info("Forcing renewal of cert %v", entry.domains)
+	_, err = s.renew(ctx, entry, false)
+	return err
+}
+
+// Evict drops the pack for domains from the cache and the store, as
+// evictIdle does for packs nobody uses. Managed packs and packs with
+// subscribers besides the HTTP lease are refused. A client requesting
+// the pack again has it issued anew.
+func (s *CertDXServer) Evict(ctx context.Context, domains []string) error {
+	key := domain.AsKey(domains)
+
+	s.certCache.mutex.Lock()
+	entry, ok := s.certCache.entries[key]
+	if !ok {
+		s.certCache.mutex.Unlock()
+		return fmt.Errorf("%v: %w", domains, ErrPackNotFound)
+	}
+	if entry.managed != nil {
+		s.certCache.mutex.Unlock()
+		return fmt.Errorf("%v: %w", domains, ErrManagedPack)
+	}
+
+	entry.stateMu.Lock()
+	lease := entry.httpLease
+	others := entry.subscribing
+	if lease {
+		others--
+	}
+	if others > 0 {
+		entry.stateMu.Unlock()
+		s.certCache.mutex.Unlock()
+		return fmt.Errorf("%v has %d subscribers: %w", domains, others, ErrPackInUse)
+	}
+	entry.httpLease = false
+	entry.stateMu.Unlock()
+
+	if lease {
+		s.release(entry)
+	}
+	delete(s.certCache.entries, key)
+	s.certCache.mutex.Unlock()
+	logging.Info("Evicted cert %v", entry.domains)
+
+	// As in evictIdle, only the leader deletes from a shared store.
+	if !s.isLeader() {
+		return nil
+	}
+	if err := s.certStore.Delete(ctx, entry.domains); err != nil {
+		return fmt.Errorf("delete %v from store: %w", entry.domains, err)
+	}
+	return nil
+}
+
+// adminError maps an admin operation's error to its API error.
+func adminError(err error) *api.HttpErrorV2 {
+	switch {
+	case errors.Is(err, ErrPackNotFound), errors.Is(err, ErrVersionNotFound):
+		return &api.HttpErrorV2{Code: api.ErrCodeNotFound, Message: err.Error()}
+	case errors.Is(err, ErrInvalidImport):
+		return &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: err.Error()}
+	case errors.Is(err, ErrNotIssuing), errors.Is(err, ErrExternalPack), errors.Is(err, ErrVersionExpired),
+		errors.Is(err, ErrManagedPack), errors.Is(err, ErrPackInUse),
+		errors.Is(err, ErrApprovalsDisabled), errors.Is(err, ErrNoApprovalNeeded):
+		return &api.HttpErrorV2{Code: api.ErrCodeConflict, Message: err.Error()}
+	}
+	e := errorV2(err)
+	if e.Code == api.ErrCodeUnavailable {
+		// Operators may see what went wrong.
+		e.Message = err.Error()
+	}
+	return e
+}
+
+// writeAdminError writes e with the status of its code.
+func writeAdminError(w http.ResponseWriter, e *api.HttpErrorV2) {
+	status := statusV2(e.Code)
+	switch e.Code {
+	case api.ErrCodeNotFound:
+		status = http.StatusNotFound
+	case api.ErrCodeConflict:
+		status = http.StatusConflict
+	}
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&api.AdminErrorResp{Error: e})
+}
+
+func (s *CertDXServer) handleAdminPacks(w http.ResponseWriter, r *http.Request) {
+	resp := api.AdminPacksResp{Packs: []api.AdminPack{}}
+	for _, entry := range s.certCache.list() {
+		resp.Packs = append(resp.Packs, entry.adminPack())
+	}
+	slices.SortFunc(resp.Packs, func(a, b api.AdminPack) int {
+		return slices.Compare(a.Domains, b.Domains)
+	})
+	writeJSON(w, &resp)
+}
+
+func (s *CertDXServer) handleAdminOrders(w http.ResponseWriter, r *http.Request) {
+	resp := api.AdminOrdersResp{Orders: []api.AdminOrder{}}
+	for _, entry := range s.certCache.list() {
+		entry.stateMu.Lock()
+		started := entry.orderStarted
+		entry.stateMu.Unlock()
+		if !started.IsZero() {
+			resp.Orders = append(resp.Orders, api.AdminOrder{Domains: entry.domains, Started: started})
+		}
+	}
+	slices.SortFunc(resp.Orders, func(a, b api.AdminOrder) int {
+		return a.Started.Compare(b.Started)
+	})
+	writeJSON(w, &resp)
+}
+
+// handleAdminPackOp serves the admin operations on one pack.
+func (s *CertDXServer) handleAdminPackOp(op func(context.Context, []string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.AdminPackReq
+		if err := decodeReq(r, &req); err != nil {
+			writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+			return
+		}
+		if len(req.Domains) == 0 {
+			writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: "No domains"})
+			return
+		}
+
+		// Look the pack up first: an evicted one is gone afterwards.
+		entry, err := s.lookupPack(req.Domains)
+		if err == nil {
+			err = op(r.Context(), req.Domains)
+		}
+		if err != nil {
+			logging.Warn("Admin %s %v from %s failed: %s", r.URL.Path, req.Domains, r.RemoteAddr, err)
+			writeAdminError(w, adminError(err))
+			return
+		}
+		logging.Info("Admin %s %v from %s done", r.URL.Path, req.Domains, r.RemoteAddr)
+		writeJSON(w, &api.AdminPackResp{Pack: entry.adminPack()})
+	}
+}
+
+func (s *CertDXServer) handleAdminHistory(w http.ResponseWriter, r *http.Request) {
+	var req api.AdminPackReq
+	if err := decodeReq(r, &req); err != nil {
+		writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+	versions, err := s.History(req.Domains)
+	if err != nil {
+		writeAdminError(w, adminError(err))
+		return
+	}
+	resp := api.AdminHistoryResp{Versions: make([]api.HttpCertVersion, 0, len(versions))}
+	for _, v := range versions {
+		resp.Versions = append(resp.Versions, toAPIVersion(v))
+	}
+	writeJSON(w, &resp)
+}
+
+func (s *CertDXServer) handleAdminRollback(w http.ResponseWriter, r *http.Request) {
+	var req api.AdminRollbackReq
+	if err := decodeReq(r, &req); err != nil {
+		writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+	current, err := s.Rollback(r.Context(), req.Domains, req.Serial)
+	if err != nil {
+		logging.Warn("Admin rollback %v to serial %s from %s failed: %s", req.Domains, req.Serial, r.RemoteAddr, err)
+		writeAdminError(w, adminError(err))
+		return
+	}
+	logging.Info("Admin rolled back %v to serial %s from %s", req.Domains, req.Serial, r.RemoteAddr)
+	writeJSON(w, &api.AdminRollbackResp{Current: toAPIVersion(current)})
+}
+
+func (s *CertDXServer) handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	var req api.AdminImportReq
+	if err := decodeReq(r, &req); err != nil {
+		writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+	domains, current, err := s.Import(r.Context(), req.FullChain, req.Key)
+	if err != nil {
+		logging.Warn("Admin import from %s failed: %s", r.RemoteAddr, err)
+		writeAdminError(w, adminError(err))
+		return
+	}
+	logging.Info("Admin imported cert %v, serial %s, from %s", domains, current.Serial, r.RemoteAddr)
+	writeJSON(w, &api.AdminImportResp{Domains: domains, Current: toAPIVersion(current)})
+}
+
+func (s *CertDXServer) handleAdminApprovals(w http.ResponseWriter, r *http.Request) {
+	resp := api.AdminApprovalsResp{Approvals: []api.ApprovalRequest{}}
+	if s.approvals != nil {
+		resp.Approvals = s.approvals.list(r.URL.Query().Get("status"))
+	}
+	writeJSON(w, &resp)
+}
+
+// handleAdminDecide serves approving and denying a pack.
+func (s *CertDXServer) handleAdminDecide(op func(*api.AdminApprovalReq) (api.ApprovalRequest, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req api.AdminApprovalReq
+		if err := decodeReq(r, &req); err != nil {
+			writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+			return
+		}
+		if len(req.Domains) == 0 {
+			writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: "No domains"})
+			return
+		}
+
+		approval, err := op(&req)
+		if err != nil {
+			logging.Warn("Admin %s %v from %s failed: %s", r.URL.Path, req.Domains, r.RemoteAddr, err)
+			writeAdminError(w, adminError(err))
+			return
+		}
+		logging.Info("Admin %s %v from %s done", r.URL.Path, req.Domains, r.RemoteAddr)
+		writeJSON(w, &api.AdminApprovalResp{Approval: approval})
+	}
+}
+
+// adminAuth admits requests carrying the [AdminServer] token.
+func (s *CertDXServer) adminAuth(next http.Handler) http.Handler {
+	want := []byte("Token " + s.Config.AdminServer.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			logging.Warn("Not authorized admin request from: %s", r.RemoteAddr)
+			writeAdminError(w, &api.HttpErrorV2{Code: api.ErrCodeUnauthorized, Message: "Missing or wrong token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler returns the handler of the admin API.
+func (s *CertDXServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+api.AdminPacksPath, s.handleAdminPacks)
+	mux.HandleFunc("POST "+api.AdminRenewPath, s.handleAdminPackOp(s.ForceRenew))
+	mux.HandleFunc("POST "+api.AdminEvictPath, s.handleAdminPackOp(s.Evict))
+	mux.HandleFunc("POST "+api.AdminHistoryPath, s.handleAdminHistory)
+	mux.HandleFunc("POST "+api.AdminRollbackPath, s.handleAdminRollback)
+	mux.HandleFunc("POST "+api.AdminImportPath, s.handleAdminImport)
+	mux.HandleFunc("GET "+api.AdminOrdersPath, s.handleAdminOrders)
+	mux.HandleFunc("GET "+api.AdminApprovalsPath, s.handleAdminApprovals)
+	mux.HandleFunc("POST "+api.AdminApprovePath, s.handleAdminDecide(func(req *api.AdminApprovalReq) (api.ApprovalRequest, error) {
+		return s.Approve(req.Domains)
+	}))
+	mux.HandleFunc("POST "+api.AdminDenyPath, s.handleAdminDecide(func(req *api.AdminApprovalReq) (api.ApprovalRequest, error) {
+		return s.Deny(req.Domains, req.Reason)
+	}))
+	return s.adminAuth(mux)
+}
+
+// AdminSrv serves the admin API on [AdminServer].listen until Stop is
+// called.
+func (s *CertDXServer) AdminSrv() error {
+	logging.Info("Start listening admin API at %s", s.Config.AdminServer.Listen)
+	server := &http.Server{
+		Addr:     s.Config.AdminServer.Listen,
+		Handler:  s.adminHandler(),
+		ErrorLog: logging.ErrorLogger(),
+	}
+	defer logging.Info("Admin server stopped")
+	return runHTTPServer(s.rootCtx, server, server.ListenAndServe)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+)
+
+// blockingObtainer holds every order until release is closed.
+type blockingObtainer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (o *blockingObtainer) Obtain(ctx context.Context, domains []string, deadline time.Time) ([]byte, []byte, error) {
+	o.started <- struct{}{}
+	<-o.release
+	return failingObtainer{}.Obtain(ctx, domains, deadline)
+}
+
+func (o *blockingObtainer) RetryObtain(ctx context.Context, domains []string, deadline time.Time) ([]byte, []byte, error) {
+	return o.Obtain(ctx, domains, deadline)
+}
+
+// adminDo sends an admin API request with the admin token to s.
+func adminDo(t *testing.T, s *CertDXServer, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Token admin")
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, req)
+	return w
+}
+
+// makeAdminTestServer returns a server holding a cert for example.com,
+// with no subscribers.
+func makeAdminTestServer(t *testing.T) *CertDXServer {
+	t.Helper()
+	s := makeHistoryTestServer(t)
+	s.Config.AdminServer.Token = "admin"
+	if _, err := s.renew(context.Background(), s.certCache.get([]string{"example.com"}), false); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	<-s.storeUpdate
+	return s
+}
+
+func adminPacks(t *testing.T, s *CertDXServer) []api.AdminPack {
+	t.Helper()
+	w := adminDo(t, s, "GET", api.AdminPacksPath, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list packs: got %d %s", w.Code, w.Body.String())
+	}
+	var resp api.AdminPacksResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode packs: %v", err)
+	}
+	return resp.Packs
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.AdminServer.Token = "admin"
+
+	for _, auth := range []string{"", "Token wrong", "Token admin2", "admin"} {
+		req := httptest.NewRequest("GET", api.AdminPacksPath, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), api.ErrCodeUnauthorized) {
+			t.Errorf("auth %q: got %d %s", auth, w.Code, w.Body.String())
+		}
+	}
+	if w := adminDo(t, s, "GET", api.AdminPacksPath, ""); w.Code != http.StatusOK {
+		t.Errorf("admin token: got %d", w.Code)
+	}
+}
+
+func TestOperatorOpsNotOnClientAPI(t *testing.T) {
+	s := makeTestServer("mysecret", "/api", []string{"example.com"})
+	for _, path := range []string{"/api/history", "/api/rollback", "/api/import"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"domains":["example.com"]}`))
+		req.Header.Set("Authorization", "Token mysecret")
+		w := httptest.NewRecorder()
+		s.apiWithTokenHandler(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("POST %s with a client token: got %d", path, w.Code)
+		}
+	}
+}
+
+func TestAdminPacks(t *testing.T) {
+	s := makeAdminTestServer(t)
+	s.leaseHTTP(s.certCache.get([]string{"example.com"}))
+	packs := adminPacks(t, s)
+	if len(packs) != 1 {
+		t.Fatalf("packs: got %+v", packs)
+	}
+	p := packs[0]
+	if p.Domains[0] != "example.com" || p.Version != 1 || p.Cert == nil || p.Cert.Serial == "" {
+		t.Errorf("pack: %+v", p)
+	}
+	if !p.HttpLease || p.Subscribers != 1 || p.Renewing || p.LastError != "" {
+		t.Errorf("pack state: %+v", p)
+	}
+}
+
+func TestAdminForceRenew(t *testing.T) {
+	s := makeAdminTestServer(t)
+	before := adminPacks(t, s)[0]
+
+	w := adminDo(t, s, "POST", api.AdminRenewPath, `{"domains":["example.com"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("renew: got %d %s", w.Code, w.Body.String())
+	}
+	<-s.storeUpdate
+	var resp api.AdminPackResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Pack.Version != before.Version+1 || resp.Pack.Cert.Serial == before.Cert.Serial {
+		t.Errorf("renewed pack: %+v, before %+v", resp.Pack, before)
+	}
+
+	if w := adminDo(t, s, "POST", api.AdminRenewPath, `{"domains":["other.example.com"]}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown pack: got %d", w.Code)
+	}
+	if w := adminDo(t, s, "POST", api.AdminRenewPath, `{"domains":[]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("no domains: got %d", w.Code)
+	}
+
+	s.acme = failingObtainer{}
+	w = adminDo(t, s, "POST", api.AdminRenewPath, `{"domains":["example.com"]}`)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "unexpected order") {
+		t.Errorf("failed renewal: got %d %s", w.Code, w.Body.String())
+	}
+	p := adminPacks(t, s)[0]
+	if p.LastError == "" || p.LastErrorAt.IsZero() || p.Version != before.Version+1 {
+		t.Errorf("pack after failed renewal: %+v", p)
+	}
+}
+
+func TestAdminForceRenewExternal(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.AdminServer.Token = "admin"
+	fullchain, key := makeExternalCert(t, 3*time.Hour, "ext.example.com")
+	if _, _, err := s.Import(context.Background(), fullchain, key); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	<-s.storeUpdate
+
+	if w := adminDo(t, s, "POST", api.AdminRenewPath, `{"domains":["ext.example.com"]}`); w.Code != http.StatusConflict {
+		t.Errorf("external pack: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminEvict(t *testing.T) {
+	s := makeAdminTestServer(t)
+	s.certStore = makeTempCertStore(t)
+	ctx := context.Background()
+	entry := s.certCache.get([]string{"example.com"})
+	s.leaseHTTP(entry)
+	if err := s.certStore.SaveEntry(ctx, &CertStoreEntry{Domains: entry.domains, Cert: entry.Cert()}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	s.subscribe(entry)
+	if w := adminDo(t, s, "POST", api.AdminEvictPath, `{"domains":["example.com"]}`); w.Code != http.StatusConflict {
+		t.Errorf("subscribed pack: got %d %s", w.Code, w.Body.String())
+	}
+	s.release(entry)
+
+	if w := adminDo(t, s, "POST", api.AdminEvictPath, `{"domains":["example.com"]}`); w.Code != http.StatusOK {
+		t.Fatalf("evict: got %d %s", w.Code, w.Body.String())
+	}
+	if packs := adminPacks(t, s); len(packs) != 0 {
+		t.Errorf("packs after evict: %+v", packs)
+	}
+	if s.isSubscribing(entry) {
+		t.Error("evicted pack still leased")
+	}
+	if stored, err := s.certStore.List(ctx); err != nil || len(stored) != 0 {
+		t.Errorf("store after evict: %d entries, %v", len(stored), err)
+	}
+	if w := adminDo(t, s, "POST", api.AdminEvictPath, `{"domains":["example.com"]}`); w.Code != http.StatusNotFound {
+		t.Errorf("evicted twice: got %d", w.Code)
+	}
+}
+
+func TestAdminOrders(t *testing.T) {
+	s := makeAdminTestServer(t)
+	o := &blockingObtainer{started: make(chan struct{}), release: make(chan struct{})}
+	s.acme = o
+
+	done := make(chan error)
+	go func() { done <- s.ForceRenew(context.Background(), []string{"example.com"}) }()
+	<-o.started
+
+	w := adminDo(t, s, "GET", api.AdminOrdersPath, "")
+	var resp api.AdminOrdersResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode orders: %v", err)
+	}
+	if len(resp.Orders) != 1 || resp.Orders[0].Domains[0] != "example.com" || resp.Orders[0].Started.IsZero() {
+		t.Errorf("orders in flight: %+v", resp.Orders)
+	}
+	if !adminPacks(t, s)[0].Renewing {
+		t.Error("pack not reported renewing")
+	}
+
+	close(o.release)
+	<-done
+	w = adminDo(t, s, "GET", api.AdminOrdersPath, "")
+	if !strings.Contains(w.Body.String(), `"orders":[]`) {
+		t.Errorf("orders after completion: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+// approvalMaxPending caps the pending approval requests, so clients
+// can't fill the approvals file with domain combinations.
+const approvalMaxPending = 1000
+
+var (
+	// ErrApprovalPending is returned for a pack under
+	// ACME.requireApproval that an operator hasn't approved yet.
+	ErrApprovalPending = errors.New("pack awaits approval")
+
+	// ErrApprovalDenied is returned for a pack an operator denied.
+	ErrApprovalDenied = errors.New("pack denied by an operator")
+
+	// ErrApprovalsDisabled is returned by Approve and Deny on a server
+	// without ACME.requireApproval.
+	ErrApprovalsDisabled = errors.New("no domains require approval")
+
+	// ErrNoApprovalNeeded is returned by Approve and Deny for a pack
+	// outside ACME.requireApproval.
+	ErrNoApprovalNeeded = errors.New("pack doesn't require approval")
+)
+
+// approvals holds the approval requests of packs under
+// ACME.requireApproval, kept in a JSON file so pending requests and
+// decisions survive restarts.
+type approvals struct {
+	path string
+
+	mu       sync.Mutex
+	requests map[domain.Key]*api.ApprovalRequest
+}
+
+// openApprovals loads the approvals kept at path, or at the default
+// approvals.json when path is empty.
+func openApprovals(path string) (*approvals, error) {
+	if path == "" {
+		var err error
+		if path, err = paths.ServerApprovalsPath(); err != nil {
+			return nil, fmt.Errorf("resolve approvals path: %w", err)
+		}
+	}
+	a := &approvals{path: path, requests: make(map[domain.Key]*api.ApprovalRequest)}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read approvals: %w", err)
+	}
+	var list []*api.ApprovalRequest
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parse approvals %s: %w", path, err)
+	}
+	for _, r := range list {
+		a.requests[domain.AsKey(r.Domains)] = r
+	}
+	return a, nil
+}
+
+// saveLocked writes the requests to the file, replacing it at once so a
+// crash doesn't leave it half written. Callers hold mu.
+func (a *approvals) saveLocked() error {
+	b, err := json.MarshalIndent(a.listLocked(""), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal approvals: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), ".approvals-*")
+	if err != nil {
+		return fmt.Errorf("write approvals: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write approvals: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write approvals: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("write approvals: %w", err)
+	}
+	return nil
+}
+
+// listLocked returns copies of the requests with status, or all of them
+// when status is empty, oldest first. Callers hold mu.
+func (a *approvals) listLocked(status string) []api.ApprovalRequest {
+	ret := []api.ApprovalRequest{}
+	for _, r := range a.requests {
+		if status == "" || r.Status == status {
+			ret = append(ret, *r)
+		}
+	}
+	slices.SortFunc(ret, func(x, y api.ApprovalRequest) int {
+		if c := x.RequestedAt.Compare(y.RequestedAt); c != 0 {
+			return c
+		}
+		return slices.Compare(x.Domains, y.Domains)
+	})
+	return ret
+}
+
+func (a *approvals) list(status string) []api.ApprovalRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.listLocked(status)
+}
+
+// check returns nil for an approved pack, and otherwise the error to
+// answer requester with, recording a pending request on first sight.
+func (a *approvals) check(domains []string, requester string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := domain.AsKey(domains)
+	r, ok := a.requests[key]
+	if !ok {
+		if len(a.listLocked(api.ApprovalPending)) >= approvalMaxPending {
+			return &QuotaError{
+				Limit:  "pendingApprovals",
+				Reason: fmt.Sprintf("%d packs await approval", approvalMaxPending),
+				err:    ErrQuotaExceeded,
+			}
+		}
+		r = &api.ApprovalRequest{
+			Domains:     domains,
+			Status:      api.ApprovalPending,
+			Requester:   requester,
+			RequestedAt: time.Now(),
+		}
+		a.requests[key] = r
+		if err := a.saveLocked(); err != nil {
+			delete(a.requests, key)
+			return err
+		}
+		logging.Info("Cert %v requested by %q awaits approval", domains, requester)
+	}
+
+	switch r.Status {
+	case api.ApprovalApproved:
+		return nil
+	case api.ApprovalDenied:
+		return fmt.Errorf("%v: %w", domains, ErrApprovalDenied)
+	}
+	return fmt.Errorf("%v: %w", domains, ErrApprovalPending)
+}
+
+// decide records status for the pack for domains, which need not have
+// been requested yet.
+func (a *approvals) decide(domains []string, status, reason string) (api.ApprovalRequest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	key := domain.AsKey(domains)
+	r, ok := a.requests[key]
+	if !ok {
+		r = &api.ApprovalRequest{Domains: domains, RequestedAt: now}
+	}
+	prev := *r
+	r.Status, r.Reason, r.DecidedAt = status, reason, now
+	a.requests[key] = r
+	if err := a.saveLocked(); err != nil {
+		if ok {
+			*r = prev
+		} else {
+			delete(a.requests, key)
+		}
+		return api.ApprovalRequest{}, err
+	}
+	return *r, nil
+}
+
+// needsApproval reports whether a new pack for domains waits for an
+// operator's approval.
+func (s *CertDXServer) needsApproval(domains []string) bool {
+	return s.approvals != nil && slices.ContainsFunc(domains, func(d string) bool {
+		return domain.IsSubdomain(d, s.Config.ACME.RequireApproval)
+	})
+}
+
+// checkApproval returns an error wrapping ErrApprovalPending or
+// ErrApprovalDenied for a pack not yet in the cache that needs an
+// approval it doesn't have. Packs already in the cache are known and
+// served as before.
+func (s *CertDXServer) checkApproval(ctx context.Context, domains []string) error {
+	if !s.needsApproval(domains) {
+		return nil
+	}
+	s.certCache.mutex.Lock()
+	_, cached := s.certCache.entries[domain.AsKey(domains)]
+	s.certCache.mutex.Unlock()
+	if cached {
+		return nil
+	}
+
+	var requester string
+	if t := requestToken(ctx); t != nil {
+		requester = t.Name
+	}
+	return s.approvals.check(domains, requester)
+}
+
+// decideApproval checks that domains is a pack needing approval and
+// records the decision.
+func (s *CertDXServer) decideApproval(domains []string, status, reason string) (api.ApprovalRequest, error) {
+	if s.approvals == nil {
+		return api.ApprovalRequest{}, ErrApprovalsDisabled
+	}
+	if err := s.checkDomains(context.Background(), domains); err != nil {
+		return api.ApprovalRequest{}, err
+	}
+	if !s.needsApproval(domains) {
+		return api.ApprovalRequest{}, fmt.Errorf("%v: %w", domains, ErrNoApprovalNeeded)
+	}
+	r, err := s.approvals.decide(domains, status, reason)
+	if err != nil {
+		return r, err
+	}
+	logging.Info("Cert %v %s", domains, status)
+	return r, nil
+}
+
+// Approve approves the pack for domains and has it issued through the
+// same path as a client request, in the name of the client that asked
+// for it.
+func (s *CertDXServer) Approve(domains []string) (api.ApprovalRequest, error) {
+	r, err := s.decideApproval(domains, api.ApprovalApproved, "")
+	if err != nil {
+		return r, err
+	}
+	go func() {
+		ctx := withCredential(s.rootCtx, &config.HttpToken{Name: r.Requester})
+		if _, _, err := s.fetchCert(ctx, domains); err != nil {
+			logging.Warn("Issue approved cert %v failed, left to the next client request: %s", domains, err)
+		}
+	}()
+	return r, nil
+}
+
+// Deny denies the pack for domains. A pack already in the cache keeps
+// being served until it is evicted.
+func (s *CertDXServer) Deny(domains []string, reason string) (api.ApprovalRequest, error) {
+	return s.decideApproval(domains, api.ApprovalDenied, reason)
+}
+
+// approvalErrV1 returns the v1 "err" of a pack waiting for or denied
+// approval.
+func approvalErrV1(err error) (string, bool) {
+	switch {
+	case errors.Is(err, ErrApprovalPending):
+		return "Approval pending", true
+	case errors.Is(err, ErrApprovalDenied):
+		return "Approval denied", true
+	}
+	return "", false
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// makeApprovalTestServer returns a mock-backed server on which new packs
+// under secure.example.com need approval.
+func makeApprovalTestServer(t *testing.T) *CertDXServer {
+	t.Helper()
+	s := makeHistoryTestServer(t)
+	s.Config.AdminServer.Token = "admin"
+	s.Config.ACME.RequireApproval = []string{"secure.example.com"}
+	s.Config.ACME.ApprovalsFile = filepath.Join(t.TempDir(), "approvals.json")
+	var err error
+	if s.approvals, err = openApprovals(s.Config.ACME.ApprovalsFile); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func adminApprovals(t *testing.T, s *CertDXServer, status string) []api.ApprovalRequest {
+	t.Helper()
+	w := adminDo(t, s, "GET", api.AdminApprovalsPath+"?status="+status, "")
+	var resp api.AdminApprovalsResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list approvals: %d %s", w.Code, w.Body.String())
+	}
+	return resp.Approvals
+}
+
+// issued reports whether the pack for domains is cached with a valid
+// cert.
+func issued(s *CertDXServer, domains []string) bool {
+	if !cached(s, domains) {
+		return false
+	}
+	cert := s.certCache.get(domains).Cert()
+	return cert.IsValid()
+}
+
+func TestApprovalWorkflow(t *testing.T) {
+	s := makeApprovalTestServer(t)
+	secure := `{"packs":[{"domains":["a.secure.example.com"]}]}`
+
+	w, resp := postV2(t, s, `{"packs":[{"domains":["www.example.com"]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("pack without approval: %d %s", w.Code, w.Body.String())
+	}
+
+	for range 2 {
+		w, resp = postV2(t, s, secure)
+		if w.Code != http.StatusAccepted || resp.Error == nil || resp.Error.Code != api.ErrCodeApprovalPending {
+			t.Fatalf("new pack: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if cached(s, []string{"a.secure.example.com"}) {
+		t.Fatal("pending pack cached")
+	}
+	pending := adminApprovals(t, s, api.ApprovalPending)
+	if len(pending) != 1 || pending[0].Domains[0] != "a.secure.example.com" || pending[0].RequestedAt.IsZero() {
+		t.Fatalf("pending: %+v", pending)
+	}
+
+	w = adminDo(t, s, "POST", api.AdminApprovePath, `{"domains":["a.secure.example.com"]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"approved"`) {
+		t.Fatalf("approve: %d %s", w.Code, w.Body.String())
+	}
+	// Approving issues the pack in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for !issued(s, []string{"a.secure.example.com"}) {
+		if time.Now().After(deadline) {
+			t.Fatal("approved pack not issued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w, _ := postV2(t, s, secure); w.Code != http.StatusOK {
+		t.Fatalf("approved pack: %d %s", w.Code, w.Body.String())
+	}
+
+	w = adminDo(t, s, "POST", api.AdminDenyPath, `{"domains":["b.secure.example.com"],"reason":"not ours"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deny: %d %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"domains":["b.secure.example.com"]}`))
+	rec := httptest.NewRecorder()
+	s.apiHandler(rec, req)
+	var v1 api.HttpCertResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &v1); err != nil || v1.Err != "Approval denied" {
+		t.Fatalf("denied pack over v1: %s", rec.Body.String())
+	}
+
+	// Decisions survive a restart.
+	a, err := openApprovals(s.Config.ACME.ApprovalsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.list(""); len(got) != 2 || got[0].Status != api.ApprovalApproved ||
+		got[1].Status != api.ApprovalDenied || got[1].Reason != "not ours" {
+		t.Errorf("reloaded: %+v", got)
+	}
+	if r := a.requests[domain.AsKey([]string{"a.secure.example.com"})]; r == nil || r.DecidedAt.IsZero() {
+		t.Errorf("reloaded approval: %+v", r)
+	}
+}
+
+func TestApprovalAdminErrors(t *testing.T) {
+	s := makeApprovalTestServer(t)
+	cases := []struct {
+		path, body string
+		status     int
+	}{
+		{api.AdminApprovePath, `{"domains":["www.example.com"]}`, http.StatusConflict},
+		{api.AdminApprovePath, `{"domains":["a.secure.example.org"]}`, http.StatusForbidden},
+		{api.AdminDenyPath, `{"domains":[]}`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if w := adminDo(t, s, "POST", tc.path, tc.body); w.Code != tc.status {
+			t.Errorf("%s %s: got %d want %d, %s", tc.path, tc.body, w.Code, tc.status, w.Body.String())
+		}
+	}
+
+	s.approvals = nil
+	if w := adminDo(t, s, "POST", api.AdminApprovePath, `{"domains":["a.secure.example.com"]}`); w.Code != http.StatusConflict {
+		t.Errorf("approvals disabled: got %d", w.Code)
+	}
+	if got := adminApprovals(t, s, ""); len(got) != 0 {
+		t.Errorf("approvals disabled: listed %+v", got)
+	}
+}
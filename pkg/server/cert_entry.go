@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"sync"
+	"time"
 
 	"pkg.para.party/certdx/pkg/domain"
 )
@@ -21,18 +22,41 @@ import (
 //   - subscribing is the consumer refcount, guarded by stateMu. subscribe
 //     transitions 0->1 spawn the renewal goroutine; release transitions 1->0
 //     cancel it via cancelRenew.
+//   - lastUsed and httpLease, guarded by stateMu, drive idle eviction (see
+//     evictIdle). Changing them together with the entry's presence in
+//     certCache additionally requires certCache.mutex, taken first.
+//   - storedAt and requestedAt, guarded by stateMu, track the entry's
+//     state in a store shared under leader election (see leader.go).
+//   - renewForced, orderStarted and lastErr(At), guarded by stateMu, serve
+//     the admin API (see admin.go).
 type certEntry struct {
 	domains []string
 
+	// managed is set by Init for packs declared in [[ManagedCertificates]]
+	// and never changes afterwards.
+	managed *managedPack
+
 	renewMu sync.Mutex // serializes Renew (held during ACME)
 
 	stateMu     sync.Mutex // brief; guards everything below
 	cert        CertT
+	history     []CertT // previous certs, newest first, for rollback
 	version     uint64
 	updated     chan struct{} // closed on each successful renewal, then replaced
 	cancelRenew context.CancelFunc
 
 	subscribing int64
+	lastUsed    time.Time // last HTTP request, subscribe or release
+	httpLease   bool      // held subscription keeping an HTTP pack renewed
+
+	storedAt    time.Time // UpdatedAt of the store entry the cert came from
+	owner       string    // client that brought the pack in, for [Quota]
+	requestedAt time.Time // last renewal request sent to the leader
+
+	renewForced  bool      // next renew orders a cert even if valid
+	orderStarted time.Time // start of the ACME order in flight, if any
+	lastErr      string    // error of the last failed order
+	lastErrAt    time.Time
 }
 
 type certCache struct {
@@ -48,8 +72,9 @@ func makeCertCache() certCache {
 
 func newCertEntry(domains []string) *certEntry {
 	return &certEntry{
-		domains: domains,
-		updated: make(chan struct{}),
+		domains:  domains,
+		updated:  make(chan struct{}),
+		lastUsed: time.Now(),
 	}
 }
 
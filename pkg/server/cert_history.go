@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+var (
+	// ErrPackNotFound is returned by history operations on a domain set
+	// the server holds no cert for.
+	ErrPackNotFound = errors.New("no cert pack for domains")
+
+	// ErrVersionNotFound is returned by Rollback when the serial is not
+	// in the pack's history.
+	ErrVersionNotFound = errors.New("cert version not found in history")
+
+	// ErrVersionExpired is returned by Rollback when the requested version
+	// is no longer valid.
+	ErrVersionExpired = errors.New("cert version is no longer valid")
+)
+
+// CertVersion describes one issued cert of a pack, as listed by History.
+type CertVersion struct {
+	Serial      string
+	Issuer      string
+	NotAfter    time.Time
+	ValidBefore time.Time
+	RenewAt     time.Time
+	External    bool
+	Current     bool
+}
+
+func (c *CertT) version(current bool) CertVersion {
+	return CertVersion{
+		Serial:      c.Serial,
+		Issuer:      c.Issuer,
+		NotAfter:    c.NotAfter,
+		ValidBefore: c.ValidBefore,
+		RenewAt:     c.RenewAt,
+		External:    c.External,
+		Current:     current,
+	}
+}
+
+// pushHistory returns history with prev prepended, unusable versions
+// dropped and the result capped at limit entries. history is ordered
+// newest first.
+func pushHistory(history []CertT, prev CertT, limit int) []CertT {
+	ret := make([]CertT, 0, limit)
+	if len(prev.FullChain) != 0 && prev.usable() {
+		ret = append(ret, prev)
+	}
+	for _, c := range history {
+		if c.usable() {
+			ret = append(ret, c)
+		}
+	}
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+// lookupPack returns the cache entry for domains without creating one.
+func (s *CertDXServer) lookupPack(domains []string) (*certEntry, error) {
+	s.certCache.mutex.Lock()
+	entry, ok := s.certCache.entries[domain.AsKey(domains)]
+	s.certCache.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", domains, ErrPackNotFound)
+	}
+	return entry, nil
+}
+
+// History lists the current cert and the retained previous versions of
+// the pack for domains, newest first.
+func (s *CertDXServer) History(domains []string) ([]CertVersion, error) {
+	entry, err := s.lookupPack(domains)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.stateMu.Lock()
+	defer entry.stateMu.Unlock()
+	if len(entry.cert.FullChain) == 0 {
+		return nil, fmt.Errorf("%v: %w", domains, ErrPackNotFound)
+	}
+
+	ret := make([]CertVersion, 0, len(entry.history)+1)
+	ret = append(ret, entry.cert.version(true))
+	for i := range entry.history {
+		ret = append(ret, entry.history[i].version(false))
+	}
+	return ret, nil
+}
+
+// Rollback makes the retained version with serial the pack's current
+// cert. The version is bumped and broadcast exactly like a renewal, so
+// SDS subscribers get it pushed and HTTP pollers pick it up on their
+// next poll. The replaced cert moves into the history, so a rollback can
+// itself be undone. The pack stays pinned to the rolled-back cert until
+// shortly before that cert expires, when it is renewed as usual.
+func (s *CertDXServer) Rollback(ctx context.Context, domains []string, serial string) (CertVersion, error) {
+	entry, err := s.lookupPack(domains)
+	if err != nil {
+		return CertVersion{}, err
+	}
+
+	// Hold renewMu so a rollback never interleaves with an ACME renewal
+	// of the same pack.
+	entry.renewMu.Lock()
+	defer entry.renewMu.Unlock()
+
+	entry.stateMu.Lock()
+	idx := slices.IndexFunc(entry.history, func(c CertT) bool { return c.Serial == serial })
+	if idx < 0 {
+		entry.stateMu.Unlock()
+		return CertVersion{}, fmt.Errorf("%v serial %s: %w", domains, serial, ErrVersionNotFound)
+	}
+	// Pin the pack: the rolled-back cert is past the ValidBefore it was
+	// issued with, so move ValidBefore to renewTimeLeft before the leaf
+	// expires, leaving clients polling as usual time to pick up its
+	// replacement. Otherwise the renewer would replace it right away. A
+	// version already past that point is refused as expired.
+	target := entry.history[idx]
+	if !target.NotAfter.IsZero() && !target.External {
+		_, acmeConfig := s.acmeFor(entry)
+		target.ValidBefore = target.NotAfter.Add(-acmeConfig.RenewTimeLeftDuration)
+	}
+	if !target.IsValid() {
+		entry.stateMu.Unlock()
+		return CertVersion{}, fmt.Errorf("%v serial %s: %w", domains, serial, ErrVersionExpired)
+	}
+
+	rest := slices.Delete(slices.Clone(entry.history), idx, idx+1)
+	persisted := entry.publishLocked(target, rest, s.Config.CertStore.History)
+	entry.stateMu.Unlock()
+
+	logging.Info("Rolled back cert %v to serial %s", domains, serial)
+
+	select {
+	case s.storeUpdate <- persisted:
+	case <-ctx.Done():
+		return target.version(true), ctx.Err()
+	}
+	return target.version(true), nil
+}
+
+// publishLocked makes cert the entry's current cert, moves the replaced
+// one to the front of history and broadcasts the new version. It returns
+// the entry to persist. Callers hold stateMu, and renewMu so it never
+// interleaves with a renewal.
+func (c *certEntry) publishLocked(cert CertT, history []CertT, limit int) *CertStoreEntry {
+	c.history = pushHistory(history, c.cert, limit)
+	c.cert = cert
+	c.version++
+	close(c.updated)
+	c.updated = make(chan struct{})
+	persisted := c.storeEntryLocked()
+	c.storedAt = persisted.UpdatedAt
+	return persisted
+}
+
+// adoptLocked makes the cert and history of e, an entry written by
+// another server, current if e holds a usable cert other than ours that
+// changed after ours was stored. It reports whether it did. Callers hold
+// stateMu.
+func (c *certEntry) adoptLocked(e *CertStoreEntry) bool {
+	changedAt := e.changedAt()
+	if bytes.Equal(c.cert.FullChain, e.Cert.FullChain) || !changedAt.After(c.storedAt) || !e.Cert.usable() {
+		return false
+	}
+	c.history = e.History
+	c.cert = e.Cert
+	c.storedAt = changedAt
+	if e.Owner != "" {
+		c.owner = e.Owner
+	}
+	c.version++
+	close(c.updated)
+	c.updated = make(chan struct{})
+	return true
+}
+
+// storeEntryLocked builds the persisted form of the entry. Callers hold
+// stateMu.
+func (c *certEntry) storeEntryLocked() *CertStoreEntry {
+	return &CertStoreEntry{
+		Domains:   c.domains,
+		Cert:      c.cert,
+		History:   slices.Clone(c.history),
+		UpdatedAt: time.Now(),
+		Owner:     c.owner,
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/api"
+)
+
+// makeHistoryTestServer returns a server backed by MockACME, so renew
+// mints real certificates with distinct serials. It trusts the test CA
+// for imports.
+func makeHistoryTestServer(t *testing.T) *CertDXServer {
+	t.Helper()
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.ACME.CertLifeTimeDuration = 2 * time.Hour
+	s.Config.ACME.RenewTimeLeftDuration = time.Hour
+	s.acme = acme.NewMockACME(3 * time.Hour)
+	trustTestCA(t, s)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// forceRenew makes the entry's cert due for renewal and renews it.
+func forceRenew(t *testing.T, s *CertDXServer, entry *certEntry) {
+	t.Helper()
+	entry.stateMu.Lock()
+	entry.cert.ValidBefore = time.Now().Add(-time.Second)
+	entry.stateMu.Unlock()
+
+	if _, err := s.renew(context.Background(), entry, false); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	<-s.storeUpdate
+}
+
+func TestPushHistory(t *testing.T) {
+	valid := func(serial string) CertT {
+		return CertT{FullChain: []byte(serial), Serial: serial, ValidBefore: time.Now().Add(time.Hour)}
+	}
+	expired := CertT{FullChain: []byte("x"), Serial: "x", NotAfter: time.Now().Add(-time.Hour)}
+	// Due for renewal but not expired yet: kept.
+	due := CertT{FullChain: []byte("d"), Serial: "d", ValidBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+
+	got := pushHistory([]CertT{valid("b"), expired, valid("c")}, due, 2)
+	if len(got) != 2 || got[0].Serial != "d" || got[1].Serial != "b" {
+		t.Fatalf("pushHistory: got %+v", got)
+	}
+
+	if got := pushHistory(nil, CertT{}, 3); len(got) != 0 {
+		t.Fatalf("empty cert pushed into history: %+v", got)
+	}
+	if got := pushHistory([]CertT{valid("b")}, valid("a"), 0); len(got) != 0 {
+		t.Fatalf("history kept with limit 0: %+v", got)
+	}
+}
+
+func TestRenewRecordsMetadataAndHistory(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	entry := s.certCache.get([]string{"example.com"})
+
+	forceRenew(t, s, entry)
+	first := entry.Cert()
+	if first.Serial == "" || first.Issuer == "" || first.NotAfter.IsZero() {
+		t.Fatalf("metadata not recorded: %+v", first)
+	}
+
+	forceRenew(t, s, entry)
+	versions, err := s.History([]string{"example.com"})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(versions) != 2 || !versions[0].Current || versions[1].Serial != first.Serial {
+		t.Fatalf("History: got %+v", versions)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	domains := []string{"example.com"}
+	entry := s.certCache.get(domains)
+
+	forceRenew(t, s, entry)
+	first := entry.Cert()
+	forceRenew(t, s, entry)
+	second, seen := entry.Snapshot()
+
+	current, err := s.Rollback(context.Background(), domains, first.Serial)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if current.Serial != first.Serial {
+		t.Fatalf("Rollback returned serial %s want %s", current.Serial, first.Serial)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if v := entry.WaitForUpdate(ctx, seen); v != seen+1 {
+		t.Fatalf("version after rollback: got %d want %d", v, seen+1)
+	}
+	got := entry.Cert()
+	if !bytes.Equal(got.FullChain, first.FullChain) {
+		t.Fatal("rolled-back cert is not being served")
+	}
+	if !got.IsValid() {
+		t.Fatal("rolled-back cert is immediately due for renewal")
+	}
+	// It is renewed renewTimeLeft before it expires, like an issued
+	// cert, so clients get the replacement before the leaf lapses.
+	if due := got.NotAfter.Add(-s.Config.ACME.RenewTimeLeftDuration); got.ValidBefore.After(due) {
+		t.Fatalf("rolled-back cert renews at %s, after %s", got.ValidBefore, due)
+	}
+
+	persisted := <-s.storeUpdate
+	if persisted.Cert.Serial != first.Serial || len(persisted.History) == 0 || persisted.History[0].Serial != second.Serial {
+		t.Fatalf("persisted entry: %+v", persisted)
+	}
+
+	// The replaced cert is in the history, so the rollback can be undone.
+	if _, err := s.Rollback(context.Background(), domains, second.Serial); err != nil {
+		t.Fatalf("undo Rollback: %v", err)
+	}
+	<-s.storeUpdate
+}
+
+func TestRollbackErrors(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	domains := []string{"example.com"}
+
+	if _, err := s.Rollback(context.Background(), domains, "1"); !errors.Is(err, ErrPackNotFound) {
+		t.Fatalf("unknown pack: got %v", err)
+	}
+
+	entry := s.certCache.get(domains)
+	forceRenew(t, s, entry)
+	if _, err := s.Rollback(context.Background(), domains, "nope"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("unknown serial: got %v", err)
+	}
+
+	entry.stateMu.Lock()
+	entry.history = []CertT{{FullChain: []byte("old"), Serial: "old", NotAfter: time.Now().Add(time.Minute)}}
+	entry.stateMu.Unlock()
+	if _, err := s.Rollback(context.Background(), domains, "old"); !errors.Is(err, ErrVersionExpired) {
+		t.Fatalf("expired version: got %v", err)
+	}
+}
+
+func TestAdminHistoryAndRollback(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.AdminServer.Token = "admin"
+	domains := []string{"example.com"}
+	entry := s.certCache.get(domains)
+	forceRenew(t, s, entry)
+	first := entry.Cert()
+	forceRenew(t, s, entry)
+
+	w := adminDo(t, s, "POST", api.AdminHistoryPath, `{"domains":["example.com"]}`)
+	var history api.AdminHistoryResp
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("history: %d %s", w.Code, w.Body.String())
+	}
+	if len(history.Versions) != 2 || history.Versions[1].Serial != first.Serial {
+		t.Fatalf("history response: %+v", history)
+	}
+
+	w = adminDo(t, s, "POST", api.AdminRollbackPath, `{"domains":["example.com"],"serial":"`+first.Serial+`"}`)
+	var rollback api.AdminRollbackResp
+	if err := json.Unmarshal(w.Body.Bytes(), &rollback); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("rollback: %d %s", w.Code, w.Body.String())
+	}
+	if rollback.Current.Serial != first.Serial {
+		t.Fatalf("rollback response: %+v", rollback)
+	}
+	<-s.storeUpdate
+
+	if w := adminDo(t, s, "POST", api.AdminRollbackPath, `{"domains":["example.com"],"serial":"nope"}`); w.Code != http.StatusNotFound {
+		t.Errorf("unknown serial: got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+var (
+	// ErrInvalidImport is returned when an imported chain or key fails
+	// validation. The wrapping error says why.
+	ErrInvalidImport = errors.New("invalid certificate")
+
+	// ErrExternalExpired is returned when an imported cert expired. The
+	// server can't renew it; a replacement has to be imported.
+	ErrExternalExpired = errors.New("external cert expired")
+)
+
+// LoadImportRoots returns the roots imported certs must chain to: the
+// system roots plus the PEM certs in files, for private CAs. Without
+// files it returns nil, which x509 takes as the system roots.
+func LoadImportRoots(files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		logging.Warn("Load system roots failed, trusting only importRoots: %s", err)
+		roots = x509.NewCertPool()
+	}
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read import roots: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("import roots %s: no PEM certificates", file)
+		}
+	}
+	return roots, nil
+}
+
+// ParseExternalCert validates an externally obtained PEM chain and
+// private key and returns them as an external cert, along with the
+// domain set taken from the leaf's SANs. The key must match the leaf,
+// and the leaf must be currently valid and verify up to one of roots,
+// nil meaning the system roots, through the rest of the chain.
+func ParseExternalCert(fullchain, key []byte, roots *x509.CertPool) (CertT, []string, error) {
+	pair, err := tls.X509KeyPair(fullchain, key)
+	if err != nil {
+		return CertT{}, nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+	}
+
+	chain := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for _, der := range pair.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return CertT{}, nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+		}
+		chain = append(chain, c)
+	}
+
+	leaf := chain[0]
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || !now.Before(leaf.NotAfter) {
+		return CertT{}, nil, fmt.Errorf("%w: valid from %s to %s", ErrInvalidImport, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	}); err != nil {
+		return CertT{}, nil, fmt.Errorf("%w: %w", ErrInvalidImport, err)
+	}
+
+	domains := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		domains = append(domains, ip.String())
+	}
+	if len(domains) == 0 {
+		return CertT{}, nil, fmt.Errorf("%w: no DNS or IP SANs", ErrInvalidImport)
+	}
+
+	cert := CertT{
+		FullChain: fullchain,
+		Key:       key,
+		RenewAt:   now,
+		External:  true,
+	}
+	cert.fillMetadata()
+	// Never due for renewal: the server can't obtain a replacement.
+	cert.ValidBefore = cert.NotAfter
+	return cert, domains, nil
+}
+
+// Import validates an externally obtained chain and key and makes it the
+// current cert of the pack for its SANs, which must all be allowed. The
+// cert is served like an issued one but never renewed through ACME. The
+// replaced cert, if any, moves into the history.
+func (s *CertDXServer) Import(ctx context.Context, fullchain, key []byte) ([]string, CertVersion, error) {
+	cert, domains, err := ParseExternalCert(fullchain, key, s.importRoots)
+	if err != nil {
+		return nil, CertVersion{}, err
+	}
+	if err := s.checkDomains(ctx, domains); err != nil {
+		return nil, CertVersion{}, err
+	}
+
+	logging.Info("Importing external cert %v, serial %s, valid until %s", domains, cert.Serial, cert.NotAfter)
+	return domains, cert.version(true), s.publishExternal(ctx, domains, cert)
+}
+
+// publishExternal makes an external cert the current cert of the pack
+// for domains and hands it to the store writer. Subscribers are woken
+// like on a renewal.
+func (s *CertDXServer) publishExternal(ctx context.Context, domains []string, cert CertT) error {
+	entry := s.certCache.use(domains)
+	entry.renewMu.Lock()
+	defer entry.renewMu.Unlock()
+
+	entry.stateMu.Lock()
+	persisted := entry.publishLocked(cert, entry.history, s.Config.CertStore.History)
+	entry.stateMu.Unlock()
+
+	select {
+	case s.storeUpdate <- persisted:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ImportToStore is Import for a server that isn't running: it writes the
+// cert straight into store, checking it against c's import roots and its
+// domains against c.
+func ImportToStore(ctx context.Context, store CertStore, c *config.ServerConfig, fullchain, key []byte) (*CertStoreEntry, error) {
+	roots, err := LoadImportRoots(c.CertStore.ImportRoots)
+	if err != nil {
+		return nil, err
+	}
+	cert, domains, err := ParseExternalCert(fullchain, key, roots)
+	if err != nil {
+		return nil, err
+	}
+	if !domain.AllAllowed(c.ACME.AllowedDomains, domains) {
+		return nil, fmt.Errorf("domains %v: %w", domains, domain.ErrNotAllowed)
+	}
+
+	entries, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list cert store: %w", err)
+	}
+	entry := &CertStoreEntry{Domains: domains}
+	for _, e := range entries {
+		if domain.AsKey(e.Domains) == domain.AsKey(domains) {
+			entry.History = pushHistory(e.History, e.Cert, c.CertStore.History)
+			break
+		}
+	}
+	entry.Cert = cert
+	entry.UpdatedAt = time.Now()
+
+	if err := store.SaveEntry(ctx, entry); err != nil {
+		return nil, fmt.Errorf("save imported cert: %w", err)
+	}
+	return entry, nil
+}
+
+// expiryWarning returns a warning for an external cert past the point
+// where an issued cert would have been renewed, or "" otherwise.
+func (s *CertDXServer) expiryWarning(c *certEntry, cert *CertT) string {
+	if !cert.External || cert.NotAfter.IsZero() {
+		return ""
+	}
+	_, acmeConfig := s.acmeFor(c)
+	if time.Now().Before(renewalTime(cert.NotBefore, cert.NotAfter, acmeConfig.RenewTimeLeftDuration)) {
+		return ""
+	}
+	return fmt.Sprintf("external cert %v expires at %s, import a replacement", c.domains, cert.NotAfter.Format(time.RFC3339))
+}
+
+// checkExternal stands in for the renewal of an imported cert: it warns
+// once the cert is due for replacement and fails once it expired.
+func (s *CertDXServer) checkExternal(c *certEntry, cert *CertT) error {
+	if !cert.usable() {
+		return fmt.Errorf("%v expired at %s: %w", c.domains, cert.NotAfter, ErrExternalExpired)
+	}
+	if msg := s.expiryWarning(c, cert); msg != "" {
+		logging.Warn("Cert check: %s", msg)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// testCA is the private root and intermediate makeExternalCert issues
+// from, created on first use.
+var testCA struct {
+	once     sync.Once
+	rootPEM  []byte
+	inter    *x509.Certificate
+	interPEM []byte
+	interKey *ecdsa.PrivateKey
+	serial   atomic.Int64
+}
+
+func signTestCert(t *testing.T, tmpl, parent *x509.Certificate, pub, signer any) *x509.Certificate {
+	t.Helper()
+	tmpl.SerialNumber = big.NewInt(testCA.serial.Add(1))
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	if err != nil {
+		t.Fatalf("sign %s: %v", tmpl.Subject.CommonName, err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse %s: %v", tmpl.Subject.CommonName, err)
+	}
+	return c
+}
+
+func initTestCA(t *testing.T) {
+	t.Helper()
+	testCA.once.Do(func() {
+		now := time.Now()
+		ca := func(name string) *x509.Certificate {
+			return &x509.Certificate{
+				Subject:               pkix.Name{CommonName: name},
+				NotBefore:             now.Add(-time.Hour),
+				NotAfter:              now.Add(365 * 24 * time.Hour),
+				IsCA:                  true,
+				KeyUsage:              x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+			}
+		}
+		rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rootTmpl := ca("certdx test root")
+		root := signTestCert(t, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+		testCA.interKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		testCA.inter = signTestCert(t, ca("certdx test intermediate"), root, &testCA.interKey.PublicKey, rootKey)
+		testCA.rootPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+		testCA.interPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCA.inter.Raw})
+	})
+}
+
+// makeExternalCert returns a chain of a leaf and the test intermediate,
+// and the leaf's key, for domains valid for lifetime from now.
+func makeExternalCert(t *testing.T, lifetime time.Duration, domains ...string) (fullchain, key []byte) {
+	t.Helper()
+	initTestCA(t)
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	now := time.Now()
+	leaf := signTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: domains[0]},
+		DNSNames:    domains,
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(lifetime),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, testCA.inter, &priv.PublicKey, testCA.interKey)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	fullchain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), testCA.interPEM...)
+	return fullchain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// trustTestCA makes s trust the test root as [CertStore].importRoots.
+func trustTestCA(t *testing.T, s *CertDXServer) {
+	t.Helper()
+	initTestCA(t)
+	path := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(path, testCA.rootPEM, 0o600); err != nil {
+		t.Fatalf("write roots: %v", err)
+	}
+	s.Config.CertStore.ImportRoots = []string{path}
+	roots, err := LoadImportRoots(s.Config.CertStore.ImportRoots)
+	if err != nil {
+		t.Fatalf("LoadImportRoots: %v", err)
+	}
+	s.importRoots = roots
+}
+
+func TestParseExternalCert(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com", "www.example.com")
+	cert, domains, err := ParseExternalCert(chain, key, s.importRoots)
+	if err != nil {
+		t.Fatalf("ParseExternalCert: %v", err)
+	}
+	if domain.AsKey(domains) != domain.AsKey([]string{"example.com", "www.example.com"}) {
+		t.Fatalf("domains from SANs: got %v", domains)
+	}
+	if !cert.External || cert.Serial == "" || !cert.ValidBefore.Equal(cert.NotAfter) {
+		t.Fatalf("unexpected cert: %+v", cert)
+	}
+
+	_, otherKey := makeExternalCert(t, 24*time.Hour, "example.com")
+	selfSigned, selfSignedKey, err := acme.NewMockACME(24*time.Hour).Obtain(context.Background(), []string{"example.com"}, time.Time{})
+	if err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+	leafOnly, _ := pem.Decode(chain)
+	for name, c := range map[string]struct{ chain, key []byte }{
+		"mismatched key":       {chain, otherKey},
+		"self-signed":          {selfSigned, selfSignedKey},
+		"missing intermediate": {pem.EncodeToMemory(leafOnly), key},
+		"garbage":              {[]byte("chain"), []byte("key")},
+	} {
+		if _, _, err := ParseExternalCert(c.chain, c.key, s.importRoots); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("%s: got %v, want ErrInvalidImport", name, err)
+		}
+	}
+
+	// The private root isn't among the system roots.
+	if _, _, err := ParseExternalCert(chain, key, nil); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("untrusted root: got %v, want ErrInvalidImport", err)
+	}
+}
+
+func TestImportServedAndNotRenewed(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	entry := s.certCache.get([]string{"example.com"})
+	forceRenew(t, s, entry)
+	issued := entry.Cert()
+
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, version := entry.Snapshot()
+	go func() {
+		<-s.storeUpdate
+	}()
+	if _, current, err := s.Import(ctx, chain, key); err != nil || !current.External {
+		t.Fatalf("Import: %+v, %v", current, err)
+	}
+	if entry.WaitForUpdate(ctx, version) == version {
+		t.Fatal("subscribers not notified of the import")
+	}
+
+	got := entry.Cert()
+	if !bytes.Equal(got.FullChain, chain) || !got.IsValid() {
+		t.Fatal("imported cert not served")
+	}
+	h, err := s.History(entry.domains)
+	if err != nil || len(h) != 2 || h[1].Serial != issued.Serial {
+		t.Fatalf("issued cert not kept in history: %+v, %v", h, err)
+	}
+
+	// The renewer leaves the imported cert alone even when asked.
+	if renewed, err := s.renew(ctx, entry, false); renewed || err != nil {
+		t.Fatalf("renew of external cert: %v, %v", renewed, err)
+	}
+	if !bytes.Equal(entry.Cert().FullChain, chain) {
+		t.Fatal("external cert replaced by renewal")
+	}
+}
+
+func TestImportDomainsNotAllowed(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	chain, key := makeExternalCert(t, 24*time.Hour, "other.org")
+	if _, _, err := s.Import(context.Background(), chain, key); !errors.Is(err, domain.ErrNotAllowed) {
+		t.Fatalf("got %v, want ErrNotAllowed", err)
+	}
+}
+
+func TestExternalExpiryWarning(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	entry := s.certCache.get([]string{"example.com"})
+
+	// RenewTimeLeft is 1h: a day-long cert with 30m left is past its
+	// renewal point.
+	now := time.Now()
+	for _, c := range []struct {
+		left time.Duration
+		warn bool
+	}{{12 * time.Hour, false}, {30 * time.Minute, true}} {
+		cert := CertT{External: true, NotBefore: now.Add(c.left - 24*time.Hour), NotAfter: now.Add(c.left)}
+		if got := s.expiryWarning(entry, &cert) != ""; got != c.warn {
+			t.Errorf("%s left: warning %v, want %v", c.left, got, c.warn)
+		}
+	}
+
+	expired := CertT{External: true, NotAfter: time.Now().Add(-time.Minute)}
+	if err := s.checkExternal(entry, &expired); !errors.Is(err, ErrExternalExpired) {
+		t.Fatalf("got %v, want ErrExternalExpired", err)
+	}
+}
+
+func TestEvictIdleKeepsExternal(t *testing.T) {
+	s := makeIdleTestServer(t, time.Hour)
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	go func() {
+		<-s.storeUpdate
+	}()
+	domains, _, err := s.Import(context.Background(), chain, key)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	markIdle(s, s.certCache.get(domains))
+	s.evictIdle(context.Background())
+	if !cached(s, domains) {
+		t.Fatal("imported cert evicted")
+	}
+}
+
+func TestAdminImport(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.AdminServer.Token = "admin"
+	go func() {
+		<-s.storeUpdate
+	}()
+
+	post := func(req api.AdminImportReq) (int, api.AdminImportResp) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		w := adminDo(t, s, "POST", api.AdminImportPath, string(body))
+		var resp api.AdminImportResp
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	code, resp := post(api.AdminImportReq{FullChain: chain, Key: key})
+	if code != http.StatusOK || !resp.Current.External || resp.Current.Serial == "" {
+		t.Fatalf("unexpected response: %d %+v", code, resp)
+	}
+
+	_, otherKey := makeExternalCert(t, 24*time.Hour, "example.com")
+	if code, _ := post(api.AdminImportReq{FullChain: chain, Key: otherKey}); code != http.StatusBadRequest {
+		t.Fatalf("mismatched key: got %d", code)
+	}
+	other, otherOrgKey := makeExternalCert(t, 24*time.Hour, "other.org")
+	if code, _ := post(api.AdminImportReq{FullChain: other, Key: otherOrgKey}); code != http.StatusForbidden {
+		t.Fatalf("disallowed domains: got %d", code)
+	}
+}
+
+func TestImportToStore(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	store := makeTempCertStore(t)
+
+	first, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	if _, err := ImportToStore(ctx, store, &s.Config, first, key); err != nil {
+		t.Fatalf("ImportToStore: %v", err)
+	}
+	second, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	if _, err := ImportToStore(ctx, store, &s.Config, second, key); err != nil {
+		t.Fatalf("ImportToStore: %v", err)
+	}
+
+	entries, err := makeReloadedStore(t, store.path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	e := findEntry(entries, []string{"example.com"})
+	if e == nil || !bytes.Equal(e.Cert.FullChain, second) || !e.Cert.External {
+		t.Fatalf("imported cert not stored: %+v", e)
+	}
+	if len(e.History) != 1 || !bytes.Equal(e.History[0].FullChain, first) {
+		t.Fatalf("replaced import not kept in history: %+v", e.History)
+	}
+}
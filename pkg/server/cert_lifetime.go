@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// renewLifetimeFraction is the share of a cert's lifetime after which it
+// is due for renewal, unless ACME.renewTimeLeft asks for an earlier one.
+const renewLifetimeFraction = 2.0 / 3
+
+// parseLeaf returns the first certificate in a PEM chain.
+func parseLeaf(fullchain []byte) (*x509.Certificate, error) {
+	rest := fullchain
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in chain")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// fillMetadata records the leaf's serial, issuer and validity period on
+// c. It reports whether anything was recorded; a chain that doesn't
+// parse leaves c unchanged.
+func (c *CertT) fillMetadata() bool {
+	if !c.NotBefore.IsZero() || len(c.FullChain) == 0 {
+		return false
+	}
+	leaf, err := parseLeaf(c.FullChain)
+	if err != nil {
+		logging.Debug("Parse leaf certificate failed: %s", err)
+		return false
+	}
+	c.Serial = leaf.SerialNumber.Text(16)
+	c.Issuer = leaf.Issuer.String()
+	c.NotBefore = leaf.NotBefore
+	c.NotAfter = leaf.NotAfter
+	return true
+}
+
+// notAfter returns the leaf's NotAfter, parsing the chain when it wasn't
+// recorded. It is zero when the chain doesn't parse.
+func (c *CertT) notAfter() time.Time {
+	if !c.NotAfter.IsZero() {
+		return c.NotAfter
+	}
+	leaf, err := parseLeaf(c.FullChain)
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
+
+// usable reports whether c can still be served: before its leaf's
+// NotAfter, or before ValidBefore when the chain doesn't parse. A cert
+// that is due for renewal is usually still usable.
+func (c *CertT) usable() bool {
+	notAfter := c.notAfter()
+	if notAfter.IsZero() {
+		return c.IsValid()
+	}
+	return time.Now().Before(notAfter)
+}
+
+// Expired reports whether c can no longer be served.
+func (c *CertT) Expired() bool {
+	return !c.usable()
+}
+
+// renewalTime returns when a cert valid from notBefore to notAfter falls
+// due: after renewLifetimeFraction of its lifetime, or renewTimeLeft
+// before it expires if that is earlier. A renewTimeLeft longer than half
+// the lifetime is ignored, so a fresh cert is never due right away.
+func renewalTime(notBefore, notAfter time.Time, renewTimeLeft time.Duration) time.Time {
+	lifetime := notAfter.Sub(notBefore)
+	ret := notBefore.Add(time.Duration(float64(lifetime) * renewLifetimeFraction))
+	if early := notAfter.Add(-renewTimeLeft); early.Before(ret) {
+		ret = early
+	}
+	if half := notBefore.Add(lifetime / 2); ret.Before(half) {
+		ret = half
+	}
+	return ret
+}
+
+// schedule sets ValidBefore from the leaf's validity period. It leaves c
+// unchanged when the period wasn't recorded.
+func (c *CertT) schedule(renewTimeLeft time.Duration) {
+	if c.NotBefore.IsZero() || c.NotAfter.IsZero() {
+		return
+	}
+	c.ValidBefore = renewalTime(c.NotBefore, c.NotAfter, renewTimeLeft)
+}
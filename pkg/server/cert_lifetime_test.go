@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/acme"
+)
+
+func TestRenewalTime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	cases := []struct {
+		name          string
+		lifetime      time.Duration
+		renewTimeLeft time.Duration
+		want          time.Duration
+	}{
+		{"90 days renews at two thirds", 90 * day, day, 60 * day},
+		{"renewTimeLeft earlier than two thirds", 9 * day, 4 * day, 5 * day},
+		{"renewTimeLeft past half the lifetime", 30 * time.Second, 20 * time.Second, 15 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := renewalTime(start, start.Add(tc.lifetime), tc.renewTimeLeft)
+			if want := start.Add(tc.want); !got.Equal(want) {
+				t.Fatalf("renewalTime = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRenewSchedulesFromLeaf(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	// The CA ignores the requested lifetime and issues 9h certs.
+	s.acme = acme.NewMockACME(9 * time.Hour)
+	entry := s.certCache.get([]string{"example.com"})
+
+	forceRenew(t, s, entry)
+	cert := entry.Cert()
+	// The mock backdates NotBefore by a minute, as CAs do.
+	lifetime := 9*time.Hour + time.Minute
+	if cert.NotBefore.IsZero() || cert.NotAfter.Sub(cert.NotBefore) != lifetime {
+		t.Fatalf("validity period not recorded: %s - %s", cert.NotBefore, cert.NotAfter)
+	}
+	if want := cert.NotBefore.Add(lifetime * 2 / 3); !cert.ValidBefore.Equal(want) {
+		t.Fatalf("ValidBefore = %s, want %s", cert.ValidBefore, want)
+	}
+}
+
+func TestLoadCertStoreMigratesLegacyEntry(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	fullchain, key, err := acme.NewMockACME(9*time.Hour).Obtain(ctx, []string{"example.com"}, time.Time{})
+	if err != nil {
+		t.Fatalf("Obtain: %v", err)
+	}
+
+	// A pre-metadata entry whose ValidBefore assumed a 1h lifetime.
+	store := makeTempCertStore(t)
+	legacy := &CertStoreEntry{
+		Domains: []string{"example.com"},
+		Cert: CertT{
+			FullChain:   fullchain,
+			Key:         key,
+			ValidBefore: time.Now().Add(-time.Minute),
+			RenewAt:     time.Now().Add(-time.Hour),
+		},
+	}
+	if err := store.SaveEntry(ctx, legacy); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	s.certStore = makeReloadedStore(t, store.path)
+	if err := s.loadCertStore(); err != nil {
+		t.Fatalf("loadCertStore: %v", err)
+	}
+
+	cert := s.certCache.get(legacy.Domains).Cert()
+	if cert.NotAfter.IsZero() || !cert.IsValid() {
+		t.Fatalf("legacy entry not rescheduled: %+v", cert)
+	}
+
+	stored, err := makeReloadedStore(t, store.path).List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := findEntry(stored, legacy.Domains); got == nil || !got.Cert.ValidBefore.Equal(cert.ValidBefore) {
+		t.Fatalf("migrated entry not persisted: %+v", got)
+	}
+}
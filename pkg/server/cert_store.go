@@ -1,113 +1,228 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
+	"pkg.para.party/certdx/pkg/config"
 	"pkg.para.party/certdx/pkg/domain"
 	"pkg.para.party/certdx/pkg/logging"
-	"pkg.para.party/certdx/pkg/paths"
 )
 
-type certStoreEntry struct {
-	Domains []string `json:"domains"`
-	Cert    CertT    `json:"cert"`
+// certStoreWatchInterval is how often the polling Watch implementations
+// re-read the backing store looking for changes made by another process.
+const certStoreWatchInterval = 10 * time.Second
+
+// CertStoreEntry is one persisted cert pack: the domain set it was
+// issued for, the current cert, and the previous certs retained for
+// rollback (newest first). UpdatedAt is when the server last changed the
+// pack; backends shared between servers use it to keep the newer write.
+// RequestedAt is set by a follower asking the leader to issue or renew
+// the pack (see requestRenewal). Owner is the client that brought the
+// pack into the cache, which [Quota] maxPacksPerClient counts it against.
+type CertStoreEntry struct {
+	Domains     []string  `json:"domains"`
+	Cert        CertT     `json:"cert"`
+	History     []CertT   `json:"history,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt,omitzero"`
+	RequestedAt time.Time `json:"requestedAt,omitzero"`
+	Owner       string    `json:"owner,omitempty"`
 }
 
-// CertStore handles persistent storage of obtained certificates as the
-// server's cache.json file.
-type CertStore struct {
-	path    string
-	entries map[domain.Key]*certStoreEntry
-	update  chan *certStoreEntry
-}
-
-// NewCertStore constructs a CertStore backed by the default cache.json path.
-func NewCertStore() (CertStore, error) {
-	path, err := paths.ServerCachePath()
-	if err != nil {
-		return CertStore{}, fmt.Errorf("resolve cert store path: %w", err)
+// changedAt is when the entry was last changed, falling back to the
+// cert's RenewAt for entries written before UpdatedAt was recorded.
+func (e *CertStoreEntry) changedAt() time.Time {
+	if !e.UpdatedAt.IsZero() {
+		return e.UpdatedAt
 	}
-	return CertStore{
-		path:    path,
-		entries: make(map[domain.Key]*certStoreEntry),
-		update:  make(chan *certStoreEntry, 10),
-	}, nil
+	return e.Cert.RenewAt
 }
 
-// Load reads and unmarshals the persisted certificate store. It returns
-// os.ErrNotExist when the backing file hasn't been created yet.
-// Expired certificates are discarded and domain keys are re-generated
-// so that entries written by a previous key algorithm are migrated.
-func (s *CertStore) Load() error {
-	if !paths.FileExists(s.path) {
-		return os.ErrNotExist
-	}
+// CertStoreEvent reports a change to one persisted entry observed by
+// Watch. Entry is nil when the entry was deleted.
+type CertStoreEvent struct {
+	Key   domain.Key
+	Entry *CertStoreEntry
+}
 
-	cfile, err := os.ReadFile(s.path)
-	if err != nil {
-		return fmt.Errorf("opening cert store: %w", err)
-	}
+// CertStore handles persistent storage of obtained certificates. The
+// server writes every renewal through SaveEntry and reloads the store
+// on startup through Load.
+//
+// Implementations must be safe for concurrent use.
+type CertStore interface {
+	// Load returns every persisted entry whose cert is still valid. It
+	// returns os.ErrNotExist when the backing store hasn't been created
+	// yet. Entries without a usable cert are skipped. The JSON store
+	// drops them on its next write; the stores that servers share keep
+	// them, as they may carry another server's renewal request.
+	Load(ctx context.Context) ([]*CertStoreEntry, error)
+
+	// SaveEntry persists entry, replacing any entry for the same domain
+	// set.
+	SaveEntry(ctx context.Context, entry *CertStoreEntry) error
+
+	// Delete removes the entry for domains. Deleting an entry that does
+	// not exist is not an error.
+	Delete(ctx context.Context, domains []string) error
+
+	// List returns every persisted entry, including expired ones.
+	List(ctx context.Context) ([]*CertStoreEntry, error)
+
+	// Watch reports changes to the store, including ones made by other
+	// processes sharing the same backing storage. The channel is closed
+	// when ctx is done.
+	Watch(ctx context.Context) (<-chan CertStoreEvent, error)
+
+	// Close releases any resource held by the store.
+	Close() error
+}
 
-	var raw map[domain.Key]*certStoreEntry
-	if err := json.Unmarshal(cfile, &raw); err != nil {
-		return fmt.Errorf("unmarshaling cert store: %w", err)
+// NewCertStore constructs the CertStore backend selected by c. An empty
+// Type selects the JSON file backend.
+func NewCertStore(c *config.CertStoreConfig) (CertStore, error) {
+	switch c.Type {
+	case config.CertStoreTypeJSON, "":
+		return NewJSONCertStore(c.Path)
+	case config.CertStoreTypeSQLite:
+		return NewSQLiteCertStore(c.Path)
+	case config.CertStoreTypeS3:
+		return NewS3CertStore(c)
+	default:
+		return nil, fmt.Errorf("unsupported cert store type: %q", c.Type)
 	}
+}
 
+// validEntries drops entries holding an expired cert and re-keys the rest
+// by their current domain key. Shared by the Load implementations.
+func validEntries(raw []*CertStoreEntry) map[domain.Key]*CertStoreEntry {
+	ret := make(map[domain.Key]*CertStoreEntry, len(raw))
 	for _, entry := range raw {
-		if !entry.Cert.IsValid() {
+		if !entry.Cert.usable() {
 			logging.Info("Discarding expired cert for domains: %v", entry.Domains)
 			continue
 		}
-		s.entries[domain.AsKey(entry.Domains)] = entry
+		ret[domain.AsKey(entry.Domains)] = entry
 	}
-
-	return nil
+	return ret
 }
 
-func (s *CertStore) save() error {
-	jsonBytes, err := json.Marshal(s.entries)
-	if err != nil {
-		return fmt.Errorf("marshal cert store: %w", err)
-	}
+// PrintCertInfo prints a human-readable summary of entries to stdout.
+// Used by certdx_tools show-certs.
+func PrintCertInfo(entries []*CertStoreEntry) {
+	fmt.Println()
 
-	if err := os.WriteFile(s.path, jsonBytes, 0o600); err != nil {
-		return fmt.Errorf("write cert store: %w", err)
+	if len(entries) == 0 {
+		fmt.Println("No valid cert in cache")
+		return
 	}
 
-	return nil
+	for _, cert := range entries {
+		fmt.Printf("\nDomains:     %s\nRenewAt:     %s\nValidBefore: %s\n", strings.Join(cert.Domains, ", "), cert.Cert.RenewAt, cert.Cert.ValidBefore)
+		if !cert.Cert.NotAfter.IsZero() {
+			fmt.Printf("NotBefore:   %s\nNotAfter:    %s\nSerial:      %s\nIssuer:      %s\n", cert.Cert.NotBefore, cert.Cert.NotAfter, cert.Cert.Serial, cert.Cert.Issuer)
+		}
+		if cert.Cert.External {
+			fmt.Println("Source:      external (imported, not renewed)")
+		}
+	}
 }
 
-func (s *CertStore) saveEntry(fe *certStoreEntry) error {
-	s.entries[domain.AsKey(fe.Domains)] = fe
-	return s.save()
+// sameCert reports whether a and b hold the same certificate material.
+func sameCert(a, b *CertStoreEntry) bool {
+	return bytes.Equal(a.Cert.FullChain, b.Cert.FullChain) && bytes.Equal(a.Cert.Key, b.Cert.Key)
 }
 
-func (s *CertStore) PrintCertInfo() {
-	fmt.Println()
-
-	if len(s.entries) == 0 {
-		fmt.Println("No valid cert in cache")
-		return
+// pollWatch implements CertStore.Watch for backends that can't push
+// change notifications: it calls list every interval and diffs the
+// result against the previous round. The baseline is taken before
+// pollWatch returns, so entries that existed when Watch was called are
+// not reported.
+func pollWatch(ctx context.Context, interval time.Duration,
+	list func(ctx context.Context) ([]*CertStoreEntry, error)) <-chan CertStoreEvent {
+
+	events := make(chan CertStoreEvent)
+
+	snapshot := func() (map[domain.Key]*CertStoreEntry, bool) {
+		entries, err := list(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.Warn("Watch cert store failed: %s", err)
+			}
+			return nil, false
+		}
+		ret := make(map[domain.Key]*CertStoreEntry, len(entries))
+		for _, e := range entries {
+			ret[domain.AsKey(e.Domains)] = e
+		}
+		return ret, true
 	}
 
-	for _, cert := range s.entries {
-		fmt.Printf("\nDomains:     %s\nRenewAt:     %s\nValidBefore: %s\n", strings.Join(cert.Domains, ", "), cert.Cert.RenewAt, cert.Cert.ValidBefore)
+	// Take the baseline before returning so a change made right after
+	// Watch returns is never folded into it.
+	last, _ := snapshot()
+	if last == nil {
+		last = map[domain.Key]*CertStoreEntry{}
 	}
+
+	go func() {
+		defer close(events)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+
+			current, ok := snapshot()
+			if !ok {
+				continue
+			}
+
+			var changed []CertStoreEvent
+			for key, entry := range current {
+				if prev, ok := last[key]; !ok || !sameCert(prev, entry) || !prev.RequestedAt.Equal(entry.RequestedAt) {
+					changed = append(changed, CertStoreEvent{Key: key, Entry: entry})
+				}
+			}
+			for key := range last {
+				if _, ok := current[key]; !ok {
+					changed = append(changed, CertStoreEvent{Key: key})
+				}
+			}
+			last = current
+
+			for _, ev := range changed {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events
 }
 
-// listenUpdate drains the cert-store update queue, persisting each renewed cert
-// to disk. When ctx fires, it drains any updates already in the buffered
-// channel before exiting so a renewal that landed right at shutdown is
-// not silently dropped.
-func (s *CertStore) listenUpdate(ctx context.Context) {
-	persist := func(fe *certStoreEntry) {
-		logging.Info("Update domains cache to file")
-		if err := s.saveEntry(fe); err != nil {
-			logging.Warn("Update domains cache to file failed: %s", err)
+// listenUpdate drains the cert-store update queue, persisting each renewed
+// cert to store. When ctx fires, it drains any updates already in the
+// buffered channel before exiting so a renewal that landed right at
+// shutdown is not silently dropped.
+//
+// Persisting is bounded by a fresh context rather than ctx: by the time
+// the drain runs ctx is already done, and the write still has to land.
+func listenUpdate(ctx context.Context, store CertStore, update <-chan *CertStoreEntry) {
+	persist := func(fe *CertStoreEntry) {
+		logging.Info("Update domains cache to store")
+		if err := store.SaveEntry(context.Background(), fe); err != nil {
+			logging.Warn("Update domains cache to store failed: %s", err)
 		}
 	}
 
@@ -117,13 +232,13 @@ func (s *CertStore) listenUpdate(ctx context.Context) {
 			// Drain whatever's already queued before exiting.
 			for {
 				select {
-				case fe := <-s.update:
+				case fe := <-update:
 					persist(fe)
 				default:
 					return
 				}
 			}
-		case fe := <-s.update:
+		case fe := <-update:
 			persist(fe)
 		}
 	}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// encryptedCertStore seals each entry's private key before it reaches
+// the backend and opens it on the way out, so every backend gets
+// encryption at rest without knowing about it. Only Cert.Key is sealed;
+// the chain and the dates stay readable for show-certs and the backends'
+// expiry handling.
+type encryptedCertStore struct {
+	CertStore
+
+	// keys is nil when encryption is disabled. The wrapper is still
+	// installed then, so a store that was encrypted earlier is detected
+	// instead of served as garbage.
+	keys encryption.KeyProvider
+}
+
+// NewEncryptedCertStore wraps inner so private keys are sealed under
+// keys. With a nil keys, plaintext passes through unchanged and reading
+// a sealed entry fails with encryption.ErrNoKey.
+func NewEncryptedCertStore(inner CertStore, keys encryption.KeyProvider) CertStore {
+	return &encryptedCertStore{CertStore: inner, keys: keys}
+}
+
+// OpenCertStore constructs the cert store configured in c with private
+// keys sealed under keys, the provider built from c.Encryption.
+func OpenCertStore(c *config.ServerConfig, keys encryption.KeyProvider) (CertStore, error) {
+	inner, err := NewCertStore(&c.CertStore)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedCertStore(inner, keys), nil
+}
+
+// mapKeys returns a copy of fe with f applied to the private key of the
+// current cert and of every retained history version.
+func mapKeys(fe *CertStoreEntry, f func(key []byte) ([]byte, error)) (*CertStoreEntry, error) {
+	ret := *fe
+	var err error
+	if ret.Cert.Key, err = f(fe.Cert.Key); err != nil {
+		return nil, err
+	}
+	if fe.History != nil {
+		ret.History = make([]CertT, len(fe.History))
+		for i, c := range fe.History {
+			ret.History[i] = c
+			if ret.History[i].Key, err = f(c.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &ret, nil
+}
+
+// hasPlaintextKey reports whether any private key in fe is unsealed.
+func hasPlaintextKey(fe *CertStoreEntry) bool {
+	if len(fe.Cert.Key) != 0 && !encryption.IsSealed(fe.Cert.Key) {
+		return true
+	}
+	for _, c := range fe.History {
+		if len(c.Key) != 0 && !encryption.IsSealed(c.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *encryptedCertStore) open(ctx context.Context, fe *CertStoreEntry) (*CertStoreEntry, error) {
+	ret, err := mapKeys(fe, func(key []byte) ([]byte, error) {
+		return encryption.Open(ctx, s.keys, key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open cert store entry %v: %w", fe.Domains, err)
+	}
+	return ret, nil
+}
+
+// Load opens every entry and, when encryption is enabled, first migrates
+// the store, so existing stores are encrypted on the first start with a
+// key configured.
+func (s *encryptedCertStore) Load(ctx context.Context) ([]*CertStoreEntry, error) {
+	entries, err := s.CertStore.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.keys != nil {
+		if err := s.migrate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]*CertStoreEntry, 0, len(entries))
+	for _, fe := range entries {
+		opened, err := s.open(ctx, fe)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, opened)
+	}
+	return ret, nil
+}
+
+// migrate re-saves every entry still holding a plaintext key. It goes
+// through List rather than Load, so entries with an expired cert, which
+// Load skips, are sealed too.
+func (s *encryptedCertStore) migrate(ctx context.Context) error {
+	entries, err := s.CertStore.List(ctx)
+	if err != nil {
+		return fmt.Errorf("list cert store: %w", err)
+	}
+	for _, fe := range entries {
+		if !hasPlaintextKey(fe) {
+			continue
+		}
+		logging.Info("Encrypting cert store entry for domains: %v", fe.Domains)
+		if err := s.SaveEntry(ctx, fe); err != nil {
+			return fmt.Errorf("encrypt cert store entry %v: %w", fe.Domains, err)
+		}
+	}
+	return nil
+}
+
+func (s *encryptedCertStore) SaveEntry(ctx context.Context, fe *CertStoreEntry) error {
+	if s.keys == nil || !hasPlaintextKey(fe) {
+		return s.CertStore.SaveEntry(ctx, fe)
+	}
+
+	sealed, err := mapKeys(fe, func(key []byte) ([]byte, error) {
+		if len(key) == 0 || encryption.IsSealed(key) {
+			return key, nil
+		}
+		return encryption.Seal(ctx, s.keys, key)
+	})
+	if err != nil {
+		return fmt.Errorf("encrypt cert store entry %v: %w", fe.Domains, err)
+	}
+	return s.CertStore.SaveEntry(ctx, sealed)
+}
+
+func (s *encryptedCertStore) List(ctx context.Context) ([]*CertStoreEntry, error) {
+	entries, err := s.CertStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*CertStoreEntry, 0, len(entries))
+	for _, fe := range entries {
+		opened, err := s.open(ctx, fe)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, opened)
+	}
+	return ret, nil
+}
+
+func (s *encryptedCertStore) Watch(ctx context.Context) (<-chan CertStoreEvent, error) {
+	inner, err := s.CertStore.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan CertStoreEvent)
+	go func() {
+		defer close(events)
+		for ev := range inner {
+			if ev.Entry != nil {
+				opened, err := s.open(ctx, ev.Entry)
+				if err != nil {
+					logging.Warn("Watch cert store: %s", err)
+					continue
+				}
+				ev.Entry = opened
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// RewrapCertStore re-wraps the data key of every private key in store
+// from one KEK to another, sealing plaintext keys under to. store must be
+// the raw backend from NewCertStore, not the encrypting wrapper. It
+// returns the number of entries rewritten. Used by certdx_tools
+// rotate-encryption-key.
+func RewrapCertStore(ctx context.Context, store CertStore, from, to encryption.KeyProvider) (int, error) {
+	entries, err := store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, fe := range entries {
+		rewrapped, err := mapKeys(fe, func(key []byte) ([]byte, error) {
+			if len(key) == 0 {
+				return key, nil
+			}
+			return encryption.Rewrap(ctx, from, to, key)
+		})
+		if err != nil {
+			return n, fmt.Errorf("rewrap cert store entry %v: %w", fe.Domains, err)
+		}
+		if err := store.SaveEntry(ctx, rewrapped); err != nil {
+			return n, fmt.Errorf("save cert store entry %v: %w", fe.Domains, err)
+		}
+		n++
+	}
+	return n, nil
+}
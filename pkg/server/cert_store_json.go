@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+// JSONCertStore is the CertStore backed by a single JSON file, by
+// default the server's cache.json. Every write rewrites the whole file.
+type JSONCertStore struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[domain.Key]*CertStoreEntry
+	loaded  bool
+}
+
+// NewJSONCertStore constructs a JSONCertStore backed by path, or by the
+// default cache.json path when path is empty.
+func NewJSONCertStore(path string) (*JSONCertStore, error) {
+	if path == "" {
+		var err error
+		path, err = paths.ServerCachePath()
+		if err != nil {
+			return nil, fmt.Errorf("resolve cert store path: %w", err)
+		}
+	}
+	return &JSONCertStore{
+		path:    path,
+		entries: make(map[domain.Key]*CertStoreEntry),
+	}, nil
+}
+
+// readFile reads and unmarshals the backing file. It returns
+// os.ErrNotExist when the file hasn't been created yet.
+func (s *JSONCertStore) readFile() (map[domain.Key]*CertStoreEntry, error) {
+	if !paths.FileExists(s.path) {
+		return nil, os.ErrNotExist
+	}
+
+	cfile, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("opening cert store: %w", err)
+	}
+
+	var raw map[domain.Key]*CertStoreEntry
+	if err := json.Unmarshal(cfile, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshaling cert store: %w", err)
+	}
+	return raw, nil
+}
+
+// ensureLoadedLocked seeds the in-memory mirror from disk before the
+// first write, so a store that was never Loaded doesn't clobber entries
+// already on disk. Callers hold mu.
+func (s *JSONCertStore) ensureLoadedLocked() error {
+	if s.loaded {
+		return nil
+	}
+	raw, err := s.readFile()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range raw {
+		s.entries[domain.AsKey(entry.Domains)] = entry
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *JSONCertStore) Load(_ context.Context) ([]*CertStoreEntry, error) {
+	raw, err := s.readFile()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*CertStoreEntry, 0, len(raw))
+	for _, entry := range raw {
+		entries = append(entries, entry)
+	}
+	valid := validEntries(entries)
+
+	s.mu.Lock()
+	s.entries = valid
+	s.loaded = true
+	s.mu.Unlock()
+
+	ret := make([]*CertStoreEntry, 0, len(valid))
+	for _, entry := range valid {
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func (s *JSONCertStore) saveLocked() error {
+	jsonBytes, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("marshal cert store: %w", err)
+	}
+
+	if err := os.WriteFile(s.path, jsonBytes, 0o600); err != nil {
+		return fmt.Errorf("write cert store: %w", err)
+	}
+
+	return nil
+}
+
+func (s *JSONCertStore) SaveEntry(_ context.Context, fe *CertStoreEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureLoadedLocked(); err != nil {
+		return err
+	}
+	s.entries[domain.AsKey(fe.Domains)] = fe
+	return s.saveLocked()
+}
+
+func (s *JSONCertStore) Delete(_ context.Context, domains []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureLoadedLocked(); err != nil {
+		return err
+	}
+	key := domain.AsKey(domains)
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.saveLocked()
+}
+
+func (s *JSONCertStore) List(_ context.Context) ([]*CertStoreEntry, error) {
+	raw, err := s.readFile()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ret := make([]*CertStoreEntry, 0, len(raw))
+	for _, entry := range raw {
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func (s *JSONCertStore) Watch(ctx context.Context) (<-chan CertStoreEvent, error) {
+	return pollWatch(ctx, certStoreWatchInterval, s.List), nil
+}
+
+func (s *JSONCertStore) Close() error {
+	return nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	s3provider "pkg.para.party/certdx/pkg/acme/challengeproviders/s3"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+const (
+	// s3PutAttempts bounds how many times SaveEntry re-reads and retries
+	// after losing a conditional-write race to another server.
+	s3PutAttempts = 5
+
+	s3ObjectSuffix = ".json"
+
+	s3MetaDomains     = "domains"
+	s3MetaValidBefore = "valid-before"
+)
+
+// s3Object caches one object's last observed ETag and decoded entry so
+// List only downloads objects whose ETag changed.
+type s3Object struct {
+	etag  string
+	entry *CertStoreEntry
+}
+
+// S3CertStore is the CertStore backed by an S3-compatible bucket. Each
+// cert pack is one object named <prefix><domain key>.json, carrying the
+// pack's domains and expiry as object metadata. Writes are conditional
+// on the ETag last read, so several stateless servers sharing a bucket
+// never clobber each other's renewals.
+type S3CertStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+
+	mu      sync.Mutex
+	objects map[string]s3Object
+}
+
+// NewS3CertStore constructs an S3CertStore for the bucket in c.S3.
+func NewS3CertStore(c *config.CertStoreConfig) (*S3CertStore, error) {
+	if c.S3 == nil || c.S3.Bucket == "" {
+		return nil, fmt.Errorf("s3 cert store: bucket is required")
+	}
+	client, err := s3provider.NewClient(*c.S3, s3provider.ChecksumsWhenRequired)
+	if err != nil {
+		return nil, fmt.Errorf("s3 cert store: %w", err)
+	}
+	return newS3CertStore(client, c.S3.Bucket, c.Prefix), nil
+}
+
+func newS3CertStore(client *s3.Client, bucket, prefix string) *S3CertStore {
+	return &S3CertStore{
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+		objects: make(map[string]s3Object),
+	}
+}
+
+func (s *S3CertStore) objectKey(k domain.Key) string {
+	return s.prefix + formatDomainKey(k) + s3ObjectSuffix
+}
+
+func s3StatusCode(err error) int {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// isS3ConditionFailed reports whether err is a lost conditional write:
+// 412 when the ETag precondition didn't hold, 409 when a concurrent
+// conditional write to the same key was in flight.
+func isS3ConditionFailed(err error) bool {
+	code := s3StatusCode(err)
+	return code == http.StatusPreconditionFailed || code == http.StatusConflict
+}
+
+// get downloads and decodes one object. It returns a nil entry and no
+// error when the object doesn't exist.
+func (s *S3CertStore) get(ctx context.Context, key string) (*CertStoreEntry, string, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if s3StatusCode(err) == http.StatusNotFound {
+			s.forget(key)
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("get %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", key, err)
+	}
+	entry := new(CertStoreEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, "", fmt.Errorf("unmarshaling %s: %w", key, err)
+	}
+
+	etag := aws.ToString(out.ETag)
+	s.remember(key, etag, entry)
+	return entry, etag, nil
+}
+
+// put writes fe to key. With a non-empty etag the write only succeeds if
+// the object still has that ETag; with an empty one it only succeeds if
+// the object doesn't exist yet.
+func (s *S3CertStore) put(ctx context.Context, key string, fe *CertStoreEntry, etag string) error {
+	data, err := json.Marshal(fe)
+	if err != nil {
+		return fmt.Errorf("marshal cert store entry: %w", err)
+	}
+
+	in := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+		Metadata: map[string]string{
+			s3MetaDomains:     strings.Join(fe.Domains, ","),
+			s3MetaValidBefore: fe.Cert.ValidBefore.UTC().Format(time.RFC3339),
+		},
+	}
+	if etag != "" {
+		in.IfMatch = aws.String(etag)
+	} else {
+		in.IfNoneMatch = aws.String("*")
+	}
+
+	out, err := s.client.PutObject(ctx, in)
+	if err != nil {
+		return err
+	}
+	s.remember(key, aws.ToString(out.ETag), fe)
+	return nil
+}
+
+func (s *S3CertStore) remove(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && s3StatusCode(err) != http.StatusNotFound {
+		return fmt.Errorf("delete %s: %w", key, err)
+	}
+	s.forget(key)
+	return nil
+}
+
+func (s *S3CertStore) remember(key, etag string, entry *CertStoreEntry) {
+	s.mu.Lock()
+	s.objects[key] = s3Object{etag: etag, entry: entry}
+	s.mu.Unlock()
+}
+
+func (s *S3CertStore) forget(key string) {
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+}
+
+// listKeys returns the ETag of every cert object under prefix.
+func (s *S3CertStore) listKeys(ctx context.Context) (map[string]string, error) {
+	ret := map[string]string{}
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list s3 cert store: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if !strings.HasSuffix(key, s3ObjectSuffix) {
+				continue
+			}
+			ret[key] = aws.ToString(obj.ETag)
+		}
+	}
+	return ret, nil
+}
+
+// listObjects returns every cert object keyed by object name, only
+// downloading objects whose ETag differs from the cached one.
+func (s *S3CertStore) listObjects(ctx context.Context) (map[string]*CertStoreEntry, error) {
+	keys, err := s.listKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]*CertStoreEntry, len(keys))
+	for key, etag := range keys {
+		s.mu.Lock()
+		cached, ok := s.objects[key]
+		s.mu.Unlock()
+		if ok && cached.etag == etag {
+			ret[key] = cached.entry
+			continue
+		}
+
+		entry, _, err := s.get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			ret[key] = entry
+		}
+	}
+
+	s.mu.Lock()
+	for key := range s.objects {
+		if _, ok := keys[key]; !ok {
+			delete(s.objects, key)
+		}
+	}
+	s.mu.Unlock()
+
+	return ret, nil
+}
+
+// Load skips objects holding an expired or no cert, which may carry a
+// follower's renewal request, and re-uploads objects named by a previous
+// key algorithm under their current key. Several servers loading
+// concurrently is harmless: the re-upload is conditional.
+func (s *S3CertStore) Load(ctx context.Context) ([]*CertStoreEntry, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*CertStoreEntry
+	for key, entry := range objects {
+		if !entry.Cert.usable() {
+			logging.Info("Skipping expired cert for domains: %v", entry.Domains)
+			continue
+		}
+
+		if want := s.objectKey(domain.AsKey(entry.Domains)); key != want {
+			if err := s.SaveEntry(ctx, entry); err != nil {
+				return nil, fmt.Errorf("migrate %s: %w", key, err)
+			}
+			if err := s.remove(ctx, key); err != nil {
+				logging.Warn("Delete migrated cert from s3 store failed: %s", err)
+			}
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// SaveEntry writes fe with a conditional put. If another server wrote
+// the same pack concurrently the put fails its precondition; SaveEntry
+// then re-reads the object and keeps whichever write was made later.
+func (s *S3CertStore) SaveEntry(ctx context.Context, fe *CertStoreEntry) error {
+	key := s.objectKey(domain.AsKey(fe.Domains))
+
+	for range s3PutAttempts {
+		current, etag, err := s.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.changedAt().After(fe.changedAt()) {
+			logging.Info("S3 cert store already holds a newer cert for %v, skip writing", fe.Domains)
+			return nil
+		}
+
+		err = s.put(ctx, key, fe, etag)
+		if err == nil {
+			return nil
+		}
+		if !isS3ConditionFailed(err) {
+			return fmt.Errorf("put %s: %w", key, err)
+		}
+		logging.Debug("Conditional write of %s lost a race, retrying", key)
+	}
+	return fmt.Errorf("put %s: gave up after %d conflicting writes", key, s3PutAttempts)
+}
+
+func (s *S3CertStore) Delete(ctx context.Context, domains []string) error {
+	return s.remove(ctx, s.objectKey(domain.AsKey(domains)))
+}
+
+func (s *S3CertStore) List(ctx context.Context) ([]*CertStoreEntry, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*CertStoreEntry, 0, len(objects))
+	for _, entry := range objects {
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func (s *S3CertStore) Watch(ctx context.Context) (<-chan CertStoreEvent, error) {
+	return pollWatch(ctx, certStoreWatchInterval, s.List), nil
+}
+
+func (s *S3CertStore) Close() error {
+	return nil
+}
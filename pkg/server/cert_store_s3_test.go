@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// fakeS3 is a minimal path-style S3 endpoint covering the operations
+// S3CertStore uses: GET/PUT/DELETE object with If-Match / If-None-Match
+// and ListObjectsV2.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+
+	// beforePut, when set, runs once before the next PUT is applied,
+	// letting a test slip a concurrent write in between a store's read
+	// and its conditional write.
+	beforePut func()
+}
+
+type fakeS3Object struct {
+	body []byte
+	etag string
+	meta map[string]string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	f := &fakeS3{objects: map[string]fakeS3Object{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) set(key string, body []byte) {
+	sum := md5.Sum(body)
+	f.objects[key] = fakeS3Object{body: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Path-style: /<bucket>/<key>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	if r.Method == http.MethodGet && key == "" {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f.mu.Lock()
+		obj, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", obj.etag)
+		if r.Method == http.MethodGet {
+			w.Write(obj.body)
+		}
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+
+		f.mu.Lock()
+		hook := f.beforePut
+		f.beforePut = nil
+		f.mu.Unlock()
+		if hook != nil {
+			hook()
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		obj, exists := f.objects[key]
+		if m := r.Header.Get("If-Match"); m != "" && (!exists || obj.etag != m) {
+			s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		f.set(key, body)
+		stored := f.objects[key]
+		stored.meta = map[string]string{}
+		for h := range r.Header {
+			if lh := strings.ToLower(h); strings.HasPrefix(lh, "x-amz-meta-") {
+				stored.meta[strings.TrimPrefix(lh, "x-amz-meta-")] = r.Header.Get(h)
+			}
+		}
+		f.objects[key] = stored
+		w.Header().Set("ETag", stored.etag)
+	case http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+		Size int    `xml:"Size"`
+	}
+	type result struct {
+		XMLName     xml.Name  `xml:"ListBucketResult"`
+		Contents    []content `xml:"Contents"`
+		KeyCount    int       `xml:"KeyCount"`
+		IsTruncated bool      `xml:"IsTruncated"`
+	}
+
+	f.mu.Lock()
+	var res result
+	for k, obj := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			res.Contents = append(res.Contents, content{Key: k, ETag: obj.etag, Size: len(obj.body)})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func makeTestS3CertStore(t *testing.T, url string) *S3CertStore {
+	t.Helper()
+	cs, err := NewS3CertStore(&config.CertStoreConfig{
+		Type:   config.CertStoreTypeS3,
+		Prefix: "certdx/",
+		S3: &config.S3Client{
+			Region:          "us-east-1",
+			Bucket:          "bucket",
+			URL:             url,
+			AccessKeyId:     "id",
+			AccessKeySecret: "secret",
+			PathStyle:       true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewS3CertStore: %v", err)
+	}
+	return cs
+}
+
+func TestS3CertStoreSaveAndLoad(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	cs := makeTestS3CertStore(t, srv.URL)
+	ctx := context.Background()
+
+	validBefore := time.Now().Add(time.Hour).Truncate(time.Second)
+	entry := &CertStoreEntry{
+		Domains: []string{"a.com", "b.com"},
+		Cert:    CertT{FullChain: []byte("fc"), Key: []byte("k"), ValidBefore: validBefore, RenewAt: time.Now()},
+	}
+	if err := cs.SaveEntry(ctx, entry); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	key := "certdx/" + formatDomainKey(domain.AsKey(entry.Domains)) + ".json"
+	fake.mu.Lock()
+	obj, ok := fake.objects[key]
+	fake.mu.Unlock()
+	if !ok {
+		t.Fatalf("object %s not written", key)
+	}
+	if obj.meta[s3MetaDomains] != "a.com,b.com" {
+		t.Errorf("domains metadata: got %q", obj.meta[s3MetaDomains])
+	}
+	if obj.meta[s3MetaValidBefore] != validBefore.UTC().Format(time.RFC3339) {
+		t.Errorf("valid-before metadata: got %q", obj.meta[s3MetaValidBefore])
+	}
+
+	// A fresh store (another stateless server) loads it on startup.
+	entries, err := makeTestS3CertStore(t, srv.URL).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	loaded := findEntry(entries, entry.Domains)
+	if loaded == nil || string(loaded.Cert.FullChain) != "fc" {
+		t.Fatalf("Load: got %+v", entries)
+	}
+}
+
+func TestS3CertStoreLoadSkipsExpired(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	cs := makeTestS3CertStore(t, srv.URL)
+	ctx := context.Background()
+
+	if err := cs.SaveEntry(ctx, &CertStoreEntry{
+		Domains: []string{"dead.com"},
+		Cert:    CertT{ValidBefore: time.Now().Add(-time.Hour)},
+	}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	entries, err := cs.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Load: got %d entries want 0", len(entries))
+	}
+	fake.mu.Lock()
+	n := len(fake.objects)
+	fake.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expired object deleted by Load: %d objects left", n)
+	}
+}
+
+func TestS3CertStoreConcurrentRenewalKeepsNewer(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	ctx := context.Background()
+	domains := []string{"race.com"}
+	base := time.Now()
+
+	mine := makeTestS3CertStore(t, srv.URL)
+	theirs := makeTestS3CertStore(t, srv.URL)
+
+	if err := mine.SaveEntry(ctx, &CertStoreEntry{
+		Domains: domains,
+		Cert:    CertT{FullChain: []byte("old"), ValidBefore: base.Add(time.Hour), RenewAt: base},
+	}); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	// Another server's renewal lands between our read and our write.
+	fake.mu.Lock()
+	fake.beforePut = func() {
+		if err := theirs.SaveEntry(ctx, &CertStoreEntry{
+			Domains: domains,
+			Cert:    CertT{FullChain: []byte("theirs"), ValidBefore: base.Add(3 * time.Hour), RenewAt: base.Add(2 * time.Minute)},
+		}); err != nil {
+			t.Errorf("concurrent SaveEntry: %v", err)
+		}
+	}
+	fake.mu.Unlock()
+
+	if err := mine.SaveEntry(ctx, &CertStoreEntry{
+		Domains: domains,
+		Cert:    CertT{FullChain: []byte("mine"), ValidBefore: base.Add(2 * time.Hour), RenewAt: base.Add(time.Minute)},
+	}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	entries, err := makeTestS3CertStore(t, srv.URL).List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	got := findEntry(entries, domains)
+	if got == nil || string(got.Cert.FullChain) != "theirs" {
+		t.Fatalf("concurrent renewal clobbered: got %+v", got)
+	}
+}
+
+func TestS3CertStoreDeleteAndList(t *testing.T) {
+	_, srv := newFakeS3(t)
+	cs := makeTestS3CertStore(t, srv.URL)
+	ctx := context.Background()
+
+	for _, d := range []string{"one.com", "two.com"} {
+		if err := cs.SaveEntry(ctx, &CertStoreEntry{
+			Domains: []string{d},
+			Cert:    CertT{ValidBefore: time.Now().Add(time.Hour)},
+		}); err != nil {
+			t.Fatalf("SaveEntry: %v", err)
+		}
+	}
+	if err := cs.Delete(ctx, []string{"one.com"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := cs.Delete(ctx, []string{"never.com"}); err != nil {
+		t.Fatalf("Delete missing: %v", err)
+	}
+
+	entries, err := cs.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 1 || findEntry(entries, []string{"two.com"}) == nil {
+		t.Fatalf("List: got %+v", entries)
+	}
+}
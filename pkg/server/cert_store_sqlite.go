@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+const sqliteCertStoreSchema = `
+CREATE TABLE IF NOT EXISTS cert_entries (
+	domain_key TEXT PRIMARY KEY,
+	domains    TEXT NOT NULL,
+	entry      BLOB NOT NULL,
+	updated_at INTEGER NOT NULL
+)`
+
+// SQLiteCertStore is the CertStore backed by a SQLite database. Each
+// entry is its own row, so a renewal is a single-row transactional
+// upsert instead of a rewrite of the whole store.
+type SQLiteCertStore struct {
+	path string
+	db   *sql.DB
+}
+
+// NewSQLiteCertStore opens (creating if needed) the SQLite cert store at
+// path, or at the default cache.db path when path is empty.
+func NewSQLiteCertStore(path string) (*SQLiteCertStore, error) {
+	if path == "" {
+		var err error
+		path, err = paths.ServerCacheDBPath()
+		if err != nil {
+			return nil, fmt.Errorf("resolve cert store path: %w", err)
+		}
+	}
+
+	// Create the file up front with tight permissions; SQLite would
+	// otherwise create it honoring the process umask.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create cert store %s: %w", path, err)
+	}
+	f.Close()
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open cert store %s: %w", path, err)
+	}
+
+	if _, err := db.Exec(sqliteCertStoreSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init cert store schema: %w", err)
+	}
+
+	s := &SQLiteCertStore{path: path, db: db}
+	if err := s.migrateKeys(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateKeys re-keys rows written by a previous key algorithm, so the
+// database is migrated in place when it is opened.
+func (s *SQLiteCertStore) migrateKeys(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin cert store transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := s.queryAll(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if want := formatDomainKey(domain.AsKey(row.entry.Domains)); row.key != want {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM cert_entries WHERE domain_key = ?`, row.key); err != nil {
+				return fmt.Errorf("migrate cert store entry: %w", err)
+			}
+			if err := upsertEntry(ctx, tx, row.entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit cert store transaction: %w", err)
+	}
+	return nil
+}
+
+func formatDomainKey(k domain.Key) string {
+	return strconv.FormatUint(uint64(k), 10)
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+type sqliteRow struct {
+	key   string
+	entry *CertStoreEntry
+}
+
+func (s *SQLiteCertStore) queryAll(ctx context.Context, q sqlQuerier) ([]sqliteRow, error) {
+	rows, err := q.QueryContext(ctx, `SELECT domain_key, entry FROM cert_entries`)
+	if err != nil {
+		return nil, fmt.Errorf("query cert store: %w", err)
+	}
+	defer rows.Close()
+
+	var ret []sqliteRow
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, fmt.Errorf("scan cert store row: %w", err)
+		}
+		entry := new(CertStoreEntry)
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("unmarshaling cert store row %s: %w", key, err)
+		}
+		ret = append(ret, sqliteRow{key: key, entry: entry})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query cert store: %w", err)
+	}
+	return ret, nil
+}
+
+func upsertEntry(ctx context.Context, tx *sql.Tx, fe *CertStoreEntry) error {
+	data, err := json.Marshal(fe)
+	if err != nil {
+		return fmt.Errorf("marshal cert store entry: %w", err)
+	}
+	domains, err := json.Marshal(fe.Domains)
+	if err != nil {
+		return fmt.Errorf("marshal cert store entry: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO cert_entries (domain_key, domains, entry, updated_at) VALUES (?, ?, ?, ?)
+ON CONFLICT(domain_key) DO UPDATE SET
+	domains = excluded.domains,
+	entry = excluded.entry,
+	updated_at = excluded.updated_at`,
+		formatDomainKey(domain.AsKey(fe.Domains)), string(domains), data, time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("write cert store entry: %w", err)
+	}
+	return nil
+}
+
+// Load returns the rows holding a usable cert and writes nothing. Rows
+// with an expired or no cert are skipped but kept: on a store shared
+// under leader election they may carry a follower's renewal request,
+// which the leader's renewal overwrites.
+func (s *SQLiteCertStore) Load(ctx context.Context) ([]*CertStoreEntry, error) {
+	rows, err := s.queryAll(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*CertStoreEntry
+	for _, row := range rows {
+		if !row.entry.Cert.usable() {
+			logging.Info("Skipping expired cert for domains: %v", row.entry.Domains)
+			continue
+		}
+		ret = append(ret, row.entry)
+	}
+	return ret, nil
+}
+
+func (s *SQLiteCertStore) SaveEntry(ctx context.Context, fe *CertStoreEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin cert store transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := upsertEntry(ctx, tx, fe); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit cert store transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteCertStore) Delete(ctx context.Context, domains []string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM cert_entries WHERE domain_key = ?`,
+		formatDomainKey(domain.AsKey(domains)))
+	if err != nil {
+		return fmt.Errorf("delete cert store entry: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteCertStore) List(ctx context.Context) ([]*CertStoreEntry, error) {
+	rows, err := s.queryAll(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*CertStoreEntry, 0, len(rows))
+	for _, row := range rows {
+		ret = append(ret, row.entry)
+	}
+	return ret, nil
+}
+
+func (s *SQLiteCertStore) Watch(ctx context.Context) (<-chan CertStoreEvent, error) {
+	return pollWatch(ctx, certStoreWatchInterval, s.List), nil
+}
+
+func (s *SQLiteCertStore) Close() error {
+	return s.db.Close()
+}
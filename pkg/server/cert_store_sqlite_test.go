@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+func makeTempSQLiteCertStore(t *testing.T) *SQLiteCertStore {
+	t.Helper()
+	cs, err := NewSQLiteCertStore(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteCertStore: %v", err)
+	}
+	t.Cleanup(func() { cs.Close() })
+	return cs
+}
+
+func TestSQLiteCertStoreFilePermissions(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	st, err := os.Stat(cs.path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if mode := st.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("perm: got %o want 0600", mode)
+	}
+}
+
+func TestSQLiteCertStoreSaveAndLoad(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	ctx := context.Background()
+
+	entry := &CertStoreEntry{
+		Domains: []string{"a.com", "b.com"},
+		Cert: CertT{
+			FullChain:   []byte("fc"),
+			Key:         []byte("k"),
+			ValidBefore: time.Now().Add(2 * time.Hour),
+			RenewAt:     time.Now(),
+		},
+	}
+	if err := cs.SaveEntry(ctx, entry); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	// Overwrite in place: same domain set, different order.
+	entry2 := &CertStoreEntry{
+		Domains: []string{"b.com", "a.com"},
+		Cert: CertT{
+			FullChain:   []byte("fc2"),
+			Key:         []byte("k2"),
+			ValidBefore: time.Now().Add(2 * time.Hour),
+		},
+	}
+	if err := cs.SaveEntry(ctx, entry2); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	reopened, err := NewSQLiteCertStore(cs.path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	entries, err := reopened.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Load: got %d entries want 1", len(entries))
+	}
+	if string(entries[0].Cert.FullChain) != "fc2" || string(entries[0].Cert.Key) != "k2" {
+		t.Fatalf("cert data mismatch: fc=%q k=%q", entries[0].Cert.FullChain, entries[0].Cert.Key)
+	}
+}
+
+func TestSQLiteCertStoreLoadEmpty(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	entries, err := cs.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Load: got %d entries want 0", len(entries))
+	}
+}
+
+// sqliteKeys returns the domain keys of every row in cs.
+func sqliteKeys(t *testing.T, cs *SQLiteCertStore) []string {
+	t.Helper()
+	rows, err := cs.db.Query(`SELECT domain_key FROM cert_entries ORDER BY domain_key`)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestSQLiteCertStoreLoadSkipsExpired(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	ctx := context.Background()
+
+	// A follower's renewal request for a pack it has no cert for.
+	if err := cs.SaveEntry(ctx, &CertStoreEntry{
+		Domains:     []string{"dead.com"},
+		Cert:        CertT{ValidBefore: time.Now().Add(-time.Hour)},
+		RequestedAt: time.Now(),
+	}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	entries, err := cs.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Load: got %+v", entries)
+	}
+	if keys := sqliteKeys(t, cs); len(keys) != 1 {
+		t.Fatalf("Load deleted the request row: %v", keys)
+	}
+}
+
+func TestSQLiteCertStoreMigratesKeysOnOpen(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	ctx := context.Background()
+
+	// A row keyed by a stale key algorithm.
+	if _, err := cs.db.Exec(`INSERT INTO cert_entries (domain_key, domains, entry, updated_at) VALUES (?, ?, ?, ?)`,
+		"legacy", `["live.com"]`, []byte(`{"domains":["live.com"],"cert":{"validBefore":"`+
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}}`), 0); err != nil {
+		t.Fatalf("insert legacy row: %v", err)
+	}
+
+	reopened, err := NewSQLiteCertStore(cs.path)
+	if err != nil {
+		t.Fatalf("NewSQLiteCertStore: %v", err)
+	}
+	defer reopened.Close()
+	want := formatDomainKey(domain.AsKey([]string{"live.com"}))
+	if keys := sqliteKeys(t, reopened); len(keys) != 1 || keys[0] != want {
+		t.Fatalf("keys after migration: got %v want [%s]", keys, want)
+	}
+
+	entries, err := reopened.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(entries) != 1 || findEntry(entries, []string{"live.com"}) == nil {
+		t.Fatalf("Load: got %+v", entries)
+	}
+}
+
+func TestSQLiteCertStoreDelete(t *testing.T) {
+	cs := makeTempSQLiteCertStore(t)
+	ctx := context.Background()
+	if err := cs.SaveEntry(ctx, &CertStoreEntry{
+		Domains: []string{"gone.com"},
+		Cert:    CertT{ValidBefore: time.Now().Add(time.Hour)},
+	}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+	if err := cs.Delete(ctx, []string{"gone.com"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	all, err := cs.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("List after delete: got %d entries want 0", len(all))
+	}
+}
@@ -5,25 +5,36 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"pkg.para.party/certdx/pkg/domain"
 )
 
-func makeTempCertStore(t *testing.T) CertStore {
+func makeTempCertStore(t *testing.T) *JSONCertStore {
 	t.Helper()
-	dir := t.TempDir()
-	return CertStore{
-		path:    filepath.Join(dir, "cache.json"),
-		entries: make(map[domain.Key]*certStoreEntry),
-		update:  make(chan *certStoreEntry, 10),
+	cs, err := NewJSONCertStore(filepath.Join(t.TempDir(), "cache.json"))
+	if err != nil {
+		t.Fatalf("NewJSONCertStore: %v", err)
 	}
+	return cs
+}
+
+// findEntry returns the entry in entries matching domains, or nil.
+func findEntry(entries []*CertStoreEntry, domains []string) *CertStoreEntry {
+	key := domain.AsKey(domains)
+	for _, e := range entries {
+		if domain.AsKey(e.Domains) == key {
+			return e
+		}
+	}
+	return nil
 }
 
 func TestCertStoreLoadMissingFile(t *testing.T) {
 	cs := makeTempCertStore(t)
-	err := cs.Load()
+	_, err := cs.Load(context.Background())
 	if !os.IsNotExist(err) {
 		t.Fatalf("expected os.ErrNotExist, got %v", err)
 	}
@@ -34,7 +45,7 @@ func TestCertStoreLoadCorruptedJSON(t *testing.T) {
 	if err := os.WriteFile(cs.path, []byte("{invalid json"), 0o600); err != nil {
 		t.Fatalf("write: %v", err)
 	}
-	err := cs.Load()
+	_, err := cs.Load(context.Background())
 	if err == nil {
 		t.Fatal("expected error on corrupted JSON")
 	}
@@ -43,7 +54,7 @@ func TestCertStoreLoadCorruptedJSON(t *testing.T) {
 func TestCertStoreLoadValid(t *testing.T) {
 	cs := makeTempCertStore(t)
 
-	entry := &certStoreEntry{
+	entry := &CertStoreEntry{
 		Domains: []string{"example.com"},
 		Cert: CertT{
 			FullChain:   []byte("chain"),
@@ -51,7 +62,7 @@ func TestCertStoreLoadValid(t *testing.T) {
 			ValidBefore: time.Now().Add(time.Hour),
 		},
 	}
-	data := map[domain.Key]*certStoreEntry{
+	data := map[domain.Key]*CertStoreEntry{
 		domain.AsKey(entry.Domains): entry,
 	}
 	b, err := json.Marshal(data)
@@ -62,13 +73,13 @@ func TestCertStoreLoadValid(t *testing.T) {
 		t.Fatalf("write: %v", err)
 	}
 
-	if err := cs.Load(); err != nil {
+	entries, err := cs.Load(context.Background())
+	if err != nil {
 		t.Fatalf("Load: %v", err)
 	}
 
-	key := domain.AsKey([]string{"example.com"})
-	loaded, ok := cs.entries[key]
-	if !ok {
+	loaded := findEntry(entries, []string{"example.com"})
+	if loaded == nil {
 		t.Fatal("entry not found after load")
 	}
 	if string(loaded.Cert.FullChain) != "chain" {
@@ -79,7 +90,7 @@ func TestCertStoreLoadValid(t *testing.T) {
 func TestCertStoreSaveAndLoad(t *testing.T) {
 	cs := makeTempCertStore(t)
 
-	entry := &certStoreEntry{
+	entry := &CertStoreEntry{
 		Domains: []string{"a.com", "b.com"},
 		Cert: CertT{
 			FullChain:   []byte("fc"),
@@ -88,8 +99,8 @@ func TestCertStoreSaveAndLoad(t *testing.T) {
 			RenewAt:     time.Now(),
 		},
 	}
-	if err := cs.saveEntry(entry); err != nil {
-		t.Fatalf("saveEntry: %v", err)
+	if err := cs.SaveEntry(context.Background(), entry); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
 	}
 
 	// Check file permissions.
@@ -102,17 +113,16 @@ func TestCertStoreSaveAndLoad(t *testing.T) {
 	}
 
 	// Reload into a fresh store.
-	cs2 := CertStore{
-		path:    cs.path,
-		entries: make(map[domain.Key]*certStoreEntry),
-		update:  make(chan *certStoreEntry, 10),
+	cs2, err := NewJSONCertStore(cs.path)
+	if err != nil {
+		t.Fatalf("NewJSONCertStore: %v", err)
 	}
-	if err := cs2.Load(); err != nil {
+	entries, err := cs2.Load(context.Background())
+	if err != nil {
 		t.Fatalf("Load after save: %v", err)
 	}
-	key := domain.AsKey([]string{"a.com", "b.com"})
-	loaded, ok := cs2.entries[key]
-	if !ok {
+	loaded := findEntry(entries, []string{"a.com", "b.com"})
+	if loaded == nil {
 		t.Fatal("entry not found after reload")
 	}
 	if string(loaded.Cert.FullChain) != "fc" || string(loaded.Cert.Key) != "k" {
@@ -123,10 +133,11 @@ func TestCertStoreSaveAndLoad(t *testing.T) {
 func TestCertStoreListenUpdatePersists(t *testing.T) {
 	cs := makeTempCertStore(t)
 	ctx, cancel := context.WithCancel(context.Background())
+	update := make(chan *CertStoreEntry, 10)
 
-	go cs.listenUpdate(ctx)
+	go listenUpdate(ctx, cs, update)
 
-	cs.update <- &certStoreEntry{
+	update <- &CertStoreEntry{
 		Domains: []string{"test.com"},
 		Cert: CertT{
 			FullChain:   []byte("lfc"),
@@ -142,16 +153,11 @@ func TestCertStoreListenUpdatePersists(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Verify persisted.
-	cs2 := CertStore{
-		path:    cs.path,
-		entries: make(map[domain.Key]*certStoreEntry),
-		update:  make(chan *certStoreEntry, 10),
-	}
-	if err := cs2.Load(); err != nil {
+	entries, err := makeReloadedStore(t, cs.path).Load(context.Background())
+	if err != nil {
 		t.Fatalf("Load: %v", err)
 	}
-	key := domain.AsKey([]string{"test.com"})
-	if _, ok := cs2.entries[key]; !ok {
+	if findEntry(entries, []string{"test.com"}) == nil {
 		t.Fatal("entry not persisted by listenUpdate")
 	}
 }
@@ -159,9 +165,10 @@ func TestCertStoreListenUpdatePersists(t *testing.T) {
 func TestCertStoreListenUpdateDrainsOnCancel(t *testing.T) {
 	cs := makeTempCertStore(t)
 	ctx, cancel := context.WithCancel(context.Background())
+	update := make(chan *CertStoreEntry, 10)
 
 	// Buffer entries before starting the listener.
-	cs.update <- &certStoreEntry{
+	update <- &CertStoreEntry{
 		Domains: []string{"drain.com"},
 		Cert:    CertT{FullChain: []byte("d"), Key: []byte("k"), ValidBefore: time.Now().Add(time.Hour)},
 	}
@@ -169,18 +176,153 @@ func TestCertStoreListenUpdateDrainsOnCancel(t *testing.T) {
 	// Cancel immediately, then start listenUpdate — it should drain
 	// the buffered entry before returning.
 	cancel()
-	cs.listenUpdate(ctx)
+	listenUpdate(ctx, cs, update)
 
-	cs2 := CertStore{
-		path:    cs.path,
-		entries: make(map[domain.Key]*certStoreEntry),
-		update:  make(chan *certStoreEntry, 10),
-	}
-	if err := cs2.Load(); err != nil {
+	entries, err := makeReloadedStore(t, cs.path).Load(context.Background())
+	if err != nil {
 		t.Fatalf("Load: %v", err)
 	}
-	key := domain.AsKey([]string{"drain.com"})
-	if _, ok := cs2.entries[key]; !ok {
+	if findEntry(entries, []string{"drain.com"}) == nil {
 		t.Fatal("buffered entry not drained on cancel")
 	}
 }
+
+func makeReloadedStore(t *testing.T, path string) *JSONCertStore {
+	t.Helper()
+	cs, err := NewJSONCertStore(path)
+	if err != nil {
+		t.Fatalf("NewJSONCertStore: %v", err)
+	}
+	return cs
+}
+
+func TestCertStoreLoadDiscardsExpired(t *testing.T) {
+	cs := makeTempCertStore(t)
+	ctx := context.Background()
+
+	for _, e := range []*CertStoreEntry{
+		{Domains: []string{"live.com"}, Cert: CertT{ValidBefore: time.Now().Add(time.Hour)}},
+		{Domains: []string{"dead.com"}, Cert: CertT{ValidBefore: time.Now().Add(-time.Hour)}},
+	} {
+		if err := cs.SaveEntry(ctx, e); err != nil {
+			t.Fatalf("SaveEntry: %v", err)
+		}
+	}
+
+	entries, err := makeReloadedStore(t, cs.path).Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if findEntry(entries, []string{"live.com"}) == nil {
+		t.Fatal("valid entry dropped by Load")
+	}
+	if findEntry(entries, []string{"dead.com"}) != nil {
+		t.Fatal("expired entry returned by Load")
+	}
+
+	// List still reports everything on disk.
+	all, err := cs.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("List: got %d entries want 2", len(all))
+	}
+}
+
+func TestCertStoreSaveEntryKeepsUnloadedEntries(t *testing.T) {
+	cs := makeTempCertStore(t)
+	ctx := context.Background()
+	first := &CertStoreEntry{Domains: []string{"first.com"}, Cert: CertT{ValidBefore: time.Now().Add(time.Hour)}}
+	if err := cs.SaveEntry(ctx, first); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	// A second store that never called Load must not clobber first.com.
+	cs2 := makeReloadedStore(t, cs.path)
+	second := &CertStoreEntry{Domains: []string{"second.com"}, Cert: CertT{ValidBefore: time.Now().Add(time.Hour)}}
+	if err := cs2.SaveEntry(ctx, second); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	all, err := cs.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if findEntry(all, first.Domains) == nil || findEntry(all, second.Domains) == nil {
+		t.Fatalf("expected both entries on disk, got %d", len(all))
+	}
+}
+
+func TestCertStoreDelete(t *testing.T) {
+	cs := makeTempCertStore(t)
+	ctx := context.Background()
+	entry := &CertStoreEntry{Domains: []string{"gone.com"}, Cert: CertT{ValidBefore: time.Now().Add(time.Hour)}}
+	if err := cs.SaveEntry(ctx, entry); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+	if err := cs.Delete(ctx, []string{"GONE.com."}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := cs.Delete(ctx, []string{"never.com"}); err != nil {
+		t.Fatalf("Delete missing: %v", err)
+	}
+
+	all, err := cs.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("List after delete: got %d entries want 0", len(all))
+	}
+}
+
+func TestPollWatchReportsChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		current []*CertStoreEntry
+	)
+	list := func(context.Context) ([]*CertStoreEntry, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*CertStoreEntry(nil), current...), nil
+	}
+	set := func(entries ...*CertStoreEntry) {
+		mu.Lock()
+		current = entries
+		mu.Unlock()
+	}
+
+	a := &CertStoreEntry{Domains: []string{"a.com"}, Cert: CertT{FullChain: []byte("1")}}
+	set(a)
+	events := pollWatch(ctx, 10*time.Millisecond, list)
+
+	next := func() CertStoreEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for watch event")
+			return CertStoreEvent{}
+		}
+	}
+
+	a2 := &CertStoreEntry{Domains: []string{"a.com"}, Cert: CertT{FullChain: []byte("2")}}
+	set(a2)
+	if ev := next(); ev.Key != domain.AsKey(a.Domains) || ev.Entry == nil || string(ev.Entry.Cert.FullChain) != "2" {
+		t.Fatalf("update event: got %+v", ev)
+	}
+
+	set()
+	if ev := next(); ev.Key != domain.AsKey(a.Domains) || ev.Entry != nil {
+		t.Fatalf("delete event: got %+v", ev)
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// clientIdentity is what an mTLS client is known by: its certificate,
+// and on an SDS stream the Envoy node it reports.
+type clientIdentity struct {
+	cert    *x509.Certificate
+	nodeID  string
+	cluster string
+}
+
+func (id *clientIdentity) uris() []string {
+	ret := make([]string, 0, len(id.cert.URIs))
+	for _, u := range id.cert.URIs {
+		ret = append(ret, u.String())
+	}
+	return ret
+}
+
+// name is the short name of id in logs: its SPIFFE ID or other URI SAN,
+// or its CN.
+func (id *clientIdentity) name() string {
+	if uris := id.uris(); len(uris) > 0 {
+		return uris[0]
+	}
+	return id.cert.Subject.CommonName
+}
+
+// String describes id in full, for denial logs.
+func (id *clientIdentity) String() string {
+	parts := []string{fmt.Sprintf("CN %q", id.cert.Subject.CommonName)}
+	if len(id.cert.DNSNames) > 0 {
+		parts = append(parts, fmt.Sprintf("DNS %v", id.cert.DNSNames))
+	}
+	if uris := id.uris(); len(uris) > 0 {
+		parts = append(parts, fmt.Sprintf("URI %v", uris))
+	}
+	if id.nodeID != "" || id.cluster != "" {
+		parts = append(parts, fmt.Sprintf("node %q cluster %q", id.nodeID, id.cluster))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matchAny reports whether pattern is unset, or matches one of the
+// non-empty values.
+func matchAny(pattern string, values ...string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok && v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(r *config.MTLSClientRule, id *clientIdentity) bool {
+	return matchAny(r.CommonName, id.cert.Subject.CommonName) &&
+		matchAny(r.DNSName, id.cert.DNSNames...) &&
+		matchAny(r.URI, id.uris()...) &&
+		matchAny(r.NodeID, id.nodeID) &&
+		matchAny(r.Cluster, id.cluster)
+}
+
+// authorizeClient returns the credential of an mTLS client: named after
+// id and scoped to the domains of the [[MTLS.Clients]] rules it matches.
+// With rules configured, a client matching none is refused.
+func (s *CertDXServer) authorizeClient(id *clientIdentity) (*config.HttpToken, bool) {
+	cred := &config.HttpToken{Name: id.name()}
+	rules := s.Config.MTLS.Clients
+	if len(rules) == 0 {
+		return cred, true
+	}
+
+	matched := false
+	for i := range rules {
+		r := &rules[i]
+		if !ruleMatches(r, id) {
+			continue
+		}
+		if len(r.Domains) == 0 {
+			cred.Domains = nil
+			return cred, true
+		}
+		matched = true
+		cred.Domains = append(cred.Domains, r.Domains...)
+	}
+	return cred, matched
+}
+
+// checkClientCert authorizes an mTLS request by its client certificate,
+// which the TLS handshake already verified against the CA.
+func (s *CertDXServer) checkClientCert(r *http.Request) (*config.HttpToken, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		logging.Warn("Not authorized request from: %s, no client certificate", r.RemoteAddr)
+		return nil, false
+	}
+	id := &clientIdentity{cert: r.TLS.PeerCertificates[0]}
+	cred, ok := s.authorizeClient(id)
+	if !ok {
+		logging.Warn("Not authorized request from: %s, client %s matches no mTLS client rule", r.RemoteAddr, id)
+	}
+	return cred, ok
+}
+
+// withCredential returns ctx carrying the credential a request or stream
+// was authorized with, for checkDomains and requester.
+func withCredential(ctx context.Context, cred *config.HttpToken) context.Context {
+	return context.WithValue(ctx, tokenCtxKey{}, cred)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func makeClientCert(cn string, dnsNames []string, uris ...string) *x509.Certificate {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			panic(err)
+		}
+		cert.URIs = append(cert.URIs, parsed)
+	}
+	return cert
+}
+
+var testClientRules = []config.MTLSClientRule{
+	{Name: "web", URI: "spiffe://example.org/ns/web/sa/*", Domains: []string{"web.example.com"}},
+	{Name: "mail", CommonName: "mail-*", DNSName: "*.mail.internal", Domains: []string{"mail.example.com"}},
+	{Name: "edge", NodeID: "edge-*", Cluster: "edge", Domains: []string{"edge.example.com"}},
+	{Name: "ops", CommonName: "ops"},
+}
+
+func TestAuthorizeClient(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+
+	cases := []struct {
+		name    string
+		id      clientIdentity
+		ok      bool
+		domains []string
+	}{
+		{"spiffe", clientIdentity{cert: makeClientCert("", nil, "spiffe://example.org/ns/web/sa/api")}, true, []string{"web.example.com"}},
+		{"spiffe other namespace", clientIdentity{cert: makeClientCert("", nil, "spiffe://example.org/ns/db/sa/api")}, false, nil},
+		{"cn and dns", clientIdentity{cert: makeClientCert("mail-1", []string{"a.mail.internal"})}, true, []string{"mail.example.com"}},
+		{"cn without dns", clientIdentity{cert: makeClientCert("mail-1", nil)}, false, nil},
+		{"node and cluster", clientIdentity{cert: makeClientCert("envoy", nil), nodeID: "edge-7", cluster: "edge"}, true, []string{"edge.example.com"}},
+		{"no node over http", clientIdentity{cert: makeClientCert("envoy", nil)}, false, nil},
+		{"two rules", clientIdentity{cert: makeClientCert("mail-1", []string{"a.mail.internal"}, "spiffe://example.org/ns/web/sa/x")}, true, []string{"web.example.com", "mail.example.com"}},
+		{"every domain", clientIdentity{cert: makeClientCert("ops", nil)}, true, nil},
+	}
+
+	// Without rules, every client gets every domain.
+	for _, tc := range cases {
+		cred, ok := s.authorizeClient(&tc.id)
+		if !ok || cred.Domains != nil {
+			t.Errorf("%s without rules: %+v, %v", tc.name, cred, ok)
+		}
+	}
+
+	s.Config.MTLS.Clients = testClientRules
+	for _, tc := range cases {
+		cred, ok := s.authorizeClient(&tc.id)
+		if ok != tc.ok {
+			t.Errorf("%s: authorized %v", tc.name, ok)
+			continue
+		}
+		if ok && !slices.Equal(cred.Domains, tc.domains) {
+			t.Errorf("%s: domains %v want %v", tc.name, cred.Domains, tc.domains)
+		}
+	}
+}
+
+func TestApiWithTokenHandlerClientCert(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.HttpServer.AuthMethod = config.HTTP_AUTH_MTLS
+	s.Config.MTLS.Clients = testClientRules
+	entry := s.certCache.get([]string{"web.example.com"})
+	entry.stateMu.Lock()
+	entry.cert = CertT{FullChain: []byte("PEM-chain"), Key: []byte("PEM-key"), ValidBefore: time.Now().Add(time.Hour)}
+	entry.subscribing = 1
+	entry.stateMu.Unlock()
+
+	request := func(cert *x509.Certificate, domains ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.HttpCertReq{Domains: domains})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		}
+		w := httptest.NewRecorder()
+		s.apiWithTokenHandler(w, req)
+		return w
+	}
+
+	web := makeClientCert("api", nil, "spiffe://example.org/ns/web/sa/api")
+	var resp api.HttpCertResp
+	w := request(web, "web.example.com")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || string(resp.FullChain) != "PEM-chain" {
+		t.Errorf("in scope: %d %s", w.Code, w.Body.String())
+	}
+	w = request(web, "mail.example.com")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Err != "Domains not allowed" {
+		t.Errorf("out of scope: %d %s", w.Code, w.Body.String())
+	}
+	if w := request(makeClientCert("stranger", nil), "web.example.com"); w.Code != http.StatusNotFound {
+		t.Errorf("no matching rule: got %d want 404", w.Code)
+	}
+	if w := request(nil, "web.example.com"); w.Code != http.StatusNotFound {
+		t.Errorf("no client cert: got %d want 404", w.Code)
+	}
+}
+
+// fakeSDSStream is an SDS stream from a client presenting cert.
+type fakeSDSStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs chan *discoveryv3.DiscoveryRequest
+	sent chan *discoveryv3.DiscoveryResponse
+}
+
+func newFakeSDSStream(ctx context.Context, cert *x509.Certificate) *fakeSDSStream {
+	ctx = peer.NewContext(ctx, &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+	return &fakeSDSStream{
+		ctx:  ctx,
+		reqs: make(chan *discoveryv3.DiscoveryRequest, 1),
+		sent: make(chan *discoveryv3.DiscoveryResponse, 1),
+	}
+}
+
+func (f *fakeSDSStream) Context() context.Context { return f.ctx }
+
+func (f *fakeSDSStream) Send(r *discoveryv3.DiscoveryResponse) error {
+	select {
+	case f.sent <- r:
+		return nil
+	case <-f.ctx.Done():
+		return f.ctx.Err()
+	}
+}
+
+func (f *fakeSDSStream) Recv() (*discoveryv3.DiscoveryRequest, error) {
+	select {
+	case r := <-f.reqs:
+		return r, nil
+	case <-f.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+// sdsRequest asks for the pack named site holding domains, as node.
+func sdsRequest(t *testing.T, nodeID, cluster string, domains ...string) *discoveryv3.DiscoveryRequest {
+	items := make([]any, len(domains))
+	for i, d := range domains {
+		items[i] = d
+	}
+	md, err := structpb.NewStruct(map[string]any{domainKey: map[string]any{"site": items}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &discoveryv3.DiscoveryRequest{
+		TypeUrl:       typeUrl,
+		ResourceNames: []string{"site"},
+		Node:          &corev3.Node{Id: nodeID, Cluster: cluster, Metadata: md},
+	}
+}
+
+func TestStreamSecretsClientPolicy(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.MTLS.Clients = testClientRules
+	entry := s.certCache.get([]string{"edge.example.com"})
+	entry.stateMu.Lock()
+	entry.cert = CertT{FullChain: []byte("PEM-chain"), Key: []byte("PEM-key"), ValidBefore: time.Now().Add(time.Hour)}
+	entry.stateMu.Unlock()
+	sds := &MySDS{cdxsrv: s}
+
+	stream := func(t *testing.T, cert *x509.Certificate, req *discoveryv3.DiscoveryRequest) (*fakeSDSStream, chan error, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		f := newFakeSDSStream(ctx, cert)
+		f.reqs <- req
+		done := make(chan error, 1)
+		go func() { done <- sds.StreamSecrets(f) }()
+		return f, done, cancel
+	}
+	wantCode := func(t *testing.T, done chan error, code codes.Code) {
+		t.Helper()
+		select {
+		case err := <-done:
+			if status.Code(err) != code {
+				t.Fatalf("stream ended with %v, want %s", err, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream not ended")
+		}
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		f, done, cancel := stream(t, makeClientCert("envoy", nil), sdsRequest(t, "edge-1", "edge", "edge.example.com"))
+		select {
+		case r := <-f.sent:
+			if len(r.Resources) != 1 {
+				t.Fatalf("response: %v", r)
+			}
+		case err := <-done:
+			t.Fatalf("stream ended: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no cert sent")
+		}
+		cancel()
+		<-done
+	})
+	t.Run("pack out of scope", func(t *testing.T) {
+		_, done, _ := stream(t, makeClientCert("envoy", nil), sdsRequest(t, "edge-1", "edge", "web.example.com"))
+		wantCode(t, done, codes.PermissionDenied)
+	})
+	t.Run("no matching rule", func(t *testing.T) {
+		_, done, _ := stream(t, makeClientCert("envoy", nil), sdsRequest(t, "edge-1", "core", "edge.example.com"))
+		wantCode(t, done, codes.PermissionDenied)
+	})
+}
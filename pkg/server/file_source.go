@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// fileSourceExt and fileSourceKeyExt name the two halves of a pair in
+// the file source directory.
+const (
+	fileSourceExt    = ".pem"
+	fileSourceKeyExt = ".key"
+)
+
+// fileSource serves the <name>.pem/<name>.key pairs in a directory
+// written by tooling outside certdx. Each pair is an external cert, so
+// the pack for its SANs is never renewed through ACME.
+type fileSource struct {
+	dir string
+	// seen maps a pair name to the hash of the contents last published,
+	// so an unchanged pair is only published once.
+	seen map[string][sha256.Size]byte
+	// failed maps a pair name to the hash of the contents that last
+	// failed. Such a pair is retried on every scan, as it may become
+	// valid without changing, but its failure is only logged once.
+	failed map[string][sha256.Size]byte
+}
+
+func newFileSource(dir string) *fileSource {
+	return &fileSource{
+		dir:    dir,
+		seen:   map[string][sha256.Size]byte{},
+		failed: map[string][sha256.Size]byte{},
+	}
+}
+
+// scan publishes every pair that changed since it was last published.
+// Pairs that fail validation are logged and retried on later scans, so a
+// half-written pair is picked up once both files are consistent, and a
+// not yet valid one once it is. A removed pair
+// leaves its pack serving the last cert until it expires.
+func (f *fileSource) scan(ctx context.Context, s *CertDXServer) {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*"+fileSourceExt))
+	if err != nil {
+		logging.Warn("File source: list %s failed: %s", f.dir, err)
+		return
+	}
+
+	present := make(map[string]bool, len(names))
+	for _, path := range names {
+		name := strings.TrimSuffix(filepath.Base(path), fileSourceExt)
+		present[name] = true
+
+		fullchain, err := os.ReadFile(path)
+		if err != nil {
+			logging.Warn("File source: read %s failed: %s", path, err)
+			continue
+		}
+		keyPath := strings.TrimSuffix(path, fileSourceExt) + fileSourceKeyExt
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			logging.Warn("File source: read %s failed: %s", keyPath, err)
+			continue
+		}
+
+		sum := sha256.Sum256(append(append([]byte{}, fullchain...), key...))
+		if prev, ok := f.seen[name]; ok && prev == sum {
+			continue
+		}
+
+		if err := f.publish(ctx, s, name, fullchain, key); err != nil {
+			if prev, ok := f.failed[name]; !ok || prev != sum {
+				logging.Warn("File source: %s: %s", name, err)
+			} else {
+				logging.Debug("File source: %s: %s", name, err)
+			}
+			f.failed[name] = sum
+			continue
+		}
+		f.seen[name] = sum
+		delete(f.failed, name)
+	}
+
+	for name := range f.seen {
+		if !present[name] {
+			logging.Info("File source: %s removed, its pack keeps the last cert until it expires", name)
+			delete(f.seen, name)
+		}
+	}
+	for name := range f.failed {
+		if !present[name] {
+			delete(f.failed, name)
+		}
+	}
+}
+
+func (f *fileSource) publish(ctx context.Context, s *CertDXServer, name string, fullchain, key []byte) error {
+	cert, domains, err := ParseExternalCert(fullchain, key, s.importRoots)
+	if err != nil {
+		return err
+	}
+	if !domain.AllAllowed(s.Config.ACME.AllowedDomains, domains) {
+		return fmt.Errorf("domains %v: %w", domains, domain.ErrNotAllowed)
+	}
+
+	// Already serving it, e.g. loaded from the store after a restart.
+	current, _ := s.certCache.get(domains).Snapshot()
+	if bytes.Equal(current.FullChain, fullchain) && bytes.Equal(current.Key, key) {
+		return nil
+	}
+
+	logging.Info("File source: serving %s for %v, serial %s, valid until %s", name, domains, cert.Serial, cert.NotAfter)
+	return s.publishExternal(ctx, domains, cert)
+}
+
+// runFileSource scans the configured directory every scanInterval until
+// rootCtx is done.
+func (s *CertDXServer) runFileSource() {
+	f := newFileSource(s.Config.FileSource.Dir)
+	logging.Info("File source: watching %s", f.dir)
+
+	t := time.NewTicker(s.Config.FileSource.ScanIntervalDuration)
+	defer t.Stop()
+	for {
+		f.scan(s.rootCtx, s)
+		select {
+		case <-t.C:
+		case <-s.rootCtx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePair(t *testing.T, dir, name string, fullchain, key []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name+fileSourceExt), fullchain, 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+fileSourceKeyExt), key, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+func TestFileSourceScan(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	dir := t.TempDir()
+	f := newFileSource(dir)
+
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	writePair(t, dir, "site", chain, key)
+	f.scan(ctx, s)
+	<-s.storeUpdate
+
+	entry := s.certCache.get([]string{"example.com"})
+	cert, version := entry.Snapshot()
+	if !bytes.Equal(cert.FullChain, chain) || !cert.External {
+		t.Fatal("pair from the directory not served")
+	}
+
+	// An unchanged directory publishes nothing.
+	f.scan(ctx, s)
+	if _, v := entry.Snapshot(); v != version {
+		t.Fatalf("unchanged pair republished: version %d -> %d", version, v)
+	}
+
+	// A replaced pair becomes a new version, waking subscribers.
+	next, nextKey := makeExternalCert(t, 24*time.Hour, "example.com")
+	writePair(t, dir, "site", next, nextKey)
+	f.scan(ctx, s)
+	<-s.storeUpdate
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if entry.WaitForUpdate(waitCtx, version) == version {
+		t.Fatal("subscribers not notified of the replaced pair")
+	}
+	if !bytes.Equal(entry.Cert().FullChain, next) {
+		t.Fatal("replaced pair not served")
+	}
+}
+
+func TestFileSourceSkipsBadPairs(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	dir := t.TempDir()
+	f := newFileSource(dir)
+
+	chain, _ := makeExternalCert(t, 24*time.Hour, "a.example.com")
+	_, otherKey := makeExternalCert(t, 24*time.Hour, "a.example.com")
+	writePair(t, dir, "mismatched", chain, otherKey)
+	other, otherOrgKey := makeExternalCert(t, 24*time.Hour, "other.org")
+	writePair(t, dir, "disallowed", other, otherOrgKey)
+	// A cert without its key is ignored until the key shows up.
+	lone, loneKey := makeExternalCert(t, 24*time.Hour, "b.example.com")
+	if err := os.WriteFile(filepath.Join(dir, "lone"+fileSourceExt), lone, 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+
+	f.scan(ctx, s)
+	for _, domains := range [][]string{{"a.example.com"}, {"other.org"}, {"b.example.com"}} {
+		if cached(s, domains) {
+			t.Errorf("bad pair for %v published", domains)
+		}
+	}
+
+	writePair(t, dir, "lone", lone, loneKey)
+	f.scan(ctx, s)
+	<-s.storeUpdate
+	if !bytes.Equal(s.certCache.get([]string{"b.example.com"}).Cert().FullChain, lone) {
+		t.Fatal("pair not served once its key appeared")
+	}
+}
+
+func TestFileSourceSkipsAlreadyServed(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	dir := t.TempDir()
+
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	writePair(t, dir, "site", chain, key)
+	newFileSource(dir).scan(ctx, s)
+	<-s.storeUpdate
+	_, version := s.certCache.get([]string{"example.com"}).Snapshot()
+
+	// A fresh scanner, as after a restart that loaded the cert from the
+	// store, doesn't publish it again.
+	newFileSource(dir).scan(ctx, s)
+	if _, v := s.certCache.get([]string{"example.com"}).Snapshot(); v != version {
+		t.Fatalf("served pair republished: version %d -> %d", version, v)
+	}
+}
+
+func TestFileSourceRetriesFailedPairs(t *testing.T) {
+	ctx := context.Background()
+	s := makeHistoryTestServer(t)
+	dir := t.TempDir()
+	f := newFileSource(dir)
+
+	// The pair can't be verified until its CA is trusted.
+	roots := s.importRoots
+	s.importRoots = x509.NewCertPool()
+	chain, key := makeExternalCert(t, 24*time.Hour, "example.com")
+	writePair(t, dir, "site", chain, key)
+	f.scan(ctx, s)
+	if cached(s, []string{"example.com"}) {
+		t.Fatal("unverifiable pair published")
+	}
+
+	// It is picked up once it verifies, though the files didn't change.
+	s.importRoots = roots
+	f.scan(ctx, s)
+	<-s.storeUpdate
+	if !bytes.Equal(s.certCache.get([]string{"example.com"}).Cert().FullChain, chain) {
+		t.Fatal("pair not served once it verified")
+	}
+}
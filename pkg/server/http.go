@@ -2,12 +2,16 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -22,11 +26,25 @@ import (
 // waits for in-flight requests to drain before forcing a close.
 const httpShutdownTimeout = 30 * time.Second
 
+// apiSubPath returns the path of the named endpoint under APIPath.
+func (s *CertDXServer) apiSubPath(name string) string {
+	return strings.TrimSuffix(s.Config.HttpServer.APIPath, "/") + "/" + name
+}
+
 func (s *CertDXServer) apiHandler(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == s.Config.HttpServer.APIPath {
-		switch r.Method {
-		case "POST":
-			logstr := fmt.Sprintf("Http received cert request from: %s", r.RemoteAddr)
+	if handler := s.v2Handler(r.URL.Path); handler != nil {
+		if r.Method != "POST" {
+			writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeMethodNotAllowed, Message: "Use POST"})
+			return
+		}
+		handler(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		switch r.URL.Path {
+		case s.Config.HttpServer.APIPath:
+			logstr := fmt.Sprintf("Http received cert request from: %s", requester(r))
 			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 				logstr = fmt.Sprintf("%s, xff: %s", logstr, xff)
 			}
@@ -34,35 +52,183 @@ func (s *CertDXServer) apiHandler(w http.ResponseWriter, r *http.Request) {
 
 			s.handleCertReq(&w, r)
 			return
-		default:
+		case s.apiSubPath("sync"):
+			if s.Config.PeerSync.Serve {
+				s.handleSyncReq(w, r)
+				return
+			}
 		}
 	}
 	http.Error(w, "", http.StatusNotFound)
 }
 
+// apiWithTokenHandler serves the API to the requests authorize lets in,
+// with the credential they were let in with in their context.
 func (s *CertDXServer) apiWithTokenHandler(w http.ResponseWriter, r *http.Request) {
-	if s.checkAuthorizationToken(r) {
+	var ip netip.Addr
+	if s.limiter != nil {
+		ip = clientIP(r, s.Config.HttpServer.TrustedProxyPrefixes)
+		if !s.limitBeforeAuth(w, r, ip) {
+			return
+		}
+	}
+	token, ok := s.authorize(r)
+	if s.limiter != nil && !s.limitAfterAuth(w, r, ip, token, ok) {
+		return
+	}
+	switch {
+	case ok:
+		if token != nil {
+			r = r.WithContext(withCredential(r.Context(), token))
+		}
 		s.apiHandler(w, r)
-	} else {
+	case s.v2Handler(r.URL.Path) != nil:
+		// v1 hides its endpoints from unauthorized callers; v2 says why
+		// it refuses.
+		if s.Config.HttpServer.UsesJWT() {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeUnauthorized, Message: "Missing or wrong credentials"})
+	default:
 		http.Error(w, "", http.StatusNotFound)
 	}
 }
 
-func (s *CertDXServer) checkAuthorizationToken(r *http.Request) bool {
-	if s.Config.HttpServer.Token == "" {
-		return true
+// authorize returns the credential r is authorized with, per the auth
+// method: a configured token, the identity of a bearer JWT or that of a
+// client certificate. Peer sync takes a peer token and nothing else.
+func (s *CertDXServer) authorize(r *http.Request) (*config.HttpToken, bool) {
+	switch {
+	case s.Config.PeerSync.Serve && r.URL.Path == s.apiSubPath("sync"):
+		return matchToken(r, s.Config.PeerSync.Peers)
+	case s.Config.HttpServer.UsesJWT():
+		return s.checkBearerToken(r)
+	case s.Config.HttpServer.AuthMethod == config.HTTP_AUTH_MTLS:
+		return s.checkClientCert(r)
 	}
+	return s.checkAuthorizationToken(r)
+}
 
+// checkAuthorizationToken returns the token r carries if it is one of
+// the configured tokens and hasn't expired. With no token configured
+// every request is authorized, with a nil token.
+func (s *CertDXServer) checkAuthorizationToken(r *http.Request) (*config.HttpToken, bool) {
+	tokens := s.Config.HttpServer.AuthTokens()
+	if len(tokens) == 0 {
+		return nil, true
+	}
+	return matchToken(r, tokens)
+}
+
+// matchToken returns the one of tokens r carries, if it hasn't expired.
+func matchToken(r *http.Request, tokens []config.HttpToken) (*config.HttpToken, bool) {
+	xff := r.Header.Get("X-Forwarded-For")
 	auth := r.Header.Get("Authorization")
-	if auth != "" && strings.HasPrefix(auth, "Token ") {
-		token := strings.TrimPrefix(auth, "Token ")
-		if token == s.Config.HttpServer.Token {
-			return true
+	if token, ok := strings.CutPrefix(auth, "Token "); ok && token != "" {
+		// Check every token so the time taken doesn't tell which one
+		// matched.
+		var found *config.HttpToken
+		for i := range tokens {
+			if tokens[i].Matches(token) && found == nil {
+				found = &tokens[i]
+			}
+		}
+		if found != nil {
+			if !found.Expired(time.Now()) {
+				return found, true
+			}
+			logging.Warn("Expired token %q used from: %s, xff: %s", found.Name, r.RemoteAddr, xff)
+			return nil, false
 		}
 	}
 
-	xff := r.Header.Get("X-Forwarded-For")
 	logging.Warn("Not authorized request from: %s, xff: %s", r.RemoteAddr, xff)
+	return nil, false
+}
+
+// tokenCtxKey keys the credential a request was authorized with in its
+// context.
+type tokenCtxKey struct{}
+
+// requestToken returns the credential the request of ctx was authorized
+// with, or nil when the API is open.
+func requestToken(ctx context.Context) *config.HttpToken {
+	t, _ := ctx.Value(tokenCtxKey{}).(*config.HttpToken)
+	return t
+}
+
+// requester describes who sent r for logs: its address, and the name of
+// its credential.
+func requester(r *http.Request) string {
+	if t := requestToken(r.Context()); t != nil {
+		return fmt.Sprintf("%s (%s)", r.RemoteAddr, t.Name)
+	}
+	return r.RemoteAddr
+}
+
+// checkDomains returns an error wrapping domain.ErrNotAllowed unless all
+// of domains are allowed, and within the scope of the credential of ctx,
+// if any.
+func (s *CertDXServer) checkDomains(ctx context.Context, domains []string) error {
+	if !domain.AllAllowed(s.Config.ACME.AllowedDomains, domains) {
+		return fmt.Errorf("domains %v: %w", domains, domain.ErrNotAllowed)
+	}
+	if t := requestToken(ctx); t != nil && !t.Allows(domains) {
+		return fmt.Errorf("domains %v for %q: %w", domains, t.Name, domain.ErrNotAllowed)
+	}
+	return nil
+}
+
+// fetchCert returns the pack for domains and the cert to serve from it,
+// renewing the pack first when needed. The pack is leased, so it keeps
+// being renewed while clients poll it.
+func (s *CertDXServer) fetchCert(ctx context.Context, domains []string) (*certEntry, CertT, error) {
+	// The error wraps domain.ErrNotAllowed so callers can branch on
+	// errors.Is — same pattern as the SDS path, instead of separate
+	// "domains not allowed" code sites.
+	if err := s.checkDomains(ctx, domains); err != nil {
+		return nil, CertT{}, err
+	}
+
+	entry, err := s.admitPack(ctx, domains)
+	if err != nil {
+		return nil, CertT{}, err
+	}
+	s.leaseHTTP(entry)
+	// A subscribed pack is kept fresh by its renewer; only wait on it
+	// when there is nothing to serve yet, e.g. on the first request for
+	// a pack, while the renewer's first issuance is still in flight.
+	cert := entry.Cert()
+	if !s.isSubscribing(entry) || cert.Expired() {
+		if _, err := s.renew(ctx, entry, false); err != nil {
+			return nil, CertT{}, err
+		}
+		cert = entry.Cert()
+	}
+	return entry, cert, nil
+}
+
+// certETag returns the ETag of a cert response: a digest of what it
+// carries besides the key, which comes and goes with the chain. It is
+// derived from the cert rather than the entry's version so that it holds
+// across server restarts and the servers of a client's pool.
+func certETag(resp *api.HttpCertResp) string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, int64(resp.RenewTimeLeft))
+	h.Write(resp.FullChain)
+	h.Write([]byte(resp.Warning))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatch reports whether the If-None-Match header value header
+// matches etag, comparing weakly as RFC 9110 asks.
+func etagMatch(header, etag string) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
 	return false
 }
 
@@ -71,6 +237,9 @@ func (s *CertDXServer) handleCertReq(w *http.ResponseWriter, r *http.Request) {
 	var resp []byte
 	var cachedCert *certEntry
 	var cert CertT
+	var acmeConfig *config.ACMEConfig
+	var certResp *api.HttpCertResp
+	var etag string
 
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -80,35 +249,34 @@ func (s *CertDXServer) handleCertReq(w *http.ResponseWriter, r *http.Request) {
 		goto ERR
 	}
 
-	if !domain.AllAllowed(s.Config.ACME.AllowedDomains, req.Domains) {
-		// Wrap the sentinel so the response handler below can branch on
-		// errors.Is — same pattern as the SDS path, instead of two
-		// separate "domains not allowed" code sites.
-		err = fmt.Errorf("domains %v: %w", req.Domains, domain.ErrNotAllowed)
+	cachedCert, cert, err = s.fetchCert(r.Context(), req.Domains)
+	if err != nil {
 		goto ERR
 	}
 
-	cachedCert = s.certCache.get(req.Domains)
-	if !s.isSubscribing(cachedCert) {
-		_, err = s.renew(r.Context(), cachedCert, false)
-		if err != nil {
-			goto ERR
-		}
-	}
-
-	cert = cachedCert.Cert()
-	resp, err = json.Marshal(&api.HttpCertResp{
-		RenewTimeLeft: s.Config.ACME.RenewTimeLeftDuration,
+	_, acmeConfig = s.acmeFor(cachedCert)
+	certResp = &api.HttpCertResp{
+		RenewTimeLeft: acmeConfig.RenewTimeLeftDuration,
 		FullChain:     cert.FullChain,
 		Key:           cert.Key,
-	})
+		Warning:       s.expiryWarning(cachedCert, &cert),
+	}
+	etag = certETag(certResp)
+	(*w).Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		(*w).WriteHeader(http.StatusNotModified)
+		logging.Info("Http cert: %v not modified for: %s", cachedCert.domains, requester(r))
+		return
+	}
+
+	resp, err = json.Marshal(certResp)
 	if err != nil {
 		goto ERR
 	}
 
 	(*w).Header().Set("Content-Type", "application/json")
 	(*w).Write(resp)
-	logging.Info("Http sent cert: %v to: %s", cachedCert.domains, r.RemoteAddr)
+	logging.Info("Http sent cert: %v to: %s", cachedCert.domains, requester(r))
 	return
 
 ERR:
@@ -118,10 +286,58 @@ ERR:
 		(*w).Write([]byte(`{ "err": "Domains not allowed" }`))
 		return
 	}
+	if v1, ok := approvalErrV1(err); ok {
+		logging.Warn("Requested domains %v from %s: %s", req.Domains, requester(r), err)
+		writeJSON(*w, &api.HttpCertResp{Err: v1})
+		return
+	}
+	if v1, ok := quotaErrV1(err); ok {
+		logging.Warn("Requested domains %v from %s refused: %s", req.Domains, requester(r), err)
+		writeJSON(*w, &api.HttpCertResp{Err: v1})
+		return
+	}
+	if errors.Is(err, ErrExternalExpired) {
+		logging.Warn("Requested external cert expired: %s", err)
+		(*w).Header().Set("Content-Type", "application/json")
+		(*w).Write([]byte(`{ "err": "External cert expired" }`))
+		return
+	}
 	logging.Error("Handle http cert request failed: %s", err)
 	http.Error(*w, "", http.StatusInternalServerError)
 }
 
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		logging.Error("Marshal http response failed: %s", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func decodeReq(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return fmt.Errorf("no body")
+	}
+	return err
+}
+
+func toAPIVersion(v CertVersion) api.HttpCertVersion {
+	return api.HttpCertVersion{
+		Serial:      v.Serial,
+		Issuer:      v.Issuer,
+		NotAfter:    v.NotAfter,
+		ValidBefore: v.ValidBefore,
+		RenewAt:     v.RenewAt,
+		External:    v.External,
+		Current:     v.Current,
+	}
+}
+
 // runHTTPServer starts a graceful-shutdown watcher tied to ctx and then
 // blocks on listen() until either the listener exits on its own or ctx
 // fires. On ctx fire, server.Shutdown is called with httpShutdownTimeout
@@ -187,7 +403,11 @@ func (s *CertDXServer) serveHttps(handler http.Handler) error {
 
 		logging.Info("Https server started")
 		err = runHTTPServer(iterCtx, server, func() error {
-			return server.ListenAndServeTLS("", "")
+			l, err := listen(s.Config.HttpServer.Listen, &s.Config.HttpServer.ListenOptions)
+			if err != nil {
+				return err
+			}
+			return server.ServeTLS(l, "", "")
 		})
 		cancel()
 		logging.Info("Https server stopped")
@@ -200,8 +420,8 @@ func (s *CertDXServer) serveHttps(handler http.Handler) error {
 	return nil
 }
 
-// serveHttp runs the plain (unencrypted) token-auth HTTP API. Used only
-// when token auth is enabled and Secure is false.
+// serveHttp runs the plain (unencrypted) token- or JWT-auth HTTP API.
+// Used only when Secure is false.
 func (s *CertDXServer) serveHttp(handler http.Handler) error {
 	server := &http.Server{
 		Addr:     s.Config.HttpServer.Listen,
@@ -210,7 +430,13 @@ func (s *CertDXServer) serveHttp(handler http.Handler) error {
 	}
 	logging.Info("Http server started")
 	defer logging.Info("Http server stopped")
-	return runHTTPServer(s.rootCtx, server, server.ListenAndServe)
+	return runHTTPServer(s.rootCtx, server, func() error {
+		l, err := listen(s.Config.HttpServer.Listen, &s.Config.HttpServer.ListenOptions)
+		if err != nil {
+			return err
+		}
+		return server.Serve(l)
+	})
 }
 
 // serveHttpMtls runs the mTLS-authenticated HTTP API.
@@ -229,7 +455,11 @@ func (s *CertDXServer) serveHttpMtls(handler http.Handler) error {
 	logging.Info("Http mtls server started")
 	defer logging.Info("Http mtls server stopped")
 	return runHTTPServer(s.rootCtx, server, func() error {
-		return server.ListenAndServeTLS("", "")
+		l, err := listen(s.Config.HttpServer.Listen, &s.Config.HttpServer.ListenOptions)
+		if err != nil {
+			return err
+		}
+		return server.ServeTLS(l, "", "")
 	})
 }
 
@@ -240,14 +470,19 @@ func (s *CertDXServer) HttpSrv() error {
 
 	mux := http.NewServeMux()
 	switch s.Config.HttpServer.AuthMethod {
-	case config.HTTP_AUTH_TOKEN:
+	case config.HTTP_AUTH_TOKEN, config.HTTP_AUTH_JWT, config.HTTP_AUTH_OIDC:
+		if s.Config.HttpServer.UsesJWT() {
+			s.jwt = newJWTAuth(&s.Config.HttpServer.JWT)
+		}
+		s.initLimiter()
 		mux.HandleFunc("/", s.apiWithTokenHandler)
 		if s.Config.HttpServer.Secure {
 			return s.serveHttps(mux)
 		}
 		return s.serveHttp(mux)
 	case config.HTTP_AUTH_MTLS:
-		mux.HandleFunc("/", s.apiHandler)
+		s.initLimiter()
+		mux.HandleFunc("/", s.apiWithTokenHandler)
 		return s.serveHttpMtls(mux)
 	default:
 		return fmt.Errorf("unsupported HTTP auth method: %q", s.Config.HttpServer.AuthMethod)
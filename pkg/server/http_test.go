@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
 )
 
 func makeTestServer(token string, apiPath string, allowedDomains []string) *CertDXServer {
@@ -26,7 +27,7 @@ func makeTestServer(token string, apiPath string, allowedDomains []string) *Cert
 func TestCheckAuthorizationTokenEmptyConfig(t *testing.T) {
 	s := makeTestServer("", "/", nil)
 	req := httptest.NewRequest("POST", "/", nil)
-	if !s.checkAuthorizationToken(req) {
+	if _, ok := s.checkAuthorizationToken(req); !ok {
 		t.Fatal("empty config token should always authorize")
 	}
 }
@@ -35,7 +36,7 @@ func TestCheckAuthorizationTokenValid(t *testing.T) {
 	s := makeTestServer("secret123", "/", nil)
 	req := httptest.NewRequest("POST", "/", nil)
 	req.Header.Set("Authorization", "Token secret123")
-	if !s.checkAuthorizationToken(req) {
+	if _, ok := s.checkAuthorizationToken(req); !ok {
 		t.Fatal("valid token should authorize")
 	}
 }
@@ -44,7 +45,7 @@ func TestCheckAuthorizationTokenInvalid(t *testing.T) {
 	s := makeTestServer("secret123", "/", nil)
 	req := httptest.NewRequest("POST", "/", nil)
 	req.Header.Set("Authorization", "Token wrong")
-	if s.checkAuthorizationToken(req) {
+	if _, ok := s.checkAuthorizationToken(req); ok {
 		t.Fatal("invalid token should not authorize")
 	}
 }
@@ -52,7 +53,7 @@ func TestCheckAuthorizationTokenInvalid(t *testing.T) {
 func TestCheckAuthorizationTokenMissingHeader(t *testing.T) {
 	s := makeTestServer("secret123", "/", nil)
 	req := httptest.NewRequest("POST", "/", nil)
-	if s.checkAuthorizationToken(req) {
+	if _, ok := s.checkAuthorizationToken(req); ok {
 		t.Fatal("missing Authorization header should not authorize")
 	}
 }
@@ -61,11 +62,75 @@ func TestCheckAuthorizationTokenWrongScheme(t *testing.T) {
 	s := makeTestServer("secret123", "/", nil)
 	req := httptest.NewRequest("POST", "/", nil)
 	req.Header.Set("Authorization", "Bearer secret123")
-	if s.checkAuthorizationToken(req) {
+	if _, ok := s.checkAuthorizationToken(req); ok {
 		t.Fatal("Bearer scheme should not authorize (expects 'Token ')")
 	}
 }
 
+func TestCheckAuthorizationTokenNamed(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.HttpServer.Tokens = []config.HttpToken{
+		{Name: "web", Hash: config.HashToken("web-secret")},
+		{Name: "old", Hash: config.HashToken("old-secret"), ExpiresAt: time.Now().Add(-time.Minute)},
+	}
+
+	cases := []struct {
+		auth string
+		want string
+	}{
+		{"Token web-secret", "web"},
+		{"Token old-secret", ""},
+		{"Token " + config.HashToken("web-secret"), ""},
+		{"Token ", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Authorization", tc.auth)
+		token, ok := s.checkAuthorizationToken(req)
+		if ok != (tc.want != "") {
+			t.Errorf("%q: authorized %v", tc.auth, ok)
+			continue
+		}
+		if ok && token.Name != tc.want {
+			t.Errorf("%q: token %q want %q", tc.auth, token.Name, tc.want)
+		}
+	}
+}
+
+func TestApiWithTokenHandlerScopedToken(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.HttpServer.Tokens = []config.HttpToken{
+		{Name: "web", Hash: config.HashToken("web-secret"), Domains: []string{"web.example.com"}},
+	}
+	entry := s.certCache.get([]string{"web.example.com"})
+	entry.stateMu.Lock()
+	entry.cert = CertT{FullChain: []byte("PEM-chain"), Key: []byte("PEM-key"), ValidBefore: time.Now().Add(time.Hour)}
+	entry.subscribing = 1
+	entry.stateMu.Unlock()
+
+	request := func(domains ...string) api.HttpCertResp {
+		body, _ := json.Marshal(api.HttpCertReq{Domains: domains})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Token web-secret")
+		w := httptest.NewRecorder()
+		s.apiWithTokenHandler(w, req)
+		var resp api.HttpCertResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: unmarshal response %q: %v", domains, w.Body.String(), err)
+		}
+		return resp
+	}
+
+	if resp := request("web.example.com"); string(resp.FullChain) != "PEM-chain" {
+		t.Errorf("domain in scope: %+v", resp)
+	}
+	for _, domains := range [][]string{{"example.com"}, {"web.example.com", "mail.example.com"}} {
+		if resp := request(domains...); resp.Err != "Domains not allowed" {
+			t.Errorf("%v out of scope: %+v", domains, resp)
+		}
+	}
+}
+
 func TestApiHandlerWrongPath(t *testing.T) {
 	s := makeTestServer("", "/api/cert", nil)
 	req := httptest.NewRequest("POST", "/wrong", nil)
@@ -170,3 +235,51 @@ func TestHandleCertReqInvalidJSON(t *testing.T) {
 		t.Fatalf("invalid json: got %d want %d", w.Code, http.StatusInternalServerError)
 	}
 }
+
+func TestHandleCertReqETag(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	entry := s.certCache.get([]string{"example.com"})
+	entry.stateMu.Lock()
+	entry.cert = CertT{
+		FullChain:   []byte("PEM-chain"),
+		Key:         []byte("PEM-key"),
+		ValidBefore: time.Now().Add(time.Hour),
+	}
+	entry.subscribing = 1
+	entry.stateMu.Unlock()
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.HttpCertReq{Domains: []string{"example.com"}})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		var rw http.ResponseWriter = w
+		s.handleCertReq(&rw, req)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("first request: got %d etag %q", w.Code, etag)
+	}
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = get(inm)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: got %d with %d bytes", inm, w.Code, w.Body.Len())
+		}
+	}
+	if w = get(`"other"`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fullchain") {
+		t.Errorf("stale etag: got %d %s", w.Code, w.Body.String())
+	}
+
+	entry.stateMu.Lock()
+	entry.cert.FullChain = []byte("PEM-chain-2")
+	entry.stateMu.Unlock()
+	if w = get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after cert change: got %d etag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// statusV2 returns the HTTP status of a v2 error code.
+func statusV2(code string) int {
+	switch code {
+	case api.ErrCodeApprovalPending:
+		return http.StatusAccepted
+	case api.ErrCodeBadRequest:
+		return http.StatusBadRequest
+	case api.ErrCodeUnauthorized:
+		return http.StatusUnauthorized
+	case api.ErrCodeNotAllowed, api.ErrCodeApprovalDenied:
+		return http.StatusForbidden
+	case api.ErrCodeMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case api.ErrCodePackRejected:
+		return http.StatusUnprocessableEntity
+	case api.ErrCodeQuotaExceeded, api.ErrCodeRateLimited, api.ErrCodeTooManyRequests:
+		return http.StatusTooManyRequests
+	case api.ErrCodeUnavailable, api.ErrCodeExternalExpired:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errorV2 maps an error fetching a pack to its v2 error. Messages don't
+// carry err itself, which may hold details of the ACME setup; it is
+// logged instead.
+func errorV2(err error) *api.HttpErrorV2 {
+	switch {
+	case errors.Is(err, domain.ErrNotAllowed):
+		return &api.HttpErrorV2{Code: api.ErrCodeNotAllowed, Message: "Domains not allowed"}
+	case errors.Is(err, ErrExternalExpired):
+		return &api.HttpErrorV2{Code: api.ErrCodeExternalExpired, Message: "External cert expired"}
+	case errors.Is(err, ErrApprovalPending):
+		return &api.HttpErrorV2{Code: api.ErrCodeApprovalPending, Message: "Pack awaits an operator's approval"}
+	case errors.Is(err, ErrApprovalDenied):
+		return &api.HttpErrorV2{Code: api.ErrCodeApprovalDenied, Message: "Pack denied by an operator"}
+	}
+	var qe *QuotaError
+	if errors.As(err, &qe) {
+		code := api.ErrCodeQuotaExceeded
+		if errors.Is(err, ErrPackRejected) {
+			code = api.ErrCodePackRejected
+		}
+		return &api.HttpErrorV2{
+			Code:       code,
+			Message:    fmt.Sprintf("%s (%s)", qe.Reason, qe.Limit),
+			RetryAfter: int((qe.RetryAfter + time.Second - 1) / time.Second),
+		}
+	}
+	if wait, ok := acme.RateLimited(err); ok {
+		return &api.HttpErrorV2{
+			Code:       api.ErrCodeRateLimited,
+			Message:    "ACME rate limit reached",
+			RetryAfter: int((wait + time.Second - 1) / time.Second),
+		}
+	}
+	return &api.HttpErrorV2{Code: api.ErrCodeUnavailable, Message: "Cert could not be obtained"}
+}
+
+// writeJSONV2 writes resp with the given status.
+func writeJSONV2(w http.ResponseWriter, status int, resp *api.HttpCertsRespV2) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		logging.Error("Marshal http v2 response failed: %s", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":{"code":"internal","message":"Internal error"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Error != nil && resp.Error.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(resp.Error.RetryAfter))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeErrorV2 rejects a v2 request as a whole.
+func writeErrorV2(w http.ResponseWriter, e *api.HttpErrorV2) {
+	writeJSONV2(w, statusV2(e.Code), &api.HttpCertsRespV2{Error: e})
+}
+
+// splitFullChain splits a PEM chain into its first certificate and the
+// ones that follow it.
+func splitFullChain(fullchain []byte) (leaf, chain []byte) {
+	rest := fullchain
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return fullchain, nil
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	leaf = fullchain[:len(fullchain)-len(rest)]
+	return bytes.TrimSpace(leaf), bytes.TrimSpace(rest)
+}
+
+// v2Handler returns the handler of the v2 endpoint at path, or nil if
+// path is none of them.
+func (s *CertDXServer) v2Handler(path string) http.HandlerFunc {
+	switch path {
+	case s.apiSubPath(api.V2Path):
+		return s.handleCertsReqV2
+	case s.apiSubPath(api.WatchPathV2):
+		return s.handleWatchV2
+	}
+	return nil
+}
+
+// fetchPackV2 fetches the pack for domains. On failure the returned pack
+// carries the error and the entry is nil.
+func (s *CertDXServer) fetchPackV2(ctx context.Context, domains []string) (*certEntry, api.HttpPackV2) {
+	entry, _, err := s.fetchCert(ctx, domains)
+	if err != nil {
+		pack := api.HttpPackV2{Domains: domains, Error: errorV2(err)}
+		if pack.Error.Code == api.ErrCodeUnavailable {
+			logging.Error("Http v2 get cert %v failed: %s", domains, err)
+		} else {
+			logging.Warn("Http v2 get cert %v: %s", domains, err)
+		}
+		return nil, pack
+	}
+	return entry, s.entryPackV2(entry)
+}
+
+// packV2 fetches the pack for domains as a v2 response pack.
+func (s *CertDXServer) packV2(ctx context.Context, domains []string) api.HttpPackV2 {
+	_, pack := s.fetchPackV2(ctx, domains)
+	return pack
+}
+
+// entryPackV2 returns the current cert of entry as a v2 response pack.
+func (s *CertDXServer) entryPackV2(entry *certEntry) api.HttpPackV2 {
+	var pack api.HttpPackV2
+	cert, version := entry.Snapshot()
+	_, acmeConfig := s.acmeFor(entry)
+	pack.Domains = entry.domains
+	pack.Version = version
+	pack.Serial = cert.Serial
+	pack.Issuer = cert.Issuer
+	pack.NotBefore = cert.NotBefore
+	pack.NotAfter = cert.NotAfter
+	pack.RenewTimeLeft = acmeConfig.RenewTimeLeftDuration
+	pack.External = cert.External
+	pack.Leaf, pack.Chain = splitFullChain(cert.FullChain)
+	pack.Key = cert.Key
+	pack.Warning = s.expiryWarning(entry, &cert)
+	return pack
+}
+
+// handleCertsReqV2 serves POST <apiPath>/v2/certs. The requested packs
+// are fetched concurrently, so one waiting on an issuance doesn't hold
+// up the others.
+func (s *CertDXServer) handleCertsReqV2(w http.ResponseWriter, r *http.Request) {
+	var req api.HttpCertsReqV2
+	if err := decodeReq(r, &req); err != nil {
+		writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+	if len(req.Packs) == 0 || len(req.Packs) > api.HttpCertsMaxPacksV2 {
+		writeErrorV2(w, &api.HttpErrorV2{
+			Code:    api.ErrCodeBadRequest,
+			Message: fmt.Sprintf("Request 1 to %d packs", api.HttpCertsMaxPacksV2),
+		})
+		return
+	}
+	for i, p := range req.Packs {
+		if len(p.Domains) == 0 {
+			writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Pack %d has no domains", i)})
+			return
+		}
+	}
+	logging.Info("Http v2 received request for %d packs from: %s", len(req.Packs), requester(r))
+
+	resp := &api.HttpCertsRespV2{Packs: make([]api.HttpPackV2, len(req.Packs))}
+	var wg sync.WaitGroup
+	for i, p := range req.Packs {
+		wg.Go(func() { resp.Packs[i] = s.packV2(r.Context(), p.Domains) })
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, p := range resp.Packs {
+		if p.Error != nil {
+			if failed == 0 {
+				resp.Error = p.Error
+			}
+			failed++
+			continue
+		}
+		logging.Info("Http v2 sent cert: %v to: %s", p.Domains, requester(r))
+	}
+
+	status := http.StatusOK
+	if failed == len(resp.Packs) {
+		status = statusV2(resp.Error.Code)
+	} else {
+		resp.Error = nil
+	}
+	writeJSONV2(w, status, resp)
+}
+
+// handleWatchV2 serves POST <apiPath>/v2/watch. While the request waits
+// the pack is subscribed, so its renewer runs and any new cert, renewed,
+// rolled back, imported or adopted from the store, wakes the request.
+func (s *CertDXServer) handleWatchV2(w http.ResponseWriter, r *http.Request) {
+	var req api.HttpWatchReqV2
+	if err := decodeReq(r, &req); err != nil {
+		writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: fmt.Sprintf("Invalid request body: %s", err)})
+		return
+	}
+	if len(req.Domains) == 0 {
+		writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeBadRequest, Message: "No domains"})
+		return
+	}
+	wait := req.Wait
+	if wait <= 0 || wait > api.HttpWatchMaxWaitV2 {
+		wait = api.HttpWatchMaxWaitV2
+	}
+
+	entry, pack := s.fetchPackV2(r.Context(), req.Domains)
+	if entry == nil {
+		writeJSONV2(w, statusV2(pack.Error.Code), &api.HttpCertsRespV2{Packs: []api.HttpPackV2{pack}, Error: pack.Error})
+		return
+	}
+
+	if pack.Version == req.Version {
+		s.subscribe(entry)
+		defer s.release(entry)
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		// Shutdown waits for requests to finish; don't hold it up.
+		stop := context.AfterFunc(s.rootCtx, cancel)
+		defer stop()
+
+		if entry.WaitForUpdate(ctx, req.Version) == req.Version {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		pack = s.entryPackV2(entry)
+	}
+
+	logging.Info("Http v2 sent cert: %v version %d to watcher: %s", pack.Domains, pack.Version, requester(r))
+	writeJSONV2(w, http.StatusOK, &api.HttpCertsRespV2{Packs: []api.HttpPackV2{pack}})
+}
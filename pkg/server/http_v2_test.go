@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+
+	"pkg.para.party/certdx/pkg/api"
+)
+
+// rateLimitedObtainer fails every order the way lego reports a CA rate
+// limit.
+type rateLimitedObtainer struct{}
+
+func (rateLimitedObtainer) Obtain(context.Context, []string, time.Time) ([]byte, []byte, error) {
+	return nil, nil, &legoacme.RateLimitedError{
+		ProblemDetails: &legoacme.ProblemDetails{Type: "urn:ietf:params:acme:error:rateLimited", HTTPStatus: 429},
+		RetryAfter:     "60",
+	}
+}
+
+func (o rateLimitedObtainer) RetryObtain(ctx context.Context, domains []string, deadline time.Time) ([]byte, []byte, error) {
+	return o.Obtain(ctx, domains, deadline)
+}
+
+// postV2 sends body to the v2 endpoint of s and decodes the response.
+func postV2(t *testing.T, s *CertDXServer, body string) (*httptest.ResponseRecorder, *api.HttpCertsRespV2) {
+	t.Helper()
+	return postPathV2(t, s, api.V2Path, body)
+}
+
+// postPathV2 sends body to the v2 endpoint at path and decodes the
+// response, if it has one.
+func postPathV2(t *testing.T, s *CertDXServer, path, body string) (*httptest.ResponseRecorder, *api.HttpCertsRespV2) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/"+path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.apiHandler(w, req)
+
+	resp := new(api.HttpCertsRespV2)
+	if w.Code == http.StatusNoContent {
+		return w, resp
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+	return w, resp
+}
+
+// watchV2 watches the pack for example.com on s past version.
+func watchV2(t *testing.T, s *CertDXServer, version uint64, wait time.Duration) (*httptest.ResponseRecorder, *api.HttpCertsRespV2) {
+	t.Helper()
+	body, _ := json.Marshal(&api.HttpWatchReqV2{Domains: []string{"example.com"}, Version: version, Wait: wait})
+	return postPathV2(t, s, api.WatchPathV2, string(body))
+}
+
+func TestHandleCertsReqV2MultiplePacks(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	w, resp := postV2(t, s, `{"packs":[{"domains":["example.com"]},{"domains":["www.example.com"]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: got %d want 200, body %s", w.Code, w.Body.String())
+	}
+	if resp.Error != nil || len(resp.Packs) != 2 {
+		t.Fatalf("response: %+v", resp)
+	}
+	for i, want := range []string{"example.com", "www.example.com"} {
+		p := resp.Packs[i]
+		if p.Error != nil || len(p.Domains) != 1 || p.Domains[0] != want {
+			t.Fatalf("pack %d: %+v", i, p)
+		}
+		if p.Serial == "" || p.Issuer == "" || p.Version == 0 || p.RenewTimeLeft != time.Hour {
+			t.Errorf("pack %d metadata: %+v", i, p)
+		}
+		if !p.NotBefore.Before(p.NotAfter) {
+			t.Errorf("pack %d validity: %s - %s", i, p.NotBefore, p.NotAfter)
+		}
+		if !bytes.HasPrefix(p.Leaf, []byte("-----BEGIN CERTIFICATE-----")) || len(p.Chain) != 0 || len(p.Key) == 0 {
+			t.Errorf("pack %d PEM: leaf %q chain %q", i, p.Leaf, p.Chain)
+		}
+	}
+}
+
+func TestHandleCertsReqV2PartialFailure(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	w, resp := postV2(t, s, `{"packs":[{"domains":["example.com"]},{"domains":["evil.com"]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: got %d want 200", w.Code)
+	}
+	if resp.Error != nil {
+		t.Errorf("top-level error with a pack served: %+v", resp.Error)
+	}
+	if resp.Packs[0].Error != nil || len(resp.Packs[0].Leaf) == 0 {
+		t.Errorf("allowed pack: %+v", resp.Packs[0])
+	}
+	if e := resp.Packs[1].Error; e == nil || e.Code != api.ErrCodeNotAllowed {
+		t.Errorf("denied pack error: %+v", e)
+	}
+}
+
+func TestHandleCertsReqV2Errors(t *testing.T) {
+	cases := []struct {
+		name       string
+		obtainer   func(s *CertDXServer)
+		body       string
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{"not allowed", nil, `{"packs":[{"domains":["evil.com"]}]}`, http.StatusForbidden, api.ErrCodeNotAllowed, ""},
+		{"no packs", nil, `{"packs":[]}`, http.StatusBadRequest, api.ErrCodeBadRequest, ""},
+		{"empty pack", nil, `{"packs":[{"domains":[]}]}`, http.StatusBadRequest, api.ErrCodeBadRequest, ""},
+		{"bad json", nil, `{"packs":`, http.StatusBadRequest, api.ErrCodeBadRequest, ""},
+		{"rate limited", func(s *CertDXServer) { s.acme = rateLimitedObtainer{} },
+			`{"packs":[{"domains":["example.com"]}]}`, http.StatusTooManyRequests, api.ErrCodeRateLimited, "60"},
+		{"issuance failed", func(s *CertDXServer) { s.acme = failingObtainer{} },
+			`{"packs":[{"domains":["example.com"]}]}`, http.StatusServiceUnavailable, api.ErrCodeUnavailable, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := makeHistoryTestServer(t)
+			if tc.obtainer != nil {
+				tc.obtainer(s)
+			}
+			w, resp := postV2(t, s, tc.body)
+			if w.Code != tc.status {
+				t.Fatalf("status: got %d want %d, body %s", w.Code, tc.status, w.Body.String())
+			}
+			if resp.Error == nil || resp.Error.Code != tc.code {
+				t.Fatalf("error: got %+v want code %s", resp.Error, tc.code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tc.retryAfter {
+				t.Errorf("Retry-After: got %q want %q", got, tc.retryAfter)
+			}
+		})
+	}
+}
+
+func TestHandleCertsReqV2MethodAndAuth(t *testing.T) {
+	s := makeTestServer("secret", "/", []string{"example.com"})
+
+	req := httptest.NewRequest("GET", "/"+api.V2Path, nil)
+	req.Header.Set("Authorization", "Token secret")
+	w := httptest.NewRecorder()
+	s.apiWithTokenHandler(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d want 405", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/"+api.V2Path, strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Token wrong")
+	w = httptest.NewRecorder()
+	s.apiWithTokenHandler(w, req)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), api.ErrCodeUnauthorized) {
+		t.Errorf("wrong token: got %d %s want 401", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleWatchV2(t *testing.T) {
+	s := makeHistoryTestServer(t)
+
+	w, resp := watchV2(t, s, 0, time.Minute)
+	if w.Code != http.StatusOK || len(resp.Packs) != 1 || resp.Packs[0].Version == 0 {
+		t.Fatalf("initial watch: got %d %+v", w.Code, resp)
+	}
+	<-s.storeUpdate
+	version := resp.Packs[0].Version
+
+	w, _ = watchV2(t, s, version, 50*time.Millisecond)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("unchanged watch: got %d want 204", w.Code)
+	}
+
+	entry := s.certCache.get([]string{"example.com"})
+	entry.stateMu.Lock()
+	subscribing := entry.subscribing
+	entry.stateMu.Unlock()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		forceRenew(t, s, entry)
+	}()
+	w, resp = watchV2(t, s, version, time.Minute)
+	if w.Code != http.StatusOK || len(resp.Packs) != 1 {
+		t.Fatalf("watch across renewal: got %d %+v", w.Code, resp)
+	}
+	if p := resp.Packs[0]; p.Version <= version || p.Serial == "" || len(p.Leaf) == 0 {
+		t.Errorf("renewed pack: %+v", p)
+	}
+	entry.stateMu.Lock()
+	defer entry.stateMu.Unlock()
+	if entry.subscribing != subscribing {
+		t.Errorf("subscribers after watch: got %d want %d", entry.subscribing, subscribing)
+	}
+}
+
+func TestHandleWatchV2Errors(t *testing.T) {
+	s := makeHistoryTestServer(t)
+
+	w, resp := postPathV2(t, s, api.WatchPathV2, `{"domains":[]}`)
+	if w.Code != http.StatusBadRequest || resp.Error.Code != api.ErrCodeBadRequest {
+		t.Errorf("no domains: got %d %+v", w.Code, resp.Error)
+	}
+
+	w, resp = postPathV2(t, s, api.WatchPathV2, `{"domains":["evil.com"]}`)
+	if w.Code != http.StatusForbidden || resp.Error.Code != api.ErrCodeNotAllowed {
+		t.Errorf("not allowed: got %d %+v", w.Code, resp.Error)
+	}
+	if len(resp.Packs) != 1 || resp.Packs[0].Error == nil {
+		t.Errorf("not allowed pack: %+v", resp.Packs)
+	}
+}
+
+func TestHandleWatchV2Shutdown(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	_, resp := watchV2(t, s, 0, time.Minute)
+	<-s.storeUpdate
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+	}()
+	start := time.Now()
+	w, _ := watchV2(t, s, resp.Packs[0].Version, time.Minute)
+	if w.Code != http.StatusNoContent || time.Since(start) > 10*time.Second {
+		t.Errorf("watch during shutdown: got %d after %s", w.Code, time.Since(start))
+	}
+}
+
+func TestSplitFullChain(t *testing.T) {
+	fullchain, _ := makeExternalCert(t, time.Hour, "example.com")
+	leafBlock, _ := pem.Decode(fullchain)
+	leafPEM := pem.EncodeToMemory(leafBlock)
+	caPEM := fullchain[len(leafPEM):]
+
+	leaf, chain := splitFullChain(fullchain)
+	if !bytes.Equal(leaf, bytes.TrimSpace(leafPEM)) {
+		t.Errorf("leaf: got %q", leaf)
+	}
+	if !bytes.Equal(chain, bytes.TrimSpace(caPEM)) {
+		t.Errorf("chain: got %q", chain)
+	}
+
+	leaf, chain = splitFullChain(leafPEM)
+	if !bytes.Equal(leaf, bytes.TrimSpace(leafPEM)) || len(chain) != 0 {
+		t.Errorf("single cert: leaf %q chain %q", leaf, chain)
+	}
+}
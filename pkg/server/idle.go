@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// maxEvictInterval caps how long evictIdle waits between sweeps.
+const maxEvictInterval = time.Hour
+
+// use returns the entry for domains, creating it if needed, and marks it
+// as just used. It holds the cache mutex while doing so, so an entry
+// returned by use is never evicted by a concurrent sweep.
+func (c *certCache) use(domains []string) *certEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.useNoLock(domains)
+}
+
+func (c *certCache) useNoLock(domains []string) *certEntry {
+	entry := c.getNoLock(domains)
+	entry.stateMu.Lock()
+	entry.lastUsed = time.Now()
+	entry.stateMu.Unlock()
+	return entry
+}
+
+// leaseHTTP keeps a pack requested over HTTP renewed in the background
+// until nobody has requested it for CertStore.idleTimeout. The lease is
+// a subscription held by the server itself; evictIdle releases it.
+func (s *CertDXServer) leaseHTTP(c *certEntry) {
+	if s.Config.CertStore.IdleTimeoutDuration == 0 {
+		return
+	}
+
+	c.stateMu.Lock()
+	leased := c.httpLease
+	c.httpLease = true
+	c.stateMu.Unlock()
+
+	if !leased {
+		logging.Info("Keeping HTTP requested cert %v renewed", c.domains)
+		s.subscribe(c)
+	}
+}
+
+// evictIdle releases the HTTP leases of packs not used for
+// CertStore.idleTimeout, then evicts those packs from the cache and the
+// store unless something else still subscribes to them. Managed packs
+// and packs serving an imported cert are never evicted: neither could be
+// issued again on demand.
+func (s *CertDXServer) evictIdle(ctx context.Context) {
+	timeout := s.Config.CertStore.IdleTimeoutDuration
+	now := time.Now()
+	var evicted []*certEntry
+
+	s.certCache.mutex.Lock()
+	for key, entry := range s.certCache.entries {
+		if entry.managed != nil {
+			continue
+		}
+
+		entry.stateMu.Lock()
+		lastUsed := entry.lastUsed
+		idle := now.Sub(lastUsed) >= timeout && !entry.cert.External
+		lease := idle && entry.httpLease
+		if lease {
+			entry.httpLease = false
+		}
+		entry.stateMu.Unlock()
+
+		if !idle {
+			continue
+		}
+		if lease {
+			s.releaseUsedAt(entry, lastUsed)
+		}
+		if !s.isSubscribing(entry) {
+			logging.Info("Evicting cert %v, not used since %s", entry.domains, lastUsed)
+			delete(s.certCache.entries, key)
+			evicted = append(evicted, entry)
+		}
+	}
+	s.certCache.mutex.Unlock()
+
+	// Under leader election the store is shared: a pack idle here may
+	// still be used through another server, so only the leader, which
+	// sees every follower's renewal requests, deletes it.
+	if !s.isLeader() {
+		return
+	}
+	for _, entry := range evicted {
+		if err := s.certStore.Delete(ctx, entry.domains); err != nil {
+			logging.Warn("Delete evicted cert %v from store failed: %s", entry.domains, err)
+		}
+	}
+}
+
+// runEvictor sweeps for idle packs until rootCtx is done.
+func (s *CertDXServer) runEvictor() {
+	timeout := s.Config.CertStore.IdleTimeoutDuration
+	if timeout == 0 {
+		return
+	}
+
+	interval := min(timeout/4, maxEvictInterval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.evictIdle(s.rootCtx)
+		case <-s.rootCtx.Done():
+			return
+		}
+	}
+}
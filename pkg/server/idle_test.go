@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// makeIdleTestServer returns a mock-backed server with a JSON store and
+// the given idle timeout.
+func makeIdleTestServer(t *testing.T, timeout time.Duration) *CertDXServer {
+	t.Helper()
+	s := makeHistoryTestServer(t)
+	s.Config.CertStore.IdleTimeoutDuration = timeout
+	s.certStore = makeTempCertStore(t)
+	return s
+}
+
+// markIdle makes entry look unused since before the idle timeout.
+func markIdle(s *CertDXServer, entry *certEntry) {
+	entry.stateMu.Lock()
+	entry.lastUsed = time.Now().Add(-s.Config.CertStore.IdleTimeoutDuration - time.Minute)
+	entry.stateMu.Unlock()
+}
+
+func cached(s *CertDXServer, domains []string) bool {
+	s.certCache.mutex.Lock()
+	defer s.certCache.mutex.Unlock()
+	_, ok := s.certCache.entries[domain.AsKey(domains)]
+	return ok
+}
+
+func TestLeaseHTTPRenewsInBackground(t *testing.T) {
+	s := makeIdleTestServer(t, time.Hour)
+	entry := s.certCache.use([]string{"example.com"})
+
+	s.leaseHTTP(entry)
+	s.leaseHTTP(entry)
+	entry.stateMu.Lock()
+	subscribing := entry.subscribing
+	entry.stateMu.Unlock()
+	if subscribing != 1 {
+		t.Fatalf("subscribing after two leases: got %d want 1", subscribing)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if entry.WaitForUpdate(ctx, 0) == 0 {
+		t.Fatal("leased pack was not issued in the background")
+	}
+}
+
+func TestLeaseHTTPDisabled(t *testing.T) {
+	s := makeIdleTestServer(t, 0)
+	entry := s.certCache.use([]string{"example.com"})
+	s.leaseHTTP(entry)
+	if s.isSubscribing(entry) {
+		t.Fatal("lease taken with idle eviction disabled")
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	ctx := context.Background()
+	s := makeIdleTestServer(t, time.Hour)
+
+	idle := []string{"idle.example.com"}
+	forceRenew(t, s, s.certCache.get(idle))
+	if err := s.certStore.SaveEntry(ctx, &CertStoreEntry{Domains: idle, Cert: s.certCache.get(idle).Cert()}); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+	leased := s.certCache.use([]string{"leased.example.com"})
+	s.leaseHTTP(leased)
+	streamed := s.certCache.get([]string{"sds.example.com"})
+	s.subscribe(streamed)
+	fresh := s.certCache.use([]string{"fresh.example.com"})
+
+	for _, e := range []*certEntry{s.certCache.get(idle), leased, streamed} {
+		markIdle(s, e)
+	}
+	s.evictIdle(ctx)
+
+	if cached(s, idle) {
+		t.Error("idle pack not evicted")
+	}
+	if cached(s, leased.domains) {
+		t.Error("idle leased pack not evicted")
+	}
+	if s.isSubscribing(leased) {
+		t.Error("HTTP lease not released")
+	}
+	if !cached(s, streamed.domains) {
+		t.Error("pack with an SDS subscriber evicted")
+	}
+	if !cached(s, fresh.domains) {
+		t.Error("recently used pack evicted")
+	}
+
+	stored, err := s.certStore.List(ctx)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if findEntry(stored, idle) != nil {
+		t.Error("evicted pack still in the store")
+	}
+}
+
+func TestReleaseStartsIdleTimeout(t *testing.T) {
+	s := makeIdleTestServer(t, time.Hour)
+	entry := s.certCache.get([]string{"sds.example.com"})
+	s.subscribe(entry)
+	markIdle(s, entry)
+
+	// A stream that just ended counts as a use.
+	s.release(entry)
+	s.evictIdle(context.Background())
+	if !cached(s, entry.domains) {
+		t.Fatal("pack evicted right after its last subscriber left")
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+const (
+	// jwksMinRefetch limits refetching the JWKS for tokens signed by an
+	// unknown key, so a stream of forged tokens can't hammer the issuer.
+	jwksMinRefetch = 30 * time.Second
+
+	// jwksFetchTimeout caps fetching the JWKS or the OIDC discovery
+	// document.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwtAlgorithms are the signature algorithms accepted for bearer JWTs.
+// Only public-key ones: a JWKS never holds a shared secret.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+var (
+	// ErrNoJWTRule is returned for a valid JWT matched by no rule.
+	ErrNoJWTRule = errors.New("no rule matches the token")
+
+	// ErrNoJWTExpiry is returned for a JWT without an exp claim, which
+	// would be good forever.
+	ErrNoJWTExpiry = errors.New("token has no expiry")
+
+	// ErrNoJWTName is returned for a JWT without the nameClaim. Rate
+	// limits and quotas are kept per name, so nameless callers would
+	// share them.
+	ErrNoJWTName = errors.New("token has no name claim")
+)
+
+// jwtAuth verifies bearer JWTs against the configured JWKS. The key set
+// is cached, reloaded every RefreshDuration and early when a token names
+// a key it doesn't hold, as after the issuer rotated its keys.
+type jwtAuth struct {
+	cfg    *config.HttpJWTConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	jwksURL   string
+	fetchedAt time.Time
+	triedAt   time.Time
+	loadErr   error
+	// loading is closed when the reload in flight, if any, is done.
+	loading chan struct{}
+}
+
+func newJWTAuth(c *config.HttpJWTConfig) *jwtAuth {
+	return &jwtAuth{
+		cfg:     c,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+		jwksURL: c.JWKSURL,
+	}
+}
+
+// keySet returns the cached JWKS, reloading it when stale or missing
+// kid. A failed reload keeps serving the previous keys. The reload runs
+// outside mu, one at a time: meanwhile requests whose kid is cached are
+// served the cached keys, and the others wait for it.
+func (a *jwtAuth) keySet(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	a.mu.Lock()
+	for a.loading != nil {
+		if a.keys != nil && len(a.keys.Key(kid)) > 0 {
+			defer a.mu.Unlock()
+			return a.keys, nil
+		}
+		loading := a.loading
+		a.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		a.mu.Lock()
+	}
+
+	now := time.Now()
+	if now.Sub(a.triedAt) < jwksMinRefetch {
+		defer a.mu.Unlock()
+		// Reloaded just now; don't try again for every unknown kid, or
+		// while the source is failing.
+		if a.keys == nil {
+			return nil, a.loadErr
+		}
+		return a.keys, nil
+	}
+	if a.keys != nil && now.Sub(a.fetchedAt) < a.cfg.RefreshDuration && len(a.keys.Key(kid)) > 0 {
+		defer a.mu.Unlock()
+		return a.keys, nil
+	}
+
+	a.triedAt = now
+	loading := make(chan struct{})
+	a.loading = loading
+	jwksURL := a.jwksURL
+	a.mu.Unlock()
+
+	// Others wait on this reload, so it must not end with the request
+	// that happened to start it.
+	keys, jwksURL, err := a.loadKeys(context.WithoutCancel(ctx), jwksURL)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.loading = nil
+	close(loading)
+	a.jwksURL = jwksURL
+	a.loadErr = err
+	if err != nil {
+		if a.keys == nil {
+			return nil, err
+		}
+		logging.Warn("Reload JWKS failed, keeping the previous keys: %s", err)
+		return a.keys, nil
+	}
+	a.keys, a.fetchedAt = keys, now
+	return keys, nil
+}
+
+// loadKeys reads the JWKS from the file or jwksURL, discovering the URL
+// first when empty. It returns the URL to fetch from next time.
+func (a *jwtAuth) loadKeys(ctx context.Context, jwksURL string) (*jose.JSONWebKeySet, string, error) {
+	var b []byte
+	var err error
+	if a.cfg.JWKSFile != "" {
+		if b, err = os.ReadFile(a.cfg.JWKSFile); err != nil {
+			return nil, jwksURL, fmt.Errorf("read JWKS: %w", err)
+		}
+	} else {
+		if jwksURL == "" {
+			if jwksURL, err = a.discoverJWKS(ctx); err != nil {
+				return nil, "", err
+			}
+		}
+		if b, err = a.get(ctx, jwksURL); err != nil {
+			return nil, jwksURL, fmt.Errorf("fetch JWKS: %w", err)
+		}
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(b, keys); err != nil {
+		return nil, jwksURL, fmt.Errorf("parse JWKS: %w", err)
+	}
+	return keys, jwksURL, nil
+}
+
+// discoverJWKS returns the jwks_uri of the issuer's OpenID provider
+// metadata.
+func (a *jwtAuth) discoverJWKS(ctx context.Context) (string, error) {
+	b, err := a.get(ctx, strings.TrimSuffix(a.cfg.Issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("fetch OIDC discovery document: %w", err)
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("parse OIDC discovery document: %w", err)
+	}
+	if doc.Issuer != a.cfg.Issuer || doc.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC discovery document of %s: issuer %q, jwks_uri %q", a.cfg.Issuer, doc.Issuer, doc.JWKSURI)
+	}
+	return doc.JWKSURI, nil
+}
+
+func (a *jwtAuth) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// verify checks the signature, issuer, audience and validity period of
+// raw and returns the identity its claims map to.
+func (a *jwtAuth) verify(ctx context.Context, raw string) (*config.HttpToken, error) {
+	tok, err := jwt.ParseSigned(raw, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+	keys, err := a.keySet(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	var std jwt.Claims
+	var claims map[string]any
+	if err := tok.Claims(keys, &std, &claims); err != nil {
+		return nil, err
+	}
+	if std.Expiry == nil {
+		return nil, ErrNoJWTExpiry
+	}
+	err = std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      a.cfg.Issuer,
+		AnyAudience: jwt.Audience{a.cfg.Audience},
+		Time:        time.Now(),
+	}, a.cfg.LeewayDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	name := claimValues(claims, a.cfg.NameClaim)
+	if len(name) == 0 || name[0] == "" {
+		return nil, fmt.Errorf("%s: %w", a.cfg.NameClaim, ErrNoJWTName)
+	}
+	id := &config.HttpToken{Name: name[0], ExpiresAt: std.Expiry.Time()}
+	matched := false
+	for _, r := range a.cfg.Rules {
+		values := claimValues(claims, r.Claim)
+		if !slices.ContainsFunc(values, func(v string) bool { return slices.Contains(r.Values, v) }) {
+			continue
+		}
+		if len(r.Domains) == 0 {
+			// Every allowed domain; narrower rules add nothing.
+			id.Domains = nil
+			return id, nil
+		}
+		matched = true
+		id.Domains = append(id.Domains, r.Domains...)
+	}
+	if !matched {
+		return nil, fmt.Errorf("%s %q: %w", a.cfg.NameClaim, id.Name, ErrNoJWTRule)
+	}
+	return id, nil
+}
+
+// claimValues returns the claim at the dotted path as strings: a string
+// or number as one value, a list as one per item.
+func claimValues(claims map[string]any, path string) []string {
+	var v any = claims
+	for key := range strings.SplitSeq(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		ret := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	case float64, bool:
+		return []string{fmt.Sprint(v)}
+	}
+	return nil
+}
+
+// checkBearerToken authorizes r by the JWT in its Authorization header.
+func (s *CertDXServer) checkBearerToken(r *http.Request) (*config.HttpToken, bool) {
+	xff := r.Header.Get("X-Forwarded-For")
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || raw == "" || s.jwt == nil {
+		logging.Warn("Not authorized request from: %s, xff: %s", r.RemoteAddr, xff)
+		return nil, false
+	}
+	id, err := s.jwt.verify(r.Context(), raw)
+	if err != nil {
+		logging.Warn("Not authorized request from: %s, xff: %s, %s", r.RemoteAddr, xff, err)
+		return nil, false
+	}
+	return id, true
+}
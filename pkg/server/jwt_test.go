@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// testIssuer is a stand-in identity provider: a signing key and the JWKS
+// publishing it, served over HTTP with OIDC discovery.
+type testIssuer struct {
+	srv     *httptest.Server
+	key     *ecdsa.PrivateKey
+	kid     string
+	fetches atomic.Int32
+	// hold, when set, holds JWKS responses until closed.
+	hold chan struct{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{}
+	iss.rotate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.srv.URL, "jwks_uri": iss.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches.Add(1)
+		if iss.hold != nil {
+			<-iss.hold
+		}
+		json.NewEncoder(w).Encode(iss.jwks())
+	})
+	iss.srv = httptest.NewServer(mux)
+	t.Cleanup(iss.srv.Close)
+	return iss
+}
+
+// rotate replaces the signing key with a new one under a new kid.
+func (iss *testIssuer) rotate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.key = key
+	iss.kid = time.Now().Format(time.RFC3339Nano)
+}
+
+func (iss *testIssuer) jwks() jose.JSONWebKeySet {
+	return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &iss.key.PublicKey, KeyID: iss.kid, Algorithm: string(jose.ES256), Use: "sig"},
+	}}
+}
+
+// sign returns a JWT from iss for aud, expiring in exp unless zero, with
+// claims merged in.
+func (iss *testIssuer) sign(t *testing.T, aud string, exp time.Duration, claims map[string]any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: iss.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", iss.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	std := jwt.Claims{Issuer: iss.srv.URL, Subject: "web", Audience: jwt.Audience{aud}, IssuedAt: jwt.NewNumericDate(time.Now())}
+	if exp != 0 {
+		std.Expiry = jwt.NewNumericDate(time.Now().Add(exp))
+	}
+	raw, err := jwt.Signed(signer).Claims(std).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// makeJWTTestServer returns a server authenticating JWTs from iss, with
+// JWKS discovery through OIDC.
+func makeJWTTestServer(t *testing.T, iss *testIssuer) *CertDXServer {
+	s := makeTestServer("", "/", []string{"example.com"})
+	h := &s.Config.HttpServer
+	h.AuthMethod = config.HTTP_AUTH_OIDC
+	h.JWT.Issuer = iss.srv.URL
+	h.JWT.Audience = "certdx"
+	h.JWT.RefreshDuration = time.Hour
+	h.JWT.LeewayDuration = time.Minute
+	h.JWT.Rules = []config.HttpJWTRule{
+		{Claim: "sub", Values: []string{"web"}, Domains: []string{"web.example.com"}},
+		{Claim: "groups", Values: []string{"mail"}, Domains: []string{"mail.example.com"}},
+		{Claim: "realm.roles", Values: []string{"admin"}},
+	}
+	s.jwt = newJWTAuth(&h.JWT)
+	return s
+}
+
+func TestJWTVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	s := makeJWTTestServer(t, iss)
+	ctx := context.Background()
+
+	id, err := s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, nil))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id.Name != "web" || !slices.Equal(id.Domains, []string{"web.example.com"}) {
+		t.Errorf("identity: %+v", id)
+	}
+
+	id, err = s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, map[string]any{"groups": []string{"ops", "mail"}}))
+	if err != nil || !slices.Equal(id.Domains, []string{"web.example.com", "mail.example.com"}) {
+		t.Errorf("list claim: %+v, %v", id, err)
+	}
+
+	id, err = s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, map[string]any{"realm": map[string]any{"roles": []string{"admin"}}}))
+	if err != nil || id.Domains != nil {
+		t.Errorf("nested claim granting every domain: %+v, %v", id, err)
+	}
+
+	for name, raw := range map[string]string{
+		"wrong audience": iss.sign(t, "other", time.Hour, nil),
+		"expired":        iss.sign(t, "certdx", -time.Hour, nil),
+		"no expiry":      iss.sign(t, "certdx", 0, nil),
+		"no rule":        iss.sign(t, "certdx", time.Hour, map[string]any{"sub": "db"}),
+		"garbage":        "not.a.jwt",
+	} {
+		if _, err := s.jwt.verify(ctx, raw); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+	if _, err := s.jwt.verify(ctx, iss.sign(t, "certdx", 0, nil)); !errors.Is(err, ErrNoJWTExpiry) {
+		t.Errorf("no expiry: got %v", err)
+	}
+	if _, err := s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, map[string]any{"sub": "db"})); !errors.Is(err, ErrNoJWTRule) {
+		t.Errorf("no rule: got %v", err)
+	}
+	// Without a name, callers would share one rate limit and quota.
+	s.jwt.cfg.NameClaim = "email"
+	if _, err := s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, nil)); !errors.Is(err, ErrNoJWTName) {
+		t.Errorf("no name: got %v", err)
+	}
+	s.jwt.cfg.NameClaim = "sub"
+
+	other := newTestIssuer(t)
+	if _, err := s.jwt.verify(ctx, other.sign(t, "certdx", time.Hour, nil)); err == nil {
+		t.Error("token of another issuer verified")
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	s := makeJWTTestServer(t, iss)
+	ctx := context.Background()
+
+	if _, err := s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, nil)); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if _, err := s.jwt.verify(ctx, iss.sign(t, "certdx", time.Hour, nil)); err != nil {
+		t.Fatalf("verify again: %v", err)
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want cached", n)
+	}
+
+	// A token under a new kid reloads the keys, but not again right
+	// away for every unknown kid.
+	iss.rotate(t)
+	raw := iss.sign(t, "certdx", time.Hour, nil)
+	if _, err := s.jwt.verify(ctx, raw); err == nil {
+		t.Fatal("verified before the refetch interval passed")
+	}
+	s.jwt.mu.Lock()
+	s.jwt.triedAt = time.Now().Add(-jwksMinRefetch)
+	s.jwt.mu.Unlock()
+	if _, err := s.jwt.verify(ctx, raw); err != nil {
+		t.Fatalf("verify after rotation: %v", err)
+	}
+	if n := iss.fetches.Load(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestJWTSlowReloadServesCachedKeys(t *testing.T) {
+	iss := newTestIssuer(t)
+	s := makeJWTTestServer(t, iss)
+	ctx := context.Background()
+	raw := iss.sign(t, "certdx", time.Hour, nil)
+	if _, err := s.jwt.verify(ctx, raw); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// The keys are due for a refresh, and the issuer is slow to answer.
+	iss.hold = make(chan struct{})
+	s.jwt.mu.Lock()
+	s.jwt.fetchedAt = time.Now().Add(-2 * s.jwt.cfg.RefreshDuration)
+	s.jwt.triedAt = time.Time{}
+	s.jwt.mu.Unlock()
+	reloaded := make(chan error, 1)
+	go func() {
+		_, err := s.jwt.verify(ctx, raw)
+		reloaded <- err
+	}()
+	for {
+		s.jwt.mu.Lock()
+		loading := s.jwt.loading != nil
+		s.jwt.mu.Unlock()
+		if loading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.jwt.verify(ctx, raw)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("verify during reload: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("verify with a cached key waited for the reload")
+	}
+
+	close(iss.hold)
+	if err := <-reloaded; err != nil {
+		t.Fatalf("verify starting the reload: %v", err)
+	}
+}
+
+func TestJWTKeysFromFile(t *testing.T) {
+	iss := newTestIssuer(t)
+	b, _ := json.Marshal(iss.jwks())
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := makeJWTTestServer(t, iss)
+	s.Config.HttpServer.AuthMethod = config.HTTP_AUTH_JWT
+	s.Config.HttpServer.JWT.JWKSFile = path
+	s.jwt = newJWTAuth(&s.Config.HttpServer.JWT)
+	if _, err := s.jwt.verify(context.Background(), iss.sign(t, "certdx", time.Hour, nil)); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if n := iss.fetches.Load(); n != 0 {
+		t.Errorf("JWKS fetched %d times with a file", n)
+	}
+}
+
+func TestApiWithTokenHandlerJWT(t *testing.T) {
+	iss := newTestIssuer(t)
+	s := makeJWTTestServer(t, iss)
+	entry := s.certCache.get([]string{"web.example.com"})
+	entry.stateMu.Lock()
+	entry.cert = CertT{FullChain: []byte("PEM-chain"), Key: []byte("PEM-key"), ValidBefore: time.Now().Add(time.Hour)}
+	entry.subscribing = 1
+	entry.stateMu.Unlock()
+
+	request := func(auth string, domains ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(api.HttpCertReq{Domains: domains})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		s.apiWithTokenHandler(w, req)
+		return w
+	}
+
+	raw := iss.sign(t, "certdx", time.Hour, nil)
+	var resp api.HttpCertResp
+	w := request("Bearer "+raw, "web.example.com")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || string(resp.FullChain) != "PEM-chain" {
+		t.Errorf("in scope: %d %s", w.Code, w.Body.String())
+	}
+	w = request("Bearer "+raw, "mail.example.com")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Err != "Domains not allowed" {
+		t.Errorf("out of scope: %d %s", w.Code, w.Body.String())
+	}
+	for _, auth := range []string{"", "Token " + raw, "Bearer " + iss.sign(t, "other", time.Hour, nil)} {
+		if w := request(auth, "web.example.com"); w.Code != http.StatusNotFound {
+			t.Errorf("%q: got %d want 404", auth, w.Code)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// Leader election lets several servers share one cert store while only
+// one of them, the holder of the Lease, orders certs from ACME.
+//
+// Followers serve what the leader writes to the store: followStore
+// applies every change it sees through CertStore.Watch to the cache, so
+// SDS streams and HTTP clients of a follower get renewals like the
+// leader's own. A follower needing a cert it doesn't have, or holding
+// one that is due, records a renewal request in the pack's store entry
+// (requestRenewal); the leader sees it through its own watch and renews
+// the pack. When the leader stops extending its lease another server
+// takes it over and picks up every pending request (takeOver).
+
+// newLeaseHolder returns the name this server holds the lease under when
+// [LeaderElection] name is not set: the host name plus a random suffix,
+// so two servers on one host never share a name.
+func newLeaseHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "certdx"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// isLeader reports whether this server may order certs from ACME, which
+// is always the case without leader election.
+func (s *CertDXServer) isLeader() bool {
+	return s.lease == nil || s.leading.Load()
+}
+
+// initElection opens the lease and runs the first election round, so a
+// server that finds the lease free starts out as the leader.
+func (s *CertDXServer) initElection() error {
+	c := &s.Config.LeaderElection
+	lease, err := NewLease(&s.Config)
+	if err != nil {
+		return err
+	}
+	s.lease = lease
+	s.leaseHolder = c.Name
+	if s.leaseHolder == "" {
+		s.leaseHolder = newLeaseHolder()
+	}
+	logging.Info("Leader election: using %s lock as %s", c.Lock, s.leaseHolder)
+
+	s.elect(time.Time{})
+	return nil
+}
+
+// elect runs one election round and returns when the lease was last
+// confirmed held. If the lock can't be reached, a leader keeps leading
+// until the lease it last extended is about to run out, since no other
+// server can have taken it before then.
+func (s *CertDXServer) elect(lastHeld time.Time) time.Time {
+	c := &s.Config.LeaderElection
+	interval := c.LeaseDuration / 3
+
+	ctx, cancel := context.WithTimeout(s.rootCtx, interval)
+	held, err := s.lease.TryAcquire(ctx, s.leaseHolder, c.LeaseDuration)
+	cancel()
+
+	now := time.Now()
+	switch {
+	case err != nil:
+		if s.rootCtx.Err() != nil {
+			return lastHeld
+		}
+		logging.Warn("Leader election: %s", err)
+		held = s.leading.Load() && now.Before(lastHeld.Add(c.LeaseDuration-interval))
+	case held:
+		lastHeld = now
+	}
+
+	if s.leading.Swap(held) != held {
+		if held {
+			logging.Info("Leader election: %s is now the leader", s.leaseHolder)
+			go s.takeOver()
+		} else {
+			logging.Info("Leader election: %s is now a follower", s.leaseHolder)
+		}
+	}
+	return lastHeld
+}
+
+// runElection extends or contends for the lease every third of its
+// duration until rootCtx is done, then releases it so another server can
+// take over right away.
+func (s *CertDXServer) runElection() {
+	t := time.NewTicker(s.Config.LeaderElection.LeaseDuration / 3)
+	defer t.Stop()
+
+	var lastHeld time.Time
+	if s.leading.Load() {
+		lastHeld = time.Now()
+	}
+	for {
+		select {
+		case <-t.C:
+			lastHeld = s.elect(lastHeld)
+		case <-s.rootCtx.Done():
+			if s.leading.Load() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := s.lease.Release(ctx, s.leaseHolder); err != nil {
+					logging.Warn("Leader election: release lease failed: %s", err)
+				}
+				cancel()
+			}
+			if err := s.lease.Close(); err != nil {
+				logging.Warn("Leader election: close lease failed: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// takeOver runs when this server becomes the leader. It catches up with
+// the store and renews every pack a follower asked for, along with the
+// packs this server's own subscribers wait on.
+func (s *CertDXServer) takeOver() {
+	entries, err := s.certStore.List(s.rootCtx)
+	if err != nil {
+		logging.Warn("Leader election: list cert store failed: %s", err)
+	}
+	for _, e := range entries {
+		s.applyStoreEntry(e)
+	}
+	s.renewSubscribed()
+}
+
+// renewSubscribed renews every pack this server's subscribers wait on,
+// after it takes over ordering from another server.
+func (s *CertDXServer) renewSubscribed() {
+	s.certCache.mutex.Lock()
+	var subscribed []*certEntry
+	for _, entry := range s.certCache.entries {
+		if s.isSubscribing(entry) {
+			subscribed = append(subscribed, entry)
+		}
+	}
+	s.certCache.mutex.Unlock()
+	for _, entry := range subscribed {
+		go s.renewRequested(entry)
+	}
+}
+
+// followStore applies the changes other servers make to the shared
+// store until rootCtx is done. Deletions are ignored: only the leader
+// evicts packs, and a follower keeps serving what it holds.
+func (s *CertDXServer) followStore() {
+	events, err := s.certStore.Watch(s.rootCtx)
+	if err != nil {
+		logging.Error("Leader election: watch cert store failed: %s", err)
+		return
+	}
+	for ev := range events {
+		if ev.Entry != nil {
+			s.applyStoreEntry(ev.Entry)
+		}
+	}
+}
+
+// applyStoreEntry brings the cache entry for e up to date with a store
+// entry written by another server. On the leader it also serves renewal
+// requests, and rewrites its own newer cert over a stale one that a
+// follower's request put back.
+func (s *CertDXServer) applyStoreEntry(e *CertStoreEntry) {
+	entry := s.certCache.get(e.Domains)
+
+	entry.stateMu.Lock()
+	changedAt := e.changedAt()
+	differs := !bytes.Equal(entry.cert.FullChain, e.Cert.FullChain)
+	newer := entry.adoptLocked(e)
+	var stale *CertStoreEntry
+	if differs && !newer && entry.storedAt.After(changedAt) && entry.cert.usable() {
+		stale = entry.storeEntryLocked()
+		stale.UpdatedAt = entry.storedAt
+	}
+	requested := e.RequestedAt.After(changedAt)
+	entry.stateMu.Unlock()
+
+	if newer {
+		logging.Info("Leader election: picked up cert %v from the store, serial %s", e.Domains, e.Cert.Serial)
+	}
+	if !s.isLeader() {
+		return
+	}
+	if stale != nil {
+		select {
+		case s.storeUpdate <- stale:
+		case <-s.rootCtx.Done():
+		}
+	}
+	if requested {
+		logging.Info("Leader election: follower requested cert %v", e.Domains)
+		s.leaseHTTP(s.certCache.use(e.Domains))
+		go s.renewRequested(entry)
+	}
+}
+
+// renewRequested renews entry in the background on behalf of a follower
+// or a subscriber that waited for a leader.
+func (s *CertDXServer) renewRequested(entry *certEntry) {
+	if _, err := s.renew(s.rootCtx, entry, true); err != nil && s.rootCtx.Err() == nil {
+		logging.Error("Failed to renew cert %s: %s", entry.domains, err)
+	}
+}
+
+// followerRenew stands in for renew on a follower. A valid cert is served
+// as is. Otherwise the follower checks the store for a newer cert, and
+// failing that asks the leader for one; a due cert is served until the
+// leader's arrives, while a missing or expired one is waited for.
+func (s *CertDXServer) followerRenew(ctx context.Context, c *certEntry) error {
+	current, version := c.Snapshot()
+	if current.External {
+		return s.checkExternal(c, &current)
+	}
+	if current.IsValid() {
+		return nil
+	}
+
+	if err := s.refreshFromStore(ctx, c); err != nil {
+		logging.Warn("Leader election: read cert %v from store failed: %s", c.domains, err)
+	}
+	current, version = c.Snapshot()
+	if current.IsValid() {
+		return nil
+	}
+
+	if err := s.requestRenewal(ctx, c); err != nil {
+		return err
+	}
+	for !current.usable() {
+		c.WaitForUpdate(ctx, version)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("wait for the leader to issue %v: %w", c.domains, err)
+		}
+		current, version = c.Snapshot()
+	}
+	return nil
+}
+
+// refreshFromStore applies the store's entry for c, if any, in case the
+// watch hasn't delivered it yet.
+func (s *CertDXServer) refreshFromStore(ctx context.Context, c *certEntry) error {
+	entries, err := s.certStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	key := domain.AsKey(c.domains)
+	for _, e := range entries {
+		if domain.AsKey(e.Domains) == key {
+			s.applyStoreEntry(e)
+			break
+		}
+	}
+	return nil
+}
+
+// requestRenewal records in the store that this follower needs a fresh
+// cert for c. The entry keeps the cert and UpdatedAt the follower last
+// saw, so it never passes for a newer cert. A request is sent at most
+// once per lease duration per pack: the leader acts on the first one,
+// and a new leader picks up pending ones when it takes over.
+func (s *CertDXServer) requestRenewal(ctx context.Context, c *certEntry) error {
+	now := time.Now()
+	c.stateMu.Lock()
+	if now.Before(c.requestedAt.Add(s.Config.LeaderElection.LeaseDuration)) {
+		c.stateMu.Unlock()
+		return nil
+	}
+	c.requestedAt = now
+	req := c.storeEntryLocked()
+	req.UpdatedAt = c.storedAt
+	req.RequestedAt = now
+	c.stateMu.Unlock()
+
+	logging.Info("Leader election: asking the leader to renew cert %v", c.domains)
+	if err := s.certStore.SaveEntry(ctx, req); err != nil {
+		return fmt.Errorf("request renewal of %v: %w", c.domains, err)
+	}
+	return nil
+}
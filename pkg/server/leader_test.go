@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeElectionTestServer returns a mock-backed server on the SQLite store
+// and lease at path, elected once under holder.
+func makeElectionTestServer(t *testing.T, path, holder string) *CertDXServer {
+	t.Helper()
+	s := makeHistoryTestServer(t)
+	s.Config.LeaderElection.LeaseDuration = time.Minute
+
+	store, err := NewSQLiteCertStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteCertStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	s.certStore = store
+
+	lease, err := NewSQLLease(path)
+	if err != nil {
+		t.Fatalf("NewSQLLease: %v", err)
+	}
+	t.Cleanup(func() { lease.Close() })
+	s.lease = lease
+	s.leaseHolder = holder
+	s.elect(time.Time{})
+	return s
+}
+
+// storeEntry reads the store entry for domains from s's store.
+func storeEntry(t *testing.T, s *CertDXServer, domains []string) *CertStoreEntry {
+	t.Helper()
+	entries, err := s.certStore.List(context.Background())
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	e := findEntry(entries, domains)
+	if e == nil {
+		t.Fatalf("no store entry for %v", domains)
+	}
+	return e
+}
+
+func TestFollowerRequestsRenewalFromLeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	leader := makeElectionTestServer(t, path, "leader")
+	follower := makeElectionTestServer(t, path, "follower")
+	if !leader.isLeader() || follower.isLeader() {
+		t.Fatalf("leader %v, follower %v", leader.isLeader(), follower.isLeader())
+	}
+
+	domains := []string{"example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entry := follower.certCache.use(domains)
+	done := make(chan error, 1)
+	go func() {
+		_, err := follower.renew(ctx, entry, false)
+		done <- err
+	}()
+
+	// The follower records its request in the store and waits.
+	var req *CertStoreEntry
+	for req == nil || req.RequestedAt.IsZero() {
+		entries, err := leader.certStore.List(ctx)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if req = findEntry(entries, domains); ctx.Err() != nil {
+			t.Fatal("follower did not request a renewal")
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("follower returned before the leader issued: %v", err)
+	default:
+	}
+
+	// The leader sees the request, issues and persists the cert.
+	leader.applyStoreEntry(req)
+	persisted := <-leader.storeUpdate
+	if err := leader.certStore.SaveEntry(ctx, persisted); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	follower.applyStoreEntry(storeEntry(t, follower, domains))
+	if err := <-done; err != nil {
+		t.Fatalf("follower renew: %v", err)
+	}
+	got, _ := entry.Snapshot()
+	if got.Serial != persisted.Cert.Serial {
+		t.Fatalf("follower serves serial %s, leader issued %s", got.Serial, persisted.Cert.Serial)
+	}
+}
+
+func TestLeaderRewritesStaleRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	leader := makeElectionTestServer(t, path, "leader")
+	domains := []string{"example.com"}
+	entry := leader.certCache.use(domains)
+	if _, err := leader.renew(context.Background(), entry, false); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	issued := <-leader.storeUpdate
+
+	// A follower that never saw the cert asks for one, overwriting it.
+	stale := &CertStoreEntry{Domains: domains, RequestedAt: time.Now()}
+	leader.applyStoreEntry(stale)
+
+	rewritten := <-leader.storeUpdate
+	if rewritten.Cert.Serial != issued.Cert.Serial || !rewritten.UpdatedAt.Equal(issued.UpdatedAt) {
+		t.Fatalf("rewrote serial %s at %s, want %s at %s",
+			rewritten.Cert.Serial, rewritten.UpdatedAt, issued.Cert.Serial, issued.UpdatedAt)
+	}
+}
+
+func TestElectionFailover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	a := makeElectionTestServer(t, path, "a")
+	b := makeElectionTestServer(t, path, "b")
+
+	if err := a.lease.Release(context.Background(), "a"); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	b.elect(time.Time{})
+	a.elect(time.Now())
+	if a.isLeader() || !b.isLeader() {
+		t.Fatalf("after release: a leader %v, b leader %v", a.isLeader(), b.isLeader())
+	}
+}
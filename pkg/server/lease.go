@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// Lease is the leadership lock shared by servers running leader
+// election. At most one holder owns it at a time; ownership lapses when
+// the holder stops extending it.
+//
+// Implementations must be safe for concurrent use.
+type Lease interface {
+	// TryAcquire takes the lease for holder, or extends it if holder
+	// already owns it, until ttl from now. It reports whether holder
+	// owns the lease afterwards. Losing to another holder is not an
+	// error.
+	TryAcquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+
+	// Release gives the lease up if holder owns it, so another server
+	// can take over without waiting for it to lapse.
+	Release(ctx context.Context, holder string) error
+
+	// Close releases any resource held by the lease.
+	Close() error
+}
+
+// leaseRecord is the lease state kept by the file and s3 locks.
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// acquire updates r for holder and reports whether holder owns it.
+func (r *leaseRecord) acquire(holder string, ttl time.Duration, now time.Time) bool {
+	if r.Holder != "" && r.Holder != holder && now.Before(r.ExpiresAt) {
+		return false
+	}
+	r.Holder = holder
+	r.ExpiresAt = now.Add(ttl)
+	return true
+}
+
+// release clears r if holder owns it and reports whether it changed.
+func (r *leaseRecord) release(holder string) bool {
+	if r.Holder != holder {
+		return false
+	}
+	*r = leaseRecord{}
+	return true
+}
+
+// NewLease constructs the lock selected by c.LeaderElection.
+func NewLease(c *config.ServerConfig) (Lease, error) {
+	l := &c.LeaderElection
+	switch l.Lock {
+	case config.LeaderLockFile:
+		return newFileLease(l.Path), nil
+	case config.LeaderLockS3:
+		return NewS3Lease(l.S3, l.Key)
+	case config.LeaderLockSQL:
+		return NewSQLLease(l.Path)
+	default:
+		return nil, fmt.Errorf("unsupported leader lock: %q", l.Lock)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// fileLeaseRetry is how often a file lease retries a lock held by a
+// concurrent update.
+const fileLeaseRetry = 50 * time.Millisecond
+
+// fileLease keeps the lease record in a file on storage shared by the
+// servers, e.g. an NFS mount. Each update reads, changes and rewrites the
+// record under an exclusive flock, so two servers never both see the
+// lease free.
+type fileLease struct {
+	path string
+}
+
+func newFileLease(path string) *fileLease {
+	return &fileLease{path: path}
+}
+
+// update applies fn to the record under the file lock, writing it back
+// when fn reports a change.
+func (l *fileLease) update(ctx context.Context, fn func(r *leaseRecord) bool) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open lease file: %w", err)
+	}
+	defer f.Close()
+
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			return fmt.Errorf("lock lease file: %w", err)
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-time.After(fileLeaseRetry):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// Closing the file drops the lock.
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("read lease file: %w", err)
+	}
+	var r leaseRecord
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("unmarshal lease file: %w", err)
+		}
+	}
+
+	if !fn(&r) {
+		return nil
+	}
+	if data, err = json.Marshal(&r); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("write lease file: %w", err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("write lease file: %w", err)
+	}
+	return f.Sync()
+}
+
+func (l *fileLease) TryAcquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	var held bool
+	err := l.update(ctx, func(r *leaseRecord) bool {
+		held = r.acquire(holder, ttl, time.Now())
+		return held
+	})
+	return held, err
+}
+
+func (l *fileLease) Release(ctx context.Context, holder string) error {
+	return l.update(ctx, func(r *leaseRecord) bool {
+		return r.release(holder)
+	})
+}
+
+func (l *fileLease) Close() error {
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(*os.File) (bool, error) {
+	return false, errors.New("file locks are not supported on this platform")
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	s3provider "pkg.para.party/certdx/pkg/acme/challengeproviders/s3"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// S3Lease keeps the lease record in one object, updated with conditional
+// writes on its ETag so two servers never both take a free lease.
+type S3Lease struct {
+	client *s3.Client
+	bucket string
+	key    string
+}
+
+// NewS3Lease constructs an S3Lease on the object key in c's bucket.
+func NewS3Lease(c *config.S3Client, key string) (*S3Lease, error) {
+	client, err := s3provider.NewClient(*c, s3provider.ChecksumsWhenRequired)
+	if err != nil {
+		return nil, fmt.Errorf("s3 lease: %w", err)
+	}
+	return newS3Lease(client, c.Bucket, key), nil
+}
+
+func newS3Lease(client *s3.Client, bucket, key string) *S3Lease {
+	return &S3Lease{client: client, bucket: bucket, key: key}
+}
+
+// read returns the current record and its ETag, or an empty record and
+// ETag when the object doesn't exist yet.
+func (l *S3Lease) read(ctx context.Context) (leaseRecord, string, error) {
+	var r leaseRecord
+	out, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	})
+	if err != nil {
+		if s3StatusCode(err) == http.StatusNotFound {
+			return r, "", nil
+		}
+		return r, "", fmt.Errorf("get %s: %w", l.key, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return r, "", fmt.Errorf("read %s: %w", l.key, err)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, "", fmt.Errorf("unmarshal %s: %w", l.key, err)
+	}
+	return r, aws.ToString(out.ETag), nil
+}
+
+// write stores r if the object still has etag, or doesn't exist yet for
+// an empty etag. It reports false when another server wrote first.
+func (l *S3Lease) write(ctx context.Context, r leaseRecord, etag string) (bool, error) {
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return false, err
+	}
+	in := &s3.PutObjectInput{
+		Bucket:      aws.String(l.bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	if etag != "" {
+		in.IfMatch = aws.String(etag)
+	} else {
+		in.IfNoneMatch = aws.String("*")
+	}
+
+	if _, err := l.client.PutObject(ctx, in); err != nil {
+		if isS3ConditionFailed(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("put %s: %w", l.key, err)
+	}
+	return true, nil
+}
+
+func (l *S3Lease) TryAcquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	r, etag, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !r.acquire(holder, ttl, time.Now()) {
+		return false, nil
+	}
+	return l.write(ctx, r, etag)
+}
+
+func (l *S3Lease) Release(ctx context.Context, holder string) error {
+	r, etag, err := l.read(ctx)
+	if err != nil || !r.release(holder) {
+		return err
+	}
+	_, err = l.write(ctx, r, etag)
+	return err
+}
+
+func (l *S3Lease) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+const sqlLeaseSchema = `
+CREATE TABLE IF NOT EXISTS leader_lease (
+	name       TEXT PRIMARY KEY,
+	holder     TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+)`
+
+// sqlLeaseName is the row holding the lease.
+const sqlLeaseName = "leader"
+
+// SQLLease keeps the lease in a row of a SQLite database, by default the
+// SQLite cert store's. Taking it is a single upsert that only applies
+// when the row is free, expired or already ours, so the database decides
+// races between servers.
+type SQLLease struct {
+	db *sql.DB
+}
+
+// NewSQLLease opens the database at path, or the default cache.db when
+// path is empty, and creates the lease table if needed.
+func NewSQLLease(path string) (*SQLLease, error) {
+	if path == "" {
+		var err error
+		path, err = paths.ServerCacheDBPath()
+		if err != nil {
+			return nil, fmt.Errorf("resolve lease database path: %w", err)
+		}
+	}
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open lease database %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqlLeaseSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init lease schema: %w", err)
+	}
+	return &SQLLease{db: db}, nil
+}
+
+func (l *SQLLease) TryAcquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := l.db.ExecContext(ctx, `
+INSERT INTO leader_lease (name, holder, expires_at) VALUES (?, ?, ?)
+ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+WHERE leader_lease.holder = excluded.holder OR leader_lease.expires_at <= ?`,
+		sqlLeaseName, holder, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("acquire lease: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("acquire lease: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (l *SQLLease) Release(ctx context.Context, holder string) error {
+	_, err := l.db.ExecContext(ctx,
+		`UPDATE leader_lease SET expires_at = 0 WHERE name = ? AND holder = ?`, sqlLeaseName, holder)
+	if err != nil {
+		return fmt.Errorf("release lease: %w", err)
+	}
+	return nil
+}
+
+func (l *SQLLease) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// testLease runs the contention sequence shared by every lock: a holds
+// the lease, b can't take it until it lapses or a releases it.
+func testLease(t *testing.T, l Lease) {
+	t.Helper()
+	ctx := context.Background()
+	const ttl = 200 * time.Millisecond
+	acquire := func(holder string, want bool) {
+		t.Helper()
+		held, err := l.TryAcquire(ctx, holder, ttl)
+		if err != nil {
+			t.Fatalf("TryAcquire(%s): %v", holder, err)
+		}
+		if held != want {
+			t.Fatalf("TryAcquire(%s): got %v want %v", holder, held, want)
+		}
+	}
+
+	acquire("a", true)
+	acquire("a", true)
+	acquire("b", false)
+
+	// Releasing a lease held by someone else changes nothing.
+	if err := l.Release(ctx, "b"); err != nil {
+		t.Fatalf("Release(b): %v", err)
+	}
+	acquire("b", false)
+
+	time.Sleep(ttl + 50*time.Millisecond)
+	acquire("b", true)
+	acquire("a", false)
+
+	if err := l.Release(ctx, "b"); err != nil {
+		t.Fatalf("Release(b): %v", err)
+	}
+	acquire("a", true)
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestFileLease(t *testing.T) {
+	testLease(t, newFileLease(filepath.Join(t.TempDir(), "leader.lock")))
+}
+
+func TestSQLLease(t *testing.T) {
+	l, err := NewSQLLease(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("NewSQLLease: %v", err)
+	}
+	testLease(t, l)
+}
+
+func TestS3Lease(t *testing.T) {
+	_, srv := newFakeS3(t)
+	l, err := NewS3Lease(&config.S3Client{
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		URL:             srv.URL,
+		AccessKeyId:     "id",
+		AccessKeySecret: "secret",
+		PathStyle:       true,
+	}, "certdx/leader.lock")
+	if err != nil {
+		t.Fatalf("NewS3Lease: %v", err)
+	}
+	testLease(t, l)
+}
+
+func TestS3LeaseLosesRace(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	c := &config.S3Client{
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		URL:             srv.URL,
+		AccessKeyId:     "id",
+		AccessKeySecret: "secret",
+		PathStyle:       true,
+	}
+	a, err := NewS3Lease(c, "leader.lock")
+	if err != nil {
+		t.Fatalf("NewS3Lease: %v", err)
+	}
+	b, _ := NewS3Lease(c, "leader.lock")
+
+	// b takes the free lease between a's read and a's conditional write.
+	ctx := context.Background()
+	fake.mu.Lock()
+	fake.beforePut = func() {
+		if held, err := b.TryAcquire(ctx, "b", time.Minute); err != nil || !held {
+			t.Errorf("b TryAcquire: held %v, err %v", held, err)
+		}
+	}
+	fake.mu.Unlock()
+	held, err := a.TryAcquire(ctx, "a", time.Minute)
+	if err != nil {
+		t.Fatalf("a TryAcquire: %v", err)
+	}
+	if held {
+		t.Fatal("a took a lease b already holds")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/proxyproto"
+)
+
+// proxyHeaderTimeout is how long a connection to a proxyProtocol
+// listener may take to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// listen binds addr per opts: a unix socket for unix:/path, given opts'
+// permissions, or a TCP listener, reading PROXY headers if asked to.
+func listen(addr string, opts *config.ListenOptions) (net.Listener, error) {
+	path, unix := config.UnixSocketPath(addr)
+	if !unix {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen at %s: %w", addr, err)
+		}
+		if opts.ProxyProtocol {
+			l = proxyproto.NewListener(l, proxyHeaderTimeout, opts.ProxyProtocolPrefixes)
+		}
+		return l, nil
+	}
+
+	// A socket left behind by an unclean exit would fail the bind; other
+	// files are not ours to remove.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen at %s: file exists and is no socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket %s: %w", path, err)
+		}
+	}
+
+	// The socket is bound in a private directory, given its permissions
+	// there and only then moved into place, so no one can connect while
+	// it still has the umask's.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".certdx-")
+	if err != nil {
+		return nil, fmt.Errorf("listen at %s: %w", path, err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("listen at %s: %w", path, err)
+	}
+	l.SetUnlinkOnClose(false)
+	if err := setSocketPermissions(tmp, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("listen at %s: %w", path, err)
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener removes its socket, bound under another name, on Close.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// setSocketPermissions applies opts' mode and group to the socket at
+// path.
+func setSocketPermissions(path string, opts *config.ListenOptions) error {
+	if opts.SocketGroup != "" {
+		gid, err := lookupGroup(opts.SocketGroup)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("chown socket %s: %w", path, err)
+		}
+	}
+	if err := os.Chmod(path, opts.SocketFileMode); err != nil {
+		return fmt.Errorf("chmod socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// lookupGroup returns the id of group, a group name or id.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("socket group: %w", err)
+	}
+	return strconv.Atoi(g.Gid)
+}
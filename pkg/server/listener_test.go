@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certdx.sock")
+	opts := &config.ListenOptions{SocketFileMode: 0o600}
+
+	// A socket left behind is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:"+path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode: got %v want 0600", fi.Mode().Perm())
+	}
+	// Nothing is left of the private directory it was bound in.
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("socket directory holds %d entries, want 1", len(entries))
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://certdx/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "ok" {
+		t.Errorf("body: got %q", b)
+	}
+}
+
+func TestListenUnixRefusesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certdx.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := listen("unix:"+path, &config.ListenOptions{SocketFileMode: 0o600})
+	if err == nil || !strings.Contains(err.Error(), "is no socket") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestListenProxyProtocol(t *testing.T) {
+	l, err := listen("127.0.0.1:0", &config.ListenOptions{
+		ProxyProtocol:         true,
+		ProxyProtocolPrefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.RemoteAddr
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 198.51.100.7 192.0.2.2 40000 443\r\nGET / HTTP/1.1\r\nHost: certdx\r\n\r\n")
+	if addr := <-got; addr != "198.51.100.7:40000" {
+		t.Errorf("remote address: got %s", addr)
+	}
+}
+
+func TestListenUnixRemovesSocketOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certdx.sock")
+	l, err := listen("unix:"+path, &config.ListenOptions{SocketFileMode: 0o600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left after close: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+
+	"pkg.para.party/certdx/pkg/acme"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// managedPack holds the issuing settings of a pack declared in
+// [[ManagedCertificates]], which override the server-wide ones.
+type managedPack struct {
+	name   string
+	acme   acme.Obtainer
+	config config.ACMEConfig
+}
+
+// acmeFor returns the obtainer and ACME settings used to issue c's cert.
+func (s *CertDXServer) acmeFor(c *certEntry) (acme.Obtainer, *config.ACMEConfig) {
+	if c.managed != nil {
+		return c.managed.acme, &c.managed.config
+	}
+	return s.acme, &s.Config.ACME
+}
+
+// initManaged attaches the settings of every managed pack to its cache
+// entry. It runs in Init, before the cert store is loaded and before any
+// renewer can observe the entries.
+func (s *CertDXServer) initManaged() error {
+	for i := range s.Config.ManagedCertificates {
+		m := &s.Config.ManagedCertificates[i]
+		eff := s.Config.Managed(m)
+		obtainer, err := acme.Derive(s.acme, eff)
+		if err != nil {
+			return fmt.Errorf("managed cert %s: %w", m.Name, err)
+		}
+
+		entry := s.certCache.get(m.Domains)
+		entry.managed = &managedPack{
+			name:   m.Name,
+			acme:   obtainer,
+			config: eff.ACME,
+		}
+	}
+	return nil
+}
+
+// startManaged subscribes the server itself to every managed pack, so
+// each is issued right away and renewed in the background for the
+// server's lifetime. The subscriptions are never released; Stop winds
+// the renewers down through rootCtx.
+func (s *CertDXServer) startManaged() {
+	for i := range s.Config.ManagedCertificates {
+		m := &s.Config.ManagedCertificates[i]
+		logging.Info("Managing cert %s: %v", m.Name, m.Domains)
+		s.subscribe(s.certCache.get(m.Domains))
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func TestManagedPackIssuedWithoutSubscribers(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.ManagedCertificates = []config.ManagedCertificate{{
+		Name:          "www",
+		Domains:       []string{"www.example.com"},
+		CertLifeTime:  "9h",
+		RenewTimeLeft: "2h",
+	}}
+	if err := s.initManaged(); err != nil {
+		t.Fatalf("initManaged: %v", err)
+	}
+	s.startManaged()
+
+	entry := s.certCache.get([]string{"www.example.com"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if entry.WaitForUpdate(ctx, 0) == 0 {
+		t.Fatal("managed pack was not issued at startup")
+	}
+	<-s.storeUpdate
+
+	cert := entry.Cert()
+	if got := cert.NotAfter.Sub(cert.NotBefore); got != 9*time.Hour+time.Minute {
+		t.Fatalf("managed lifetime override not used: got %s", got)
+	}
+
+	// HTTP requests are served from the renewer's cert with the pack's
+	// own polling hint, without another ACME order.
+	body, _ := json.Marshal(api.HttpCertReq{Domains: []string{"www.example.com"}})
+	w := httptest.NewRecorder()
+	s.apiHandler(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	var resp api.HttpCertResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if !bytes.Equal(resp.FullChain, cert.FullChain) || resp.RenewTimeLeft != 2*time.Hour {
+		t.Fatalf("unexpected response: renewTimeLeft %s", resp.RenewTimeLeft)
+	}
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/logging"
+	"pkg.para.party/certdx/pkg/mtls"
+)
+
+// Peer sync keeps a standby server's cache a copy of a main server's, so
+// clients failing over to the standby get the certs they had instead of
+// new orders.
+//
+// The standby polls the main's <apiPath>/sync endpoint, authenticated
+// with one of the main's [PeerSync] peer tokens rather than a client
+// credential, and adopts every cert newer than its own, persisting it to
+// its own store. A pack the standby needs and doesn't have a valid cert
+// for is asked of the main, which issues it if needed. Only once the main has been unreachable for
+// [PeerSync] takeoverAfter does the standby order from ACME itself.
+
+// PeerSyncReq is the request body for POST <apiPath>/sync. With Domains
+// set the main returns only that pack, issuing or renewing it first if it
+// holds no valid cert. Otherwise it returns every pack changed since
+// Since, or all of them when Since is zero.
+type PeerSyncReq struct {
+	Since   time.Time `json:"since,omitzero"`
+	Domains []string  `json:"domains,omitempty"`
+}
+
+// PeerSyncResp is the response body for POST <apiPath>/sync. Time is the
+// main's clock when the entries were collected, to be sent back as Since
+// by the next request.
+type PeerSyncResp struct {
+	Time    time.Time         `json:"time"`
+	Entries []*CertStoreEntry `json:"entries"`
+	Err     string            `json:"err,omitempty"`
+}
+
+// syncEntries returns the persisted form of every pack holding a usable
+// cert that changed at or after since.
+func (s *CertDXServer) syncEntries(since time.Time) []*CertStoreEntry {
+	s.certCache.mutex.Lock()
+	defer s.certCache.mutex.Unlock()
+
+	ret := []*CertStoreEntry{}
+	for _, entry := range s.certCache.entries {
+		entry.stateMu.Lock()
+		if entry.cert.usable() && !entry.storedAt.Before(since) {
+			e := entry.storeEntryLocked()
+			e.UpdatedAt = entry.storedAt
+			ret = append(ret, e)
+		}
+		entry.stateMu.Unlock()
+	}
+	return ret
+}
+
+// syncEntry returns the pack for domains, renewing it first unless it
+// holds a valid cert. The pack is leased like one requested over HTTP, so
+// the main keeps it renewed for the standby.
+func (s *CertDXServer) syncEntry(ctx context.Context, domains []string) (*CertStoreEntry, error) {
+	if err := s.checkDomains(ctx, domains); err != nil {
+		return nil, err
+	}
+	entry, err := s.admitPack(ctx, domains)
+	if err != nil {
+		return nil, err
+	}
+	s.leaseHTTP(entry)
+	if cert := entry.Cert(); !cert.IsValid() {
+		if _, err := s.renew(ctx, entry, false); err != nil {
+			return nil, err
+		}
+	}
+
+	entry.stateMu.Lock()
+	defer entry.stateMu.Unlock()
+	e := entry.storeEntryLocked()
+	e.UpdatedAt = entry.storedAt
+	return e, nil
+}
+
+func (s *CertDXServer) handleSyncReq(w http.ResponseWriter, r *http.Request) {
+	var req PeerSyncReq
+	resp := &PeerSyncResp{Time: time.Now()}
+	err := func() error {
+		if err := decodeReq(r, &req); err != nil {
+			return err
+		}
+		if len(req.Domains) == 0 {
+			resp.Entries = s.syncEntries(req.Since)
+			if t := requestToken(r.Context()); t != nil {
+				// A scoped peer only syncs the packs it may fetch.
+				resp.Entries = slices.DeleteFunc(resp.Entries, func(e *CertStoreEntry) bool {
+					return !t.Allows(e.Domains)
+				})
+			}
+			return nil
+		}
+		e, err := s.syncEntry(r.Context(), req.Domains)
+		if err != nil {
+			return err
+		}
+		resp.Entries = []*CertStoreEntry{e}
+		return nil
+	}()
+	if err != nil {
+		if errors.Is(err, domain.ErrNotAllowed) {
+			logging.Warn("Peer sync request for %v: %s", req.Domains, err)
+			writeJSON(w, &PeerSyncResp{Err: "Domains not allowed"})
+			return
+		}
+		if v1, ok := approvalErrV1(err); ok {
+			logging.Warn("Peer sync request for %v: %s", req.Domains, err)
+			writeJSON(w, &PeerSyncResp{Err: v1})
+			return
+		}
+		if v1, ok := quotaErrV1(err); ok {
+			logging.Warn("Peer sync request for %v: %s", req.Domains, err)
+			writeJSON(w, &PeerSyncResp{Err: v1})
+			return
+		}
+		logging.Error("Handle peer sync request failed: %s", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	logging.Debug("Peer sync sent %d entries to: %s", len(resp.Entries), requester(r))
+	writeJSON(w, resp)
+}
+
+// peerSync is the standby side of peer sync.
+type peerSync struct {
+	main   *config.ClientHttpServer
+	client *http.Client
+
+	// lastContact is when the main last answered, in Unix nanoseconds.
+	// It starts at the standby's start, so a standby never orders before
+	// it has given the main takeoverAfter to show up.
+	lastContact atomic.Int64
+}
+
+func newPeerSync(c *config.PeerSyncConfig) (*peerSync, error) {
+	p := &peerSync{main: c.Main, client: &http.Client{}}
+	if c.Main.AuthMethod == config.HTTP_AUTH_MTLS {
+		cfg, err := mtls.LoadClient(c.Main.PEM)
+		if err != nil {
+			return nil, fmt.Errorf("load mtls bundle: %w", err)
+		}
+		p.client.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+	p.lastContact.Store(time.Now().UnixNano())
+	return p, nil
+}
+
+// fetch posts req to the main's sync endpoint.
+func (p *peerSync) fetch(ctx context.Context, req *PeerSyncReq) (*PeerSyncResp, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(p.main.Url, "/") + "/sync"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	// The main checks its peer tokens on this endpoint whatever its auth
+	// method, so the token is sent alongside an mTLS certificate too.
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Token %s", p.main.Token))
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, httpResp.Body)
+		return nil, fmt.Errorf("POST '%s' status: %s", url, httpResp.Status)
+	}
+
+	resp := new(PeerSyncResp)
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	p.lastContact.Store(time.Now().UnixNano())
+	if resp.Err != "" {
+		return nil, fmt.Errorf("main server: %s", resp.Err)
+	}
+	return resp, nil
+}
+
+// deferToMain reports whether this server is a standby that leaves
+// ordering to its main, which is the case until the main has been
+// unreachable for takeoverAfter.
+func (s *CertDXServer) deferToMain() bool {
+	if s.peer == nil {
+		return false
+	}
+	last := time.Unix(0, s.peer.lastContact.Load())
+	return time.Since(last) < s.Config.PeerSync.TakeoverAfterDuration
+}
+
+// adoptSynced applies entries received from the main to the cache and
+// persists the ones adopted.
+func (s *CertDXServer) adoptSynced(ctx context.Context, entries []*CertStoreEntry) {
+	for _, e := range entries {
+		entry := s.certCache.get(e.Domains)
+		entry.stateMu.Lock()
+		adopted := entry.adoptLocked(e)
+		entry.stateMu.Unlock()
+		if !adopted {
+			continue
+		}
+
+		logging.Info("Peer sync: picked up cert %v from the main server, serial %s", e.Domains, e.Cert.Serial)
+		select {
+		case s.storeUpdate <- e:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncFromMain fetches the packs changed on the main since the last
+// successful sync and returns the Since of the next one.
+func (s *CertDXServer) syncFromMain(ctx context.Context, since time.Time) (time.Time, error) {
+	resp, err := s.peer.fetch(ctx, &PeerSyncReq{Since: since})
+	if err != nil {
+		return since, err
+	}
+	s.adoptSynced(ctx, resp.Entries)
+	return resp.Time, nil
+}
+
+// runPeerSync polls the main every interval until rootCtx is done. When
+// the main has been unreachable for takeoverAfter it renews the packs
+// subscribers wait on itself; once the main is back, it defers again.
+func (s *CertDXServer) runPeerSync() {
+	c := &s.Config.PeerSync
+	t := time.NewTicker(c.IntervalDuration)
+	defer t.Stop()
+
+	var since time.Time
+	deferring := true
+	for {
+		ctx, cancel := context.WithTimeout(s.rootCtx, c.IntervalDuration)
+		var err error
+		since, err = s.syncFromMain(ctx, since)
+		cancel()
+		if err != nil && s.rootCtx.Err() == nil {
+			logging.Warn("Peer sync: sync from %s failed: %s", c.Main.Url, err)
+		}
+
+		if d := s.deferToMain(); d != deferring {
+			deferring = d
+			if deferring {
+				logging.Info("Peer sync: main server %s is reachable again, leaving ordering to it", c.Main.Url)
+			} else {
+				logging.Warn("Peer sync: main server %s unreachable for %s, ordering certs from ACME", c.Main.Url, c.TakeoverAfter)
+				s.renewSubscribed()
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-s.rootCtx.Done():
+			return
+		}
+	}
+}
+
+// standbyRenew stands in for renew on a standby while the main is
+// considered up. A valid cert is served as is; otherwise the pack is
+// asked of the main. If the main can't be reached, a cert that is due
+// keeps being served until it answers or the standby takes over.
+func (s *CertDXServer) standbyRenew(ctx context.Context, c *certEntry) error {
+	current := c.Cert()
+	if current.External {
+		return s.checkExternal(c, &current)
+	}
+	if current.IsValid() {
+		return nil
+	}
+
+	resp, err := s.peer.fetch(ctx, &PeerSyncReq{Domains: c.domains})
+	if err != nil {
+		if current.usable() {
+			logging.Warn("Peer sync: get cert %v from the main server failed, serving the current one: %s", c.domains, err)
+			return nil
+		}
+		return fmt.Errorf("get cert %v from the main server: %w", c.domains, err)
+	}
+	s.adoptSynced(ctx, resp.Entries)
+	if current = c.Cert(); !current.usable() {
+		return fmt.Errorf("main server returned no usable cert for %v", c.domains)
+	}
+	return nil
+}
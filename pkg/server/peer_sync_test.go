@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/config"
+)
+
+// failingObtainer fails every order, standing in for the ACME client of
+// a server that must not order.
+type failingObtainer struct{}
+
+func (failingObtainer) Obtain(context.Context, []string, time.Time) ([]byte, []byte, error) {
+	return nil, nil, errors.New("unexpected order")
+}
+
+func (f failingObtainer) RetryObtain(ctx context.Context, domains []string, deadline time.Time) ([]byte, []byte, error) {
+	return f.Obtain(ctx, domains, deadline)
+}
+
+// makePeerSyncPair returns a main server serving peer sync over a token
+// API and a standby of it, holding the main's peer token.
+func makePeerSyncPair(t *testing.T) (main, standby *CertDXServer, srv *httptest.Server) {
+	t.Helper()
+	main = makeHistoryTestServer(t)
+	main.Config.HttpServer.Token = "client-secret"
+	main.Config.PeerSync.Serve = true
+	main.Config.PeerSync.Peers = []config.HttpToken{{Name: "standby", Hash: config.HashToken("peer-secret")}}
+	srv = httptest.NewServer(http.HandlerFunc(main.apiWithTokenHandler))
+	t.Cleanup(srv.Close)
+
+	standby = makeHistoryTestServer(t)
+	standby.Config.PeerSync.Main = &config.ClientHttpServer{
+		Url:        srv.URL + "/",
+		AuthMethod: config.HTTP_AUTH_TOKEN,
+		Token:      "peer-secret",
+	}
+	peer, err := newPeerSync(&standby.Config.PeerSync)
+	if err != nil {
+		t.Fatalf("newPeerSync: %v", err)
+	}
+	standby.peer = peer
+	return main, standby, srv
+}
+
+func TestPeerSyncReplicatesMain(t *testing.T) {
+	main, standby, _ := makePeerSyncPair(t)
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	if _, err := main.renew(ctx, main.certCache.use(domains), false); err != nil {
+		t.Fatalf("main renew: %v", err)
+	}
+	issued := <-main.storeUpdate
+
+	since, err := standby.syncFromMain(ctx, time.Time{})
+	if err != nil {
+		t.Fatalf("syncFromMain: %v", err)
+	}
+	persisted := <-standby.storeUpdate
+	if persisted.Cert.Serial != issued.Cert.Serial {
+		t.Fatalf("standby persisted serial %s, main issued %s", persisted.Cert.Serial, issued.Cert.Serial)
+	}
+	if got := standby.certCache.get(domains).Cert(); got.Serial != issued.Cert.Serial {
+		t.Fatalf("standby serves serial %s, main issued %s", got.Serial, issued.Cert.Serial)
+	}
+
+	// Nothing changed on the main since the last sync.
+	resp, err := standby.peer.fetch(ctx, &PeerSyncReq{Since: since})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(resp.Entries) != 0 {
+		t.Fatalf("incremental sync returned %d entries, want 0", len(resp.Entries))
+	}
+}
+
+func TestPeerSyncStandbyAsksMain(t *testing.T) {
+	main, standby, _ := makePeerSyncPair(t)
+	standby.acme = failingObtainer{}
+
+	domains := []string{"www.example.com"}
+	entry := standby.certCache.use(domains)
+	if _, err := standby.renew(context.Background(), entry, false); err != nil {
+		t.Fatalf("standby renew: %v", err)
+	}
+	issued := <-main.storeUpdate
+	if got := entry.Cert(); got.Serial != issued.Cert.Serial {
+		t.Fatalf("standby serves serial %s, main issued %s", got.Serial, issued.Cert.Serial)
+	}
+}
+
+func TestPeerSyncTakeover(t *testing.T) {
+	_, standby, srv := makePeerSyncPair(t)
+	srv.Close()
+	ctx := context.Background()
+	entry := standby.certCache.use([]string{"example.com"})
+
+	if _, err := standby.renew(ctx, entry, false); err == nil {
+		t.Fatal("standby ordered while the main was down for less than takeoverAfter")
+	}
+
+	standby.peer.lastContact.Store(time.Now().Add(-standby.Config.PeerSync.TakeoverAfterDuration).UnixNano())
+	if _, err := standby.renew(ctx, entry, false); err != nil {
+		t.Fatalf("standby renew after takeoverAfter: %v", err)
+	}
+	if cert := entry.Cert(); !cert.IsValid() {
+		t.Fatal("standby did not order after takeoverAfter")
+	}
+}
+
+func TestPeerSyncNotServed(t *testing.T) {
+	main, standby, _ := makePeerSyncPair(t)
+	main.Config.PeerSync.Serve = false
+	if _, err := standby.peer.fetch(context.Background(), &PeerSyncReq{}); err == nil {
+		t.Fatal("sync answered with serve disabled")
+	}
+}
+
+func TestPeerSyncRequiresPeerToken(t *testing.T) {
+	main, standby, srv := makePeerSyncPair(t)
+	if _, err := main.renew(context.Background(), main.certCache.use([]string{"example.com"}), false); err != nil {
+		t.Fatalf("main renew: %v", err)
+	}
+
+	// A client credential doesn't reach the other clients' keys.
+	standby.peer.main.Token = "client-secret"
+	if _, err := standby.peer.fetch(context.Background(), &PeerSyncReq{}); err == nil {
+		t.Fatal("sync answered a client token")
+	}
+
+	// Nor does the peer token fetch certs as a client.
+	req, err := http.NewRequest("POST", srv.URL+"/", strings.NewReader(`{"domains":["example.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Token peer-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("cert request with the peer token: status %d, want 404", resp.StatusCode)
+	}
+}
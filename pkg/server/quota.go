@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// quotaWindow is the window of [Quota] maxNewOrdersPerHour.
+const quotaWindow = time.Hour
+
+var (
+	// ErrQuotaExceeded is returned for a new pack past one of the [Quota]
+	// limits on how many packs the server takes on.
+	ErrQuotaExceeded = errors.New("issuance quota exceeded")
+
+	// ErrPackRejected is returned for a pack whose domains [Quota]
+	// forbids, however many packs there are.
+	ErrPackRejected = errors.New("pack rejected by quota policy")
+)
+
+// QuotaError is a pack refused by [Quota]: Limit names the setting that
+// refused it, and RetryAfter, when known, is when maxNewOrdersPerHour
+// will admit a new pack again. It wraps ErrQuotaExceeded or
+// ErrPackRejected.
+type QuotaError struct {
+	Limit      string
+	Reason     string
+	RetryAfter time.Duration
+
+	err error
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.err, e.Reason)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return e.err
+}
+
+// quotaErrV1 returns the v1 "err" of a pack refused by [Quota]: "Pack
+// rejected" or "Quota exceeded", and why.
+func quotaErrV1(err error) (string, bool) {
+	var qe *QuotaError
+	if !errors.As(err, &qe) {
+		return "", false
+	}
+	kind := "Quota exceeded"
+	if errors.Is(err, ErrPackRejected) {
+		kind = "Pack rejected"
+	}
+	return fmt.Sprintf("%s: %s (%s)", kind, qe.Reason, qe.Limit), true
+}
+
+// issuanceQuota is what [Quota] counts, guarded by certCache.mutex so
+// admitting a pack and creating its entry happen at once.
+type issuanceQuota struct {
+	// owners holds the packs each client identity brought into the
+	// cache, rebuilt from the store's Owner on start. Packs evicted
+	// since are pruned when the client asks for another one.
+	owners map[string]map[domain.Key]struct{}
+
+	// admitted holds when new packs were admitted, oldest first, within
+	// the last quotaWindow.
+	admitted []time.Time
+}
+
+// admitPack returns the entry for domains requested by the client of
+// ctx, marked as just used, unless it awaits approval (see
+// checkApproval) or [Quota] refuses it with a *QuotaError. It replaces
+// certCache.use on the paths by which clients bring packs into the
+// cache.
+func (s *CertDXServer) admitPack(ctx context.Context, domains []string) (*certEntry, error) {
+	if err := s.checkApproval(ctx, domains); err != nil {
+		return nil, err
+	}
+
+	c := &s.certCache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := domain.AsKey(domains)
+	entry, cached := c.entries[key]
+	if cached && quotaExempt(entry) {
+		return c.useNoLock(domains), nil
+	}
+	if err := s.checkPackDomains(domains); err != nil {
+		return nil, err
+	}
+	if cached {
+		return c.useNoLock(domains), nil
+	}
+	client := requestClient(ctx)
+	if err := s.admitNewPack(client, key, time.Now()); err != nil {
+		return nil, err
+	}
+	entry = c.useNoLock(domains)
+	entry.stateMu.Lock()
+	entry.owner = client
+	entry.stateMu.Unlock()
+	return entry, nil
+}
+
+// requestClient returns the client identity of ctx that [Quota] counts
+// packs against, empty for clients without a name.
+func requestClient(ctx context.Context) string {
+	if t := requestToken(ctx); t != nil {
+		return t.Name
+	}
+	return ""
+}
+
+// quotaExempt reports whether entry is one [Quota] doesn't apply to: a
+// managed pack, or one serving an imported cert.
+func quotaExempt(entry *certEntry) bool {
+	return entry.managed != nil || entry.Cert().External
+}
+
+// checkPackDomains applies the [Quota] limits on what a pack may hold.
+func (s *CertDXServer) checkPackDomains(domains []string) error {
+	q := &s.Config.Quota
+	names := make([]string, 0, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if d != "" && !slices.Contains(names, d) {
+			names = append(names, d)
+		}
+	}
+
+	if q.MaxDomainsPerPack > 0 && len(names) > q.MaxDomainsPerPack {
+		return &QuotaError{
+			Limit:  "maxDomainsPerPack",
+			Reason: fmt.Sprintf("pack has %d domains, at most %d allowed", len(names), q.MaxDomainsPerPack),
+			err:    ErrPackRejected,
+		}
+	}
+
+	if q.ForbidWildcardMix && slices.ContainsFunc(names, isWildcard) {
+		// A wildcard covers its apex only with the apex itself listed,
+		// so a wildcard and its own apex go together.
+		for _, n := range names {
+			if !isWildcard(n) && !slices.Contains(names, "*."+n) {
+				return &QuotaError{
+					Limit:  "forbidWildcardMix",
+					Reason: fmt.Sprintf("pack mixes wildcards with %s", n),
+					err:    ErrPackRejected,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// admitNewPack applies the [Quota] limits on how many packs the server
+// takes on to a pack not yet in the cache, and counts it against
+// client if admitted.
+func (s *CertDXServer) admitNewPack(client string, key domain.Key, now time.Time) error {
+	q := &s.Config.Quota
+	quota := &s.quota
+
+	if q.MaxPacks > 0 {
+		n := 0
+		for _, entry := range s.certCache.entries {
+			if !quotaExempt(entry) {
+				n++
+			}
+		}
+		if n >= q.MaxPacks {
+			return &QuotaError{
+				Limit:  "maxPacks",
+				Reason: fmt.Sprintf("server holds %d packs, at most %d allowed", n, q.MaxPacks),
+				err:    ErrQuotaExceeded,
+			}
+		}
+	}
+
+	owned := quota.owners[client]
+	for k := range owned {
+		if _, ok := s.certCache.entries[k]; !ok {
+			delete(owned, k)
+		}
+	}
+	if q.MaxPacksPerClient > 0 && len(owned) >= q.MaxPacksPerClient {
+		return &QuotaError{
+			Limit:  "maxPacksPerClient",
+			Reason: fmt.Sprintf("client %q holds %d packs, at most %d allowed", client, len(owned), q.MaxPacksPerClient),
+			err:    ErrQuotaExceeded,
+		}
+	}
+
+	start := slices.IndexFunc(quota.admitted, func(t time.Time) bool { return now.Sub(t) < quotaWindow })
+	if start < 0 {
+		start = len(quota.admitted)
+	}
+	quota.admitted = quota.admitted[start:]
+	if q.MaxNewOrdersPerHour > 0 && len(quota.admitted) >= q.MaxNewOrdersPerHour {
+		return &QuotaError{
+			Limit:      "maxNewOrdersPerHour",
+			Reason:     fmt.Sprintf("%d new packs in the last hour, at most %d allowed", len(quota.admitted), q.MaxNewOrdersPerHour),
+			RetryAfter: quota.admitted[0].Add(quotaWindow).Sub(now),
+			err:        ErrQuotaExceeded,
+		}
+	}
+
+	quota.own(client, key)
+	quota.admitted = append(quota.admitted, now)
+	return nil
+}
+
+// own counts the pack of key against client.
+func (q *issuanceQuota) own(client string, key domain.Key) {
+	owned := q.owners[client]
+	if owned == nil {
+		owned = make(map[domain.Key]struct{})
+		if q.owners == nil {
+			q.owners = make(map[string]map[domain.Key]struct{})
+		}
+		q.owners[client] = owned
+	}
+	owned[key] = struct{}{}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+)
+
+// clientCtx returns a context authorized as the client named name.
+func clientCtx(name string) context.Context {
+	return withCredential(context.Background(), &config.HttpToken{Name: name})
+}
+
+func TestAdmitPackDomains(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.Quota = config.QuotaConfig{MaxDomainsPerPack: 3, ForbidWildcardMix: true}
+
+	cases := []struct {
+		domains []string
+		limit   string
+	}{
+		{[]string{"a.example.com", "b.example.com", "c.example.com"}, ""},
+		{[]string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}, "maxDomainsPerPack"},
+		{[]string{"a.example.com", "b.example.com", "c.example.com", "A.example.com."}, ""},
+		{[]string{"*.example.com", "example.com"}, ""},
+		{[]string{"*.example.com", "*.a.example.com"}, ""},
+		{[]string{"*.example.com", "www.example.com"}, "forbidWildcardMix"},
+		{[]string{"*.a.example.com", "example.com"}, "forbidWildcardMix"},
+	}
+	for _, tc := range cases {
+		_, err := s.admitPack(context.Background(), tc.domains)
+		var qe *QuotaError
+		switch {
+		case tc.limit == "" && err != nil:
+			t.Errorf("%v: %v", tc.domains, err)
+		case tc.limit != "" && (!errors.As(err, &qe) || qe.Limit != tc.limit || !errors.Is(err, ErrPackRejected)):
+			t.Errorf("%v: got %v want %s", tc.domains, err, tc.limit)
+		}
+	}
+	if cached(s, []string{"*.example.com", "www.example.com"}) {
+		t.Error("rejected pack cached")
+	}
+}
+
+func TestAdmitPackCounts(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.Quota = config.QuotaConfig{MaxPacks: 3, MaxPacksPerClient: 2}
+	limitOf := func(err error) string {
+		var qe *QuotaError
+		if errors.As(err, &qe) && errors.Is(err, ErrQuotaExceeded) {
+			return qe.Limit
+		}
+		return ""
+	}
+
+	for _, d := range []string{"a.example.com", "b.example.com"} {
+		if _, err := s.admitPack(clientCtx("web"), []string{d}); err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+	}
+	if _, err := s.admitPack(clientCtx("web"), []string{"c.example.com"}); limitOf(err) != "maxPacksPerClient" {
+		t.Fatalf("third pack of web: %v", err)
+	}
+	// Packs already cached are served, whoever brought them in.
+	if _, err := s.admitPack(clientCtx("mail"), []string{"a.example.com"}); err != nil {
+		t.Fatalf("cached pack: %v", err)
+	}
+	if _, err := s.admitPack(clientCtx("mail"), []string{"c.example.com"}); err != nil {
+		t.Fatalf("first pack of mail: %v", err)
+	}
+	if _, err := s.admitPack(clientCtx("mail"), []string{"d.example.com"}); limitOf(err) != "maxPacks" {
+		t.Fatalf("fourth pack: %v", err)
+	}
+
+	// Managed packs and imported certs neither count nor are limited.
+	s.certCache.get([]string{"m.example.com"}).managed = &managedPack{}
+	imported := s.certCache.get([]string{"i.example.com"})
+	imported.cert.External = true
+	for _, d := range []string{"m.example.com", "i.example.com"} {
+		if _, err := s.admitPack(clientCtx("web"), []string{d}); err != nil {
+			t.Errorf("exempt pack %s: %v", d, err)
+		}
+	}
+
+	// An evicted pack no longer counts.
+	s.certCache.mutex.Lock()
+	delete(s.certCache.entries, domain.AsKey([]string{"a.example.com"}))
+	s.certCache.mutex.Unlock()
+	if _, err := s.admitPack(clientCtx("web"), []string{"e.example.com"}); err != nil {
+		t.Fatalf("pack after eviction: %v", err)
+	}
+}
+
+func TestAdmitPackNewOrdersPerHour(t *testing.T) {
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.Quota = config.QuotaConfig{MaxNewOrdersPerHour: 2}
+	s.quota.admitted = []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-30 * time.Minute)}
+
+	if _, err := s.admitPack(context.Background(), []string{"a.example.com"}); err != nil {
+		t.Fatalf("second pack in the hour: %v", err)
+	}
+	_, err := s.admitPack(context.Background(), []string{"b.example.com"})
+	var qe *QuotaError
+	if !errors.As(err, &qe) || qe.Limit != "maxNewOrdersPerHour" {
+		t.Fatalf("third pack in the hour: %v", err)
+	}
+	if qe.RetryAfter < 29*time.Minute || qe.RetryAfter > 30*time.Minute {
+		t.Errorf("retry after %s, want about 30m", qe.RetryAfter)
+	}
+	if _, err := s.admitPack(context.Background(), []string{"a.example.com"}); err != nil {
+		t.Errorf("cached pack: %v", err)
+	}
+}
+
+func TestHandleCertReqQuota(t *testing.T) {
+	s := makeHistoryTestServer(t)
+	s.Config.Quota = config.QuotaConfig{MaxDomainsPerPack: 1, MaxNewOrdersPerHour: 1}
+	s.quota.admitted = []time.Time{time.Now()}
+
+	body, _ := json.Marshal(api.HttpCertReq{Domains: []string{"example.com"}})
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.apiHandler(w, req)
+	var resp api.HttpCertResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !strings.HasPrefix(resp.Err, "Quota exceeded: ") {
+		t.Errorf("v1: %d %s", w.Code, w.Body.String())
+	}
+
+	w, respV2 := postV2(t, s, `{"packs":[{"domains":["example.com"]}]}`)
+	if w.Code != http.StatusTooManyRequests || respV2.Error == nil || respV2.Error.Code != api.ErrCodeQuotaExceeded {
+		t.Errorf("v2 quota: %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("v2 Retry-After: got %q", got)
+	}
+
+	w, respV2 = postV2(t, s, `{"packs":[{"domains":["example.com","www.example.com"]}]}`)
+	if w.Code != http.StatusUnprocessableEntity || respV2.Error == nil || respV2.Error.Code != api.ErrCodePackRejected {
+		t.Errorf("v2 rejected: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdmitPackOwnersSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	s := makeTestServer("", "/", []string{"example.com"})
+	s.Config.Quota = config.QuotaConfig{MaxPacksPerClient: 1}
+
+	entry, err := s.admitPack(clientCtx("web"), []string{"a.example.com"})
+	if err != nil {
+		t.Fatalf("first pack of web: %v", err)
+	}
+	entry.stateMu.Lock()
+	persisted := entry.storeEntryLocked()
+	entry.stateMu.Unlock()
+	if persisted.Owner != "web" {
+		t.Fatalf("owner %q persisted, want web", persisted.Owner)
+	}
+	persisted.Cert = makeTestEntry().Cert
+	store := makeTempCertStore(t)
+	if err := store.SaveEntry(ctx, persisted); err != nil {
+		t.Fatalf("SaveEntry: %v", err)
+	}
+
+	// A restarted server still counts the pack against its owner.
+	s = makeTestServer("", "/", []string{"example.com"})
+	s.Config.Quota = config.QuotaConfig{MaxPacksPerClient: 1}
+	s.certStore = makeReloadedStore(t, store.path)
+	if err := s.loadCertStore(); err != nil {
+		t.Fatalf("loadCertStore: %v", err)
+	}
+	_, err = s.admitPack(clientCtx("web"), []string{"b.example.com"})
+	var qe *QuotaError
+	if !errors.As(err, &qe) || qe.Limit != "maxPacksPerClient" {
+		t.Fatalf("second pack of web after restart: %v", err)
+	}
+	if _, err := s.admitPack(clientCtx("mail"), []string{"b.example.com"}); err != nil {
+		t.Fatalf("first pack of mail: %v", err)
+	}
+}
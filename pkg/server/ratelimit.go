@@ -0,0 +1,276 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/logging"
+)
+
+// limiterSweep is how often idle limiter state is dropped, and how long
+// state must be idle to be dropped at least.
+const limiterSweep = time.Minute
+
+// initLimiter sets the limiter when [HttpServer.RateLimit] turns on any
+// limit.
+func (s *CertDXServer) initLimiter() {
+	if s.Config.HttpServer.RateLimit.Enabled() {
+		s.limiter = newHTTPLimiter(&s.Config.HttpServer.RateLimit)
+	}
+}
+
+// clientIP returns the address of the client sending r. Behind trusted
+// proxies it is the rightmost X-Forwarded-For hop not itself a trusted
+// proxy; otherwise, or when the header is malformed, the peer address.
+// A peer with no address, on a unix socket, gives the zero Addr.
+func clientIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	isTrusted := func(a netip.Addr) bool {
+		for _, p := range trusted {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		return false
+	}
+	if !isTrusted(addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return addr
+		}
+		addr = hop.Unmap()
+		if !isTrusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// ipLimit is the state kept for one client address.
+type ipLimit struct {
+	bucket      *rate.Limiter
+	failures    []time.Time
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// identityLimit is the state kept for one credential.
+type identityLimit struct {
+	bucket   *rate.Limiter
+	lastSeen time.Time
+}
+
+// httpLimiter enforces [HttpServer.RateLimit]: token buckets per client
+// address and per credential, and lockout of addresses failing to
+// authenticate.
+type httpLimiter struct {
+	cfg *config.HttpRateLimitConfig
+
+	mu         sync.Mutex
+	ips        map[netip.Addr]*ipLimit
+	identities map[string]*identityLimit
+	lastSweep  time.Time
+}
+
+func newHTTPLimiter(cfg *config.HttpRateLimitConfig) *httpLimiter {
+	return &httpLimiter{
+		cfg:        cfg,
+		ips:        make(map[netip.Addr]*ipLimit),
+		identities: make(map[string]*identityLimit),
+		lastSweep:  time.Now(),
+	}
+}
+
+// sweepLocked drops the state of addresses and credentials idle long
+// enough that their buckets have refilled and their failures and
+// lockouts expired. Callers hold mu.
+func (l *httpLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweep {
+		return
+	}
+	l.lastSweep = now
+	idle := max(limiterSweep, l.cfg.FailureWindowDuration)
+	for ip, s := range l.ips {
+		if now.Sub(s.lastSeen) > idle && now.After(s.lockedUntil) {
+			delete(l.ips, ip)
+		}
+	}
+	for name, s := range l.identities {
+		if now.Sub(s.lastSeen) > limiterSweep {
+			delete(l.identities, name)
+		}
+	}
+}
+
+// ipLocked returns the state of ip, creating it. Callers hold mu.
+func (l *httpLimiter) ipLocked(ip netip.Addr, now time.Time) *ipLimit {
+	l.sweepLocked(now)
+	s, ok := l.ips[ip]
+	if !ok {
+		s = &ipLimit{}
+		if l.cfg.PerIP > 0 {
+			s.bucket = rate.NewLimiter(rate.Limit(l.cfg.PerIP), l.cfg.PerIPBurst)
+		}
+		l.ips[ip] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// take takes a token from bucket, returning how long to wait for one
+// when it is empty.
+func take(bucket *rate.Limiter, now time.Time) (time.Duration, bool) {
+	if bucket == nil {
+		return 0, true
+	}
+	res := bucket.ReserveN(now, 1)
+	if d := res.DelayFrom(now); d > 0 {
+		res.CancelAt(now)
+		return d, false
+	}
+	return 0, true
+}
+
+// allowIP reports whether a request from ip may be served, and if not,
+// when to retry and whether ip is locked out. Unix socket peers, with the
+// zero ip, are exempt: they have no address to tell them apart, and the
+// socket's mode and group already decide who may connect.
+func (l *httpLimiter) allowIP(ip netip.Addr) (retry time.Duration, locked, ok bool) {
+	if !ip.IsValid() {
+		return 0, false, true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.ipLocked(ip, now)
+	if now.Before(s.lockedUntil) {
+		return s.lockedUntil.Sub(now), true, false
+	}
+	retry, ok = take(s.bucket, now)
+	return retry, false, ok
+}
+
+// authFailed records a failed authentication from ip, reporting whether
+// it locked ip out. Unix socket peers are never locked out.
+func (l *httpLimiter) authFailed(ip netip.Addr) bool {
+	if l.cfg.MaxAuthFailures == 0 || !ip.IsValid() {
+		return false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.ipLocked(ip, now)
+	since := now.Add(-l.cfg.FailureWindowDuration)
+	kept := s.failures[:0]
+	for _, t := range s.failures {
+		if t.After(since) {
+			kept = append(kept, t)
+		}
+	}
+	s.failures = append(kept, now)
+	if len(s.failures) < l.cfg.MaxAuthFailures {
+		return false
+	}
+	s.failures = nil
+	s.lockedUntil = now.Add(l.cfg.LockoutDuration)
+	return true
+}
+
+// authSucceeded forgets the failed authentications of ip.
+func (l *httpLimiter) authSucceeded(ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.ips[ip]; ok {
+		s.failures = nil
+	}
+}
+
+// allowIdentity reports whether a request with the credential name may
+// be served, and if not, when to retry.
+func (l *httpLimiter) allowIdentity(name string) (time.Duration, bool) {
+	if l.cfg.PerIdentity == 0 {
+		return 0, true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweepLocked(now)
+	s, ok := l.identities[name]
+	if !ok {
+		s = &identityLimit{bucket: rate.NewLimiter(rate.Limit(l.cfg.PerIdentity), l.cfg.PerIdentityBurst)}
+		l.identities[name] = s
+	}
+	s.lastSeen = now
+	return take(s.bucket, now)
+}
+
+// writeTooManyRequests rejects r with 429, as a v2 error on the v2
+// endpoints.
+func (s *CertDXServer) writeTooManyRequests(w http.ResponseWriter, r *http.Request, msg string, retry time.Duration) {
+	secs := max(1, int((retry+time.Second-1)/time.Second))
+	if s.v2Handler(r.URL.Path) != nil {
+		writeErrorV2(w, &api.HttpErrorV2{Code: api.ErrCodeTooManyRequests, Message: msg, RetryAfter: secs})
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// limitBeforeAuth applies the per-address limit and lockout to r,
+// rejecting it if they are hit.
+func (s *CertDXServer) limitBeforeAuth(w http.ResponseWriter, r *http.Request, ip netip.Addr) bool {
+	retry, locked, ok := s.limiter.allowIP(ip)
+	switch {
+	case ok:
+		return true
+	case locked:
+		s.writeTooManyRequests(w, r, "Too many failed authentications", retry)
+	default:
+		s.writeTooManyRequests(w, r, "Too many requests", retry)
+	}
+	return false
+}
+
+// limitAfterAuth records the outcome of authenticating r and applies the
+// per-credential limit, rejecting r if it is hit.
+func (s *CertDXServer) limitAfterAuth(w http.ResponseWriter, r *http.Request, ip netip.Addr, token *config.HttpToken, authorized bool) bool {
+	if !authorized {
+		if s.limiter.authFailed(ip) {
+			logging.Warn("Locked out %s after %d failed authentications", ip, s.Config.HttpServer.RateLimit.MaxAuthFailures)
+		}
+		return true
+	}
+	s.limiter.authSucceeded(ip)
+	if token == nil {
+		return true
+	}
+	if retry, ok := s.limiter.allowIdentity(token.Name); !ok {
+		s.writeTooManyRequests(w, r, "Too many requests", retry)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg.para.party/certdx/pkg/api"
+	"pkg.para.party/certdx/pkg/config"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	cases := []struct {
+		name, remote, xff, want string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted peer's header ignored", "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"behind proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hop skipped", "10.0.0.1:1234", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"malformed hop", "10.0.0.1:1234", "198.51.100.1, junk", "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"mapped", "[::ffff:192.0.2.1]:1234", "", "192.0.2.1"},
+		{"unix socket", "@", "198.51.100.1", "invalid IP"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				req.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if got := clientIP(req, trusted); got.String() != tc.want {
+				t.Errorf("got %s want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func makeRateLimitTestServer(rl config.HttpRateLimitConfig) *CertDXServer {
+	s := makeTestServer("mysecret", "/", []string{"example.com"})
+	s.Config.HttpServer.Enabled = true
+	s.Config.HttpServer.RateLimit = rl
+	if err := s.Config.HttpServer.Validate(); err != nil {
+		panic(err)
+	}
+	s.initLimiter()
+	return s
+}
+
+func doLimited(s *CertDXServer, path, remote, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remote
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	w := httptest.NewRecorder()
+	s.apiWithTokenHandler(w, req)
+	return w
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	s := makeRateLimitTestServer(config.HttpRateLimitConfig{PerIP: 0.01, PerIPBurst: 2})
+	for range 2 {
+		if w := doLimited(s, "/", "192.0.2.1:1", "mysecret"); w.Code == http.StatusTooManyRequests {
+			t.Fatal("limited within burst")
+		}
+	}
+	w := doLimited(s, "/", "192.0.2.1:1", "mysecret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("v1 over limit: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = doLimited(s, "/"+api.V2Path, "192.0.2.1:1", "")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), api.ErrCodeTooManyRequests) {
+		t.Fatalf("v2 over limit: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doLimited(s, "/", "192.0.2.2:1", "mysecret"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("other address limited")
+	}
+}
+
+func TestRateLimitLockout(t *testing.T) {
+	s := makeRateLimitTestServer(config.HttpRateLimitConfig{MaxAuthFailures: 3, Lockout: "1h"})
+	for range 3 {
+		if w := doLimited(s, "/", "192.0.2.1:1", "wrong"); w.Code != http.StatusNotFound {
+			t.Fatalf("wrong token: got %d", w.Code)
+		}
+	}
+	w := doLimited(s, "/", "192.0.2.1:1", "mysecret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out: got %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "3600" {
+		t.Errorf("locked out Retry-After: got %q", retry)
+	}
+
+	// A success forgets earlier failures.
+	for range 2 {
+		doLimited(s, "/", "192.0.2.2:1", "wrong")
+	}
+	doLimited(s, "/", "192.0.2.2:1", "mysecret")
+	doLimited(s, "/", "192.0.2.2:1", "wrong")
+	if w := doLimited(s, "/", "192.0.2.2:1", "mysecret"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("failures counted across a success")
+	}
+
+	s.limiter.ips[netip.MustParseAddr("192.0.2.1")].lockedUntil = time.Now()
+	if w := doLimited(s, "/", "192.0.2.1:1", "mysecret"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("still locked out after lockout")
+	}
+}
+
+func TestRateLimitPerIdentity(t *testing.T) {
+	s := makeRateLimitTestServer(config.HttpRateLimitConfig{PerIdentity: 0.01})
+	if w := doLimited(s, "/", "192.0.2.1:1", "mysecret"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("limited within burst")
+	}
+	// The limit follows the credential across addresses.
+	if w := doLimited(s, "/", "192.0.2.2:1", "mysecret"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over identity limit: got %d", w.Code)
+	}
+	// Failed authentications aren't charged to any identity.
+	if w := doLimited(s, "/", "192.0.2.3:1", "wrong"); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong token: got %d", w.Code)
+	}
+}
+
+func TestRateLimitUnixPeers(t *testing.T) {
+	s := makeRateLimitTestServer(config.HttpRateLimitConfig{PerIP: 0.01, MaxAuthFailures: 1, Lockout: "1h", PerIdentity: 0.01})
+	// Unix socket peers share no address, so one failing doesn't lock
+	// out the others, nor do they share a bucket.
+	if w := doLimited(s, "/", "@", "wrong"); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong token: got %d", w.Code)
+	}
+	if w := doLimited(s, "/", "@", "mysecret"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unix peer limited per address")
+	}
+	// The per-credential limit still applies.
+	if w := doLimited(s, "/", "@", "mysecret"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over identity limit: got %d", w.Code)
+	}
+}
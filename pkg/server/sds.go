@@ -2,9 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"net"
 	"time"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
@@ -12,11 +12,13 @@ import (
 	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
-	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/config"
 	"pkg.para.party/certdx/pkg/logging"
 	"pkg.para.party/certdx/pkg/mtls"
 )
@@ -94,6 +96,9 @@ func (sds *MySDS) StreamSecrets(server secretv3.SecretDiscoveryService_StreamSec
 	}()
 
 	var domainSets map[string]interface{}
+	// cred is what the client may receive, set from its certificate and
+	// node on the first request.
+	var cred *config.HttpToken
 
 	go func() {
 		// goroutine for receiving
@@ -132,9 +137,21 @@ func (sds *MySDS) StreamSecrets(server secretv3.SecretDiscoveryService_StreamSec
 					return
 				}
 				domainSets = m
+
+				id := &clientIdentity{cert: peerCert(ctx), nodeID: req.Node.Id, cluster: req.Node.Cluster}
+				if id.cert == nil {
+					sendStreamErr(ctx, errChan, status.Errorf(codes.Unauthenticated, "no client certificate"))
+					return
+				}
+				if cred, ok = sds.cdxsrv.authorizeClient(id); !ok {
+					logging.Warn("Denied SDS stream from %s: client %s matches no mTLS client rule", peer, id)
+					sendStreamErr(ctx, errChan, status.Errorf(codes.PermissionDenied, "client %s matches no mTLS client rule", id))
+					return
+				}
+				logging.Info("SDS client %s from %s", id, peer)
 			}
 
-			packRequests := map[string][]string{}
+			packRequests := map[string]*certEntry{}
 			for _, name := range req.ResourceNames {
 				// this is an ack
 				if reqChan, ok := dispatch[name]; ok {
@@ -166,17 +183,34 @@ func (sds *MySDS) StreamSecrets(server secretv3.SecretDiscoveryService_StreamSec
 					}
 					domains = append(domains, vs)
 				}
-				if !domain.AllAllowed(sds.cdxsrv.Config.ACME.AllowedDomains, domains) {
-					sendStreamErr(ctx, errChan, fmt.Errorf("domains %v: %w", domains, domain.ErrNotAllowed))
+				credCtx := withCredential(ctx, cred)
+				if err := sds.cdxsrv.checkDomains(credCtx, domains); err != nil {
+					logging.Warn("Denied pack %s to SDS client %s from %s: %s", name, cred.Name, peer, err)
+					sendStreamErr(ctx, errChan, status.Errorf(codes.PermissionDenied, "pack %s: %s", name, err))
+					return
+				}
+				entry, err := sds.cdxsrv.admitPack(credCtx, domains)
+				if err != nil {
+					code := codes.Internal
+					switch {
+					case errors.Is(err, ErrQuotaExceeded):
+						code = codes.ResourceExhausted
+					case errors.Is(err, ErrPackRejected):
+						code = codes.InvalidArgument
+					case errors.Is(err, ErrApprovalPending):
+						code = codes.FailedPrecondition
+					case errors.Is(err, ErrApprovalDenied):
+						code = codes.PermissionDenied
+					}
+					logging.Warn("Refused pack %s to SDS client %s from %s: %s", name, cred.Name, peer, err)
+					sendStreamErr(ctx, errChan, status.Errorf(code, "pack %s: %s", name, err))
 					return
 				}
-				packRequests[name] = domains
+				packRequests[name] = entry
 			}
 
-			for name, domains := range packRequests {
-				logging.Info("Handling pack %s with domains %v in response to %s", name, domains, peer)
-
-				entry := sds.cdxsrv.certCache.get(domains)
+			for name, entry := range packRequests {
+				logging.Info("Handling pack %s with domains %v in response to %s", name, entry.domains, peer)
 
 				reqChan := make(chan *discoveryv3.DiscoveryRequest)
 				dispatch[name] = reqChan
@@ -281,20 +315,37 @@ func (sds *MySDS) handleCert(ctx context.Context, name string, entry *certEntry,
 	}
 }
 
-func clientTLSLog(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	if p, ok := peer.FromContext(ctx); ok {
-		if mtls, ok := p.AuthInfo.(credentials.TLSInfo); ok {
-			if len(mtls.State.PeerCertificates) > 1 {
-				logging.Error("Client %s providing multiple client certificate.", p.Addr.String())
-			}
-			for _, item := range mtls.State.PeerCertificates {
-				logging.Info("Client `%s` from %s.", item.Subject.CommonName, p.Addr.String())
-			}
-		}
+// peerCert returns the client certificate of the gRPC peer of ctx, or
+// nil without one.
+func peerCert(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p == nil {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return info.State.PeerCertificates[0]
+}
+
+// logClientTLS logs the client certificate of the gRPC peer of ctx.
+func logClientTLS(ctx context.Context) {
+	if cert := peerCert(ctx); cert != nil {
+		logging.Info("Client `%s` from %s.", cert.Subject.CommonName, peerAddr(ctx))
 	}
+}
+
+func clientTLSLog(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	logClientTLS(ctx)
 	return handler(ctx, req)
 }
 
+func clientTLSStreamLog(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	logClientTLS(ss.Context())
+	return handler(srv, ss)
+}
+
 // SDSSrv runs the gRPC SDS endpoint until Stop is called. A goroutine
 // watches the server's rootCtx and triggers grpcServer.Stop on shutdown,
 // which closes every active stream — StreamSecrets goroutines then exit
@@ -310,6 +361,7 @@ func (s *CertDXServer) SDSSrv() error {
 	grpcServer := grpc.NewServer(
 		grpc.Creds(credentials.NewTLS(mtlsConfig)),
 		grpc.UnaryInterceptor(clientTLSLog),
+		grpc.StreamInterceptor(clientTLSStreamLog),
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime:             time.Second,
 			PermitWithoutStream: true,
@@ -323,9 +375,9 @@ func (s *CertDXServer) SDSSrv() error {
 	sds := &MySDS{cdxsrv: s}
 	secretv3.RegisterSecretDiscoveryServiceServer(grpcServer, sds)
 
-	listener, err := net.Listen("tcp", s.Config.GRPCSDSServer.Listen)
+	listener, err := listen(s.Config.GRPCSDSServer.Listen, &s.Config.GRPCSDSServer.ListenOptions)
 	if err != nil {
-		return fmt.Errorf("listen at %s: %w", s.Config.GRPCSDSServer.Listen, err)
+		return err
 	}
 
 	go func() {
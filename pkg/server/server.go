@@ -2,21 +2,40 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pkg.para.party/certdx/pkg/acme"
 	"pkg.para.party/certdx/pkg/config"
+	"pkg.para.party/certdx/pkg/domain"
+	"pkg.para.party/certdx/pkg/encryption"
 	"pkg.para.party/certdx/pkg/logging"
 )
 
 type CertT struct {
-	FullChain   []byte    `json:"fullChain"`
-	Key         []byte    `json:"key"`
+	FullChain []byte `json:"fullChain"`
+	Key       []byte `json:"key"`
+	// ValidBefore is when the cert falls due for renewal, derived from
+	// the leaf's validity period (see renewalTime).
 	ValidBefore time.Time `json:"validBefore"`
 	RenewAt     time.Time `json:"renewAt"`
+
+	// Leaf certificate metadata, parsed from FullChain when the cert is
+	// obtained. Entries persisted before it was recorded are migrated on
+	// load.
+	Serial    string    `json:"serial,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"`
+	NotBefore time.Time `json:"notBefore,omitzero"`
+	NotAfter  time.Time `json:"notAfter,omitzero"`
+
+	// External marks a cert imported by an operator rather than obtained
+	// through ACME. It is served until it expires and never renewed.
+	External bool `json:"external,omitempty"`
 }
 
 type CertDXServer struct {
@@ -24,7 +43,11 @@ type CertDXServer struct {
 
 	acme      acme.Obtainer
 	certCache certCache
-	certStore CertStore
+
+	// certStore is constructed by Init from Config.CertStore. Renewals
+	// are handed to its writer goroutine through storeUpdate.
+	certStore   CertStore
+	storeUpdate chan *CertStoreEntry
 
 	// rootCtx is the lifecycle parent for every server subgoroutine
 	// (HttpSrv, SDSSrv, the cache-file writer, every per-entry renewer).
@@ -33,48 +56,132 @@ type CertDXServer struct {
 	rootCtx    context.Context
 	rootCancel context.CancelFunc
 	stopOnce   sync.Once
+
+	// lease is set by Init when [LeaderElection] is enabled; leading
+	// reports whether this server currently holds it (see leader.go).
+	lease       Lease
+	leaseHolder string
+	leading     atomic.Bool
+
+	// peer is set by Init on a [PeerSync] standby (see peer_sync.go).
+	peer *peerSync
+
+	// jwt is set by HttpSrv with the jwt and oidc auth methods (see
+	// jwt.go).
+	jwt *jwtAuth
+
+	// limiter is set by HttpSrv when [HttpServer.RateLimit] turns on any
+	// limit (see ratelimit.go).
+	limiter *httpLimiter
+
+	// quota counts packs against [Quota] (see quota.go).
+	quota issuanceQuota
+
+	// approvals is set by Init when ACME.requireApproval lists domains
+	// (see approval.go).
+	approvals *approvals
+
+	// importRoots is set by Init from CertStore.importRoots; imported
+	// certs must chain to them (see cert_import.go).
+	importRoots *x509.CertPool
 }
 
 func MakeCertDXServer() (*CertDXServer, error) {
-	store, err := NewCertStore()
-	if err != nil {
-		return nil, err
-	}
 	rootCtx, rootCancel := context.WithCancel(context.Background())
 	ret := &CertDXServer{
-		certCache:  makeCertCache(),
-		certStore:  store,
-		rootCtx:    rootCtx,
-		rootCancel: rootCancel,
+		certCache:   makeCertCache(),
+		storeUpdate: make(chan *CertStoreEntry, 10),
+		rootCtx:     rootCtx,
+		rootCancel:  rootCancel,
 	}
 	ret.Config.SetDefault()
 
 	return ret, nil
 }
 
+// IsValid reports whether c is not yet due for renewal.
 func (c *CertT) IsValid() bool {
-	return time.Now().Before(c.ValidBefore)
+	now := time.Now()
+	if !c.NotAfter.IsZero() && !now.Before(c.NotAfter) {
+		return false
+	}
+	return now.Before(c.ValidBefore)
 }
 
 func (s *CertDXServer) Init() error {
 	var err error
 
-	s.acme, err = acme.MakeACME(&s.Config)
+	keys, err := encryption.NewKeyProvider(&s.Config.Encryption)
+	if err != nil {
+		return fmt.Errorf("initialize encryption: %w", err)
+	}
+
+	s.acme, err = acme.MakeACME(&s.Config, keys)
 	if err != nil {
 		return fmt.Errorf("initialize ACME: %w", err)
 	}
 
+	if len(s.Config.ACME.RequireApproval) > 0 {
+		if s.approvals, err = openApprovals(s.Config.ACME.ApprovalsFile); err != nil {
+			return fmt.Errorf("initialize approvals: %w", err)
+		}
+	}
+
+	if s.importRoots, err = LoadImportRoots(s.Config.CertStore.ImportRoots); err != nil {
+		return fmt.Errorf("initialize import roots: %w", err)
+	}
+
+	if err = s.initManaged(); err != nil {
+		return fmt.Errorf("initialize managed certs: %w", err)
+	}
+
+	s.certStore, err = OpenCertStore(&s.Config, keys)
+	if err != nil {
+		return fmt.Errorf("initialize cert store: %w", err)
+	}
+
 	if err = s.loadCertStore(); err != nil {
+		// Starting without a key would re-issue everything and overwrite
+		// the encrypted store with plaintext, so refuse instead.
+		if errors.Is(err, encryption.ErrNoKey) {
+			s.certStore.Close()
+			return fmt.Errorf("load cert store: %w", err)
+		}
 		// It's okay that previous saved cert can not be loaded, just log and continue to run
 		logging.Warn("Load cache file failed: %s", err)
 	}
-	go s.certStore.listenUpdate(s.rootCtx)
+	go func() {
+		listenUpdate(s.rootCtx, s.certStore, s.storeUpdate)
+		if err := s.certStore.Close(); err != nil {
+			logging.Warn("Close cert store failed: %s", err)
+		}
+	}()
+
+	if s.Config.LeaderElection.Enabled() {
+		if err = s.initElection(); err != nil {
+			return fmt.Errorf("initialize leader election: %w", err)
+		}
+		go s.runElection()
+		go s.followStore()
+	}
+
+	if s.Config.PeerSync.Standby() {
+		if s.peer, err = newPeerSync(&s.Config.PeerSync); err != nil {
+			return fmt.Errorf("initialize peer sync: %w", err)
+		}
+		go s.runPeerSync()
+	}
 
+	s.startManaged()
+	go s.runEvictor()
+	if s.Config.FileSource.Enabled() {
+		go s.runFileSource()
+	}
 	return nil
 }
 
 func (s *CertDXServer) loadCertStore() error {
-	err := s.certStore.Load()
+	entries, err := s.certStore.Load(s.rootCtx)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -83,15 +190,43 @@ func (s *CertDXServer) loadCertStore() error {
 		}
 	}
 
+	var migrated []*CertStoreEntry
 	s.certCache.mutex.Lock()
-	for _, cache := range s.certStore.entries {
+	for _, cache := range entries {
 		entry := s.certCache.getNoLock(cache.Domains)
+		_, acmeConfig := s.acmeFor(entry)
+
+		// Entries written before the leaf's validity period was recorded
+		// carry a ValidBefore computed from ACME.certLifeTime, which the
+		// CA may not have honored. Reschedule them from the real one.
+		if cache.Cert.fillMetadata() {
+			cache.Cert.schedule(acmeConfig.RenewTimeLeftDuration)
+			migrated = append(migrated, cache)
+		}
+		for i := range cache.History {
+			cache.History[i].fillMetadata()
+		}
+
 		entry.stateMu.Lock()
 		entry.cert = cache.Cert
+		entry.history = cache.History
+		entry.storedAt = cache.changedAt()
+		entry.owner = cache.Owner
 		entry.stateMu.Unlock()
+
+		if !quotaExempt(entry) {
+			s.quota.own(cache.Owner, domain.AsKey(cache.Domains))
+		}
 	}
 	s.certCache.mutex.Unlock()
 
+	for _, entry := range migrated {
+		logging.Info("Rescheduled cert %v to renew at %s", entry.Domains, entry.Cert.ValidBefore)
+		if err := s.certStore.SaveEntry(s.rootCtx, entry); err != nil {
+			logging.Warn("Save migrated cert %v failed: %s", entry.Domains, err)
+		}
+	}
+
 	logging.Info("Previous cache loaded")
 	return nil
 }
@@ -110,6 +245,13 @@ func (s *CertDXServer) renew(ctx context.Context, c *certEntry, retry bool) (boo
 		return false, err
 	}
 
+	if s.deferToMain() {
+		return false, s.standbyRenew(ctx, c)
+	}
+	if !s.isLeader() {
+		return false, s.followerRenew(ctx, c)
+	}
+
 	c.renewMu.Lock()
 	defer c.renewMu.Unlock()
 
@@ -119,20 +261,29 @@ func (s *CertDXServer) renew(ctx context.Context, c *certEntry, retry bool) (boo
 	// skip the ACME round-trip. This collapses concurrent expired-cert
 	// fetches into one ACME call.
 	current, _ := c.Snapshot()
-	if current.IsValid() {
+	if current.External {
+		return false, s.checkExternal(c, &current)
+	}
+	if forced := c.takeForced(); current.IsValid() && !forced {
 		logging.Info("Cert: %v is valid until %s", c.domains, current.ValidBefore)
 		return false, nil
 	}
 
-	newValidBefore := time.Now().Truncate(1 * time.Hour).Add(s.Config.ACME.CertLifeTimeDuration)
+	// The requested lifetime is only a hint: CAs that don't take a
+	// NotAfter in the order (Let's Encrypt) pick their own, so renewal
+	// is scheduled from the issued leaf.
+	obtainer, acmeConfig := s.acmeFor(c)
+	newValidBefore := time.Now().Truncate(1 * time.Hour).Add(acmeConfig.CertLifeTimeDuration)
 
 	var fullchain, key []byte
 	var err error
+	c.startOrder()
 	if retry {
-		fullchain, key, err = s.acme.RetryObtain(ctx, c.domains, newValidBefore.Add(s.Config.ACME.RenewTimeLeftDuration))
+		fullchain, key, err = obtainer.RetryObtain(ctx, c.domains, newValidBefore.Add(acmeConfig.RenewTimeLeftDuration))
 	} else {
-		fullchain, key, err = s.acme.Obtain(ctx, c.domains, newValidBefore.Add(s.Config.ACME.RenewTimeLeftDuration))
+		fullchain, key, err = obtainer.Obtain(ctx, c.domains, newValidBefore.Add(acmeConfig.RenewTimeLeftDuration))
 	}
+	c.endOrder(err)
 	if err != nil {
 		return false, err
 	}
@@ -143,16 +294,19 @@ func (s *CertDXServer) renew(ctx context.Context, c *certEntry, retry bool) (boo
 		ValidBefore: newValidBefore,
 		RenewAt:     time.Now(),
 	}
+	if newCert.fillMetadata() {
+		newCert.schedule(acmeConfig.RenewTimeLeftDuration)
+	} else {
+		logging.Warn("Cert %v: can not read validity period, renewing at %s", c.domains, newValidBefore)
+	}
 
 	// Broadcast: under stateMu, swap in the new cert + version and
 	// close+replace the updated chan. Holding stateMu makes the
 	// (cert, version) pair atomic for Snapshot readers and keeps
 	// WaitForUpdate's chan snapshot consistent with the version it sees.
+	// The replaced cert is kept in the history for rollback.
 	c.stateMu.Lock()
-	c.cert = newCert
-	c.version++
-	close(c.updated)
-	c.updated = make(chan struct{})
+	persisted := c.publishLocked(newCert, c.history, s.Config.CertStore.History)
 	c.stateMu.Unlock()
 
 	// Hand off the persisted cert to the cache-file writer. If the writer
@@ -160,15 +314,12 @@ func (s *CertDXServer) renew(ctx context.Context, c *certEntry, retry bool) (boo
 	// honor ctx instead of blocking forever on a buffered send that no
 	// one will receive.
 	select {
-	case s.certStore.update <- &certStoreEntry{
-		Domains: c.domains,
-		Cert:    newCert,
-	}:
+	case s.storeUpdate <- persisted:
 	case <-ctx.Done():
 		return true, nil
 	}
 
-	logging.Info("Obtained new cert: %v", c.domains)
+	logging.Info("Obtained new cert: %v, valid until %s, renewing at %s", c.domains, newCert.NotAfter, newCert.ValidBefore)
 	return true, nil
 }
 
@@ -176,6 +327,7 @@ func (s *CertDXServer) subscribeCertCacheEntry(ctx context.Context, c *certEntry
 	logging.Info("Start subscribing cert: %v", c.domains)
 	defer logging.Info("Stopped subscribing cert: %v", c.domains)
 
+	_, acmeConfig := s.acmeFor(c)
 	for {
 		_, err := s.renew(ctx, c, true)
 		if err != nil {
@@ -185,7 +337,7 @@ func (s *CertDXServer) subscribeCertCacheEntry(ctx context.Context, c *certEntry
 			logging.Error("Failed to renew cert %s: %s", c.domains, err)
 		}
 
-		t := time.NewTimer(s.Config.ACME.RenewTimeLeftDuration / 4)
+		t := time.NewTimer(acmeConfig.RenewTimeLeftDuration / 4)
 		select {
 		case <-t.C:
 			// Do next check
@@ -214,6 +366,7 @@ func (s *CertDXServer) subscribe(c *certEntry) {
 		start = true
 	}
 	c.subscribing++
+	c.lastUsed = time.Now()
 	c.stateMu.Unlock()
 
 	if start {
@@ -224,12 +377,21 @@ func (s *CertDXServer) subscribe(c *certEntry) {
 // Release drops a consumer. When the last consumer leaves, the renewal
 // goroutine's context is cancelled and it winds down.
 func (s *CertDXServer) release(c *certEntry) {
+	s.releaseUsedAt(c, time.Now())
+}
+
+// releaseUsedAt is release for a consumer last active at usedAt, which
+// becomes the entry's lastUsed time.
+func (s *CertDXServer) releaseUsedAt(c *certEntry, usedAt time.Time) {
 	var cancel context.CancelFunc
 
 	c.stateMu.Lock()
 	if c.subscribing > 0 {
 		c.subscribing--
 	}
+	if usedAt.After(c.lastUsed) {
+		c.lastUsed = usedAt
+	}
 	if c.subscribing == 0 {
 		cancel = c.cancelRenew
 		c.cancelRenew = nil
@@ -0,0 +1,434 @@
+package tools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+// BackupFormat is the archive layout version written by WriteBackup.
+// RestoreBackup refuses archives from a newer format.
+const BackupFormat = 1
+
+const backupManifestName = "manifest.json"
+
+// Archive paths are prefixed with the root they were taken from, so a
+// backup restores correctly whether or not the roots coincide.
+const (
+	backupConfigPrefix = "config/"
+	backupStatePrefix  = "state/"
+)
+
+var (
+	// ErrBackupCorrupt is returned when an archive fails its integrity
+	// checks. Nothing is restored from such an archive.
+	ErrBackupCorrupt = errors.New("backup archive is corrupt")
+
+	// ErrBackupExists is returned by RestoreBackup when it would
+	// overwrite existing files and force is not set.
+	ErrBackupExists = errors.New("restore would overwrite existing files")
+)
+
+// BackupManifest describes a backup archive. It is the first entry of
+// the archive.
+type BackupManifest struct {
+	Format    int          `json:"format"`
+	Version   string       `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Files     []BackupFile `json:"files"`
+}
+
+// BackupFile is one file in a backup archive, with the checksum it is
+// verified against on restore.
+type BackupFile struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	SHA256 string      `json:"sha256"`
+}
+
+// BackupPaths places the server files a backup holds where the server
+// config puts them: CertStore is the [CertStore] path of a json store,
+// CertStoreDB that of a sqlite store and Approvals the [ACME]
+// approvalsFile. Empty fields mean the default under the state root.
+type BackupPaths struct {
+	CertStore   string
+	CertStoreDB string
+	Approvals   string
+}
+
+// overrides maps archive paths to their configured location on disk.
+func (p BackupPaths) overrides() map[string]string {
+	ret := map[string]string{}
+	for name, path := range map[string]string{
+		backupStatePrefix + paths.ServerCacheFile:     p.CertStore,
+		backupStatePrefix + paths.ServerCacheDBFile:   p.CertStoreDB,
+		backupStatePrefix + paths.ServerApprovalsFile: p.Approvals,
+	} {
+		if path != "" {
+			ret[name] = path
+		}
+	}
+	return ret
+}
+
+// backupSources lists what a backup holds: the mtls/ material including
+// the CA serial counter, the ACME account keys, the server cert cache
+// and its approval requests, each relative to its root unless p places
+// it elsewhere.
+func backupSources(p BackupPaths) (map[string]string, error) {
+	configDir, err := paths.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	stateDir, err := paths.StateDir()
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]string{
+		backupConfigPrefix + paths.MtlsCertificateDir: filepath.Join(configDir, paths.MtlsCertificateDir),
+		backupStatePrefix + paths.ACMEPrivateKeyDir:   filepath.Join(stateDir, paths.ACMEPrivateKeyDir),
+		backupStatePrefix + paths.ServerCacheFile:     filepath.Join(stateDir, paths.ServerCacheFile),
+		backupStatePrefix + paths.ServerCacheDBFile:   filepath.Join(stateDir, paths.ServerCacheDBFile),
+		backupStatePrefix + paths.ServerApprovalsFile: filepath.Join(stateDir, paths.ServerApprovalsFile),
+	}
+	for name, path := range p.overrides() {
+		sources[name] = path
+	}
+	return sources, nil
+}
+
+// backupTarget maps an archive path back to its location on disk.
+func backupTarget(name string, p BackupPaths) (string, error) {
+	if path, ok := p.overrides()[name]; ok {
+		return path, nil
+	}
+
+	var (
+		root string
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(name, backupConfigPrefix):
+		root, err = paths.ConfigDir()
+		name = strings.TrimPrefix(name, backupConfigPrefix)
+	case strings.HasPrefix(name, backupStatePrefix):
+		root, err = paths.StateDir()
+		name = strings.TrimPrefix(name, backupStatePrefix)
+	default:
+		return "", fmt.Errorf("%w: unexpected path %q", ErrBackupCorrupt, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if name == "" || path.Clean(name) != name || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w: unsafe path %q", ErrBackupCorrupt, name)
+	}
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+// snapshotSQLite copies the SQLite database at path with VACUUM INTO,
+// so the copy is consistent even while a running server writes to it in
+// WAL mode, where the file alone may lack committed transactions.
+func snapshotSQLite(ctx context.Context, path string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "certdx-backup-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	snapshot := filepath.Join(dir, paths.ServerCacheDBFile)
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	return os.ReadFile(snapshot)
+}
+
+// collectBackup reads every file to back up, keyed by archive path.
+// Missing sources are skipped.
+func collectBackup(ctx context.Context, bp BackupPaths) (map[string][]byte, map[string]fs.FileMode, error) {
+	sources, err := backupSources(bp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := map[string][]byte{}
+	modes := map[string]fs.FileMode{}
+	for prefix, src := range sources {
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			name := prefix
+			if rel != "." {
+				name = prefix + "/" + filepath.ToSlash(rel)
+			}
+			if name == backupStatePrefix+paths.ServerCacheDBFile {
+				data[name], err = snapshotSQLite(ctx, p)
+			} else {
+				data[name], err = os.ReadFile(p)
+			}
+			if err != nil {
+				return err
+			}
+			modes[name] = info.Mode().Perm()
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", src, err)
+		}
+	}
+	return data, modes, nil
+}
+
+// WriteBackup archives the server state under the configured data roots,
+// and at the locations in p, into w. If kp is not nil the archive is
+// encrypted with it. version is recorded in the manifest.
+func WriteBackup(ctx context.Context, w io.Writer, version string, kp encryption.KeyProvider, p BackupPaths) (*BackupManifest, error) {
+	data, modes, err := collectBackup(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		Format:    BackupFormat,
+		Version:   version,
+		CreatedAt: time.Now().UTC(),
+	}
+	for name, content := range data {
+		sum := sha256.Sum256(content)
+		manifest.Files = append(manifest.Files, BackupFile{
+			Path:   name,
+			Mode:   modes[name],
+			Size:   int64(len(content)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	out, err := packBackup(manifest, data)
+	if err != nil {
+		return nil, err
+	}
+	if kp != nil {
+		if out, err = encryption.Seal(ctx, kp, out); err != nil {
+			return nil, fmt.Errorf("encrypt backup: %w", err)
+		}
+	}
+	if _, err := w.Write(out); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// packBackup writes manifest and the files it lists as a gzipped tar.
+func packBackup(manifest *BackupManifest, data map[string][]byte) ([]byte, error) {
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, mode fs.FileMode, content []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(mode),
+			Size:    int64(len(content)),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := add(backupManifestName, 0o600, manifestData); err != nil {
+		return nil, err
+	}
+	for _, f := range manifest.Files {
+		if err := add(f.Path, f.Mode, data[f.Path]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ReadBackup decrypts and unpacks an archive written by WriteBackup and
+// checks every file against the manifest. kp is only needed for an
+// encrypted archive.
+func ReadBackup(ctx context.Context, archive []byte, kp encryption.KeyProvider) (*BackupManifest, map[string][]byte, error) {
+	if encryption.IsSealed(archive) {
+		var err error
+		if archive, err = encryption.Open(ctx, kp, archive); err != nil {
+			return nil, nil, fmt.Errorf("decrypt backup: %w", err)
+		}
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBackupCorrupt, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest *BackupManifest
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrBackupCorrupt, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrBackupCorrupt, err)
+		}
+		if hdr.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, nil, fmt.Errorf("%w: manifest: %w", ErrBackupCorrupt, err)
+			}
+			continue
+		}
+		files[hdr.Name] = content
+	}
+
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%w: no manifest", ErrBackupCorrupt)
+	}
+	if manifest.Format > BackupFormat {
+		return nil, nil, fmt.Errorf("backup format %d is newer than supported format %d", manifest.Format, BackupFormat)
+	}
+	if len(files) != len(manifest.Files) {
+		return nil, nil, fmt.Errorf("%w: %d files in archive, %d in manifest", ErrBackupCorrupt, len(files), len(manifest.Files))
+	}
+	for _, f := range manifest.Files {
+		content, ok := files[f.Path]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s missing", ErrBackupCorrupt, f.Path)
+		}
+		sum := sha256.Sum256(content)
+		if int64(len(content)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, nil, fmt.Errorf("%w: %s checksum mismatch", ErrBackupCorrupt, f.Path)
+		}
+	}
+	return manifest, files, nil
+}
+
+// RestoreBackup verifies archive and writes its files back under the
+// configured data roots, or to the locations in p. Without force it
+// fails with ErrBackupExists before writing anything if any of the files
+// already exists.
+func RestoreBackup(ctx context.Context, archive []byte, kp encryption.KeyProvider, force bool, p BackupPaths) (*BackupManifest, error) {
+	manifest, files, err := ReadBackup(ctx, archive, kp)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]string, len(manifest.Files))
+	var existing []string
+	for _, f := range manifest.Files {
+		target, err := backupTarget(f.Path, p)
+		if err != nil {
+			return nil, err
+		}
+		targets[f.Path] = target
+		if paths.FileExists(target) {
+			existing = append(existing, target)
+		}
+	}
+	if len(existing) != 0 && !force {
+		return nil, fmt.Errorf("%w: %s", ErrBackupExists, strings.Join(existing, ", "))
+	}
+
+	for _, f := range manifest.Files {
+		target := targets[f.Path]
+		if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+			return nil, err
+		}
+		if f.Path == backupStatePrefix+paths.ServerCacheDBFile {
+			// A leftover write-ahead log would be replayed onto the
+			// restored database.
+			for _, suffix := range []string{"-wal", "-shm"} {
+				if err := os.Remove(target + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("restore %s: %w", target, err)
+				}
+			}
+		}
+		if err := writeFileAtomic(target, files[f.Path], f.Mode.Perm()); err != nil {
+			return nil, fmt.Errorf("restore %s: %w", target, err)
+		}
+	}
+	return manifest, nil
+}
+
+// writeFileAtomic replaces path with data through a temporary file, so a
+// failed restore never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
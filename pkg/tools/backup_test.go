@@ -0,0 +1,256 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pkg.para.party/certdx/pkg/encryption"
+	"pkg.para.party/certdx/pkg/paths"
+)
+
+// useDataDir points the data roots at a fresh directory for the test.
+func useDataDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	paths.SetDataDir(dir)
+	t.Cleanup(func() { paths.SetDataDir("") })
+	return dir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func makeBackupState(t *testing.T) string {
+	t.Helper()
+	dir := useDataDir(t)
+	writeTestFile(t, filepath.Join(dir, "mtls", "ca.pem"), "ca")
+	writeTestFile(t, filepath.Join(dir, "mtls", "counter.txt"), "42")
+	writeTestFile(t, filepath.Join(dir, "private", "me@example.com_r3.key"), "account key")
+	writeTestFile(t, filepath.Join(dir, "cache.json"), "{}")
+	return dir
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	makeBackupState(t)
+
+	var archive bytes.Buffer
+	manifest, err := WriteBackup(ctx, &archive, "v1.2.3", nil, BackupPaths{})
+	if err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	if manifest.Version != "v1.2.3" || len(manifest.Files) != 4 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+
+	dst := useDataDir(t)
+	if _, err := RestoreBackup(ctx, archive.Bytes(), nil, false, BackupPaths{}); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	for path, want := range map[string]string{
+		"mtls/counter.txt":              "42",
+		"private/me@example.com_r3.key": "account key",
+		"cache.json":                    "{}",
+	} {
+		got, err := os.ReadFile(filepath.Join(dst, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", path, got, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "private", "me@example.com_r3.key")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("account key mode not restored: %v, %v", info, err)
+	}
+}
+
+func TestRestoreRefusesOverwrite(t *testing.T) {
+	ctx := context.Background()
+	dir := makeBackupState(t)
+
+	var archive bytes.Buffer
+	if _, err := WriteBackup(ctx, &archive, "", nil, BackupPaths{}); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, "cache.json"), "newer")
+
+	if _, err := RestoreBackup(ctx, archive.Bytes(), nil, false, BackupPaths{}); !errors.Is(err, ErrBackupExists) {
+		t.Fatalf("got %v, want ErrBackupExists", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "cache.json")); string(got) != "newer" {
+		t.Fatal("file overwritten without force")
+	}
+
+	if _, err := RestoreBackup(ctx, archive.Bytes(), nil, true, BackupPaths{}); err != nil {
+		t.Fatalf("RestoreBackup with force: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "cache.json")); string(got) != "{}" {
+		t.Fatal("file not overwritten with force")
+	}
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	ctx := context.Background()
+	makeBackupState(t)
+
+	encoded, err := encryption.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	kp, err := encryption.NewLocalKeyProvider(encoded)
+	if err != nil {
+		t.Fatalf("NewLocalKeyProvider: %v", err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := WriteBackup(ctx, &archive, "", kp, BackupPaths{}); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	if bytes.Contains(archive.Bytes(), []byte("account key")) || !encryption.IsSealed(archive.Bytes()) {
+		t.Fatal("archive not encrypted")
+	}
+	if _, _, err := ReadBackup(ctx, archive.Bytes(), nil); !errors.Is(err, encryption.ErrNoKey) {
+		t.Fatalf("read without key: got %v, want ErrNoKey", err)
+	}
+	if _, files, err := ReadBackup(ctx, archive.Bytes(), kp); err != nil || string(files["state/cache.json"]) != "{}" {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+}
+
+func TestReadBackupDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	makeBackupState(t)
+
+	var archive bytes.Buffer
+	if _, err := WriteBackup(ctx, &archive, "", nil, BackupPaths{}); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	manifest, files, err := ReadBackup(ctx, archive.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+
+	// Rebuild the archive with one file changed but the old manifest.
+	files["state/cache.json"] = []byte("{tampered}")
+	tampered, err := packBackup(manifest, files)
+	if err != nil {
+		t.Fatalf("packBackup: %v", err)
+	}
+	if _, _, err := ReadBackup(ctx, tampered, nil); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("tampered file: got %v, want ErrBackupCorrupt", err)
+	}
+
+	if _, _, err := ReadBackup(ctx, []byte("not an archive"), nil); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("garbage: got %v, want ErrBackupCorrupt", err)
+	}
+}
+
+func TestRestoreRejectsUnsafePaths(t *testing.T) {
+	useDataDir(t)
+	for _, name := range []string{"state/../escape", "config/", "other/file", "state//x"} {
+		if _, err := backupTarget(name, BackupPaths{}); !errors.Is(err, ErrBackupCorrupt) {
+			t.Errorf("%q: got %v, want ErrBackupCorrupt", name, err)
+		}
+	}
+}
+
+func TestBackupSQLiteInWALMode(t *testing.T) {
+	ctx := context.Background()
+	dir := useDataDir(t)
+	dbPath := filepath.Join(dir, "cache.db")
+
+	// A server holding the database open keeps recent commits in the
+	// write-ahead log rather than in cache.db itself.
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"PRAGMA wal_autocheckpoint = 0",
+		"CREATE TABLE cert_entries (domain_key TEXT PRIMARY KEY)",
+		"INSERT INTO cert_entries VALUES ('example.com')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if _, err := WriteBackup(ctx, &archive, "", nil, BackupPaths{}); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+
+	dst := useDataDir(t)
+	restored := filepath.Join(dst, "cache.db")
+	writeTestFile(t, restored+"-wal", "stale log")
+	writeTestFile(t, restored+"-shm", "stale index")
+	if _, err := RestoreBackup(ctx, archive.Bytes(), nil, false, BackupPaths{}); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(restored + suffix); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind: %v", suffix, err)
+		}
+	}
+
+	rdb, err := sql.Open("sqlite", "file:"+restored)
+	if err != nil {
+		t.Fatalf("open restored: %v", err)
+	}
+	defer rdb.Close()
+	var key string
+	if err := rdb.QueryRow("SELECT domain_key FROM cert_entries").Scan(&key); err != nil || key != "example.com" {
+		t.Fatalf("restored row: %q, %v", key, err)
+	}
+}
+
+func TestBackupConfiguredPaths(t *testing.T) {
+	ctx := context.Background()
+	makeBackupState(t)
+	elsewhere := t.TempDir()
+	p := BackupPaths{
+		CertStore: filepath.Join(elsewhere, "store.json"),
+		Approvals: filepath.Join(elsewhere, "approvals.json"),
+	}
+	writeTestFile(t, p.CertStore, `{"configured":true}`)
+	writeTestFile(t, p.Approvals, "[]")
+
+	var archive bytes.Buffer
+	if _, err := WriteBackup(ctx, &archive, "", nil, p); err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	_, files, err := ReadBackup(ctx, archive.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+	if string(files["state/cache.json"]) != `{"configured":true}` || string(files["state/approvals.json"]) != "[]" {
+		t.Fatalf("configured files not backed up: %q", files)
+	}
+
+	useDataDir(t)
+	restoreTo := t.TempDir()
+	p = BackupPaths{
+		CertStore: filepath.Join(restoreTo, "store.json"),
+		Approvals: filepath.Join(restoreTo, "approvals.json"),
+	}
+	if _, err := RestoreBackup(ctx, archive.Bytes(), nil, false, p); err != nil {
+		t.Fatalf("RestoreBackup: %v", err)
+	}
+	if got, err := os.ReadFile(p.CertStore); err != nil || string(got) != `{"configured":true}` {
+		t.Errorf("cert store: got %q, %v", got, err)
+	}
+	if got, err := os.ReadFile(p.Approvals); err != nil || string(got) != "[]" {
+		t.Errorf("approvals: got %q, %v", got, err)
+	}
+}